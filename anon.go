@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// Name of the cache dir prefix and clone dir of an anonymous clone, from the
+// last component of the URL.
+func anonymousCloneName(repo_url string) string {
+	name := strings.TrimSuffix(path.Base(strings.TrimRight(repo_url, "/")), ".git")
+	name = gNonAlphanumericRe.ReplaceAllString(name, "_")
+	if len(name) == 0 {
+		name = "repo"
+	}
+	return name
+}
+
+// The dir of the clone of repo_url used by run --git. Keyed by the URL, so
+// that repeated runs against it reuse the clone.
+func anonymousClonePath(repo_url string) string {
+	digest := sha256.Sum256([]byte(repo_url))
+	return path.Join(GetAppDataDir(), "anon", anonymousCloneName(repo_url)+"_"+hex.EncodeToString(digest[:8]))
+}
+
+// Clones repo_url, or fetches it when it was already cloned by a previous
+// run. The clone is not added to the config.
+func prepareAnonymousClone(runner CommandRunner, repo_url string) (*RepoInfo, error) {
+	clonedir := anonymousClonePath(repo_url)
+	release, err := AcquireRepoLock(clonedir)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	if filepathExists(path.Join(clonedir, ".git")) {
+		ConsoleLogInfo("Fetching %s", repo_url)
+		if err = runCommandDir(runner, clonedir, gGitPath, "fetch", "--quiet", "origin"); err != nil {
+			// The clone may still hold the commits of the range.
+			gLogger.Printf("Error: %v\n", err)
+			ConsoleLogError("Failed to fetch %s, using the commits cloned previously.", repo_url)
+		}
+	} else if isDryRun(runner) {
+		return nil, fmt.Errorf("%s was not cloned yet, a dry run needs the clone to resolve the range", repo_url)
+	} else {
+		// Cloned next to its final location and moved in place once
+		// complete, so that an interrupted clone is not reused.
+		tmpdir := clonedir + ".tmp"
+		ConsoleLogInfo("Cloning git repo: %s", repo_url)
+		if err = cloneGitRepo(runner, repo_url, tmpdir); err != nil {
+			os.RemoveAll(tmpdir)
+			return nil, fmt.Errorf("Git clone failed: %w", err)
+		}
+		if err = os.Rename(tmpdir, clonedir); err != nil {
+			os.RemoveAll(tmpdir)
+			return nil, err
+		}
+	}
+	default_branch, err := detectDefaultBranch(runner, clonedir, false)
+	if err != nil {
+		gLogger.Printf("Failed to detect the default branch: %v\n", err)
+	}
+	return &RepoInfo{Remote: repo_url, LocalPath: clonedir, DefaultBranch: default_branch}, nil
+}
+
+// Removes the clones made by run --git.
+func cleanAnonymousClones() (int64, error) {
+	anondir := path.Join(GetAppDataDir(), "anon")
+	size, err := removeDirFreed(anondir)
+	if err != nil {
+		gLogger.Printf("Error: %v\n", err)
+		return size, wrapError(err, "Error occurred when removing %s", anondir)
+	}
+	return size, nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Imports the repo of a git bundle, made with `git bundle create`, by
+// cloning it. The bundle is the remote of the clone, which update fetches
+// from again, e.g. once it was replaced by a newer one.
+func ImportBundle(runner CommandRunner, file, name string, clone CloneOptions, hooks CloneHooks) error {
+	abspath, err := filepath.Abs(file)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(abspath)
+	if err != nil {
+		gLogger.Printf("Error: %v\n", err)
+		return fmt.Errorf("Invalid --bundle: cannot read %s.", abspath)
+	}
+	// Bundles start with their signature line, e.g. "# v2 git bundle".
+	header, _ := bufio.NewReader(f).ReadString('\n')
+	f.Close()
+	if !strings.HasPrefix(header, "# v") || !strings.HasSuffix(header, " git bundle\n") {
+		return fmt.Errorf("Invalid --bundle: %s is not a git bundle.", abspath)
+	}
+	return ImportGitRepo(runner, abspath, "", name, clone, hooks)
+}
+
+// Imports the repo of a tarball, optionally compressed with gzip or bzip2,
+// holding a checkout with its .git, at its root or in its only top level
+// dir. It is extracted into the repos dir, and imported as a local dir
+// without a remote.
+func ImportArchive(runner CommandRunner, file, name string) error {
+	name, display_name, err := checkImportName(name)
+	if err != nil {
+		return err
+	}
+	abspath, err := filepath.Abs(file)
+	if err != nil {
+		return err
+	}
+	if err = requireGitVersion(); err != nil {
+		return err
+	}
+	clonedir := path.Join(GetAppDataDir(), "repos", name)
+	if filepathExists(clonedir) {
+		return fmt.Errorf("%s already exists. Remove it, e.g. with `%s clean --repos`, or import under another --name.",
+			clonedir, kApplicationName)
+	}
+	ConsoleLogInfo("Extracting %s to %s", abspath, clonedir)
+	if isDryRun(runner) {
+		return nil
+	}
+	// Extracted next to the clone dir, for the repo to be moved into it.
+	extractdir := path.Join(GetAppDataDir(), "repos", "."+name+".extract")
+	if err = os.RemoveAll(extractdir); err != nil {
+		return err
+	}
+	defer os.RemoveAll(extractdir)
+	if err = extractTarball(abspath, extractdir); err != nil {
+		gLogger.Printf("Error: %v\n", err)
+		return fmt.Errorf("Invalid --archive %s: %w", abspath, err)
+	}
+	root := extractdir
+	if !filepathExists(path.Join(root, ".git")) {
+		if entries, err := os.ReadDir(root); err == nil && len(entries) == 1 && entries[0].IsDir() {
+			root = path.Join(root, entries[0].Name())
+		}
+	}
+	if !isDir(path.Join(root, ".git")) {
+		return fmt.Errorf("Invalid --archive %s: it holds no repo, a .git dir is expected at its root or in its only top level dir.",
+			abspath)
+	}
+	if err = runCommandDir(runner, root, gGitPath, "rev-parse", "--verify", "--quiet", "HEAD^{commit}"); err != nil {
+		gLogger.Printf("Error: %v\n", err)
+		return fmt.Errorf("Invalid --archive %s: the HEAD of its repo is not a commit, the repo may be incomplete.", abspath)
+	}
+	if err = os.Rename(root, clonedir); err != nil {
+		gLogger.Printf("Error: %v\n", err)
+		return wrapError(err, "Failed to move the extracted repo to %s", clonedir)
+	}
+	default_branch, detached_head, err := localRepoHead(runner, clonedir)
+	if err != nil {
+		os.RemoveAll(clonedir)
+		return err
+	}
+	gConfig.AddRepo(RepoInfo{LocalPath: clonedir, Name: name, DisplayName: display_name,
+		DefaultBranch: default_branch, DetachedHead: detached_head, Archive: abspath})
+	return nil
+}
+
+// Extracts the tarball into dir, which is created. The entries are only
+// written inside dir: those with absolute paths or going up are rejected,
+// and the symlinks are created last, for no entry to be written through
+// them.
+func extractTarball(file, dir string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	reader := bufio.NewReader(f)
+	magic, _ := reader.Peek(3)
+	var stream io.Reader = reader
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		stream = gz
+	case bytes.Equal(magic, []byte("BZh")):
+		stream = bzip2.NewReader(reader)
+	}
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	var symlinks [][2]string
+	archive := tar.NewReader(stream)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("not a readable tarball: %w", err)
+		}
+		name := filepath.Clean(filepath.FromSlash(header.Name))
+		if name == "." {
+			continue
+		}
+		if !filepath.IsLocal(name) {
+			return fmt.Errorf("entry %s is outside of the archive root", header.Name)
+		}
+		target := filepath.Join(dir, name)
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, header.FileInfo().Mode().Perm()|0700)
+		case tar.TypeReg:
+			err = extractTarFile(archive, target, header.FileInfo().Mode().Perm())
+		case tar.TypeSymlink:
+			symlinks = append(symlinks, [2]string{header.Linkname, target})
+		case tar.TypeLink:
+			linked := filepath.Clean(filepath.FromSlash(header.Linkname))
+			if !filepath.IsLocal(linked) {
+				return fmt.Errorf("entry %s links outside of the archive root", header.Name)
+			}
+			if err = os.MkdirAll(filepath.Dir(target), 0700); err == nil {
+				err = os.Link(filepath.Join(dir, linked), target)
+			}
+		default:
+			gLogger.Printf("Not extracting %s of type %c\n", header.Name, header.Typeflag)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for _, symlink := range symlinks {
+		if err = os.MkdirAll(filepath.Dir(symlink[1]), 0700); err != nil {
+			return err
+		}
+		if err = os.Symlink(symlink[0], symlink[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func extractTarFile(content io.Reader, target string, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, content); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Dir of the run dir of a commit the --artifact paths are copied into once
+// the steps ran on it.
+const kArtifactsDirName = "artifacts"
+
+// Dir of the run's cache dir the comparison of the artifacts of the first
+// bad commit and of its parent is written to.
+const kArtifactsDiffDirName = "artifacts_diff"
+
+// The number of changes of the artifacts printed on the console, the
+// others are only written to the run's cache dir.
+const kArtifactDiffTopChanges = 10
+
+// Validates the --artifact paths, which must be inside the repo.
+func validateArtifactPaths(paths []string) ([]string, error) {
+	var cleaned []string
+	for _, artifact := range paths {
+		artifact = filepath.Clean(artifact)
+		if !filepath.IsLocal(artifact) {
+			return nil, fmt.Errorf("Invalid --artifact %q. Expected a path inside the repo.", artifact)
+		}
+		cleaned = append(cleaned, artifact)
+	}
+	return cleaned, nil
+}
+
+// The dir the artifacts of the commit are collected into.
+func artifactsDir(cachedir, hash string) string {
+	return path.Join(cachedir, "_run", hash, kArtifactsDirName)
+}
+
+// The wrapper script copying the artifact paths of the commit when the
+// wrapper exits, whatever the verdict. cwd is the repo.
+func artifactsWrapperScript(cachedir string, paths []string) string {
+	quoted_paths := make([]string, len(paths))
+	for i, artifact := range paths {
+		quoted_paths[i] = shellQuote(artifact)
+	}
+	return fmt.Sprintf(`
+			# Copy the artifacts of the commit into its run dir once the
+			# steps ran, including when one failed.
+			xbisect_collect_artifacts() {
+				local ARTIFACTS_DIR=%s/"$("${GIT}" rev-parse HEAD)"/%s
+				local ARTIFACT
+				rm -rf "${ARTIFACTS_DIR}"
+				mkdir -p "${ARTIFACTS_DIR}"
+				for ARTIFACT in %s
+				do
+					if [ -e "${ARTIFACT}" ]
+					then
+						mkdir -p "${ARTIFACTS_DIR}/$(dirname "${ARTIFACT}")"
+						cp -R "${ARTIFACT}" "${ARTIFACTS_DIR}/${ARTIFACT}"
+					fi
+				done
+			}
+			trap xbisect_collect_artifacts EXIT
+			`, shellQuote(path.Join(cachedir, "_run")), kArtifactsDirName, strings.Join(quoted_paths, " "))
+}
+
+// A file of the artifacts differing between two commits.
+type ArtifactChange struct {
+	// Relative to the artifacts dir, which is relative to the repo root.
+	Path string
+	// A (appeared), D (disappeared) or M (modified).
+	Change  string
+	OldSize int64
+	NewSize int64
+	OldHash string
+	NewHash string
+	// Whether either side is not text, in which case no lines are counted.
+	Binary bool
+	// The lines added and removed, for the modified text files.
+	Added   int
+	Removed int
+}
+
+// The size of the change, to rank the changes.
+func (c *ArtifactChange) magnitude() int64 {
+	if c.Change == "M" && !c.Binary {
+		return int64(c.Added + c.Removed)
+	}
+	return max(c.NewSize-c.OldSize, c.OldSize-c.NewSize)
+}
+
+// Describes the change in a line.
+func (c *ArtifactChange) String() string {
+	switch {
+	case c.Change == "A":
+		return fmt.Sprintf("A %s (%s)", c.Path, formatBytes(c.NewSize))
+	case c.Change == "D":
+		return fmt.Sprintf("D %s (%s)", c.Path, formatBytes(c.OldSize))
+	case c.Binary:
+		return fmt.Sprintf("M %s %s -> %s (%+d bytes), sha256 %.12s -> %.12s", c.Path, formatBytes(c.OldSize),
+			formatBytes(c.NewSize), c.NewSize-c.OldSize, c.OldHash, c.NewHash)
+	}
+	return fmt.Sprintf("M %s +%d -%d lines (%+d bytes)", c.Path, c.Added, c.Removed, c.NewSize-c.OldSize)
+}
+
+type artifactFile struct {
+	size int64
+	hash string
+	text bool
+}
+
+// Lists the regular files under dir, keyed by their path relative to it.
+func listArtifactFiles(dir string) (map[string]artifactFile, error) {
+	files := map[string]artifactFile{}
+	err := filepath.WalkDir(dir, func(file string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		relative, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		// Like git, text has no NUL byte in its first 8000 bytes.
+		head := data[:min(len(data), 8000)]
+		files[filepath.ToSlash(relative)] = artifactFile{size: int64(len(data)), hash: hex.EncodeToString(sum[:]),
+			text: bytes.IndexByte(head, 0) < 0 && utf8.Valid(head)}
+		return nil
+	})
+	return files, err
+}
+
+// Runs git diff --no-index in dir on the files or dirs, returning the diff,
+// which is empty when they do not differ.
+func diffNoIndex(runner CommandRunner, dir, old_path, new_path string, args ...string) ([]byte, error) {
+	command := append([]string{gGitPath, "diff", "--no-index", "--no-color"}, args...)
+	out, err := runCommandDirOutput(runner, dir, append(command, "--", old_path, new_path)...)
+	var exit_err *exec.ExitError
+	if errors.As(err, &exit_err) && exit_err.ExitCode() == 1 {
+		// They differ.
+		return out, nil
+	}
+	return out, err
+}
+
+// Compares the artifacts collected into the dirs, returning the changes from
+// old_dir to new_dir, the largest first.
+func compareArtifacts(runner CommandRunner, old_dir, new_dir string) ([]ArtifactChange, error) {
+	old_files, err := listArtifactFiles(old_dir)
+	if err != nil {
+		return nil, err
+	}
+	new_files, err := listArtifactFiles(new_dir)
+	if err != nil {
+		return nil, err
+	}
+	var changes []ArtifactChange
+	for file, old := range old_files {
+		if _, found := new_files[file]; !found {
+			changes = append(changes, ArtifactChange{Path: file, Change: "D", OldSize: old.size, OldHash: old.hash,
+				Binary: !old.text})
+		}
+	}
+	for file, new_file := range new_files {
+		old, found := old_files[file]
+		if !found {
+			changes = append(changes, ArtifactChange{Path: file, Change: "A", NewSize: new_file.size,
+				NewHash: new_file.hash, Binary: !new_file.text})
+			continue
+		}
+		if old.hash == new_file.hash {
+			continue
+		}
+		change := ArtifactChange{Path: file, Change: "M", OldSize: old.size, NewSize: new_file.size,
+			OldHash: old.hash, NewHash: new_file.hash, Binary: !old.text || !new_file.text}
+		if !change.Binary {
+			out, err := diffNoIndex(runner, "", path.Join(old_dir, file), path.Join(new_dir, file), "--numstat")
+			if err != nil {
+				return nil, err
+			}
+			if fields := strings.Fields(string(out)); len(fields) >= 2 {
+				change.Added, _ = strconv.Atoi(fields[0])
+				change.Removed, _ = strconv.Atoi(fields[1])
+			}
+		}
+		changes = append(changes, change)
+	}
+	slices.SortFunc(changes, func(a, b ArtifactChange) int {
+		return cmp.Or(cmp.Compare(b.magnitude(), a.magnitude()), strings.Compare(a.Path, b.Path))
+	})
+	return changes, nil
+}
+
+// Returns the dir of the artifacts collected on the commit, running the
+// steps on it first if it was not tested. Returns an empty dir and why when
+// there are none.
+func collectCommitArtifacts(setup *RunSetup, hash string) (string, string, error) {
+	dir := artifactsDir(setup.CacheDir, hash)
+	if !isDir(dir) {
+		ConsoleLogInfo("The artifacts of %s were not collected, running the steps on it", hash)
+		result, err := sweepCommit(setup, hash, false)
+		if err != nil {
+			return "", "", err
+		}
+		if result.CheckoutFailed {
+			return "", fmt.Sprintf("%s could not be checked out", hash), nil
+		}
+		if len(result.Excluded) > 0 {
+			return "", fmt.Sprintf("%s is excluded from the run", hash), nil
+		}
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return "", "", err
+	}
+	if len(entries) == 0 {
+		return "", fmt.Sprintf("none of the --artifact paths exist on %s", hash), nil
+	}
+	return dir, "", nil
+}
+
+// Compares the artifacts of the first bad commit with those of its parent,
+// writing the changes and the diff of the text files to the run's cache dir
+// and printing the largest changes. Missing artifacts are only reported, the
+// comparison being a hint on top of the bisect.
+func diffCulpritArtifacts(setup *RunSetup, culprit string) {
+	out, err := runCommandDirOutput(setup.Runner, setup.CacheRepo, gGitPath, "rev-parse", "--verify", "--quiet", culprit+"^")
+	if err != nil {
+		ConsoleLogInfo("Not comparing the artifacts: the first bad commit %s has no parent.", culprit)
+		return
+	}
+	parent := strings.TrimSpace(string(out))
+	var dirs [2]string
+	for i, hash := range []string{parent, culprit} {
+		dir, missing, err := collectCommitArtifacts(setup, hash)
+		if err != nil {
+			gLogger.Printf("Error: %v\n", err)
+			ConsoleLogError("Failed to collect the artifacts of %s, not comparing them", hash)
+			return
+		}
+		if len(dir) == 0 {
+			ConsoleLogInfo("Not comparing the artifacts: %s.", missing)
+			return
+		}
+		dirs[i] = dir
+	}
+	changes, err := compareArtifacts(setup.Runner, dirs[0], dirs[1])
+	if err != nil {
+		gLogger.Printf("Error: %v\n", err)
+		ConsoleLogError("Failed to compare the artifacts of %s and %s", parent, culprit)
+		return
+	}
+	// Relative to the run dirs, for the paths of the diff to start with
+	// the commits.
+	diff, err := diffNoIndex(setup.Runner, path.Join(setup.CacheDir, "_run"), path.Join(parent, kArtifactsDirName),
+		path.Join(culprit, kArtifactsDirName))
+	if err != nil {
+		// The changes are still listed.
+		gLogger.Printf("Failed to diff the artifacts: %v\n", err)
+	}
+	diffdir := path.Join(setup.CacheDir, kArtifactsDiffDirName)
+	summary := fmt.Sprintf("Artifacts of %s compared to its parent %s\n", culprit, parent)
+	for _, change := range changes {
+		summary += change.String() + "\n"
+	}
+	if err = os.MkdirAll(diffdir, os.ModePerm); err == nil {
+		if err = os.WriteFile(path.Join(diffdir, "changes.txt"), []byte(summary), 0666); err == nil {
+			err = os.WriteFile(path.Join(diffdir, "artifacts.diff"), diff, 0666)
+		}
+	}
+	if err != nil {
+		gLogger.Printf("Error: %v\n", err)
+		ConsoleLogError("Failed to write the comparison of the artifacts to %s", diffdir)
+	}
+	if len(changes) == 0 {
+		ConsoleLogInfo("The artifacts of the first bad commit are identical to those of its parent %s", parent)
+		return
+	}
+	ConsoleLogInfo("%d files of the artifacts changed from the parent %s:", len(changes), parent)
+	for _, change := range changes[:min(len(changes), kArtifactDiffTopChanges)] {
+		ConsoleLogInfo("  %s", change.String())
+	}
+	if len(changes) > kArtifactDiffTopChanges {
+		ConsoleLogInfo("  ... and %d more", len(changes)-kArtifactDiffTopChanges)
+	}
+	ConsoleLogInfo("The changes and the diff of the text files are in %s", diffdir)
+}
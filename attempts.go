@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The --verdict-policy values, combining the attempts of a step into its
+// verdict.
+const (
+	// Fails as soon as one attempt fails.
+	kVerdictPolicyAnyFail = "any-fail"
+	// Passes if every attempt passes and fails if every attempt fails. The
+	// commit is skipped when the attempts disagree.
+	kVerdictPolicyAllPass = "all-pass"
+	// Passes if most attempts pass and fails if most fail. The commit is
+	// skipped on a tie.
+	kVerdictPolicyMajority = "majority"
+)
+
+// Runs each step several times on every commit, for steps too flaky for a
+// single run to be trusted. Every attempt runs, even once the verdict is
+// known, for the pass ratio to be reported.
+type StepAttempts struct {
+	Count  int
+	Policy string
+}
+
+// Returns nil when each step runs once, count being 0 or 1.
+func newStepAttempts(count int, policy string) (*StepAttempts, error) {
+	if count < 0 {
+		return nil, fmt.Errorf("Invalid --attempts-per-commit %d, expected at least 1.", count)
+	}
+	if count <= 1 {
+		return nil, nil
+	}
+	if policy != kVerdictPolicyAnyFail && policy != kVerdictPolicyAllPass && policy != kVerdictPolicyMajority {
+		return nil, fmt.Errorf("Invalid --verdict-policy: %s", policy)
+	}
+	return &StepAttempts{Count: count, Policy: policy}, nil
+}
+
+// Wraps the shell code running the step once into a loop over the attempts,
+// each keeping its output in attempt-<n>.txt of the step dir. RESULT is then
+// the verdict of the policy, and ATTEMPTS_TAG lists the exit status of each
+// attempt for the status marker. An interruption ends the attempts.
+func (a *StepAttempts) wrapperScript(run_step string) string {
+	verdict := ""
+	switch a.Policy {
+	case kVerdictPolicyAnyFail:
+		verdict = `
+					if [ $ATTEMPTS_FAILED -gt 0 ]
+					then
+						RESULT=$ATTEMPTS_FIRST_FAILURE
+					elif [ $ATTEMPTS_PASSED -gt 0 ]
+					then
+						RESULT=0
+					fi`
+	case kVerdictPolicyAllPass:
+		verdict = `
+					if [ $ATTEMPTS_PASSED -gt 0 ] && [ $ATTEMPTS_FAILED -eq 0 ]
+					then
+						RESULT=0
+					elif [ $ATTEMPTS_FAILED -gt 0 ] && [ $ATTEMPTS_PASSED -eq 0 ]
+					then
+						RESULT=$ATTEMPTS_FIRST_FAILURE
+					fi`
+	case kVerdictPolicyMajority:
+		verdict = `
+					if [ $ATTEMPTS_PASSED -gt $ATTEMPTS_FAILED ]
+					then
+						RESULT=0
+					elif [ $ATTEMPTS_FAILED -gt $ATTEMPTS_PASSED ]
+					then
+						RESULT=$ATTEMPTS_FIRST_FAILURE
+					fi`
+	}
+	return fmt.Sprintf(`
+				ATTEMPT_RESULTS=()
+				for ATTEMPT in $(seq 1 %d)
+				do
+					echo "Attempt ${ATTEMPT}/%d of step ${STEP_NAME}"
+					%s
+					cp "${STEP_LOG_FILE}" "${STEP_DIR}/attempt-${ATTEMPT}.txt"
+					if [ $RESULT -eq 130 ] || [ $RESULT -eq 143 ]
+					then
+						break
+					fi
+					ATTEMPT_RESULTS+=($RESULT)
+				done
+				if [ $RESULT -ne 130 ] && [ $RESULT -ne 143 ]
+				then
+					ATTEMPTS_PASSED=0
+					ATTEMPTS_FAILED=0
+					ATTEMPTS_FIRST_FAILURE=
+					for ATTEMPT_RESULT in "${ATTEMPT_RESULTS[@]}"
+					do
+						if [ $ATTEMPT_RESULT -eq 0 ]
+						then
+							ATTEMPTS_PASSED=$((ATTEMPTS_PASSED + 1))
+						elif [ $ATTEMPT_RESULT -ne %d ]
+						then
+							ATTEMPTS_FAILED=$((ATTEMPTS_FAILED + 1))
+							test -n "${ATTEMPTS_FIRST_FAILURE}" || ATTEMPTS_FIRST_FAILURE=$ATTEMPT_RESULT
+						fi
+					done
+					RESULT=%d
+					%s
+					ATTEMPTS_TAG=" attempts=$(IFS=,; echo "${ATTEMPT_RESULTS[*]}")"
+				fi
+				`, a.Count, a.Count, run_step, kBisectSkipCode, kBisectSkipCode, verdict)
+}
+
+// Parses the exit statuses of the attempts of a status marker.
+func parseAttempts(tag string) ([]int, error) {
+	var statuses []int
+	for _, field := range strings.Split(strings.TrimPrefix(tag, " attempts="), ",") {
+		status, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// How many attempts of the step passed, out of those that were not skipped.
+// Zero of zero without --attempts-per-commit.
+func (s StepResult) attemptsPassed() (int, int) {
+	passed, total := 0, 0
+	for _, status := range s.Attempts {
+		if status == kBisectSkipCode {
+			continue
+		}
+		total += 1
+		if status == 0 {
+			passed += 1
+		}
+	}
+	return passed, total
+}
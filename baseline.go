@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+)
+
+// File of a step's dir with the diff of its output to the baseline, when
+// they differ.
+const kBaselineDiffFilename = "baseline.diff"
+
+// The verdict of Step is whether its output, stdout and stderr together,
+// matches a baseline, rather than its exit status.
+type BaselineCheck struct {
+	Step string
+	// The rev the baseline is captured on before the run, by running the
+	// steps on it. Empty when the baseline is given as a file.
+	Rev string
+	// The copy of the baseline the wrapper compares the output to.
+	File string
+}
+
+// Validates the --baseline options. Returns nil when no output is compared.
+func newBaselineCheck(opts RunOptions, steps []string) (*BaselineCheck, error) {
+	if len(opts.Baseline) == 0 && len(opts.BaselineRev) == 0 {
+		if len(opts.BaselineStep) > 0 {
+			return nil, errors.New("--baseline-step requires --baseline or --baseline-rev.")
+		}
+		return nil, nil
+	}
+	if len(opts.Baseline) > 0 && len(opts.BaselineRev) > 0 {
+		return nil, errors.New("--baseline and --baseline-rev are mutually exclusive.")
+	}
+	if opts.ReuseResults {
+		// The recorded results are those of the exit status.
+		return nil, errors.New("--baseline and --baseline-rev cannot be combined with --reuse-results.")
+	}
+	if len(opts.BaselineRev) > 0 && len(opts.MatrixEnv) > 0 {
+		return nil, errors.New("--baseline-rev cannot be combined with --matrix-env, the entries would need a baseline each.")
+	}
+	step := opts.BaselineStep
+	if len(step) == 0 {
+		step = steps[len(steps)-1]
+	} else if !slices.Contains(steps, step) {
+		return nil, fmt.Errorf("Invalid --baseline-step: %s is not a step.", step)
+	}
+	if len(opts.Baseline) > 0 && !filepathExists(opts.Baseline) {
+		return nil, fmt.Errorf("Invalid --baseline: %s does not exist.", opts.Baseline)
+	}
+	return &BaselineCheck{Step: step, Rev: opts.BaselineRev}, nil
+}
+
+// Copies the baseline from the file into File, so that changing the file
+// during the run does not change the verdicts.
+func (c *BaselineCheck) saveFrom(file string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(c.File, data, 0666)
+}
+
+// The part of the wrapper script of the step making its verdict whether its
+// output matches the baseline. The steps asking to be skipped and those
+// interrupted are not compared, nor is anything until there is a baseline.
+func (c *BaselineCheck) wrapperScript() string {
+	return fmt.Sprintf(`
+				if [ -f %s ] && [ $RESULT -ne %d ] && [ $RESULT -ne 130 ] && [ $RESULT -ne 143 ]
+				then
+					"${GIT}" diff --no-index --no-color -- %s "${STEP_LOG_FILE}" > "${STEP_DIR}/%s"
+					DIFF_RESULT=$?
+					if [ $DIFF_RESULT -eq 0 ]
+					then
+						RESULT=0
+						rm -f "${STEP_DIR}/%s"
+					elif [ $DIFF_RESULT -eq 1 ]
+					then
+						RESULT=1
+						BASELINE_TAG=" diverged=1"
+					fi
+				fi
+				`, shellQuote(c.File), kBisectSkipCode, shellQuote(c.File), kBaselineDiffFilename, kBaselineDiffFilename)
+}
+
+// Runs the steps on the baseline rev and keeps the output of the step as the
+// baseline.
+func (c *BaselineCheck) capture(setup *RunSetup) error {
+	hash, err := resolveRef(setup.Runner, setup.CacheRepo, c.Rev)
+	if err != nil {
+		gLogger.Printf("Error: %v\n", err)
+		return fmt.Errorf("Invalid --baseline-rev: %w", err)
+	}
+	ConsoleLogInfo("Capturing the output of step %s on the baseline %s", c.Step, hash)
+	result, err := sweepCommit(setup, hash, false)
+	if err != nil {
+		return err
+	}
+	if result.CheckoutFailed {
+		return fmt.Errorf("Failed to check out the baseline %s", hash)
+	}
+	for _, step := range result.StepResults {
+		if step.Name != c.Step {
+			continue
+		}
+		if !step.Pass {
+			return fmt.Errorf("Step %s did not pass on the baseline %s, its output is no baseline", c.Step, hash)
+		}
+		return c.saveFrom(path.Join(setup.CacheDir, "_run", hash, c.Step, "log.txt"))
+	}
+	return fmt.Errorf("Step %s did not run on the baseline %s", c.Step, hash)
+}
+
+// The dir of the step of the commit, under the matrix entry it ran in.
+func baselineStepDir(cachedir string, matrix []string, hash string, step *StepResult) string {
+	stepdir := path.Join(cachedir, "_run", hash)
+	if index := slices.Index(matrix, step.Matrix); len(step.Matrix) > 0 && index >= 0 {
+		stepdir = path.Join(stepdir, "matrix-"+strconv.Itoa(index+1))
+	}
+	return path.Join(stepdir, step.Name)
+}
+
+// Reads the diffs of the output of the steps of the commit that diverged
+// from the baseline into its result.
+func (c *BaselineCheck) attachDiffs(cachedir string, matrix []string, commit *CommitResult) {
+	for i := range commit.StepResults {
+		step := &commit.StepResults[i]
+		if !step.Diverged {
+			continue
+		}
+		diff, err := os.ReadFile(path.Join(baselineStepDir(cachedir, matrix, commit.Hash, step), kBaselineDiffFilename))
+		if err != nil {
+			gLogger.Printf("Failed to read the baseline diff of step %s: %v\n", step.Name, err)
+			continue
+		}
+		step.BaselineDiff = string(diff)
+	}
+}
+
+// Points to the diffs of the output of the first bad commit to the baseline.
+func (c *BaselineCheck) printDiffPaths(cachedir string, matrix []string, report *BisectReport) {
+	for _, commit := range report.Commits {
+		if commit.Hash != report.Culprit {
+			continue
+		}
+		for _, step := range commit.StepResults {
+			if step.Diverged {
+				ConsoleLogInfo("The output of step %s differs from the baseline on the first bad commit: %s", step.Name,
+					path.Join(baselineStepDir(cachedir, matrix, commit.Hash, &step), kBaselineDiffFilename))
+			}
+		}
+	}
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type CleanOptions struct {
+	Cache bool
+	Repos bool
+	Logs  bool
+	// Clean everything. Asks for confirmation unless Yes is set.
+	All bool
+	Yes bool
+	// Remove the stale locks, alone unless another category is selected.
+	ForceUnlock bool
+}
+
+// Returns the total size of the regular files under dir.
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(file string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.Type().IsRegular() {
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// Removes the dir, returning the number of bytes freed.
+func removeDirFreed(dir string) (int64, error) {
+	size, err := dirSize(dir)
+	if err != nil && !os.IsNotExist(err) {
+		gLogger.Printf("Failed to compute the size of %s: %v\n", dir, err)
+	}
+	return size, os.RemoveAll(dir)
+}
+
+// Removes the cache dirs of the runs, except those still running. Runs whose
+// process died without recording it are removed as well.
+func cleanCacheDirs() (int64, error) {
+	cachedir := path.Join(GetAppDataDir(), "cache")
+	entries, err := os.ReadDir(cachedir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		gLogger.Printf("Error: %v\n", err)
+		return 0, wrapError(err, "Failed to list the cache dir")
+	}
+	active, err := activeRunIds()
+	if err != nil {
+		gLogger.Printf("Error: %v\n", err)
+		return 0, wrapError(err, "Failed to list the active runs")
+	}
+	var freed int64
+	for _, entry := range entries {
+		if slices.Contains(active, entry.Name()) {
+			state, err := LoadRunState(path.Join(cachedir, entry.Name()))
+			if err == nil && state.ProcessAlive() {
+				ConsoleLogInfo("Keeping the cache of running run %s", entry.Name())
+				continue
+			}
+		}
+		size, err := removeDirFreed(path.Join(cachedir, entry.Name()))
+		if err != nil {
+			gLogger.Printf("Error: %v\n", err)
+			return freed, wrapError(err, "Error occurred when removing cache dir %s", entry.Name())
+		}
+		freed += size
+	}
+	return freed, nil
+}
+
+// Removes the run cache dirs beyond the keep most recent ones, by the mtime
+// of their state.toml, which a run updates last when it ends. The dirs of the
+// running runs and those without a state, e.g. of a run being set up, are
+// neither removed nor counted. Neither are those of the in-place runs that
+// did not finish, whose run.toml records the ref to restore. Returns the ids
+// of the runs removed.
+func pruneCacheDirs(keep int) ([]string, int64, error) {
+	cachedir := path.Join(GetAppDataDir(), "cache")
+	entries, err := os.ReadDir(cachedir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, 0, nil
+		}
+		return nil, 0, err
+	}
+	type run struct {
+		id    string
+		mtime time.Time
+	}
+	var runs []run
+	for _, entry := range entries {
+		rundir := path.Join(cachedir, entry.Name())
+		state, err := LoadRunState(rundir)
+		if err != nil {
+			continue
+		}
+		if state.Status == kRunStatusRunning && state.ProcessAlive() {
+			continue
+		}
+		if metadata, err := LoadRunMetadata(rundir); err == nil && metadata.InPlace && state.Status != kRunStatusFinished {
+			continue
+		}
+		info, err := os.Stat(path.Join(rundir, kRunStateFilename))
+		if err != nil {
+			continue
+		}
+		runs = append(runs, run{entry.Name(), info.ModTime()})
+	}
+	if len(runs) <= keep {
+		return nil, 0, nil
+	}
+	slices.SortFunc(runs, func(a, b run) int { return b.mtime.Compare(a.mtime) })
+	var pruned []string
+	var freed int64
+	for _, run := range runs[keep:] {
+		size, err := removeDirFreed(path.Join(cachedir, run.id))
+		freed += size
+		if err != nil {
+			return pruned, freed, err
+		}
+		pruned = append(pruned, run.id)
+	}
+	return pruned, freed, nil
+}
+
+// The number of pruned run caches listed on the console, all of them are
+// logged.
+const kPrunedCachesListed = 10
+
+// Prunes the run caches beyond the number kept by the config, after a
+// successful run. Failing to only leaves more caches behind.
+func applyCacheRetention() {
+	keep := gConfig.KeepNCaches()
+	if keep <= 0 {
+		return
+	}
+	pruned, freed, err := pruneCacheDirs(keep)
+	if len(pruned) > 0 {
+		gLogger.Printf("Pruned run caches: %s\n", strings.Join(pruned, ", "))
+		listed := strings.Join(pruned[:min(len(pruned), kPrunedCachesListed)], ", ")
+		if len(pruned) > kPrunedCachesListed {
+			listed += fmt.Sprintf(" and %d more", len(pruned)-kPrunedCachesListed)
+		}
+		ConsoleLogInfo("Pruned %d run caches beyond the %d most recent (%s freed): %s", len(pruned), keep,
+			formatBytes(freed), listed)
+	}
+	if err != nil {
+		gLogger.Printf("Error: %v\n", err)
+		ConsoleLogError("Failed to prune the run caches beyond the %d most recent", keep)
+	}
+}
+
+// Removes the clones in the repos dir that no repo of the config points to,
+// e.g. left behind by a failed import.
+func cleanOrphanedRepos() (int64, error) {
+	reposdir := path.Join(GetAppDataDir(), "repos")
+	entries, err := os.ReadDir(reposdir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		gLogger.Printf("Error: %v\n", err)
+		return 0, wrapError(err, "Failed to list the repos dir")
+	}
+	var known []string
+	for _, repo := range gConfig.ListRepos() {
+		known = append(known, path.Clean(repo.LocalPath))
+	}
+	var freed int64
+	for _, entry := range entries {
+		clonedir := path.Join(reposdir, entry.Name())
+		if slices.Contains(known, clonedir) {
+			continue
+		}
+		ConsoleLogInfo("Removing orphaned clone: %s", entry.Name())
+		size, err := removeDirFreed(clonedir)
+		if err != nil {
+			gLogger.Printf("Error: %v\n", err)
+			return freed, wrapError(err, "Error occurred when removing %s", clonedir)
+		}
+		freed += size
+	}
+	return freed, nil
+}
+
+// The cache dirs of the runs of the repo, named after it by
+// randomCacheDirName.
+func repoCacheDirs(reponame string) ([]string, error) {
+	entries, err := os.ReadDir(path.Join(GetAppDataDir(), "cache"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var dirs []string
+	for _, entry := range entries {
+		suffix, found := strings.CutPrefix(entry.Name(), reponame+"_")
+		if _, err := strconv.Atoi(suffix); found && err == nil {
+			dirs = append(dirs, entry.Name())
+		}
+	}
+	return dirs, nil
+}
+
+// Removes the repo from config.toml and the cache dirs of its runs, and with
+// purge its clone. A repo with a run in progress is left alone, as is a local
+// dir imported with --path, which is not xbisect's to delete.
+func RemoveImportedRepo(reponame string, purge bool) error {
+	repo := gConfig.GetRepo(reponame)
+	if repo == nil {
+		return repoNotFoundError(reponame)
+	}
+	name, label, clonedir := repo.Name, repo.Label(), repo.LocalPath
+	cachedirs, err := repoCacheDirs(name)
+	if err != nil {
+		gLogger.Printf("Error: %v\n", err)
+		return wrapError(err, "Failed to list the cache dir")
+	}
+	for _, id := range cachedirs {
+		state, err := LoadRunState(path.Join(GetAppDataDir(), "cache", id))
+		if err == nil && state.Status == kRunStatusRunning && state.ProcessAlive() {
+			return fmt.Errorf("Run %s of %s is in progress, stop it first with `%s kill --run %s`.", id, label,
+				kApplicationName, id)
+		}
+	}
+	if !gConfig.RemoveRepo(name) {
+		return fmt.Errorf("%s is only set in %s, which is never written. Remove it from there.", label,
+			kLocalConfigFileName)
+	}
+	if gConfig.HasRepo(name) {
+		ConsoleLogInfo("Removed %s from %s, but %s still sets some of its fields", label, kConfigFileName,
+			kLocalConfigFileName)
+	} else {
+		ConsoleLogInfo("Removed %s from %s", label, kConfigFileName)
+	}
+	var freed int64
+	for _, id := range cachedirs {
+		size, err := removeDirFreed(path.Join(GetAppDataDir(), "cache", id))
+		freed += size
+		if err != nil {
+			gLogger.Printf("Error: %v\n", err)
+			return wrapError(err, "Failed to remove the cache dir %s", id)
+		}
+	}
+	if len(cachedirs) > 0 {
+		ConsoleLogInfo("Removed the caches of %d runs", len(cachedirs))
+	}
+	if !purge {
+		if isDir(clonedir) {
+			ConsoleLogInfo("Kept the clone %s, delete it with --purge or `%s clean --repos`", clonedir, kApplicationName)
+		}
+	} else if relative, err := filepath.Rel(path.Join(GetAppDataDir(), "repos"), clonedir); err != nil ||
+		!filepath.IsLocal(relative) {
+		ConsoleLogInfo("Not deleting %s, it was imported from a local dir rather than cloned", clonedir)
+	} else {
+		size, err := removeDirFreed(clonedir)
+		freed += size
+		if err != nil {
+			gLogger.Printf("Error: %v\n", err)
+			return wrapError(err, "Failed to delete the clone %s", clonedir)
+		}
+		ConsoleLogInfo("Deleted the clone %s", clonedir)
+	}
+	if freed > 0 {
+		ConsoleLogInfo("Freed %s", formatBytes(freed))
+	}
+	return nil
+}
+
+func cleanLogs() (int64, error) {
+	logfile := path.Join(GetAppDataDir(), "log.txt")
+	info, err := os.Stat(logfile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		gLogger.Printf("Error: %v\n", err)
+		return 0, wrapError(err, "Failed to read the log file")
+	}
+	// The log file is opened for appending, so writes after the truncation
+	// start over from the beginning.
+	if err = os.Truncate(logfile, 0); err != nil {
+		gLogger.Printf("Error: %v\n", err)
+		return 0, wrapError(err, "Failed to truncate the log file")
+	}
+	return info.Size(), nil
+}
+
+func confirm(prompt string) bool {
+	fmt.Print(prompt + " [y/N] ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+func Clean(opts CleanOptions) error {
+	if opts.ForceUnlock {
+		if err := ForceUnlock(opts.Yes); err != nil || (!opts.Cache && !opts.Repos && !opts.Logs) {
+			return err
+		}
+	}
+	if !opts.Cache && !opts.Repos && !opts.Logs {
+		opts.Cache = true
+	}
+	if opts.All && !opts.Yes && !confirm("Remove the run caches, orphaned clones and logs?") {
+		return wrapError(ErrAborted, "Nothing was cleaned.")
+	}
+
+	categories := []struct {
+		selected bool
+		name     string
+		clean    func() (int64, error)
+	}{
+		{opts.Cache, "cache", cleanCacheDirs},
+		{opts.Cache, "step results", cleanStepResults},
+		{opts.Repos, "orphaned repos", cleanOrphanedRepos},
+		{opts.Repos, "anonymous clones", cleanAnonymousClones},
+		{opts.Logs, "logs", cleanLogs},
+	}
+	// A failed category does not prevent cleaning the others.
+	var errs []error
+	var total int64
+	for _, category := range categories {
+		if !category.selected {
+			continue
+		}
+		freed, err := category.clean()
+		total += freed
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		ConsoleLogInfo("Cleaned up %s: %s freed", category.name, formatBytes(freed))
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	ConsoleLogInfo("Successfully cleaned up, %s freed in total.", formatBytes(total))
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import "os"
+
+// Shell commands run around the clone of an import, with bash. They see the
+// repo in XBISECT_REPO_NAME, its URL in XBISECT_REPO_URL and the clone dir in
+// XBISECT_CLONE_DIR. Their output goes to the log file.
+type CloneHooks struct {
+	// Run before cloning, e.g. to check prerequisites. A failure aborts the
+	// import.
+	Pre []string
+	// Run in the clone dir once the clone succeeded, e.g. to pull the LFS
+	// objects or init the submodules. A failure removes the clone and leaves
+	// the repo out of the config, unless KeepOnFailure.
+	Post          []string
+	KeepOnFailure bool
+}
+
+func (h *CloneHooks) env(repo_url, name, clonedir string) []string {
+	return []string{"XBISECT_REPO_NAME=" + name, "XBISECT_REPO_URL=" + repo_url, "XBISECT_CLONE_DIR=" + clonedir}
+}
+
+// Runs the hooks of the kind in order, stopping at the first failing.
+func runCloneHooks(runner CommandRunner, kind string, hooks []string, dir string, env []string) error {
+	for _, hook := range hooks {
+		ConsoleLogInfo("Running the %s hook: %s", kind, hook)
+		if err := runner.Run(CommandOptions{Dir: dir, Env: env}, "bash", "-c", hook); err != nil {
+			gLogger.Printf("Error: %v\n", err)
+			return wrapError(err, "The %s hook failed: %s. Its output is in the log file.", kind, hook)
+		}
+	}
+	return nil
+}
+
+func (h *CloneHooks) runPre(runner CommandRunner, repo_url, name, clonedir string) error {
+	return runCloneHooks(runner, "pre-clone", h.Pre, "", h.env(repo_url, name, clonedir))
+}
+
+// Runs the post-clone hooks. Returns whether the import goes on, along with
+// the failure of the hook, the clone being removed unless KeepOnFailure.
+func (h *CloneHooks) runPost(runner CommandRunner, repo_url, name, clonedir string) (bool, error) {
+	err := runCloneHooks(runner, "post-clone", h.Post, clonedir, h.env(repo_url, name, clonedir))
+	if err == nil {
+		return true, nil
+	}
+	if h.KeepOnFailure {
+		return true, err
+	}
+	// A dry run records the hooks without failing, so there is no clone
+	// to remove then.
+	if remove_err := os.RemoveAll(clonedir); remove_err != nil {
+		gLogger.Printf("Error: %v\n", remove_err)
+		ConsoleLogError("Failed to remove the clone %s", clonedir)
+	} else {
+		ConsoleLogInfo("Removed the clone %s, keep it with --keep-on-hook-failure", clonedir)
+	}
+	return false, err
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// A condition on the result of another step, which runs first.
+type StepCondition struct {
+	Step string
+	// Either "pass" or "fail".
+	Result string
+}
+
+func (c StepCondition) String() string {
+	return c.Step + ":" + c.Result
+}
+
+// Parses the "step:other:pass|fail" entries of --step-when and the
+// "step:other" entries of --step-needs, the latter being a shorthand for
+// "step:other:pass", into the conditions of each step.
+func parseStepConditions(when []string, needs []string, steps []string) (map[string][]StepCondition, error) {
+	conditions := map[string][]StepCondition{}
+	add := func(entry, step string, condition StepCondition) error {
+		if !slices.Contains(steps, step) {
+			return fmt.Errorf("Step condition given for unknown step: %s", step)
+		}
+		if !slices.Contains(steps, condition.Step) {
+			return fmt.Errorf("Step condition %q depends on unknown step: %s", entry, condition.Step)
+		}
+		if step == condition.Step {
+			return fmt.Errorf("Step condition %q depends on the step itself", entry)
+		}
+		conditions[step] = append(conditions[step], condition)
+		return nil
+	}
+	for _, entry := range when {
+		step, rest, _ := strings.Cut(entry, ":")
+		other, result, _ := strings.Cut(rest, ":")
+		if len(step) == 0 || len(other) == 0 || (result != "pass" && result != "fail") {
+			return nil, fmt.Errorf("Invalid step condition %q, expected step:other:pass or step:other:fail", entry)
+		}
+		if err := add(entry, step, StepCondition{Step: other, Result: result}); err != nil {
+			return nil, err
+		}
+	}
+	for _, entry := range needs {
+		step, other, _ := strings.Cut(entry, ":")
+		if len(step) == 0 || len(other) == 0 {
+			return nil, fmt.Errorf("Invalid step dependency %q, expected step:other", entry)
+		}
+		if err := add(entry, step, StepCondition{Step: other, Result: "pass"}); err != nil {
+			return nil, err
+		}
+	}
+	return conditions, nil
+}
+
+// Orders the steps so that each runs after the steps its conditions depend
+// on, keeping the given order otherwise. Fails if the conditions form a
+// cycle.
+func orderSteps(steps []string, conditions map[string][]StepCondition) ([]string, error) {
+	var ordered []string
+	remaining := slices.Clone(steps)
+	for len(remaining) > 0 {
+		next := slices.IndexFunc(remaining, func(step string) bool {
+			return !slices.ContainsFunc(conditions[step], func(c StepCondition) bool {
+				return !slices.Contains(ordered, c.Step)
+			})
+		})
+		if next < 0 {
+			return nil, fmt.Errorf("The conditions of the steps form a cycle: %s", strings.Join(remaining, ", "))
+		}
+		ordered = append(ordered, remaining[next])
+		remaining = slices.Delete(remaining, next, next+1)
+	}
+	return ordered, nil
+}
+
+// Whether a step with the conditions runs, given the results of the steps
+// run before it on the commit and the steps among them that failed. Once a
+// step failed, only the steps conditioned on its failure run.
+func stepConditionsMet(conditions []StepCondition, results map[string]StepResult, failed []string) bool {
+	for _, step := range failed {
+		if !slices.Contains(conditions, StepCondition{Step: step, Result: "fail"}) {
+			return false
+		}
+	}
+	for _, condition := range conditions {
+		if condition.Result == "pass" && !results[condition.Step].Pass {
+			return false
+		}
+		if condition.Result == "fail" && !slices.Contains(failed, condition.Step) {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the shell condition of the wrapper equivalent to
+// stepConditionsMet. The wrapper keeps the result of step i in
+// STEP_RESULT_<i> and the indexes of the failed steps in FAILED_STEPS.
+func stepConditionsShell(conditions []StepCondition, steps []string) string {
+	var failure_indexes []string
+	tests := []string{""}
+	for _, condition := range conditions {
+		index := slices.Index(steps, condition.Step) + 1
+		if condition.Result == "fail" {
+			failure_indexes = append(failure_indexes, fmt.Sprint(index))
+		}
+		tests = append(tests, fmt.Sprintf(`[ "${STEP_RESULT_%d}" = %s ]`, index, condition.Result))
+	}
+	tests[0] = strings.TrimSpace("xbisect_only_failed " + strings.Join(failure_indexes, " "))
+	return strings.Join(tests, " && ")
+}
+
+// Prints the steps in the order they run, with what restricts them.
+func printStepPlan(steps []string, conditions map[string][]StepCondition, workdirs map[string]string,
+	paths map[string][]string) {
+	ConsoleLogInfo("Steps run on each commit, in order:")
+	for i, step := range steps {
+		line := fmt.Sprintf("  %d. %s", i+1, step)
+		if workdir, ok := workdirs[step]; ok {
+			line += fmt.Sprintf(" (in %s)", workdir)
+		}
+		if len(conditions[step]) > 0 {
+			when := make([]string, len(conditions[step]))
+			for i, condition := range conditions[step] {
+				when[i] = condition.String()
+			}
+			line += " when " + strings.Join(when, " and ")
+		}
+		if len(paths[step]) > 0 {
+			line += " if changed: " + strings.Join(paths[step], " ")
+		}
+		fmt.Fprintln(gConsoleOutput, line)
+	}
+}
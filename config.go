@@ -0,0 +1,323 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+)
+
+const (
+	kConfigFileName      = "config.toml"
+	kLocalConfigFileName = "config.local.toml"
+)
+
+// Where each non-empty field of each repo of the effective config comes
+// from, indexed by repo name then field name. The fields of the config
+// itself are under the empty repo name.
+type ConfigSources map[string]map[string]string
+
+func (s ConfigSources) set(reponame, field, file string) {
+	if s[reponame] == nil {
+		s[reponame] = map[string]string{}
+	}
+	s[reponame][field] = file
+}
+
+// Reads a config file. A missing file is an empty config.
+func readConfigLayout(file string) (*ConfigLayout, error) {
+	layout := &ConfigLayout{}
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return layout, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err = toml.Unmarshal(data, layout); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return layout, nil
+}
+
+// Returns the base config with the local config merged over it, without
+// modifying either. The non-empty settings of the local config override
+// those of the base. Repos are merged by name: the non-empty fields of a local
+// repo override those of the base repo of the same name, and local repos
+// missing from the base are added.
+func mergeConfigLayouts(base *ConfigLayout, local *ConfigLayout) (*ConfigLayout, ConfigSources) {
+	merged := &ConfigLayout{}
+	sources := ConfigSources{}
+	index := map[string]int{}
+	add := func(repos []RepoInfo, file string) {
+		for _, repo := range repos {
+			repo.Name = strings.ToLower(repo.Name)
+			i, found := index[repo.Name]
+			if !found {
+				i = len(merged.Repos)
+				index[repo.Name] = i
+				merged.Repos = append(merged.Repos, RepoInfo{Name: repo.Name})
+			}
+			dst := reflect.ValueOf(&merged.Repos[i]).Elem()
+			src := reflect.ValueOf(repo)
+			for f := 0; f < src.NumField(); f++ {
+				if src.Field(f).IsZero() {
+					continue
+				}
+				dst.Field(f).Set(src.Field(f))
+				sources.set(repo.Name, src.Type().Field(f).Name, file)
+			}
+		}
+	}
+	add(base.Repos, kConfigFileName)
+	add(local.Repos, kLocalConfigFileName)
+	for _, layout := range []struct {
+		config *ConfigLayout
+		file   string
+	}{{base, kConfigFileName}, {local, kLocalConfigFileName}} {
+		if layout.config.KeepNCaches != 0 {
+			merged.KeepNCaches = layout.config.KeepNCaches
+			sources.set("", "KeepNCaches", layout.file)
+		}
+	}
+	return merged, sources
+}
+
+// Copies to config.toml the fields of the repos changed through GetRepo,
+// which differ from those of config.toml with config.local.toml merged over
+// it. A field config.local.toml overrides thus stays overridden.
+func (c *ConfigImpl) keepRepoChanges() {
+	if c.data == nil {
+		return
+	}
+	merged, _ := mergeConfigLayouts(c.base, c.local)
+	changed := false
+	for i := range c.data.Repos {
+		j := slices.IndexFunc(merged.Repos, func(repo RepoInfo) bool { return repo.Name == c.data.Repos[i].Name })
+		if j < 0 {
+			continue
+		}
+		current, loaded := reflect.ValueOf(c.data.Repos[i]), reflect.ValueOf(merged.Repos[j])
+		for f := 0; f < current.NumField(); f++ {
+			if current.Field(f).Equal(loaded.Field(f)) {
+				continue
+			}
+			reflect.ValueOf(c.baseRepo(c.data.Repos[i].Name)).Elem().Field(f).Set(current.Field(f))
+			changed = true
+		}
+	}
+	if changed {
+		_, c.sources = mergeConfigLayouts(c.base, c.local)
+		c.dirty = true
+	}
+}
+
+// Prints the effective config, with the file each value comes from.
+func ShowConfig() bool {
+	impl, ok := gConfig.(*ConfigImpl)
+	if !ok {
+		ConsoleLogError("Unsupported config implementation")
+		return false
+	}
+	impl.mu.Lock()
+	defer impl.mu.Unlock()
+	for _, file := range []string{impl.config_filepath, impl.local_config_filepath} {
+		exists := ""
+		if !filepathExists(file) {
+			exists = " (missing)"
+		}
+		fmt.Printf("# %s%s\n", file, exists)
+	}
+	if impl.data.KeepNCaches != 0 {
+		fmt.Printf("\n%-14s = %-40q # %s\n", "KeepNCaches", fmt.Sprint(impl.data.KeepNCaches), impl.sources[""]["KeepNCaches"])
+	}
+	for _, repo := range impl.data.Repos {
+		fmt.Printf("\n[repos.%s]\n", repo.Name)
+		value := reflect.ValueOf(repo)
+		for f := 0; f < value.NumField(); f++ {
+			field := value.Type().Field(f).Name
+			if field == "Name" || value.Field(f).IsZero() {
+				continue
+			}
+			fmt.Printf("%-14s = %-40q # %s\n", field, fmt.Sprint(value.Field(f).Interface()),
+				impl.sources[repo.Name][field])
+		}
+	}
+	return true
+}
+
+// A field of the repos that config get and set address as
+// repos.<name>.<field>.
+type ConfigKey struct {
+	Field string
+	// Validates the value to set on the repo, returning the one to store.
+	// Nil when the field is read-only.
+	set func(repo *RepoInfo, value string) (string, error)
+}
+
+var kRepoConfigKeys = []ConfigKey{
+	{Field: "Remote", set: setRepoRemote},
+	{Field: "LocalPath"},
+	{Field: "Name"},
+	{Field: "DisplayName", set: func(repo *RepoInfo, value string) (string, error) {
+		if len(value) > 0 && strings.ToLower(value) != repo.Name {
+			return "", fmt.Errorf("The display name can only change the case of the name %q.", repo.Name)
+		}
+		if value == repo.Name {
+			return "", nil
+		}
+		return value, nil
+	}},
+	{Field: "DefaultBranch", set: func(repo *RepoInfo, value string) (string, error) {
+		if len(value) == 0 {
+			// Detected by the runs.
+			return "", nil
+		}
+		ref := "refs/remotes/origin/" + value
+		if repo.Mirror {
+			ref = "refs/heads/" + value
+		}
+		if err := runCommandDir(&ExecRunner{}, repo.LocalPath, gGitPath, "rev-parse", "--quiet", "--verify", ref); err != nil {
+			gLogger.Printf("Error: %v\n", err)
+			return "", fmt.Errorf("No branch %q in %s.", value, repo.LocalPath)
+		}
+		return value, nil
+	}},
+	{Field: "Mirror"},
+	{Field: "Shallow"},
+	{Field: "Filter"},
+	{Field: "Vcs"},
+	{Field: "DetachedHead"},
+	{Field: "LastFetched"},
+	{Field: "Archive"},
+}
+
+// Points origin of the clone to the new remote before recording it.
+func setRepoRemote(repo *RepoInfo, value string) (string, error) {
+	if len(value) == 0 {
+		return "", errors.New("The remote cannot be empty.")
+	}
+	if repo.Vcs == kVcsSvn {
+		return "", errors.New("The remote of an SVN repo cannot be changed.")
+	}
+	if err := runCommandDir(&ExecRunner{}, repo.LocalPath, gGitPath, "remote", "set-url", "origin", value); err != nil {
+		gLogger.Printf("Error: %v\n", err)
+		return "", wrapError(err, "Failed to set the url of origin in %s", repo.LocalPath)
+	}
+	return value, nil
+}
+
+// The key of the number of run caches kept, the only one not of a repo.
+const kKeepNCachesKey = "KeepNCaches"
+
+// Validates a number of run caches to keep.
+func parseKeepNCaches(value string) (int, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("Invalid %s %q. Expected a number of caches, 0 to keep them all.", kKeepNCachesKey, value)
+	}
+	return n, nil
+}
+
+// Splits a key into the repo it addresses and its field.
+func parseConfigKey(key string) (*RepoInfo, *ConfigKey, error) {
+	unknown := fmt.Errorf("Unknown config key %q. Run `%s config list` for the known keys.", key, kApplicationName)
+	parts := strings.Split(key, ".")
+	if len(parts) != 3 || parts[0] != "repos" {
+		return nil, nil, unknown
+	}
+	repo := gConfig.GetRepo(parts[1])
+	if repo == nil {
+		return nil, nil, repoNotFoundError(parts[1])
+	}
+	for i := range kRepoConfigKeys {
+		if strings.EqualFold(kRepoConfigKeys[i].Field, parts[2]) {
+			return repo, &kRepoConfigKeys[i], nil
+		}
+	}
+	return nil, nil, unknown
+}
+
+func repoConfigValue(repo *RepoInfo, field string) string {
+	return fmt.Sprint(reflect.ValueOf(*repo).FieldByName(field).Interface())
+}
+
+// Prints the value of the key in the effective config.
+func GetConfigValue(key string) error {
+	if strings.EqualFold(key, kKeepNCachesKey) {
+		fmt.Println(gConfig.KeepNCaches())
+		return nil
+	}
+	repo, config_key, err := parseConfigKey(key)
+	if err != nil {
+		return err
+	}
+	fmt.Println(repoConfigValue(repo, config_key.Field))
+	return nil
+}
+
+// Validates the value and sets the key in config.toml.
+func SetConfigValue(key, value string) error {
+	if strings.EqualFold(key, kKeepNCachesKey) {
+		n, err := parseKeepNCaches(value)
+		if err != nil {
+			return err
+		}
+		gConfig.SetKeepNCaches(n)
+		ConsoleLogInfo("Set %s to %d in %s", kKeepNCachesKey, n, kConfigFileName)
+		if gConfig.KeepNCaches() != n {
+			ConsoleLogInfo("It is still overridden by the value in %s", kLocalConfigFileName)
+		}
+		return nil
+	}
+	repo, config_key, err := parseConfigKey(key)
+	if err != nil {
+		return err
+	}
+	if config_key.set == nil {
+		return fmt.Errorf("%s is read-only.", key)
+	}
+	if value, err = config_key.set(repo, value); err != nil {
+		return err
+	}
+	impl, ok := gConfig.(*ConfigImpl)
+	if !ok {
+		return errors.New("Unsupported config implementation")
+	}
+	overridden := impl.setRepoField(repo.Name, config_key.Field, value)
+	ConsoleLogInfo("Set repos.%s.%s to %q in %s", repo.Name, config_key.Field, value, kConfigFileName)
+	if overridden {
+		ConsoleLogInfo("It is still overridden by the value in %s", kLocalConfigFileName)
+	}
+	return nil
+}
+
+// Sets the field of the repo in config.toml, adding the repo to it if it is
+// only in config.local.toml. Returns whether config.local.toml overrides it.
+func (c *ConfigImpl) setRepoField(reponame, field, value string) bool {
+	c.UpdateRepo(reponame, func(repo *RepoInfo) {
+		reflect.ValueOf(repo).Elem().FieldByName(field).SetString(value)
+	})
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sources[strings.ToLower(reponame)][field] == kLocalConfigFileName
+}
+
+// Prints every key of the effective config with its value.
+func ListConfig() bool {
+	fmt.Printf("%s = %d\n", kKeepNCachesKey, gConfig.KeepNCaches())
+	for _, repo := range gConfig.ListRepos() {
+		for _, key := range kRepoConfigKeys {
+			read_only := ""
+			if key.set == nil {
+				read_only = " # read-only"
+			}
+			fmt.Printf("repos.%s.%s = %q%s\n", repo.Name, key.Field, repoConfigValue(&repo, key.Field), read_only)
+		}
+	}
+	return true
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestGetRepoChangesPersist(t *testing.T) {
+	setupTestAppData(t)
+	gConfig.AddRepo(RepoInfo{Name: "Foo", Remote: "https://example.com/foo.git", LocalPath: "/repos/foo"})
+
+	repo := gConfig.GetRepo("foo")
+	if repo == nil {
+		t.Fatal("GetRepo(foo) = nil")
+	}
+	repo.Remote = "https://example.com/moved.git"
+	if got := gConfig.GetRepo("FOO").Remote; got != repo.Remote {
+		t.Errorf("GetRepo(FOO).Remote = %q after the change through GetRepo(foo)", got)
+	}
+	// Adding a repo reallocates the repos, which the change must survive.
+	gConfig.AddRepo(RepoInfo{Name: "bar", LocalPath: "/repos/bar"})
+	if got := gConfig.GetRepo("foo").Remote; got != "https://example.com/moved.git" {
+		t.Errorf("GetRepo(foo).Remote = %q after AddRepo", got)
+	}
+	gConfig.UpdateRepo("bar", func(repo *RepoInfo) { repo.DefaultBranch = "main" })
+
+	if err := gConfig.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if err := InitConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if got := gConfig.GetRepo("foo").Remote; got != "https://example.com/moved.git" {
+		t.Errorf("GetRepo(foo).Remote = %q after Save and reload", got)
+	}
+	if got := gConfig.GetRepo("bar").DefaultBranch; got != "main" {
+		t.Errorf("GetRepo(bar).DefaultBranch = %q after Save and reload", got)
+	}
+
+	// A change made through GetRepo alone is saved too.
+	gConfig.GetRepo("bar").LocalPath = "/mnt/bar"
+	if err := gConfig.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if err := InitConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if got := gConfig.GetRepo("bar").LocalPath; got != "/mnt/bar" {
+		t.Errorf("GetRepo(bar).LocalPath = %q after Save and reload", got)
+	}
+}
+
+func TestMergeConfigLayouts(t *testing.T) {
+	tests := []struct {
+		name        string
+		base, local ConfigLayout
+		want        ConfigLayout
+		// Expected sources, by repo then field.
+		sources ConfigSources
+	}{
+		{
+			name: "base only",
+			base: ConfigLayout{KeepNCaches: 3, Repos: []RepoInfo{{Name: "foo", Remote: "r", LocalPath: "/foo"}}},
+			want: ConfigLayout{KeepNCaches: 3, Repos: []RepoInfo{{Name: "foo", Remote: "r", LocalPath: "/foo"}}},
+			sources: ConfigSources{
+				"":    {"KeepNCaches": kConfigFileName},
+				"foo": {"Name": kConfigFileName, "Remote": kConfigFileName, "LocalPath": kConfigFileName},
+			},
+		},
+		{
+			name:  "local overrides the non-empty fields",
+			base:  ConfigLayout{KeepNCaches: 3, Repos: []RepoInfo{{Name: "foo", Remote: "r", LocalPath: "/foo", DefaultBranch: "main"}}},
+			local: ConfigLayout{KeepNCaches: 5, Repos: []RepoInfo{{Name: "foo", LocalPath: "/mnt/foo"}}},
+			want:  ConfigLayout{KeepNCaches: 5, Repos: []RepoInfo{{Name: "foo", Remote: "r", LocalPath: "/mnt/foo", DefaultBranch: "main"}}},
+			sources: ConfigSources{
+				"": {"KeepNCaches": kLocalConfigFileName},
+				"foo": {"Name": kLocalConfigFileName, "Remote": kConfigFileName, "LocalPath": kLocalConfigFileName,
+					"DefaultBranch": kConfigFileName},
+			},
+		},
+		{
+			name:  "empty local keeps the base",
+			base:  ConfigLayout{KeepNCaches: 3, Repos: []RepoInfo{{Name: "foo", Remote: "r"}}},
+			local: ConfigLayout{Repos: []RepoInfo{{Name: "foo"}}},
+			want:  ConfigLayout{KeepNCaches: 3, Repos: []RepoInfo{{Name: "foo", Remote: "r"}}},
+			sources: ConfigSources{
+				"":    {"KeepNCaches": kConfigFileName},
+				"foo": {"Name": kLocalConfigFileName, "Remote": kConfigFileName},
+			},
+		},
+		{
+			name:  "repos merged case-insensitively, local only repos added",
+			base:  ConfigLayout{Repos: []RepoInfo{{Name: "Foo", Remote: "r"}}},
+			local: ConfigLayout{Repos: []RepoInfo{{Name: "FOO", Mirror: true}, {Name: "bar", LocalPath: "/bar"}}},
+			want:  ConfigLayout{Repos: []RepoInfo{{Name: "foo", Remote: "r", Mirror: true}, {Name: "bar", LocalPath: "/bar"}}},
+			sources: ConfigSources{
+				"foo": {"Name": kLocalConfigFileName, "Remote": kConfigFileName, "Mirror": kLocalConfigFileName},
+				"bar": {"Name": kLocalConfigFileName, "LocalPath": kLocalConfigFileName},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			base, local := test.base, test.local
+			merged, sources := mergeConfigLayouts(&base, &local)
+			if !reflect.DeepEqual(*merged, test.want) {
+				t.Errorf("merged = %+v, want %+v", *merged, test.want)
+			}
+			if !reflect.DeepEqual(sources, test.sources) {
+				t.Errorf("sources = %v, want %v", sources, test.sources)
+			}
+			if !reflect.DeepEqual(base, test.base) || !reflect.DeepEqual(local, test.local) {
+				t.Errorf("the layouts were modified: %+v, %+v", base, local)
+			}
+		})
+	}
+}
+
+func TestConfigSaveLoadRoundTrip(t *testing.T) {
+	home := setupTestAppData(t)
+	gConfig.AddRepo(RepoInfo{Name: "Foo", DisplayName: "Foo", Remote: "https://example.com/foo.git", LocalPath: "/repos/foo",
+		DefaultBranch: "main", Mirror: true, Shallow: true, Filter: "blob:none"})
+	gConfig.AddRepo(RepoInfo{Name: "bar", LocalPath: "/src/bar", DetachedHead: "0123456789abcdef0123456789abcdef01234567"})
+	gConfig.SetKeepNCaches(2)
+	if err := gConfig.Save(); err != nil {
+		t.Fatal(err)
+	}
+	saved := gConfig.ListRepos()
+	if err := InitConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if got := gConfig.ListRepos(); !reflect.DeepEqual(got, saved) {
+		t.Errorf("repos after reload = %+v, want %+v", got, saved)
+	}
+	if got := gConfig.KeepNCaches(); got != 2 {
+		t.Errorf("KeepNCaches after reload = %d, want 2", got)
+	}
+
+	local := "KeepNCaches = 7\n\n[[Repos]]\nName = 'foo'\nLocalPath = '/mnt/foo'\n"
+	if err := os.WriteFile(filepath.Join(home, kLocalConfigFileName), []byte(local), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := InitConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if got := gConfig.GetRepo("foo"); got.LocalPath != "/mnt/foo" || got.Remote != "https://example.com/foo.git" {
+		t.Errorf("repo foo = %+v, want the LocalPath of %s over the rest of %s", *got, kLocalConfigFileName,
+			kConfigFileName)
+	}
+	if got := gConfig.KeepNCaches(); got != 7 {
+		t.Errorf("KeepNCaches = %d, want the 7 of %s", got, kLocalConfigFileName)
+	}
+	// Saving a change only writes config.toml, without the local overrides.
+	gConfig.SetShallow("foo", false)
+	if err := gConfig.Save(); err != nil {
+		t.Fatal(err)
+	}
+	base, err := readConfigLayout(filepath.Join(home, kConfigFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if base.KeepNCaches != 2 || len(base.Repos) != 2 || base.Repos[0].LocalPath != "/repos/foo" || base.Repos[0].Shallow {
+		t.Errorf("%s = %+v, want the saved values without the local overrides", kConfigFileName, *base)
+	}
+	if data, _ := os.ReadFile(filepath.Join(home, kLocalConfigFileName)); string(data) != local {
+		t.Errorf("%s was changed: %q", kLocalConfigFileName, data)
+	}
+}
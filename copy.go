@@ -0,0 +1,233 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Returned by cloneFile when the platform or filesystem has no copy-on-write
+// clones.
+var errReflinkUnsupported = errors.New("reflink not supported")
+
+type CopyStats struct {
+	Files     int64
+	Bytes     int64
+	Reflinked int64
+	Copied    int64
+	Elapsed   time.Duration
+	// The files and dirs skipped by the exclude patterns, and the size of
+	// their content.
+	Excluded      int64
+	ExcludedBytes int64
+}
+
+// The strategy that ended up being used for the copied files.
+func (s *CopyStats) Strategy() string {
+	switch {
+	case s.Reflinked > 0 && s.Copied > 0:
+		return "reflink+copy"
+	case s.Reflinked > 0:
+		return "reflink"
+	default:
+		return "copy"
+	}
+}
+
+type CopyOptions struct {
+	// Size of the buffer each worker copies file contents through. Zero
+	// lets the kernel copy the data directly (copy_file_range, sendfile)
+	// where possible, which is usually the fastest.
+	BufferSize int
+	// Flush every copied file to disk. Off by default: the cache copy can
+	// be recreated, so losing it to a crash is cheap.
+	Fsync bool
+	// Paths not copied.
+	Excludes []ExcludePattern
+}
+
+type copyJob struct {
+	src  string
+	dst  string
+	mode fs.FileMode
+	size int64
+}
+
+// Copies the content of the file. buf is used as the copy buffer unless it
+// is nil.
+func copyFileContents(job copyJob, buf []byte, fsync bool) error {
+	in, err := os.Open(job.src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(job.dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, job.mode.Perm())
+	if err != nil {
+		return err
+	}
+	if buf == nil {
+		_, err = io.Copy(out, in)
+	} else {
+		// Hide ReadFrom/WriteTo so that the data goes through buf.
+		_, err = io.CopyBuffer(struct{ io.Writer }{out}, struct{ io.Reader }{in}, buf)
+	}
+	if err != nil {
+		out.Close()
+		return err
+	}
+	if fsync {
+		if err = out.Sync(); err != nil {
+			out.Close()
+			return err
+		}
+	}
+	if err = out.Chmod(job.mode.Perm()); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Copies the directory tree src to dst, which must not exist. Files are
+// cloned copy-on-write where the filesystem supports it (btrfs, XFS, APFS)
+// and copied by a pool of workers otherwise. File modes are preserved and
+// symlinks are recreated rather than followed, those with an absolute target
+// inside src pointing to the same path inside dst. The paths matching the
+// exclude patterns are skipped. The copied bytes are added to progress, which
+// may be nil.
+func copyDir(src, dst string, opts CopyOptions, progress *Progress) (*CopyStats, error) {
+	start := time.Now()
+	stats := &CopyStats{}
+	var reflink_unsupported atomic.Bool
+
+	jobs := make(chan copyJob)
+	errs := make(chan error, 1)
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.NumCPU()*2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var buf []byte
+			if opts.BufferSize > 0 {
+				buf = make([]byte, opts.BufferSize)
+			}
+			for job := range jobs {
+				var err error = errReflinkUnsupported
+				if !reflink_unsupported.Load() {
+					err = cloneFile(job.src, job.dst, job.mode)
+					if errors.Is(err, errReflinkUnsupported) {
+						// Don't retry on every file once the filesystem has
+						// shown that it can't clone.
+						reflink_unsupported.Store(true)
+					}
+				}
+				if err == nil {
+					atomic.AddInt64(&stats.Reflinked, 1)
+				} else if errors.Is(err, errReflinkUnsupported) {
+					if err = copyFileContents(job, buf, opts.Fsync); err == nil {
+						atomic.AddInt64(&stats.Copied, 1)
+					}
+				}
+				if err != nil {
+					select {
+					case errs <- fmt.Errorf("Failed to copy %s: %w", job.src, err):
+					default:
+					}
+					continue
+				}
+				atomic.AddInt64(&stats.Files, 1)
+				atomic.AddInt64(&stats.Bytes, job.size)
+				progress.Add(job.size)
+			}
+		}()
+	}
+
+	// Directory modes are applied once their content is written, so that
+	// read-only directories can be populated.
+	type dirMode struct {
+		path string
+		mode fs.FileMode
+	}
+	var dirs []dirMode
+	walk_err := filepath.WalkDir(src, func(file string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, file)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if rel != "." && isExcluded(opts.Excludes, filepath.ToSlash(rel), entry.IsDir()) {
+			stats.Excluded += 1
+			if !entry.IsDir() {
+				if entry.Type().IsRegular() {
+					stats.ExcludedBytes += info.Size()
+				}
+				return nil
+			}
+			size, err := dirSize(file)
+			if err != nil {
+				gLogger.Printf("Failed to compute the size of %s: %v\n", file, err)
+			}
+			stats.ExcludedBytes += size
+			return filepath.SkipDir
+		}
+		switch {
+		case entry.IsDir():
+			if err = os.Mkdir(target, 0700); err != nil {
+				return err
+			}
+			dirs = append(dirs, dirMode{target, info.Mode().Perm()})
+		case entry.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(file)
+			if err != nil {
+				return err
+			}
+			// Otherwise the steps would change the source repo through it.
+			if link_rel, err := filepath.Rel(src, link); err == nil && filepath.IsAbs(link) && filepath.IsLocal(link_rel) {
+				link = filepath.Join(dst, link_rel)
+			}
+			if err = os.Symlink(link, target); err != nil {
+				return err
+			}
+		case entry.Type().IsRegular():
+			select {
+			case jobs <- copyJob{src: file, dst: target, mode: info.Mode(), size: info.Size()}:
+			case err = <-errs:
+				return err
+			}
+		default:
+			gLogger.Printf("Not copying special file: %s\n", file)
+		}
+		return nil
+	})
+	close(jobs)
+	wg.Wait()
+	if walk_err != nil {
+		return nil, walk_err
+	}
+	select {
+	case err := <-errs:
+		return nil, err
+	default:
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Chmod(dirs[i].path, dirs[i].mode); err != nil {
+			return nil, err
+		}
+	}
+	stats.Elapsed = time.Since(start)
+	return stats, nil
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestCopyDir(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "src")
+	outside := filepath.Join(t.TempDir(), "outside")
+	files := map[string]os.FileMode{
+		"README":               0644,
+		"a/b/c/nested.txt":     0644,
+		"bin/run.sh":           0755,
+		"readonly/locked.txt":  0444,
+		"build/out.bin":        0644,
+		"a/b/obj.o":            0644,
+		".git/objects/ab/cdef": 0444,
+	}
+	for file, mode := range files {
+		if err := os.MkdirAll(filepath.Join(src, filepath.Dir(file)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(src, file), []byte(file), mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"a/link":     "b/c/nested.txt",
+		"abs-link":   filepath.Join(src, "README"),
+		"out-link":   outside,
+		"dangling":   "no/such/file",
+		"a/dir-link": "../bin",
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, filepath.Join(src, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chmod(filepath.Join(src, "readonly"), 0555); err != nil {
+		t.Fatal(err)
+	}
+	excludes, err := parseExcludePatterns([]string{"build/", "*.o"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst := filepath.Join(t.TempDir(), "dst")
+	t.Cleanup(func() { os.Chmod(filepath.Join(dst, "readonly"), 0755) })
+	stats, err := copyDir(src, dst, CopyOptions{BufferSize: 4096, Excludes: excludes}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for file, mode := range files {
+		data, err := os.ReadFile(filepath.Join(dst, file))
+		if file == "build/out.bin" || file == "a/b/obj.o" {
+			if !os.IsNotExist(err) {
+				t.Errorf("The excluded %s was copied", file)
+			}
+			continue
+		}
+		if err != nil || string(data) != file {
+			t.Errorf("%s: %q, %v", file, data, err)
+			continue
+		}
+		if info, err := os.Stat(filepath.Join(dst, file)); err != nil || info.Mode().Perm() != mode {
+			t.Errorf("%s: mode %v, %v, want %v", file, info.Mode().Perm(), err, mode)
+		}
+	}
+	if info, err := os.Stat(filepath.Join(dst, "readonly")); err != nil || info.Mode().Perm() != 0555 {
+		t.Errorf("readonly: mode %v, %v, want 0555", info.Mode().Perm(), err)
+	}
+	// Absolute links into the repo point into the copy, for the steps not
+	// to change the repo through them.
+	links["abs-link"] = filepath.Join(dst, "README")
+	for link, want := range links {
+		if got, err := os.Readlink(filepath.Join(dst, link)); err != nil || got != want {
+			t.Errorf("%s -> %q, %v, want %q", link, got, err, want)
+		}
+	}
+	if stats.Files != 5 || stats.Excluded != 2 {
+		t.Errorf("Copied %d files and excluded %d, want 5 and 2", stats.Files, stats.Excluded)
+	}
+}
+
+// Size of the tree the copy benchmarks copy, in MB. XBISECT_BENCH_TREE_MB
+// overrides it, e.g. to compare the copies on a multi-GB tree.
+const kCopyBenchTreeMB = 256
+
+// Writes a tree shaped like a git repo to a temp dir: many small files in
+// nested dirs, as in a checkout and its loose objects, and a few large ones,
+// as its packs. Returns the dir and the size of its files.
+func writeCopyBenchTree(b *testing.B) (string, int64) {
+	b.Helper()
+	total := int64(kCopyBenchTreeMB) << 20
+	if mb := os.Getenv("XBISECT_BENCH_TREE_MB"); len(mb) > 0 {
+		var n int64
+		if _, err := fmt.Sscan(mb, &n); err != nil || n <= 0 {
+			b.Fatalf("Invalid XBISECT_BENCH_TREE_MB: %q", mb)
+		}
+		total = n << 20
+	}
+	src := filepath.Join(b.TempDir(), "src")
+	rng := rand.New(rand.NewPCG(1, 2))
+	data := make([]byte, 64<<20)
+	for i := range data {
+		data[i] = byte(rng.Uint32())
+	}
+	var written int64
+	write := func(file string, size int64) {
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			b.Fatal(err)
+		}
+		f, err := os.Create(file)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for left := size; left > 0; {
+			n := min(left, int64(len(data)))
+			if _, err = f.Write(data[:n]); err != nil {
+				b.Fatal(err)
+			}
+			left -= n
+		}
+		if err = f.Close(); err != nil {
+			b.Fatal(err)
+		}
+		written += size
+	}
+	// Half of the size in packs, the other half in small files.
+	for i := 0; written < total/2; i++ {
+		write(filepath.Join(src, ".git", "objects", "pack", fmt.Sprintf("pack-%d.pack", i)), min(total/2-written, 64<<20))
+	}
+	for i := 0; written < total; i++ {
+		file := filepath.Join(src, fmt.Sprintf("dir%d", i%50), fmt.Sprintf("sub%d", i%7), fmt.Sprintf("file%d.c", i))
+		write(file, min(total-written, 512+rng.Int64N(64<<10)))
+	}
+	return src, written
+}
+
+// Copies src into a new dir with copy for each iteration, the copy being
+// removed out of the timer.
+func benchmarkCopy(b *testing.B, src string, size int64, copy func(dst string) error) {
+	b.Helper()
+	dstdir := b.TempDir()
+	b.SetBytes(size)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		dst := filepath.Join(dstdir, "dst")
+		if err := copy(dst); err != nil {
+			b.Fatal(err)
+		}
+		b.StopTimer()
+		if err := os.RemoveAll(dst); err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+	}
+}
+
+// Compares copyDir, reflinking where the filesystem of the temp dir
+// supports it, to the cp --recursive it replaced.
+func BenchmarkCopyDirStrategies(b *testing.B) {
+	src, size := writeCopyBenchTree(b)
+	b.Run("copyDir", func(b *testing.B) {
+		benchmarkCopy(b, src, size, func(dst string) error {
+			stats, err := copyDir(src, dst, CopyOptions{}, nil)
+			if err == nil && b.N == 1 {
+				b.Logf("strategy: %s", stats.Strategy())
+			}
+			return err
+		})
+	})
+	b.Run("cp -r", func(b *testing.B) {
+		benchmarkCopy(b, src, size, func(dst string) error {
+			return exec.Command("cp", "-r", src, dst).Run()
+		})
+	})
+	if runtime.GOOS == "linux" {
+		b.Run("cp --recursive --reflink=auto", func(b *testing.B) {
+			benchmarkCopy(b, src, size, func(dst string) error {
+				return exec.Command("cp", "--recursive", "--reflink=auto", src, dst).Run()
+			})
+		})
+	}
+}
+
+// Compares the --copy-buffer sizes and --copy-fsync, with cp -r for
+// reference. They only matter where the files are not reflinked, so the temp
+// dir must be on a filesystem without reflinks, e.g. ext4 or tmpfs.
+func BenchmarkCopyDirBuffers(b *testing.B) {
+	src, size := writeCopyBenchTree(b)
+	for _, fsync := range []bool{false, true} {
+		for _, buffer_size := range []int{0, 32 << 10, 256 << 10, 1 << 20, 4 << 20} {
+			b.Run(fmt.Sprintf("buffer=%d/fsync=%t", buffer_size, fsync), func(b *testing.B) {
+				opts := CopyOptions{BufferSize: buffer_size, Fsync: fsync}
+				benchmarkCopy(b, src, size, func(dst string) error {
+					_, err := copyDir(src, dst, opts, nil)
+					return err
+				})
+			})
+		}
+	}
+	b.Run("cp -r", func(b *testing.B) {
+		benchmarkCopy(b, src, size, func(dst string) error {
+			return exec.Command("cp", "-r", src, dst).Run()
+		})
+	})
+}
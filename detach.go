@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+// Printed by the detached process once its run started, followed by the run
+// id, for the process that started it.
+const kDetachedRunMarker = "xbisect detached run="
+
+// Fails if the run needs the terminal it would be detached from.
+func checkDetachable(opts RunOptions, reponame string) error {
+	switch {
+	case !kDetachSupported:
+		return errors.New("--detach is not supported on this platform.")
+	case isRepoGlob(reponame):
+		return errors.New("--detach cannot be used with a repo glob.")
+	case opts.DryRun:
+		return errors.New("--detach and --dry-run are mutually exclusive, a dry run has nothing to detach.")
+	case opts.Preview:
+		return errors.New("--detach cannot be used with --preview, which asks for confirmation.")
+	case opts.StepsFile == "-":
+		return errors.New("--detach cannot be used with --steps-file -, the detached run has no stdin.")
+	}
+	return nil
+}
+
+// The args of the detached process: those of the run, without --detach.
+func detachedArgs(args []string) []string {
+	detached := []string{"--detached"}
+	for i, arg := range args {
+		if arg == "--" {
+			return append(detached, args[i:]...)
+		}
+		if arg != "--detach" && !strings.HasPrefix(arg, "--detach=") {
+			detached = append(detached, arg)
+		}
+	}
+	return detached
+}
+
+// Starts the run with the args again in a background process, in its own
+// session. Its output is relayed until its run started, e.g. to report
+// invalid options, then it only logs to the log file.
+func RunDetached(args []string) error {
+	executable, err := os.Executable()
+	if err != nil {
+		gLogger.Printf("Error: %v\n", err)
+		return wrapError(err, "Failed to locate the %s executable", kApplicationName)
+	}
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	cmd := exec.Command(executable, detachedArgs(args)...)
+	cmd.Stdout = writer
+	cmd.Stderr = writer
+	cmd.SysProcAttr = detachedProcAttr()
+	gLogger.Printf("Running detached: %s %s\n", executable, strings.Join(cmd.Args[1:], " "))
+	err = cmd.Start()
+	writer.Close()
+	if err != nil {
+		gLogger.Printf("Error: %v\n", err)
+		return wrapError(err, "Failed to start the detached run")
+	}
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := scanner.Text()
+		run_id, found := strings.CutPrefix(line, kDetachedRunMarker)
+		if !found {
+			fmt.Println(line)
+			continue
+		}
+		pid := cmd.Process.Pid
+		cmd.Process.Release()
+		ConsoleLogInfo("Run %s detached (pid %d)", run_id, pid)
+		ConsoleLogInfo("Check on it with `%s status`, follow its log with `%s logs --follow`, and stop it with `%s kill --run %s`",
+			kApplicationName, kApplicationName, kApplicationName, run_id)
+		return nil
+	}
+	// The process ended before its run started, having reported why.
+	if err = cmd.Wait(); err != nil {
+		gLogger.Printf("Error: %v\n", err)
+	}
+	return errors.New("The run failed to start, nothing was detached.")
+}
+
+// Tells the process that started the detached process that its run started,
+// and stops writing to the output it reads.
+func announceDetachedRun(setup *RunSetup) {
+	stdout, err := detachOutput()
+	if err != nil {
+		// Still let the other process go.
+		gLogger.Printf("Failed to detach the output: %v\n", err)
+		stdout = os.Stdout
+	} else {
+		defer stdout.Close()
+	}
+	fmt.Fprintf(stdout, "%s%s\n", kDetachedRunMarker, path.Base(setup.CacheDir))
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// A check run by doctor. It returns a short description of what it found,
+// or an error.
+type doctorCheck struct {
+	name  string
+	check func() (string, error)
+}
+
+// Returns the absolute path of the git executable given with --git-bin, or
+// found on $PATH, if it is an executable file.
+func checkGitBinary(git_bin string) (string, error) {
+	if len(git_bin) == 0 {
+		git_bin = "git"
+	}
+	resolved, err := exec.LookPath(git_bin)
+	if err != nil {
+		return "", err
+	}
+	if resolved, err = filepath.Abs(resolved); err != nil {
+		return "", err
+	}
+	info, err := os.Stat(resolved)
+	if err != nil {
+		return "", err
+	}
+	if !info.Mode().IsRegular() || info.Mode().Perm()&0111 == 0 {
+		return "", fmt.Errorf("%s is not an executable file", resolved)
+	}
+	return resolved, nil
+}
+
+// Checks that xbisect can run: the git executable, its version and the app
+// data dir. Prints one line per check.
+func Doctor(git_bin string) bool {
+	git_ok := false
+	checks := []doctorCheck{
+		{"git executable", func() (string, error) {
+			resolved, err := checkGitBinary(git_bin)
+			if err == nil {
+				gGitPath = resolved
+				git_ok = true
+			}
+			return resolved, err
+		}},
+		{"git version", func() (string, error) {
+			if !git_ok {
+				return "", errors.New("skipped, no usable git executable")
+			}
+			features, err := gitFeatures()
+			if err != nil {
+				return "", err
+			}
+			return features.Version.Raw, requireGitVersion()
+		}},
+		{"app data dir", func() (string, error) {
+			f, err := os.CreateTemp(GetAppDataDir(), ".doctor")
+			if err != nil {
+				return "", err
+			}
+			f.Close()
+			return GetAppDataDir(), os.Remove(f.Name())
+		}},
+		{"locks", func() (string, error) {
+			locks, err := listLocks()
+			if err != nil {
+				return "", err
+			}
+			stale := 0
+			for _, lock := range locks {
+				if lock.Stale() {
+					stale += 1
+				}
+			}
+			if stale > 0 {
+				return "", fmt.Errorf("%d stale locks left by processes that are gone, remove them with `%s clean --force-unlock`",
+					stale, kApplicationName)
+			}
+			return fmt.Sprintf("%d held by running processes", len(locks)), nil
+		}},
+	}
+	success := true
+	for _, check := range checks {
+		found, err := check.check()
+		if err != nil {
+			gLogger.Printf("Error: %v\n", err)
+			ConsoleLogError("%-16s FAIL %v", check.name, err)
+			success = false
+			continue
+		}
+		ConsoleLogInfo("%-16s OK   %s", check.name, found)
+	}
+	return success
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+)
+
+// File of the run's cache dir recording how the bisect narrowed the range,
+// kept for results export once the cache repo is gone.
+const kBisectPathFilename = "bisect_path.toml"
+
+// An entry of git bisect log recording the verdict of a commit.
+var gBisectLogEntryRe = regexp.MustCompile(`^# (good|bad|skip): \[([0-9a-f]{40})\] (.*)$`)
+
+// A commit given a verdict in a bisect.
+type BisectVerdict struct {
+	Hash    string
+	Subject string
+	// good, bad or skip.
+	Verdict string
+}
+
+// How a bisect narrowed its range, in the order the verdicts were given.
+type BisectPath struct {
+	Lo      string
+	Hi      string
+	Culprit string `toml:",omitempty"`
+	// kModeFix when Culprit is the first commit whose steps pass. The
+	// verdicts are those of git, which names bad the commits whose steps
+	// pass in that mode.
+	Mode string `toml:",omitempty"`
+	// The verdicts given before the steps ran: lo, hi and the --mark ones.
+	Marks []BisectVerdict
+	// The commits tested by the steps.
+	Tested []BisectVerdict
+	// The parents of each commit of the range, to find the commits each
+	// verdict eliminated.
+	Parents map[string][]string
+}
+
+// Returns the verdicts of git bisect log in the repo, in order.
+func readBisectLog(runner CommandRunner, dir string) ([]BisectVerdict, error) {
+	out, err := runCommandDirOutput(runner, dir, gGitPath, "bisect", "log")
+	if err != nil {
+		return nil, err
+	}
+	var verdicts []BisectVerdict
+	for _, line := range strings.Split(string(out), "\n") {
+		if match := gBisectLogEntryRe.FindStringSubmatch(line); match != nil {
+			verdicts = append(verdicts, BisectVerdict{Hash: match[2], Subject: match[3], Verdict: match[1]})
+		}
+	}
+	return verdicts, nil
+}
+
+// Records the path of the bisect in progress in the repo, whose first marks
+// verdicts were given before the steps ran.
+func captureBisectPath(runner CommandRunner, dir, lo, hi, culprit, mode string, marks int) (*BisectPath, error) {
+	verdicts, err := readBisectLog(runner, dir)
+	if err != nil {
+		return nil, err
+	}
+	marks = min(marks, len(verdicts))
+	bisect_path := &BisectPath{Lo: lo, Hi: hi, Culprit: culprit, Mode: mode, Marks: verdicts[:marks],
+		Tested: verdicts[marks:], Parents: map[string][]string{}}
+	out, err := runCommandDirOutput(runner, dir, gGitPath, "rev-list", "--parents", hi, "^"+lo)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 {
+			bisect_path.Parents[fields[0]] = fields[1:]
+		}
+	}
+	return bisect_path, nil
+}
+
+func (p *BisectPath) Save(cachedir string) error {
+	serialized, err := toml.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path.Join(cachedir, kBisectPathFilename), serialized, 0666)
+}
+
+func LoadBisectPath(cachedir string) (*BisectPath, error) {
+	data, err := os.ReadFile(path.Join(cachedir, kBisectPathFilename))
+	if err != nil {
+		return nil, err
+	}
+	bisect_path := &BisectPath{}
+	if err = toml.Unmarshal(data, bisect_path); err != nil {
+		return nil, err
+	}
+	return bisect_path, nil
+}
+
+// The commits of the candidates that are hash or its ancestors.
+func (p *BisectPath) ancestors(candidates map[string]bool, hash string) map[string]bool {
+	found := map[string]bool{}
+	pending := []string{hash}
+	for len(pending) > 0 {
+		current := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if found[current] || !candidates[current] {
+			continue
+		}
+		found[current] = true
+		pending = append(pending, p.Parents[current]...)
+	}
+	return found
+}
+
+// Applies the verdict to the commits that may still be the first bad one.
+// Returns how many it eliminated.
+func (p *BisectPath) eliminate(candidates map[string]bool, verdict BisectVerdict) int {
+	before := len(candidates)
+	switch verdict.Verdict {
+	case "good":
+		// The commit and its ancestors are good.
+		for hash := range p.ancestors(candidates, verdict.Hash) {
+			delete(candidates, hash)
+		}
+	case "bad":
+		// The first bad commit is the commit or one of its ancestors.
+		keep := p.ancestors(candidates, verdict.Hash)
+		for hash := range candidates {
+			if !keep[hash] {
+				delete(candidates, hash)
+			}
+		}
+	}
+	return before - len(candidates)
+}
+
+// The verdict of the steps on a commit git gave the verdict, good when they
+// pass.
+func (p *BisectPath) stepVerdict(verdict string) string {
+	if p.Mode != kModeFix {
+		return verdict
+	}
+	switch verdict {
+	case "good":
+		return "bad"
+	case "bad":
+		return "good"
+	}
+	return verdict
+}
+
+func (p *BisectPath) culpritLabel() string {
+	if p.Mode == kModeFix {
+		return "first fixed commit"
+	}
+	return "first bad commit"
+}
+
+// Quotes s as a DOT string.
+func dotQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
+
+var kDotVerdictColors = map[string]string{
+	"good": "palegreen",
+	"bad":  "lightcoral",
+	"skip": "lightgray",
+}
+
+// Renders the path as a Graphviz digraph: the tested commits, colored by
+// verdict, linked in the order they were tested, each edge telling how many
+// commits the verdict eliminated. The culprit is emphasized.
+func (p *BisectPath) Dot() string {
+	candidates := map[string]bool{}
+	for hash := range p.Parents {
+		candidates[hash] = true
+	}
+	for _, mark := range p.Marks {
+		p.eliminate(candidates, mark)
+	}
+	var dot strings.Builder
+	dot.WriteString("digraph bisect {\n")
+	dot.WriteString("  node [shape=box, style=\"rounded,filled\", fontname=\"monospace\"];\n")
+	fmt.Fprintf(&dot, "  start [shape=plaintext, style=\"\", label=%s];\n",
+		dotQuote(fmt.Sprintf("%.12s..%.12s\n%d candidates", p.Lo, p.Hi, len(candidates))))
+	previous := "start"
+	label := ""
+	nodes := map[string]bool{}
+	for _, tested := range p.Tested {
+		verdict := p.stepVerdict(tested.Verdict)
+		node_label := fmt.Sprintf("%.12s\n%s\n%s", tested.Hash, tested.Subject, strings.ToUpper(verdict))
+		attrs := ""
+		if tested.Hash == p.Culprit {
+			node_label += "\n" + p.culpritLabel()
+			attrs = ", penwidth=3, color=red"
+		}
+		if !nodes[tested.Hash] {
+			fmt.Fprintf(&dot, "  %s [label=%s, fillcolor=%s%s];\n", dotQuote(tested.Hash), dotQuote(node_label),
+				kDotVerdictColors[verdict], attrs)
+			nodes[tested.Hash] = true
+		}
+		fmt.Fprintf(&dot, "  %s -> %s%s;\n", dotQuote(previous), dotQuote(tested.Hash), label)
+		eliminated := p.eliminate(candidates, tested)
+		label = fmt.Sprintf(" [label=%s]", dotQuote(fmt.Sprintf("%s: -%d, %d left", verdict, eliminated, len(candidates))))
+		previous = tested.Hash
+	}
+	if len(p.Culprit) > 0 && !nodes[p.Culprit] {
+		// Found by the marks alone, or the last candidate left untested.
+		fmt.Fprintf(&dot, "  %s [label=%s, fillcolor=%s, penwidth=3, color=red];\n", dotQuote(p.Culprit),
+			dotQuote(fmt.Sprintf("%.12s\n%s", p.Culprit, p.culpritLabel())), kDotVerdictColors[p.stepVerdict("bad")])
+	}
+	if len(p.Culprit) > 0 && previous != p.Culprit {
+		// The last verdict leading to the culprit.
+		fmt.Fprintf(&dot, "  %s -> %s%s;\n", dotQuote(previous), dotQuote(p.Culprit), label)
+	}
+	dot.WriteString("}\n")
+	return dot.String()
+}
+
+var kTreeVerdictColors = map[string]string{
+	"good": kColorGreen,
+	"bad":  kColorRed,
+	"skip": kColorGray,
+}
+
+// Renders the path as an indented tree for the console: the range, then each
+// tested commit one level deeper than the one before, with its verdict and
+// how many commits it eliminated, down to the culprit.
+func (p *BisectPath) Tree() []string {
+	candidates := map[string]bool{}
+	for hash := range p.Parents {
+		candidates[hash] = true
+	}
+	for _, mark := range p.Marks {
+		p.eliminate(candidates, mark)
+	}
+	lines := []string{fmt.Sprintf("%.12s..%.12s: %d candidates", p.Lo, p.Hi, len(candidates))}
+	branch := func(line string) {
+		lines = append(lines, strings.Repeat("   ", len(lines)-1)+"└─ "+line)
+	}
+	for _, tested := range p.Tested {
+		eliminated := p.eliminate(candidates, tested)
+		verdict := p.stepVerdict(tested.Verdict)
+		branch(fmt.Sprintf("%s%s%-4s%s %.12s %s (-%d, %d left)", kFontBold, kTreeVerdictColors[verdict],
+			strings.ToUpper(verdict), kConsoleReset, tested.Hash, tested.Subject, eliminated, len(candidates)))
+	}
+	if len(p.Culprit) > 0 {
+		branch(fmt.Sprintf("%s%s%s %.12s", kFontBold, p.culpritLabel(), kConsoleReset, p.Culprit))
+	}
+	return lines
+}
+
+// Prints the tree of the path of the bisect in progress in the repo, for
+// --summary-format tree.
+func printBisectTree(runner CommandRunner, dir, lo, hi, culprit, mode string, marks int) {
+	bisect_path, err := captureBisectPath(runner, dir, lo, hi, culprit, mode, marks)
+	if err != nil {
+		gLogger.Printf("Error: %v\n", err)
+		ConsoleLogError("Failed to read the bisect path, not printing its tree")
+		return
+	}
+	for _, line := range bisect_path.Tree() {
+		ConsoleLogInfo("%s", line)
+	}
+}
+
+// Writes the DOT graph of the path to the file, or to stdout when it is -.
+func writeDot(bisect_path *BisectPath, file string) error {
+	if file == "-" {
+		_, err := os.Stdout.WriteString(bisect_path.Dot())
+		return err
+	}
+	return os.WriteFile(file, []byte(bisect_path.Dot()), 0666)
+}
+
+// Exports the path of the run with the given id, in the format.
+func ExportResults(run_id, format, output string) error {
+	if format != "dot" {
+		return fmt.Errorf("Unsupported export format: %s", format)
+	}
+	cachedir := path.Join(GetAppDataDir(), "cache", run_id)
+	if !isDir(cachedir) {
+		return fmt.Errorf("No run with id: %s", run_id)
+	}
+	bisect_path, err := LoadBisectPath(cachedir)
+	if err != nil {
+		gLogger.Printf("Error: %v\n", err)
+		if os.IsNotExist(err) {
+			return fmt.Errorf("Run %s recorded no bisect path, it did not finish its bisect.", run_id)
+		}
+		return wrapError(err, "Failed to read the bisect path of run %s", run_id)
+	}
+	if err = writeDot(bisect_path, output); err != nil {
+		gLogger.Printf("Error: %v\n", err)
+		return wrapError(err, "Failed to write %s", output)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var gUpdateGolden = flag.Bool("update", false, "Rewrite the golden files of testdata with the current output.")
+
+// A linear range c1..c5 of lo c0, where git found c3 after testing c3 then
+// c2.
+func testBisectPath(mode string) *BisectPath {
+	return &BisectPath{
+		Lo: "c0", Hi: "c5", Culprit: "c3", Mode: mode,
+		Marks: []BisectVerdict{{Hash: "c0", Verdict: "good"}, {Hash: "c5", Verdict: "bad"}},
+		Tested: []BisectVerdict{
+			{Hash: "c3", Subject: "third", Verdict: "bad"},
+			{Hash: "c2", Subject: "second", Verdict: "good"},
+		},
+		Parents: map[string][]string{"c1": {"c0"}, "c2": {"c1"}, "c3": {"c2"}, "c4": {"c3"}, "c5": {"c4"}},
+	}
+}
+
+func TestBisectPathFixMode(t *testing.T) {
+	tests := []struct {
+		mode           string
+		culpritVerdict string
+		culpritLabel   string
+		culpritColor   string
+		secondVerdict  string
+	}{
+		{"", "BAD", "first bad commit", "lightcoral", "GOOD"},
+		{kModeFix, "GOOD", "first fixed commit", "palegreen", "BAD"},
+	}
+	for _, tt := range tests {
+		dot := testBisectPath(tt.mode).Dot()
+		culprit_node := `"c3" [label="c3\nthird\n` + tt.culpritVerdict + `\n` + tt.culpritLabel +
+			`", fillcolor=` + tt.culpritColor
+		if !strings.Contains(dot, culprit_node) {
+			t.Errorf("mode %q: Dot() has no %s in:\n%s", tt.mode, culprit_node, dot)
+		}
+		if !strings.Contains(dot, `"c2" [label="c2\nsecond\n`+tt.secondVerdict+`"`) {
+			t.Errorf("mode %q: Dot() does not give c2 the verdict %s:\n%s", tt.mode, tt.secondVerdict, dot)
+		}
+		tree := strings.Join(testBisectPath(tt.mode).Tree(), "\n")
+		if !strings.Contains(tree, tt.secondVerdict) || !strings.Contains(tree, tt.culpritLabel+kConsoleReset+" c3") {
+			t.Errorf("mode %q: Tree() does not use the verdicts of the steps:\n%s", tt.mode, tree)
+		}
+	}
+}
+
+// A range c1..c7 of lo c0, where the side branch c3 is merged by c4. The
+// merge was skipped, and git found c2 after testing c5, c3 and c2.
+func testMergeBisectPath() *BisectPath {
+	return &BisectPath{
+		Lo: "c0", Hi: "c7", Culprit: "c2",
+		Marks: []BisectVerdict{{Hash: "c0", Verdict: "good"}, {Hash: "c7", Verdict: "bad"}},
+		Tested: []BisectVerdict{
+			{Hash: "c4", Subject: `Merge branch "side"`, Verdict: "skip"},
+			{Hash: "c5", Subject: "fifth", Verdict: "bad"},
+			{Hash: "c3", Subject: "side", Verdict: "good"},
+			{Hash: "c2", Subject: "second", Verdict: "bad"},
+		},
+		Parents: map[string][]string{"c1": {"c0"}, "c2": {"c1"}, "c3": {"c1"}, "c4": {"c2", "c3"}, "c5": {"c4"},
+			"c6": {"c5"}, "c7": {"c6"}},
+	}
+}
+
+// Compares the output to the golden file of testdata, rewriting it instead
+// with -update.
+func checkGolden(t *testing.T, name, got string) {
+	t.Helper()
+	golden := filepath.Join("testdata", name)
+	if *gUpdateGolden {
+		if err := os.WriteFile(golden, []byte(got), 0666); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != string(want) {
+		t.Errorf("The output differs from %s, rerun with -update if expected:\n%s", golden, got)
+	}
+}
+
+func TestBisectPathDotGolden(t *testing.T) {
+	checkGolden(t, "bisect_path.dot", testMergeBisectPath().Dot())
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+)
+
+var (
+	// The --repo given is not in the config.
+	ErrRepoNotFound = errors.New("No imported repo with name")
+	// A rev does not name an object of the repo. Matched by InvalidRefError.
+	ErrBadRef = errors.New("Invalid ref")
+	// The bisect finished without finding the first bad commit.
+	ErrBisectInconclusive = errors.New("Bisect ended without finding the first bad commit")
+	// The first bad commit found is not the one given with --expect-culprit.
+	ErrUnexpectedCulprit = errors.New("The first bad commit is not the expected one")
+	// The user declined to go on. Reported as info rather than as an error.
+	ErrAborted = errors.New("Aborted")
+	// A command did not finish within the Timeout of its CommandOptions.
+	ErrCommandTimeout = errors.New("Command timed out")
+)
+
+func repoNotFoundError(reponame string) error {
+	return fmt.Errorf("%w: \"%s\". Run %s import --help", ErrRepoNotFound, reponame, kApplicationName)
+}
+
+// A git command that failed. Its message is the one of Err, so that wrapping
+// it does not change what is reported.
+type GitError struct {
+	Args []string
+	// What git wrote on stderr, when it was captured.
+	Stderr []byte
+	Err    error
+}
+
+func (e *GitError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *GitError) Unwrap() error {
+	return e.Err
+}
+
+// Wraps the error of running the command in a GitError if it is a git
+// command. Other errors are returned unchanged.
+func gitCommandError(command []string, err error) error {
+	if err == nil || command[0] != gGitPath {
+		return err
+	}
+	git_err := &GitError{Args: command[1:], Err: err}
+	var exit_err *exec.ExitError
+	if errors.As(err, &exit_err) {
+		git_err.Stderr = exit_err.Stderr
+	}
+	return git_err
+}
+
+// An error reported on the console as Msg. The error causing it, often too
+// low level for the console, is only logged and is kept for errors.Is and
+// errors.As.
+type ConsoleError struct {
+	Msg string
+	Err error
+}
+
+func (e *ConsoleError) Error() string {
+	return e.Msg
+}
+
+func (e *ConsoleError) Unwrap() error {
+	return e.Err
+}
+
+func wrapError(err error, format string, v ...any) error {
+	return &ConsoleError{Msg: fmt.Sprintf(format, v...), Err: err}
+}
+
+// Reports the error of an operation on the console, one line per error it
+// joins.
+func ConsoleLogErr(err error) {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		for _, err := range joined.Unwrap() {
+			ConsoleLogErr(err)
+		}
+		return
+	}
+	if errors.Is(err, ErrAborted) {
+		ConsoleLogInfo("%v", err)
+		return
+	}
+	ConsoleLogError("%v", err)
+}
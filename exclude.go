@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// File at the root of a repo listing the paths not copied into the cache,
+// one pattern per line.
+const kIgnoreFileName = ".xbisectignore"
+
+// A pattern of a path not copied into the cache, with a subset of the
+// gitignore syntax: a pattern matches the name of a file or dir at any depth,
+// unless it contains a slash, in which case it matches the path relative to
+// the repo root. A trailing slash only matches dirs. *, ? and [] are globs,
+// and a leading **/ or trailing /** is accepted. Negation is not supported.
+type ExcludePattern struct {
+	Pattern  string
+	anchored bool
+	dir_only bool
+}
+
+// Parses the patterns, e.g. from --exclude.
+func parseExcludePatterns(patterns []string) ([]ExcludePattern, error) {
+	var parsed []ExcludePattern
+	for _, pattern := range patterns {
+		exclude := ExcludePattern{Pattern: pattern}
+		if strings.HasPrefix(pattern, "!") {
+			return nil, fmt.Errorf("Invalid exclude pattern %q, negation is not supported", pattern)
+		}
+		glob := strings.TrimPrefix(pattern, "**/")
+		if trimmed, found := strings.CutSuffix(glob, "/**"); found {
+			glob = trimmed
+			exclude.dir_only = true
+		}
+		if trimmed, found := strings.CutSuffix(glob, "/"); found {
+			glob = trimmed
+			exclude.dir_only = true
+		}
+		exclude.anchored = strings.Contains(glob, "/")
+		glob = strings.TrimPrefix(glob, "/")
+		if _, err := path.Match(glob, ""); err != nil || len(glob) == 0 {
+			return nil, fmt.Errorf("Invalid exclude pattern %q", pattern)
+		}
+		exclude.Pattern = glob
+		parsed = append(parsed, exclude)
+	}
+	return parsed, nil
+}
+
+// Reads the patterns of the ignore file at the root of the repo, if any.
+// Empty lines and lines starting with # are ignored.
+func readIgnoreFile(repodir string) ([]string, error) {
+	var patterns []string
+	err := readLinesFile(path.Join(repodir, kIgnoreFileName), func(text string) error {
+		patterns = append(patterns, text)
+		return nil
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return patterns, err
+}
+
+// Whether the path, relative to the repo root and slash separated, is
+// excluded by one of the patterns.
+func isExcluded(patterns []ExcludePattern, rel string, is_dir bool) bool {
+	for _, pattern := range patterns {
+		if pattern.dir_only && !is_dir {
+			continue
+		}
+		name := rel
+		if !pattern.anchored {
+			name = path.Base(rel)
+		}
+		if matched, _ := path.Match(pattern.Pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Lists the paths of the dir that the patterns exclude, without the content
+// of the excluded dirs, for --dry-run.
+func listExcludedPaths(dir string, patterns []ExcludePattern) ([]string, error) {
+	var excluded []string
+	err := filepath.WalkDir(dir, func(file string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil || rel == "." {
+			return err
+		}
+		if !isExcluded(patterns, filepath.ToSlash(rel), entry.IsDir()) {
+			return nil
+		}
+		excluded = append(excluded, filepath.ToSlash(rel))
+		if entry.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return excluded, err
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	gGitVersionRe = regexp.MustCompile(`^git version ([0-9]+)\.([0-9]+)(?:\.([0-9]+))?`)
+
+	gGitFeaturesOnce sync.Once
+	gGitFeatures     *GitFeatures
+	gGitFeaturesErr  error
+
+	// A git config key, section.name or section.subsection.name.
+	gGitConfigKeyRe = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9-]*(\.[^=\n]+)?\.[a-zA-Z][a-zA-Z0-9-]*$`)
+
+	// The KEY=VALUE of run --git-config, passed to the git commands of the
+	// run after the kGitQuietAdvice ones.
+	gGitConfigOverrides []string
+)
+
+// Vars making git operate on another repo than the one of its working dir,
+// e.g. exported by git hooks.
+var kGitRepoEnvVars = []string{"GIT_DIR", "GIT_WORK_TREE", "GIT_INDEX_FILE", "GIT_PREFIX"}
+
+// Set by git for the commands it runs to pass on its -c options, e.g. by git
+// bisect run for the wrapper, which must not reach the steps.
+const kGitConfigParametersVar = "GIT_CONFIG_PARAMETERS"
+
+// Vars set for the git commands run by xbisect: the output that is parsed
+// must not be translated, and git must fail rather than prompt.
+var kGitEnvOverrides = [][2]string{{"LC_ALL", "C"}, {"GIT_TERMINAL_PROMPT", "0"}}
+
+// The advice hints turned off for the git commands run by xbisect. git has
+// no wildcard to turn them all off.
+var kGitQuietAdvice = []string{"detachedHead", "statusHints", "resolveConflict", "implicitIdentity",
+	"waitingForEditor", "skippedCherryPicks", "forceDeleteBranch", "ignoredHook"}
+
+// Returns the env of the git commands run by xbisect: the env of xbisect
+// without the vars pointing git elsewhere, and with kGitEnvOverrides.
+func gitEnv() []string {
+	var env []string
+	for _, v := range os.Environ() {
+		name, _, _ := strings.Cut(v, "=")
+		if slices.Contains(kGitRepoEnvVars, name) || slices.ContainsFunc(kGitEnvOverrides,
+			func(o [2]string) bool { return o[0] == name }) {
+			continue
+		}
+		env = append(env, v)
+	}
+	for _, o := range kGitEnvOverrides {
+		env = append(env, o[0]+"="+o[1])
+	}
+	return env
+}
+
+// Returns the -c options passed to the git commands run by xbisect. git
+// bisect run passes them on to the wrapper script, and so to its git
+// commands, but not to the steps (see stepEnvRestoreArgs).
+func gitConfigArgs() []string {
+	var args []string
+	for _, advice := range kGitQuietAdvice {
+		args = append(args, "-c", "advice."+advice+"=false")
+	}
+	for _, override := range gGitConfigOverrides {
+		args = append(args, "-c", override)
+	}
+	return args
+}
+
+// Validates the KEY=VALUE of --git-config and sets them for the git
+// commands run from now on.
+func setGitConfigOverrides(overrides []string) error {
+	for _, override := range overrides {
+		key, _, found := strings.Cut(override, "=")
+		if !found {
+			return fmt.Errorf("Invalid --git-config %q, expected KEY=VALUE.", override)
+		}
+		if !gGitConfigKeyRe.MatchString(key) {
+			return fmt.Errorf("Invalid --git-config key %q, expected section.name or section.subsection.name, e.g. core.autocrlf.",
+				key)
+		}
+	}
+	gGitConfigOverrides = overrides
+	return nil
+}
+
+// Returns the env args restoring, for a step started with env from the
+// wrapper, the vars of the env of xbisect that gitEnv and the -c options of
+// gitConfigArgs changed.
+func stepEnvRestoreArgs() []string {
+	names := append(slices.Clone(kGitRepoEnvVars), kGitConfigParametersVar)
+	for _, o := range kGitEnvOverrides {
+		names = append(names, o[0])
+	}
+	var args []string
+	var restored []string
+	for _, name := range names {
+		args = append(args, "-u", name)
+		if value, ok := os.LookupEnv(name); ok {
+			restored = append(restored, name+"="+value)
+		}
+	}
+	return append(args, restored...)
+}
+
+type GitVersion struct {
+	Major int
+	Minor int
+	Patch int
+	// The full output of `git --version`, e.g.
+	// "git version 2.39.3 (Apple Git-145)".
+	Raw string
+}
+
+func (v GitVersion) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+func (v GitVersion) AtLeast(major, minor int) bool {
+	if v.Major != major {
+		return v.Major > major
+	}
+	return v.Minor >= minor
+}
+
+// Parses the output of `git --version`. Vendor suffixes such as
+// "(Apple Git-145)" or ".windows.1" are ignored.
+func parseGitVersion(output string) (GitVersion, error) {
+	output = strings.TrimSpace(output)
+	match := gGitVersionRe.FindStringSubmatch(output)
+	if match == nil {
+		return GitVersion{}, fmt.Errorf("Unrecognized git version string: %q", output)
+	}
+	v := GitVersion{Raw: output}
+	v.Major, _ = strconv.Atoi(match[1])
+	v.Minor, _ = strconv.Atoi(match[2])
+	if len(match[3]) > 0 {
+		v.Patch, _ = strconv.Atoi(match[3])
+	}
+	return v, nil
+}
+
+// A git capability that is only available starting from a given version.
+type GitFeature struct {
+	Name     string
+	MinMajor int
+	MinMinor int
+}
+
+var (
+	// The oldest git xbisect runs with, for rev-parse
+	// --is-shallow-repository.
+	kGitMinimum                  = GitFeature{"xbisect", 2, 15}
+	kGitFeatureBisectNoCheckout  = GitFeature{"git bisect --no-checkout", 1, 7}
+	kGitFeatureWorktree          = GitFeature{"git worktree", 2, 5}
+	kGitFeaturePartialClone      = GitFeature{"partial clone (--filter)", 2, 19}
+	kGitFeatureBisectFirstParent = GitFeature{"git bisect --first-parent", 2, 29}
+)
+
+type GitFeatures struct {
+	Version GitVersion
+}
+
+func (f *GitFeatures) Supports(feature GitFeature) bool {
+	return f.Version.AtLeast(feature.MinMajor, feature.MinMinor)
+}
+
+// Detects the version of the git executable. The detection only runs once
+// per process; subsequent calls return the cached result.
+func gitFeatures() (*GitFeatures, error) {
+	gGitFeaturesOnce.Do(func() {
+		out, err := runCommandDirOutput(&ExecRunner{}, "", gGitPath, "--version")
+		if err != nil {
+			gGitFeaturesErr = fmt.Errorf("Failed to run git --version: %w", err)
+			return
+		}
+		version, err := parseGitVersion(string(out))
+		if err != nil {
+			gGitFeaturesErr = err
+			return
+		}
+		gLogger.Printf("Detected git version: %s\n", version.Raw)
+		gGitFeatures = &GitFeatures{Version: version}
+	})
+	return gGitFeatures, gGitFeaturesErr
+}
+
+// Returns an error describing the required git version if the detected git
+// does not support the given feature.
+func requireGitFeature(feature GitFeature) error {
+	features, err := gitFeatures()
+	if err != nil {
+		return err
+	}
+	if !features.Supports(feature) {
+		return fmt.Errorf("%s requires git >= %d.%d, you have %s",
+			feature.Name, feature.MinMajor, feature.MinMinor, features.Version)
+	}
+	return nil
+}
+
+// Fails if the detected git is older than the minimum or does not support
+// one of the features. Called while validating the args of a command, so
+// that an old git is reported before anything is done.
+func requireGitVersion(features ...GitFeature) error {
+	for _, feature := range append([]GitFeature{kGitMinimum}, features...) {
+		if err := requireGitFeature(feature); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Checks out hi in a new worktree of the mirror at dir. Worktrees have their
+// own HEAD and bisect state, so concurrent runs can share the mirror.
+func addMirrorWorktree(runner CommandRunner, mirror, dir, hi string) error {
+	if err := requireGitFeature(kGitFeatureWorktree); err != nil {
+		return err
+	}
+	release, err := AcquireRepoLock(mirror)
+	if err != nil {
+		return err
+	}
+	defer release()
+	// Forget the worktrees whose run cache was removed.
+	if err = runCommandDir(runner, mirror, gGitPath, "worktree", "prune"); err != nil {
+		return err
+	}
+	return runCommandDir(runner, mirror, gGitPath, "worktree", "add", "--detach", dir, hi)
+}
+
+// Brings a repo copied into the cache into a known state before running
+// steps on it: the copy may come from a repo that was left mid-bisect,
+// mid-merge or with stale locks by a crashed process. Each repair is logged.
+// Local changes are only discarded when clean_worktree is set, otherwise
+// they are reported as an error.
+func repairCacheRepo(runner CommandRunner, dir, hi string, clean_worktree bool) error {
+	out, err := runCommandDirOutput(runner, dir, gGitPath, "rev-parse", "--absolute-git-dir")
+	if err != nil {
+		return fmt.Errorf("%s is not a git repository: %w", dir, err)
+	}
+	gitdir := strings.TrimSpace(string(out))
+
+	// Nothing else operates on a fresh copy of the repo, so any lock file in
+	// it was left behind by a process that no longer exists.
+	locks, _ := filepath.Glob(path.Join(gitdir, "*.lock"))
+	for _, lock := range locks {
+		ConsoleLogInfo("Removing stale lock file: %s", path.Base(lock))
+		if err = os.Remove(lock); err != nil {
+			return fmt.Errorf("Failed to remove stale lock file %s: %w", lock, err)
+		}
+	}
+
+	in_progress := []struct {
+		marker string
+		name   string
+		abort  []string
+	}{
+		{"MERGE_HEAD", "merge", []string{"merge", "--abort"}},
+		{"rebase-merge", "rebase", []string{"rebase", "--abort"}},
+		{"rebase-apply", "rebase", []string{"rebase", "--abort"}},
+		{"CHERRY_PICK_HEAD", "cherry-pick", []string{"cherry-pick", "--abort"}},
+		{"REVERT_HEAD", "revert", []string{"revert", "--abort"}},
+		{"BISECT_LOG", "bisect", []string{"bisect", "reset"}},
+	}
+	for _, op := range in_progress {
+		if !filepathExists(path.Join(gitdir, op.marker)) {
+			continue
+		}
+		ConsoleLogInfo("Aborting in-progress %s in the cache repo", op.name)
+		if err = runCommandDir(runner, dir, append([]string{gGitPath}, op.abort...)...); err != nil {
+			return fmt.Errorf("Failed to abort the in-progress %s: %w", op.name, err)
+		}
+	}
+
+	out, err = runCommandDirOutput(runner, dir, gGitPath, "status", "--porcelain", "--untracked-files=no")
+	if err != nil {
+		return fmt.Errorf("Failed to get the status of the cache repo: %w", err)
+	}
+	if changes := strings.TrimSpace(string(out)); len(changes) > 0 {
+		if !clean_worktree {
+			return fmt.Errorf("The repo has %d locally modified files, rerun with --clean-worktree to discard them",
+				len(strings.Split(changes, "\n")))
+		}
+		ConsoleLogInfo("Discarding local changes in the cache repo")
+		if err = runCommandDir(runner, dir, gGitPath, "reset", "--hard", "--quiet"); err != nil {
+			return fmt.Errorf("Failed to discard local changes: %w", err)
+		}
+	}
+	if clean_worktree {
+		ConsoleLogInfo("Removing untracked files from the cache repo")
+		if err = runCommandDir(runner, dir, gGitPath, "clean", "-ffdx", "--quiet"); err != nil {
+			return fmt.Errorf("Failed to remove untracked files: %w", err)
+		}
+	}
+
+	if len(hi) > 0 {
+		if err = runCommandDir(runner, dir, gGitPath, "checkout", "--quiet", "--detach", hi); err != nil {
+			return fmt.Errorf("Failed to check out %s in the cache repo: %w", hi, err)
+		}
+	}
+	return nil
+}
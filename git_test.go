@@ -0,0 +1,131 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestStepEnvRestoreArgs(t *testing.T) {
+	t.Setenv("GIT_DIR", "/elsewhere/.git")
+	t.Setenv("LC_ALL", "fr_FR.UTF-8")
+	t.Setenv(kGitConfigParametersVar, "'user.name'='someone'")
+	os.Unsetenv("GIT_WORK_TREE")
+	args := stepEnvRestoreArgs()
+	for _, name := range []string{"GIT_DIR", "GIT_WORK_TREE", "LC_ALL", "GIT_TERMINAL_PROMPT", kGitConfigParametersVar} {
+		if !slices.Contains(args, name) || args[slices.Index(args, name)-1] != "-u" {
+			t.Errorf("%s is not unset by %q", name, args)
+		}
+	}
+	for _, restored := range []string{"GIT_DIR=/elsewhere/.git", "LC_ALL=fr_FR.UTF-8", kGitConfigParametersVar + "='user.name'='someone'"} {
+		if !slices.Contains(args, restored) {
+			t.Errorf("%s is not restored by %q", restored, args)
+		}
+	}
+	if slices.ContainsFunc(args, func(arg string) bool { return strings.HasPrefix(arg, "GIT_WORK_TREE=") }) {
+		t.Errorf("GIT_WORK_TREE is set by %q though the user had none", args)
+	}
+}
+
+// The vars of a user pointing git to another repo, e.g. in a hook, and
+// changing its output, must neither change the repo xbisect imports and
+// bisects, nor be taken from the steps.
+func TestPoisonedGitEnv(t *testing.T) {
+	setupTestAppData(t)
+	decoydir := filepath.Join(t.TempDir(), "decoy")
+	if _, err := createSelftestRepo(&ExecRunner{}, decoydir); err != nil {
+		t.Fatal(err)
+	}
+	poison := map[string]string{
+		"GIT_DIR":               filepath.Join(decoydir, ".git"),
+		"GIT_WORK_TREE":         decoydir,
+		"GIT_INDEX_FILE":        filepath.Join(decoydir, ".git", "index"),
+		"LC_ALL":                "de_DE.UTF-8",
+		kGitConfigParametersVar: "'user.name'='someone'",
+	}
+	for name, value := range poison {
+		t.Setenv(name, value)
+	}
+
+	hashes := setupTestRepo(t, "poisoned")
+	repo := gConfig.GetRepo("poisoned")
+	if head, err := resolveRef(&ExecRunner{}, repo.LocalPath, "HEAD"); err != nil || head != hashes[len(hashes)-1] {
+		t.Fatalf("HEAD of the import = %q, %v, want %s", head, err, hashes[len(hashes)-1])
+	}
+
+	envfile := filepath.Join(t.TempDir(), "env")
+	script := "#!/bin/sh\n"
+	for name := range poison {
+		script += "echo " + name + "=\"$" + name + "\" >> " + shellQuote(envfile) + "\n"
+	}
+	script += "test ! -e bug\n"
+	report := runTestBisect(t, RunOptions{Repo: "poisoned", Lo: hashes[0], Steps: []string{"check"}, Script: script})
+	if planted := hashes[kSelftestCulprit-1]; report.Culprit != planted {
+		t.Errorf("Culprit = %q, want %s", report.Culprit, planted)
+	}
+	data, err := os.ReadFile(envfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, value := range poison {
+		if !slices.Contains(strings.Split(string(data), "\n"), name+"="+value) {
+			t.Errorf("The steps did not get %s=%s:\n%s", name, value, data)
+		}
+	}
+}
+
+func TestParseGitVersion(t *testing.T) {
+	tests := []struct {
+		output string
+		want   string
+	}{
+		{"git version 2.43.0\n", "2.43.0"},
+		{"git version 2.39.3 (Apple Git-145)\n", "2.39.3"},
+		{"git version 2.42.0.windows.2\n", "2.42.0"},
+		{"git version 2.45.0.rc1", "2.45.0"},
+		{"git version 2.15", "2.15.0"},
+	}
+	for _, tt := range tests {
+		v, err := parseGitVersion(tt.output)
+		if err != nil || v.String() != tt.want {
+			t.Errorf("parseGitVersion(%q) = %s, %v, want %s", tt.output, v, err, tt.want)
+		}
+		if v.Raw != strings.TrimSpace(tt.output) {
+			t.Errorf("parseGitVersion(%q).Raw = %q", tt.output, v.Raw)
+		}
+	}
+	for _, output := range []string{"", "hub version 2.14.2", "git version two"} {
+		if v, err := parseGitVersion(output); err == nil {
+			t.Errorf("parseGitVersion(%q) = %s, want an error", output, v)
+		}
+	}
+}
+
+func TestGitFeaturesSupports(t *testing.T) {
+	features := &GitFeatures{Version: GitVersion{Major: 2, Minor: 25, Patch: 1}}
+	for feature, want := range map[GitFeature]bool{
+		kGitMinimum:                  true,
+		kGitFeatureBisectNoCheckout:  true,
+		kGitFeaturePartialClone:      true,
+		kGitFeatureBisectFirstParent: false,
+	} {
+		if got := features.Supports(feature); got != want {
+			t.Errorf("git 2.25.1 supports %s: %t, want %t", feature.Name, got, want)
+		}
+	}
+}
+
+func TestFirstParentBisect(t *testing.T) {
+	if err := requireGitFeature(kGitFeatureBisectFirstParent); err != nil {
+		t.Skip(err)
+	}
+	setupTestAppData(t)
+	hashes := setupTestRepo(t, "firstparent")
+	report := runTestBisect(t, RunOptions{Repo: "firstparent", Lo: hashes[0], Steps: []string{"check"},
+		Script: "#!/bin/sh\ntest ! -e bug\n", FirstParent: true})
+	if planted := hashes[kSelftestCulprit-1]; report.Culprit != planted {
+		t.Errorf("Culprit = %q, want %s", report.Culprit, planted)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"os"
+	"path"
+)
+
+// The dirs of the isolated home of --isolate-home, relative to it, that the
+// XDG vars point to.
+var kIsolatedHomeXdgDirs = [][2]string{
+	{"XDG_CONFIG_HOME", ".config"},
+	{"XDG_CACHE_HOME", ".cache"},
+	{"XDG_DATA_HOME", ".local/share"},
+	{"XDG_STATE_HOME", ".local/state"},
+}
+
+// Creates the home of the steps with --isolate-home, and returns the vars
+// pointing HOME and the XDG base dirs to it.
+func createIsolatedHome(homedir string) ([][2]string, error) {
+	vars := [][2]string{{"HOME", homedir}}
+	for _, xdg := range kIsolatedHomeXdgDirs {
+		dir := path.Join(homedir, xdg[1])
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			return nil, err
+		}
+		vars = append(vars, [2]string{xdg[0], dir})
+	}
+	return vars, nil
+}
+
+// Inserts the vars of the isolated home into the vars of the steps, made of
+// the vars of --clean-env followed by the env_count --env vars. They
+// override the former and are overridden by the latter, as the last value
+// of a var wins.
+func withIsolatedHome(vars [][2]string, env_count int, home_vars [][2]string) [][2]string {
+	inherited := len(vars) - env_count
+	isolated := append(append([][2]string{}, vars[:inherited]...), home_vars...)
+	return append(isolated, vars[inherited:]...)
+}
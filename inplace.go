@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Prepares the user's own working copy for running the steps in it, instead
+// of a copy in the cache. The original HEAD, and local changes if stashed,
+// are restored by the cleanups registered on the setup, which run even when
+// the run is interrupted.
+func prepareInPlace(setup *RunSetup, dir string, dirty string, clean_worktree bool) error {
+	release, err := AcquireRepoLock(dir)
+	if err != nil {
+		return err
+	}
+	setup.cleanups = append(setup.cleanups, release)
+
+	out, err := runCommandDirOutput(setup.Runner, dir, gGitPath, "rev-parse", "--absolute-git-dir")
+	if err != nil {
+		return fmt.Errorf("%s is not a git repository: %w", dir, err)
+	}
+	gitdir := strings.TrimSpace(string(out))
+	for _, marker := range []string{"BISECT_LOG", "MERGE_HEAD", "rebase-merge", "rebase-apply", "CHERRY_PICK_HEAD", "REVERT_HEAD"} {
+		if filepathExists(path.Join(gitdir, marker)) {
+			return fmt.Errorf("A git operation is in progress in %s (%s found), finish or abort it first", dir, marker)
+		}
+	}
+
+	// Remember where the user was: their branch, or the commit for a
+	// detached HEAD.
+	original_ref, err := resolveRef(setup.Runner, dir, "HEAD")
+	if err != nil {
+		return fmt.Errorf("Failed to get HEAD of %s: %w", dir, err)
+	}
+	if out, err = runCommandDirOutput(setup.Runner, dir, gGitPath, "symbolic-ref", "--quiet", "--short", "HEAD"); err == nil {
+		original_ref = strings.TrimSpace(string(out))
+	}
+	setup.Metadata.OriginalRef = original_ref
+
+	out, err = runCommandDirOutput(setup.Runner, dir, gGitPath, "status", "--porcelain", "--untracked-files=no")
+	if err != nil {
+		return fmt.Errorf("Failed to get the status of %s: %w", dir, err)
+	}
+	if changes := strings.TrimSpace(string(out)); len(changes) > 0 {
+		if dirty != "stash" {
+			return fmt.Errorf("%s has %d locally modified files, commit them or rerun with --dirty=stash",
+				dir, len(strings.Split(changes, "\n")))
+		}
+		message := fmt.Sprintf("%s in-place run %s", kApplicationName, path.Base(setup.CacheDir))
+		ConsoleLogInfo("Stashing local changes: %s", message)
+		if err = runCommandDir(setup.Runner, dir, gGitPath, "stash", "push", "--quiet", "--message", message); err != nil {
+			return fmt.Errorf("Failed to stash local changes: %w", err)
+		}
+		setup.Metadata.Stash = message
+		setup.cleanups = append(setup.cleanups, func() {
+			ConsoleLogInfo("Restoring stashed local changes")
+			if err := runCommandDir(setup.Runner, dir, gGitPath, "stash", "pop", "--quiet", "--index"); err != nil {
+				gLogger.Printf("Error: %v\n", err)
+				ConsoleLogError("Failed to restore the stashed local changes, they are kept in the stash as \"%s\"", message)
+			}
+		})
+	}
+
+	setup.cleanups = append(setup.cleanups, func() {
+		ConsoleLogInfo("Restoring %s in %s", original_ref, dir)
+		if err := runCommandDir(setup.Runner, dir, gGitPath, "checkout", "--quiet", original_ref); err != nil {
+			gLogger.Printf("Error: %v\n", err)
+			ConsoleLogError("Failed to check out %s again, restore it manually", original_ref)
+		}
+	})
+
+	// Untracked files are the user's: only remove them on explicit request,
+	// and keep the ignored ones, e.g. build dirs and editor state.
+	if clean_worktree {
+		ConsoleLogInfo("Removing untracked files from %s", dir)
+		if err = runCommandDir(setup.Runner, dir, gGitPath, "clean", "-ffd", "--quiet"); err != nil {
+			return fmt.Errorf("Failed to remove untracked files: %w", err)
+		}
+	}
+	return nil
+}
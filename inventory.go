@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"time"
+
+	"github.com/charmbracelet/lipgloss"
+	"github.com/charmbracelet/lipgloss/table"
+)
+
+// The JSON output of list --json and status --json is read by tools, its
+// field names must not change. They are documented in the README.
+
+// An imported repo, as printed by list --json.
+type RepoListing struct {
+	Name          string `json:"name"`
+	Remote        string `json:"remote"`
+	LocalPath     string `json:"local_path"`
+	DefaultBranch string `json:"default_branch"`
+	Mirror        bool   `json:"mirror"`
+	// Whether LocalPath still exists. A repo without it cannot be run on
+	// until it is imported again.
+	Exists bool `json:"exists"`
+	// When the clone was last fetched, nil if it never was since the
+	// import.
+	LastFetch *time.Time `json:"last_fetch"`
+}
+
+// A run of the cache dir, as printed by status --json.
+type RunListing struct {
+	Id   string `json:"id"`
+	Repo string `json:"repo"`
+	// One of the kRunStatus, or dead when the process of a running run is
+	// gone.
+	Status    string    `json:"status"`
+	Pid       int       `json:"pid"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// What the app data dir holds, in bytes.
+type AppDataStats struct {
+	Dir          string `json:"dir"`
+	Runs         int    `json:"runs"`
+	CacheBytes   int64  `json:"cache_bytes"`
+	ReposBytes   int64  `json:"repos_bytes"`
+	ResultsBytes int64  `json:"results_bytes"`
+	LogBytes     int64  `json:"log_bytes"`
+}
+
+// Returns when the clone was last fetched, as recorded by update or from the
+// mtime of its FETCH_HEAD for the fetches made otherwise.
+func lastFetchTime(repo *RepoInfo) *time.Time {
+	if fetched, err := time.Parse(time.RFC3339, repo.LastFetched); err == nil {
+		return &fetched
+	}
+	gitdir := path.Join(repo.LocalPath, ".git")
+	if repo.Mirror {
+		gitdir = repo.LocalPath
+	}
+	info, err := os.Stat(path.Join(gitdir, "FETCH_HEAD"))
+	if err != nil {
+		return nil
+	}
+	fetched := info.ModTime().UTC()
+	return &fetched
+}
+
+func newRepoListing(repo *RepoInfo) RepoListing {
+	return RepoListing{Name: repo.Label(), Remote: repo.Remote, LocalPath: repo.LocalPath,
+		DefaultBranch: repo.DefaultBranch, Mirror: repo.Mirror, Exists: isDir(repo.LocalPath),
+		LastFetch: lastFetchTime(repo)}
+}
+
+// Measures the app data dir. A dir that cannot be measured counts as empty.
+func collectAppDataStats() AppDataStats {
+	appdata := GetAppDataDir()
+	stats := AppDataStats{Dir: appdata}
+	measure := func(dir string) int64 {
+		size, err := dirSize(path.Join(appdata, dir))
+		if err != nil && !os.IsNotExist(err) {
+			gLogger.Printf("Failed to compute the size of %s: %v\n", dir, err)
+		}
+		return size
+	}
+	stats.CacheBytes = measure("cache")
+	stats.ReposBytes = measure("repos")
+	stats.ResultsBytes = measure("results")
+	if entries, err := os.ReadDir(path.Join(appdata, "cache")); err == nil {
+		stats.Runs = len(entries)
+	}
+	if info, err := os.Stat(path.Join(appdata, "log.txt")); err == nil {
+		stats.LogBytes = info.Size()
+	}
+	return stats
+}
+
+// Prints the value as indented JSON on stdout.
+func printJson(value any) bool {
+	data, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		gLogger.Printf("Error: %v\n", err)
+		ConsoleLogError("Failed to serialize the output")
+		return false
+	}
+	os.Stdout.Write(append(data, '\n'))
+	return true
+}
+
+// Prints the imported repos, as JSON along with the stats of the app data
+// dir with as_json.
+func ListImportedRepos(as_json bool) bool {
+	repos := gConfig.ListRepos()
+	listings := make([]RepoListing, len(repos))
+	for i := range repos {
+		listings[i] = newRepoListing(&repos[i])
+	}
+	if as_json {
+		return printJson(struct {
+			Repos   []RepoListing `json:"repos"`
+			AppData AppDataStats  `json:"appdata"`
+		}{listings, collectAppDataStats()})
+	}
+	if len(listings) == 0 {
+		ConsoleLogInfo("No repos imported yet. Import one with `%s import --git <url> --name <name>`.", kApplicationName)
+		return true
+	}
+	os.Stdout.WriteString(reposTable(listings) + "\n")
+	missing := 0
+	for _, listing := range listings {
+		if !listing.Exists {
+			missing += 1
+		}
+	}
+	if missing > 0 {
+		ConsoleLogError("%d repos have no local clone anymore. Remove them from %s and import them again.", missing,
+			kConfigFileName)
+	}
+	return true
+}
+
+// The widest a cell of the repos table gets before it is truncated.
+const kListCellMaxWidth = 48
+
+// Shortens s to width runes, eliding its middle, where the least telling
+// part of URLs and paths is.
+func truncateMiddle(s string, width int) string {
+	runes := []rune(s)
+	if len(runes) <= width {
+		return s
+	}
+	head := (width - 1) / 2
+	tail := width - 1 - head
+	return string(runes[:head]) + "…" + string(runes[len(runes)-tail:])
+}
+
+// Renders the repos as a table, in the colors of the console unless they
+// are disabled. The repos whose local path is missing are in red.
+func reposTable(repos []RepoListing) string {
+	renderer := lipgloss.NewRenderer(os.Stdout)
+	header := renderer.NewStyle().Bold(true).Padding(0, 1)
+	cell := renderer.NewStyle().Padding(0, 1)
+	missing := cell
+	border := renderer.NewStyle()
+	if gNoColor {
+		header = header.UnsetBold()
+	} else {
+		header = header.Foreground(lipgloss.Color("#38f2ae"))
+		border = border.Foreground(lipgloss.Color("240"))
+		missing = missing.Foreground(lipgloss.Color("9"))
+	}
+	rows := make([][]string, len(repos))
+	for i, repo := range repos {
+		on_disk := "yes"
+		if !repo.Exists {
+			on_disk = "missing"
+		}
+		remote := repo.Remote
+		if len(remote) == 0 {
+			remote = "(local dir)"
+		}
+		rows[i] = []string{repo.Name, truncateMiddle(remote, kListCellMaxWidth),
+			truncateMiddle(repo.LocalPath, kListCellMaxWidth), on_disk}
+	}
+	return table.New().
+		Border(lipgloss.NormalBorder()).
+		BorderStyle(border).
+		StyleFunc(func(row, col int) lipgloss.Style {
+			if row == 0 {
+				return header
+			}
+			if !repos[row-1].Exists {
+				return missing
+			}
+			return cell
+		}).
+		Headers("NAME", "REMOTE", "LOCAL PATH", "ON DISK").
+		Rows(rows...).
+		Render()
+}
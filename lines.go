@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// A line of a human-edited file, trimmed of whitespace.
+type Line struct {
+	// 1-based.
+	Number int
+	Text   string
+}
+
+// A malformed line of a file.
+type LineError struct {
+	File string
+	Line int
+	Err  error
+}
+
+func (e *LineError) Error() string {
+	return fmt.Sprintf("%s:%d: %v", e.File, e.Line, e.Err)
+}
+
+func (e *LineError) Unwrap() error {
+	return e.Err
+}
+
+// Splits the content of a human-edited file (steps file, manifest, env
+// file, ...) into its lines. Whitespace around the lines is trimmed, and
+// blank lines and lines starting with # are skipped. Both LF and CRLF line
+// endings are accepted.
+func parseLines(data string) []Line {
+	var lines []Line
+	for i, text := range strings.Split(data, "\n") {
+		text = strings.TrimSpace(text)
+		if len(text) == 0 || strings.HasPrefix(text, "#") {
+			continue
+		}
+		lines = append(lines, Line{Number: i + 1, Text: text})
+	}
+	return lines
+}
+
+// Reads the lines of the file, or of stdin when the file is "-", passing
+// each to parse. An error returned by parse is reported with the file and
+// the number of the line.
+func readLinesFile(file string, parse func(text string) error) error {
+	var data []byte
+	var err error
+	if file == "-" {
+		file = "stdin"
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(file)
+	}
+	if err != nil {
+		return err
+	}
+	for _, line := range parseLines(string(data)) {
+		if err = parse(line.Text); err != nil {
+			return &LineError{File: file, Line: line.Number, Err: err}
+		}
+	}
+	return nil
+}
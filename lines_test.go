@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const kMessyLines = "build\r\n" +
+	"\n" +
+	"   # indented comment\r\n" +
+	"\t\ttest@sub dir  \t\n" +
+	"# comment\n" +
+	"   \r\n" +
+	"lint # not a comment\n" +
+	"#"
+
+func TestParseLines(t *testing.T) {
+	want := []Line{{1, "build"}, {4, "test@sub dir"}, {7, "lint # not a comment"}}
+	if got := parseLines(kMessyLines); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseLines() = %q, want %q", got, want)
+	}
+	if got := parseLines(""); len(got) > 0 {
+		t.Errorf("parseLines(\"\") = %q", got)
+	}
+}
+
+func TestReadLinesFileReportsLine(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "lines")
+	if err := os.WriteFile(file, []byte("# header\n\nok\r\n  bad  \nok\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	errBad := errors.New("bad line")
+	var read []string
+	err := readLinesFile(file, func(text string) error {
+		if text == "bad" {
+			return errBad
+		}
+		read = append(read, text)
+		return nil
+	})
+	var line_err *LineError
+	if !errors.As(err, &line_err) || line_err.Line != 4 || !errors.Is(err, errBad) {
+		t.Errorf("readLinesFile() = %v, want the error of line 4", err)
+	}
+	if !strings.HasPrefix(err.Error(), file+":4: ") {
+		t.Errorf("readLinesFile() = %q, want it prefixed with %s:4", err, file)
+	}
+	if !reflect.DeepEqual(read, []string{"ok"}) {
+		t.Errorf("Parsed %q before the bad line", read)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/pelletier/go-toml/v2"
+)
+
+// Content of a lock file, identifying the process holding it.
+type LockInfo struct {
+	Pid       int
+	StartTime string
+	// What is locked, for display.
+	Target string
+}
+
+func repoLockPath(repo_path string) string {
+	digest := sha256.Sum256([]byte(repo_path))
+	return path.Join(GetAppDataDir(), "locks", hex.EncodeToString(digest[:8])+".lock")
+}
+
+func readLockInfo(lockfile string) (*LockInfo, error) {
+	data, err := os.ReadFile(lockfile)
+	if err != nil {
+		return nil, err
+	}
+	info := &LockInfo{}
+	if err = toml.Unmarshal(data, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// Whether the process that wrote the lock is gone, comparing start times to
+// detect pid reuse.
+func (l *LockInfo) Stale() bool {
+	start_time, err := processStartTime(l.Pid)
+	return err != nil || start_time != l.StartTime
+}
+
+// Takes the lock on a repo path so that no other xbisect process operates on
+// it concurrently. Locks left behind by dead processes are taken over.
+// Returns the function releasing the lock.
+func AcquireRepoLock(repo_path string) (func(), error) {
+	lockfile := repoLockPath(repo_path)
+	if err := os.MkdirAll(path.Dir(lockfile), os.ModePerm); err != nil {
+		return nil, err
+	}
+	state := NewRunState()
+	serialized, err := toml.Marshal(LockInfo{Pid: state.Pid, StartTime: state.StartTime, Target: repo_path})
+	if err != nil {
+		return nil, err
+	}
+	// The lock is written to a temp file, then linked into place, for no
+	// other process to ever read it empty or partially written.
+	tmpfile, err := os.CreateTemp(path.Dir(lockfile), ".lock-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmpfile.Name())
+	_, err = tmpfile.Write(serialized)
+	if close_err := tmpfile.Close(); err == nil {
+		err = close_err
+	}
+	if err != nil {
+		return nil, err
+	}
+	for attempt := 0; attempt < 2; attempt++ {
+		err := os.Link(tmpfile.Name(), lockfile)
+		if errors.Is(err, os.ErrExist) {
+			holder, err := readLockInfo(lockfile)
+			if err == nil && !holder.Stale() {
+				return nil, fmt.Errorf("%s is locked by another %s process (pid %d)", repo_path, kApplicationName, holder.Pid)
+			}
+			gLogger.Printf("Removing stale lock %s: %+v\n", lockfile, holder)
+			if err = os.Remove(lockfile); err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		gLogger.Printf("Acquired lock %s for %s\n", lockfile, repo_path)
+		return func() {
+			if err := os.Remove(lockfile); err != nil {
+				gLogger.Printf("Failed to release lock %s: %v\n", lockfile, err)
+			}
+		}, nil
+	}
+	return nil, fmt.Errorf("Failed to acquire the lock on %s", repo_path)
+}
+
+// A lock file of the locks dir. Info is nil when the file cannot be read,
+// e.g. when its process died while writing it.
+type heldLock struct {
+	File string
+	Info *LockInfo
+}
+
+func (l heldLock) Stale() bool {
+	return l.Info == nil || l.Info.Stale()
+}
+
+func (l heldLock) Describe() string {
+	if l.Info == nil {
+		return fmt.Sprintf("%s (unreadable)", l.File)
+	}
+	return fmt.Sprintf("%s (pid %d, started %s)", l.Info.Target, l.Info.Pid, l.Info.StartTime)
+}
+
+// Lists the lock files of the locks dir.
+func listLocks() ([]heldLock, error) {
+	files, err := filepath.Glob(path.Join(GetAppDataDir(), "locks", "*.lock"))
+	if err != nil {
+		return nil, err
+	}
+	locks := make([]heldLock, 0, len(files))
+	for _, file := range files {
+		info, err := readLockInfo(file)
+		if os.IsNotExist(err) {
+			// Released meanwhile.
+			continue
+		} else if err != nil {
+			gLogger.Printf("Failed to read lock %s: %v\n", file, err)
+			info = nil
+		} else if info.Pid == 0 {
+			// Empty. Locks are linked into place once written, so this one
+			// is not being taken, but was left by a process that died while
+			// writing it.
+			info = nil
+		}
+		locks = append(locks, heldLock{File: file, Info: info})
+	}
+	return locks, nil
+}
+
+// Removes the locks left behind by processes that are gone, for clean
+// --force-unlock, after warning about each and asking for confirmation
+// unless yes. The locks of live processes are kept.
+func ForceUnlock(yes bool) error {
+	locks, err := listLocks()
+	if err != nil {
+		gLogger.Printf("Error: %v\n", err)
+		return wrapError(err, "Failed to list the locks")
+	}
+	var stale []heldLock
+	for _, lock := range locks {
+		if lock.Stale() {
+			ConsoleLogInfo("Warning: stale lock on %s, its process is gone", lock.Describe())
+			stale = append(stale, lock)
+		} else {
+			ConsoleLogInfo("Keeping the lock on %s, its process is running", lock.Describe())
+		}
+	}
+	if len(stale) == 0 {
+		ConsoleLogInfo("No stale lock found.")
+		return nil
+	}
+	if !yes && !confirm(fmt.Sprintf("Remove %d stale locks?", len(stale))) {
+		return wrapError(ErrAborted, "No lock was removed.")
+	}
+	var errs []error
+	for _, lock := range stale {
+		// Taken over by another process since it was listed.
+		if info, err := readLockInfo(lock.File); err == nil && !info.Stale() {
+			ConsoleLogInfo("Keeping the lock on %s, it was taken meanwhile", info.Target)
+			continue
+		}
+		if err = os.Remove(lock.File); err != nil && !os.IsNotExist(err) {
+			gLogger.Printf("Error: %v\n", err)
+			errs = append(errs, wrapError(err, "Failed to remove the lock %s", lock.File))
+			continue
+		}
+		gLogger.Printf("Removed stale lock %s: %+v\n", lock.File, lock.Info)
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	ConsoleLogInfo("Removed %d stale locks.", len(stale))
+	return nil
+}
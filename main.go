@@ -2,7 +2,10 @@ package main
 
 import (
 	"bufio"
-	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -10,9 +13,14 @@ import (
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
 	"regexp"
+	"runtime"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/alecthomas/kong"
 	"github.com/charmbracelet/lipgloss"
@@ -33,16 +41,46 @@ const (
 	kConsoleReset = "\033[0m"
 
 	kBisectSkipCode = 125
+	// Exit status of the wrapper making git bisect run stop, for the errors
+	// that would make every commit fail the same way.
+	kBisectAbortCode = 255
+	// Exit status of xbisect when the bisect ended without finding the
+	// first bad commit.
+	kInconclusiveExitCode = 3
+
+	kCaseCollisionHelp = "It has paths differing only by case, which collide on this case-insensitive filesystem. " +
+		"This is a limitation of the environment rather than a regression, so the commit is skipped. " +
+		"To test it, set XBISECT_HOME to a directory on a case-sensitive filesystem " +
+		"(e.g. a case-sensitive APFS volume on macOS, or a directory with case sensitivity enabled on Windows)."
 )
 
 var (
 	gLogFileHandler *os.File         = nil
 	gLogger         *log.Logger      = nil
 	gConsoleLogger  *charmlog.Logger = nil
-	gConfig         Config
+	// Strip the colors and other escape sequences from the console output.
+	gNoColor bool
+	gConfig  Config
+	// The git executable used for every git invocation.
+	gGitPath string = "git"
 
 	gAlphanumericDashUnderlineRe = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
-	gBisectingRevisionsLogRe     = regexp.MustCompile(`^Bisecting: [0-9]+ revision(s)? left to test after this \\(roughly [0-9]+ step(s)?\\)$`)
+	gStepNameRe                  = regexp.MustCompile(`^[a-zA-Z0-9_./ -]+$`)
+	gAnsiEscapeRe                = regexp.MustCompile("\033\\[[0-9;]*m")
+	gNonAlphanumericRe           = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+	gEnvNameRe                   = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+	gCorePatternRe               = regexp.MustCompile(`^[a-zA-Z0-9_.*?/-]+$`)
+	gFirstBadCommitRe            = regexp.MustCompile(`^([0-9a-f]{40}) is the first bad commit$`)
+	gOnlySkippedLeftRe           = regexp.MustCompile(`^There are only 'skip'ped commits left to test\.$`)
+	gCandidateCommitRe           = regexp.MustCompile(`^([0-9a-f]{40})$`)
+	gCommitMarkerRe              = regexp.MustCompile(`^xbisect commit=([0-9a-f]+)$`)
+	gCheckoutFailedRe            = regexp.MustCompile(`^xbisect checkout-failed commit=([0-9a-f]+)( reason=(?:case-collision|repo))?$`)
+	gCommitExcludedRe            = regexp.MustCompile(`^xbisect commit-excluded commit=([0-9a-f]+) reason=(merge|non-merge)$`)
+	gCaseCollisionRe             = regexp.MustCompile(`untracked working tree files would be overwritten by checkout|have collided`)
+	gStepStatusRe                = regexp.MustCompile(`xbisect step="([a-zA-Z0-9_./ -]+)" (PASS|FAIL|SKIP)( res=[0-9]+)?( sig=[A-Z0-9+-]*)?( core=1)?( reason=(?:paths|workdir|condition|missing))?( bytes=[0-9]+)?( reused=1)?( matrix=[0-9]+)?( diverged=1)?( attempts=[0-9,]+)?( timeout=1)?`)
+	gAmbiguousRefRe              = regexp.MustCompile(`short object ID \S+ is ambiguous`)
+	gPlainShellWordRe            = regexp.MustCompile(`^[a-zA-Z0-9_./:=@%+,^~-]+$`)
+	gBisectingRevisionsLogRe     = regexp.MustCompile(`^Bisecting: [0-9]+ revision(s)? left to test after this \(roughly [0-9]+ step(s)?\)$`)
 )
 
 // The default appdata directory is $HOME/.xbisect.
@@ -57,14 +95,11 @@ func GetAppDataDir() string {
 	return appdata_dir
 }
 
-func SetupAppDataOrDie() {
-	err := os.MkdirAll(path.Join(GetAppDataDir(), "repos"), os.ModePerm)
-	if err != nil {
-		gLogger.Fatal(err)
-	}
+func SetupAppData() error {
+	return os.MkdirAll(path.Join(GetAppDataDir(), "repos"), os.ModePerm)
 }
 
-func SetupLoggerOrDie(verbose bool) {
+func SetupLoggerOrDie(verbose bool, no_color bool) {
 	logfile := path.Join(GetAppDataDir(), "log.txt")
 	var err error
 	gLogFileHandler, err = os.OpenFile(logfile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
@@ -80,19 +115,25 @@ func SetupLoggerOrDie(verbose bool) {
 	gLogger = log.New(iowriters, "", log.Ldate|log.Ltime|log.Lshortfile)
 
 	// console logger
+	gNoColor = no_color
 	styles := charmlog.DefaultStyles()
-	styles.Levels[charmlog.ErrorLevel] = lipgloss.NewStyle().
-		SetString("ERROR").
-		Padding(0, 1, 0, 1).
-		Background(lipgloss.Color("204")).
-		Foreground(lipgloss.Color("0"))
-	styles.Keys["err"] = lipgloss.NewStyle().Foreground(lipgloss.Color("204"))
-	styles.Values["err"] = lipgloss.NewStyle().Bold(true)
-	styles.Levels[charmlog.InfoLevel] = lipgloss.NewStyle().
-		SetString(">").
-		Padding(0, 1, 0, 1).
-		Foreground(lipgloss.Color("#38f2ae")).
-		Bold(true)
+	if no_color {
+		styles.Levels[charmlog.ErrorLevel] = lipgloss.NewStyle().SetString("ERROR").Padding(0, 1, 0, 1)
+		styles.Levels[charmlog.InfoLevel] = lipgloss.NewStyle().SetString(">").Padding(0, 1, 0, 1)
+	} else {
+		styles.Levels[charmlog.ErrorLevel] = lipgloss.NewStyle().
+			SetString("ERROR").
+			Padding(0, 1, 0, 1).
+			Background(lipgloss.Color("204")).
+			Foreground(lipgloss.Color("0"))
+		styles.Keys["err"] = lipgloss.NewStyle().Foreground(lipgloss.Color("204"))
+		styles.Values["err"] = lipgloss.NewStyle().Bold(true)
+		styles.Levels[charmlog.InfoLevel] = lipgloss.NewStyle().
+			SetString(">").
+			Padding(0, 1, 0, 1).
+			Foreground(lipgloss.Color("#38f2ae")).
+			Bold(true)
+	}
 
 	gConsoleLogger = charmlog.NewWithOptions(os.Stdout, charmlog.Options{
 		ReportCaller:    false,
@@ -108,109 +149,287 @@ func CleanupLogger() {
 }
 
 func ConsoleLogInfo(format string, v ...any) {
-	gConsoleLogger.Infof(format, v...)
+	gConsoleLogger.Info(consoleText(fmt.Sprintf(format, v...)))
 	gLogger.Printf(format+"\n", v...)
 }
 func ConsoleLogError(format string, v ...any) {
-	gConsoleLogger.Errorf(format, v...)
+	gConsoleLogger.Error(consoleText(fmt.Sprintf(format, v...)))
 	gLogger.Printf(format+"\n", v...)
 }
 
+// Strips the colors of the text with --no-color.
+func consoleText(text string) string {
+	if gNoColor {
+		return gAnsiEscapeRe.ReplaceAllString(text, "")
+	}
+	return text
+}
+
 type Config interface {
 	// Initializes the config file by creating it if it doesnt exist
 	// and loading the data within the config file into memory.
-	InitOrDie()
+	Init() error
 
 	HasRepo(reponame string) bool
+	// Returns the repo of the effective config, nil if there is none.
+	// Changes made through it are seen by the later calls and saved by Save.
+	// The other changes of the repos keep them, but reallocate the repos,
+	// after which the pointer no longer is the repo of the config.
 	GetRepo(reponame string) *RepoInfo
+	// Changes the repo in config.toml, adding it there if it only is in
+	// config.local.toml. Unlike the changes made through GetRepo, it is
+	// guarded by the mutex of the config, for concurrent goroutines.
+	UpdateRepo(reponame string, update func(repo *RepoInfo))
 	// Add the repo to the config if it does not already exist.
-	AddRepo(reponame string, location string, remote string) bool
-
-	Save()
+	AddRepo(repo RepoInfo) bool
+	// Remove the repo from config.toml. Returns whether it was there.
+	RemoveRepo(reponame string) bool
+	// Records in config.toml when the repo was last fetched.
+	SetLastFetched(reponame string, fetched time.Time)
+	// Records in config.toml whether the clone of the repo is shallow.
+	SetShallow(reponame string, shallow bool)
+	ListRepos() []RepoInfo
+	// The number of most recent run caches kept after a successful run. 0
+	// keeps them all.
+	KeepNCaches() int
+	SetKeepNCaches(n int)
+
+	Save() error
 }
 
 type RepoInfo struct {
 	Remote string
 	// The location of the repo on the user's local filesystem
 	LocalPath string
-	Name      string
+	// Lowercase, as repos are looked up case-insensitively.
+	Name string
+	// The name as given at import, when it is not lowercase.
+	DisplayName string `toml:",omitempty"`
+	// The branch the remote's HEAD points to, detected at import. Empty for
+	// repos imported before it was recorded.
+	DefaultBranch string `toml:",omitempty"`
+	// Whether LocalPath is a bare mirror clone, whose branches are the
+	// remote's. Runs check out a worktree of it rather than copying it.
+	Mirror bool `toml:",omitempty"`
+	// kVcsSvn when the repo was converted from the SVN repo at Remote with
+	// git svn. Empty for git repos.
+	Vcs string `toml:",omitempty"`
+	// The commit the HEAD of the local repo at Remote was detached at when
+	// it was imported. Empty when it was on a branch.
+	DetachedHead string `toml:",omitempty"`
+	// Whether the clone was made with import --depth, its history being cut
+	// at the shallow boundary.
+	Shallow bool `toml:",omitempty"`
+	// The import --filter of a partial clone, which fetches the objects it
+	// lacks from Remote when they are needed.
+	Filter string `toml:",omitempty"`
+	// The tarball the repo was extracted from with import --archive. Such a
+	// repo has no Remote.
+	Archive string `toml:",omitempty"`
+	// When the repo was last fetched by update, run --update or run
+	// --fetch, in RFC 3339. Empty if it never was since the import.
+	LastFetched string `toml:",omitempty"`
+}
+
+// Whether the repo is a local dir imported with --path, or given to a run
+// with --path, rather than a clone of Remote.
+func (r *RepoInfo) IsLocalDir() bool {
+	return len(r.Remote) == 0
+}
+
+// The name of the repo for output.
+func (r *RepoInfo) Label() string {
+	if len(r.DisplayName) > 0 {
+		return r.DisplayName
+	}
+	return r.Name
 }
 
 type ConfigLayout struct {
-	Repos []RepoInfo
+	KeepNCaches int `toml:",omitempty"`
+	Repos       []RepoInfo
 }
 
 type ConfigImpl struct {
-	data            *ConfigLayout
-	config_filepath string
+	// Guards the config, which may be accessed from concurrent goroutines.
+	mu sync.Mutex
+	// The effective config: config.toml with config.local.toml merged over
+	// it.
+	data    *ConfigLayout
+	sources ConfigSources
+	// The content of config.toml alone, which is what is saved. The local
+	// config is never written.
+	base *ConfigLayout
+	// The content of config.local.toml, empty if it does not exist.
+	local                 *ConfigLayout
+	config_filepath       string
+	local_config_filepath string
+	// Whether base changed since it was loaded.
+	dirty bool
 }
 
 func (c *ConfigImpl) GetRepo(reponame string) *RepoInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.getRepo(reponame)
+}
+
+func (c *ConfigImpl) getRepo(reponame string) *RepoInfo {
 	if c.data == nil {
 		return nil
 	}
 	reponame = strings.ToLower(reponame)
-	for _, repo := range c.data.Repos {
-		if repo.Name == reponame {
-			return &repo
+	// The element itself rather than the copy of the loop.
+	for i := range c.data.Repos {
+		if c.data.Repos[i].Name == reponame {
+			return &c.data.Repos[i]
 		}
 	}
 	return nil
 }
 
-func (c *ConfigImpl) AddRepo(reponame string, location string, remote string) bool {
+func (c *ConfigImpl) AddRepo(repo RepoInfo) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	repo.Name = strings.ToLower(repo.Name)
+	if c.getRepo(repo.Name) != nil {
+		return false
+	}
+	c.keepRepoChanges()
+	c.base.Repos = append(c.base.Repos, repo)
+	c.data, c.sources = mergeConfigLayouts(c.base, c.local)
+	c.dirty = true
+	return true
+}
+
+func (c *ConfigImpl) RemoveRepo(reponame string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	reponame = strings.ToLower(reponame)
-	if c.HasRepo(reponame) {
+	c.keepRepoChanges()
+	removed := slices.DeleteFunc(c.base.Repos, func(repo RepoInfo) bool { return strings.ToLower(repo.Name) == reponame })
+	if len(removed) == len(c.base.Repos) {
 		return false
 	}
-	c.data.Repos = append(c.data.Repos, RepoInfo{Remote: remote, LocalPath: location, Name: reponame})
+	c.base.Repos = removed
+	c.data, c.sources = mergeConfigLayouts(c.base, c.local)
+	c.dirty = true
 	return true
 }
 
+func (c *ConfigImpl) UpdateRepo(reponame string, update func(repo *RepoInfo)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.keepRepoChanges()
+	update(c.baseRepo(reponame))
+	c.data, c.sources = mergeConfigLayouts(c.base, c.local)
+	c.dirty = true
+}
+
+// Returns the repo of config.toml, adding it there if it only is in
+// config.local.toml.
+func (c *ConfigImpl) baseRepo(reponame string) *RepoInfo {
+	reponame = strings.ToLower(reponame)
+	i := slices.IndexFunc(c.base.Repos, func(repo RepoInfo) bool { return strings.ToLower(repo.Name) == reponame })
+	if i < 0 {
+		i = len(c.base.Repos)
+		c.base.Repos = append(c.base.Repos, RepoInfo{Name: reponame})
+	}
+	return &c.base.Repos[i]
+}
+
+func (c *ConfigImpl) SetLastFetched(reponame string, fetched time.Time) {
+	c.UpdateRepo(reponame, func(repo *RepoInfo) { repo.LastFetched = fetched.Format(time.RFC3339) })
+}
+
+func (c *ConfigImpl) SetShallow(reponame string, shallow bool) {
+	c.UpdateRepo(reponame, func(repo *RepoInfo) { repo.Shallow = shallow })
+}
+
 func (c *ConfigImpl) HasRepo(reponame string) bool {
 	return c.GetRepo(reponame) != nil
 }
 
-func (c *ConfigImpl) Save() {
+func (c *ConfigImpl) ListRepos() []RepoInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.data == nil {
+		return nil
+	}
+	return slices.Clone(c.data.Repos)
+}
+
+func (c *ConfigImpl) KeepNCaches() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	if c.data == nil {
+		return 0
+	}
+	return c.data.KeepNCaches
+}
+
+func (c *ConfigImpl) SetKeepNCaches(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.base.KeepNCaches == n {
 		return
 	}
-	serialized, err := toml.Marshal(c.data)
+	c.keepRepoChanges()
+	c.base.KeepNCaches = n
+	c.data, c.sources = mergeConfigLayouts(c.base, c.local)
+	c.dirty = true
+}
+
+// Writes the config back to disk if it changed. Concurrent xbisect
+// processes only reading the config thus never overwrite each other's
+// changes.
+func (c *ConfigImpl) Save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.base == nil {
+		return nil
+	}
+	c.keepRepoChanges()
+	if !c.dirty {
+		return nil
+	}
+	serialized, err := toml.Marshal(c.base)
 	if err != nil {
-		gLogger.Fatalf("Failed to serialize config: %v", err)
+		return fmt.Errorf("Failed to serialize config: %w", err)
 	}
 	err = os.WriteFile(c.config_filepath, serialized, 0666)
 	if err != nil {
-		gLogger.Fatalf("Failed to write config to %s: %v", c.config_filepath, err)
+		return fmt.Errorf("Failed to write config to %s: %w", c.config_filepath, err)
 	}
+	c.dirty = false
+	return nil
 }
 
-func (c *ConfigImpl) InitOrDie() {
-	c.config_filepath = path.Join(GetAppDataDir(), "config.toml")
+func (c *ConfigImpl) Init() error {
+	c.config_filepath = path.Join(GetAppDataDir(), kConfigFileName)
+	c.local_config_filepath = path.Join(GetAppDataDir(), kLocalConfigFileName)
 	// Ensure that the file exists.
 	f, err := os.OpenFile(c.config_filepath, os.O_CREATE|os.O_RDONLY, 0666)
 	if err != nil {
-		gLogger.Fatal(err)
+		return err
 	}
 	f.Close()
 
-	data, err := os.ReadFile(c.config_filepath)
-	if err != nil {
-		gLogger.Fatal(err)
+	if c.base, err = readConfigLayout(c.config_filepath); err != nil {
+		return err
 	}
-
-	c.data = &ConfigLayout{}
-	err = toml.Unmarshal(data, c.data)
-	if err != nil {
-		gLogger.Fatal(err)
+	if c.local, err = readConfigLayout(c.local_config_filepath); err != nil {
+		return err
 	}
+	c.data, c.sources = mergeConfigLayouts(c.base, c.local)
+	return nil
 }
 
-func InitConfigOrDie() {
+func InitConfig() error {
 	cfg := &ConfigImpl{}
 	gConfig = cfg
 
-	gConfig.InitOrDie()
+	return gConfig.Init()
 }
 
 func filepathExists(filepath string) bool {
@@ -218,422 +437,3209 @@ func filepathExists(filepath string) bool {
 	return err == nil // !os.IsNotExist(err)
 }
 
-func ImportGitRepo(repo_url string, name string) bool {
+func isDir(filepath string) bool {
+	info, err := os.Stat(filepath)
+	return err == nil && info.IsDir()
+}
+
+// Validates the --name of an import, which must not be taken. Returns it
+// lowercased, and as given if that differs.
+func checkImportName(name string) (string, string, error) {
 	if len(name) == 0 {
-		ConsoleLogError("--name not specified for repo import.")
-		return false
+		return "", "", errors.New("--name not specified for repo import.")
 	}
 	if matched := gAlphanumericDashUnderlineRe.MatchString(name); !matched {
-		ConsoleLogError("Invalid repo name. Only alphanumeric and underscore/dash allowed.")
-		return false
+		return "", "", errors.New("Invalid repo name. Only alphanumeric and underscore/dash allowed.")
 	}
+	display_name := name
 	name = strings.ToLower(name)
+	if display_name == name {
+		display_name = ""
+	}
+	if existing := gConfig.GetRepo(name); existing != nil {
+		return "", "", fmt.Errorf("Repo \"%s\" already exists.", existing.Label())
+	}
+	return name, display_name, nil
+}
+
+// Matches the owner/repo shorthand of import --git, with the subgroups of
+// GitLab, e.g. group/subgroup/repo.
+var gRepoShorthandRe = regexp.MustCompile(`^[a-zA-Z0-9_-][a-zA-Z0-9_.-]*(/[a-zA-Z0-9_-][a-zA-Z0-9_.-]*)+$`)
+
+// Expands the owner/repo shorthand into the https url of the repo on host,
+// e.g. https://github.com/owner/repo.git. Urls, and paths of existing dirs,
+// are returned as is, as is everything when host is empty.
+func expandRepoShorthand(repo_url string, host string) string {
+	if len(host) == 0 || !gRepoShorthandRe.MatchString(repo_url) || filepathExists(repo_url) {
+		return repo_url
+	}
+	return fmt.Sprintf("https://%s/%s.git", strings.TrimSuffix(host, "/"), strings.TrimSuffix(repo_url, ".git"))
+}
+
+// Derives the name of a repo imported without --name from the last component
+// of its url, without .git and lowercased, e.g. foo for
+// git@github.com:owner/Foo.git.
+func deriveRepoName(repo_url string) (string, error) {
+	trimmed := strings.TrimRight(repo_url, "/")
+	name := trimmed[strings.LastIndexAny(trimmed, "/:")+1:]
+	name = strings.ToLower(strings.TrimSuffix(name, ".git"))
+	if !gAlphanumericDashUnderlineRe.MatchString(name) {
+		return "", fmt.Errorf("Cannot derive a repo name from %s: %q is not only alphanumeric and underscore/dash. Pass --name.",
+			repo_url, name)
+	}
+	if existing := gConfig.GetRepo(name); existing != nil {
+		return "", fmt.Errorf("Repo \"%s\" already exists. Pass --name to import %s under another name.",
+			existing.Label(), repo_url)
+	}
+	return name, nil
+}
+
+// Clones the git repo at repo_url into the repos dir and imports it. With
+// host, repo_url may be the owner/repo shorthand of a repo on that host, and
+// without name, the name is derived from repo_url.
+func ImportGitRepo(runner CommandRunner, repo_url string, host string, name string, clone CloneOptions, hooks CloneHooks) error {
 	if len(repo_url) == 0 {
-		ConsoleLogError("--git is empty.")
-		return false
+		return errors.New("One of --git, --svn, --path, --bundle or --archive is required.")
 	}
-	if gConfig.HasRepo(name) {
-		ConsoleLogError("Repo \"%s\" already exists.", name)
-		return false
+	if expanded := expandRepoShorthand(repo_url, host); expanded != repo_url {
+		ConsoleLogInfo("Expanded %s to %s", repo_url, expanded)
+		repo_url = expanded
+	}
+	if len(name) == 0 {
+		var err error
+		if name, err = deriveRepoName(repo_url); err != nil {
+			return err
+		}
+		ConsoleLogInfo("Importing as %s, pass --name to choose another name", name)
+	}
+	name, display_name, err := checkImportName(name)
+	if err != nil {
+		return err
+	}
+	if err = clone.validate(); err != nil {
+		return err
+	}
+	if err := requireGitVersion(clone.requiredFeatures()...); err != nil {
+		return err
 	}
 
-	var err error
-	clonedir := path.Join(GetAppDataDir(), "repos", name)
-	gLogger.Printf("Removing directory before cloning new repo into it: [exists? %t] %s\n",
-		filepathExists(clonedir), clonedir)
-	if err = os.RemoveAll(clonedir); err != nil {
-		gLogger.Printf("Error: %v", err)
-		ConsoleLogError("System error")
-		return false
+	// A local repo in detached HEAD state has no branch for its HEAD, which
+	// the clone inherits.
+	detached_head := ""
+	if source_dir := strings.TrimPrefix(repo_url, "file://"); isDir(source_dir) {
+		var err error
+		if detached_head, err = detachedHead(runner, source_dir); err != nil {
+			gLogger.Printf("Failed to check the HEAD of %s: %v\n", source_dir, err)
+		}
 	}
 
+	clonedir := path.Join(GetAppDataDir(), "repos", name)
+	if err = hooks.runPre(runner, repo_url, name, clonedir); err != nil {
+		return err
+	}
+	clone_args, clone_url := clone.args(repo_url)
 	ConsoleLogInfo("Cloning git repo: %s", repo_url)
-	err = runCommand("git", "clone", repo_url, clonedir)
+	if err = cloneGitRepo(runner, clone_url, clonedir, clone_args...); err != nil {
+		gLogger.Printf("Error: %v\n", err)
+		return wrapError(err, "Git clone failed")
+	}
+	imported, hook_err := hooks.runPost(runner, repo_url, name, clonedir)
+	if !imported {
+		return hook_err
+	}
+	if isDryRun(runner) {
+		// There is no clone to add.
+		return nil
+	}
+	if size, err := dirSize(clonedir); err == nil {
+		ConsoleLogInfo("The clone takes %s on disk", formatBytes(size))
+	}
+	default_branch, err := detectDefaultBranch(runner, clonedir, clone.Mirror)
+	if err != nil && len(detached_head) > 0 {
+		default_branch, err = branchContaining(runner, clonedir, detached_head, clone.Mirror)
+	}
 	if err != nil {
+		// Only needed to default --hi, which is then detected at run time.
+		gLogger.Printf("Failed to detect the default branch: %v\n", err)
+	}
+	if len(detached_head) > 0 {
+		ConsoleLogInfo("Warning: %s is in detached HEAD state, at %s. HEAD of the imported repo is not a branch either, pass --hi explicitly rather than HEAD.",
+			repo_url, detached_head)
+		if len(default_branch) > 0 {
+			ConsoleLogInfo("Using %s as the default branch, --hi defaults to its tip.", default_branch)
+		} else {
+			ConsoleLogInfo("No default branch found, --hi must be given to run on it. Set one with `%s config set repos.%s.DefaultBranch <branch>`.",
+				kApplicationName, name)
+		}
+	}
+	gConfig.AddRepo(RepoInfo{Remote: repo_url, LocalPath: clonedir, Name: name, DisplayName: display_name,
+		DefaultBranch: default_branch, Mirror: clone.Mirror, DetachedHead: detached_head, Shallow: clone.Depth > 0,
+		Filter: clone.Filter})
+	if hook_err != nil {
+		ConsoleLogInfo("Imported %s despite the failed hook, as --keep-on-hook-failure was given", name)
+	}
+	return hook_err
+}
+
+// Returns the branch checked out in the local repo at dir, or the commit
+// its HEAD is detached at, which --hi defaults to.
+func localRepoHead(runner CommandRunner, dir string) (default_branch string, detached_head string, err error) {
+	if detached_head, err = detachedHead(runner, dir); err != nil {
 		gLogger.Printf("Error: %v\n", err)
-		ConsoleLogError("Git clone failed")
-		return false
+		return "", "", wrapError(err, "Failed to read the HEAD of %s", dir)
 	}
-	gConfig.AddRepo(name, clonedir, repo_url)
-	return true
+	if len(detached_head) > 0 {
+		ConsoleLogInfo("Warning: %s is in detached HEAD state, at %s. --hi defaults to its HEAD.", dir, detached_head)
+	} else if out, err := runCommandDirOutput(runner, dir, gGitPath, "symbolic-ref", "--short", "HEAD"); err == nil {
+		default_branch = strings.TrimSpace(string(out))
+	}
+	return default_branch, detached_head, nil
 }
 
-func CleanCache() bool {
-	cachedir := path.Join(GetAppDataDir(), "cache")
-	err := os.RemoveAll(cachedir)
+// Imports the git repo checked out at dir as is, without cloning it. It has
+// no remote: runs copy it like a clone, and --hi defaults to the branch it
+// was on when imported. With make_copy, dir is copied into the repos dir and the
+// copy is imported instead, for the repo not to depend on dir anymore.
+func ImportLocalRepo(runner CommandRunner, dir string, name string, make_copy bool) error {
+	name, display_name, err := checkImportName(name)
+	if err != nil {
+		return err
+	}
+	toplevel, err := resolveRepoPath(runner, dir)
 	if err != nil {
 		gLogger.Printf("Error: %v\n", err)
-		ConsoleLogError("Error occurred when removing cache dir")
-		return false
+		return fmt.Errorf("Invalid --path: %w", err)
+	}
+	if !filepathExists(path.Join(toplevel, ".git")) {
+		return fmt.Errorf("Invalid --path: %s has no .git, import a bare repo with --git instead.", toplevel)
+	}
+	if err = requireGitVersion(); err != nil {
+		return err
+	}
+	default_branch, detached_head, err := localRepoHead(runner, toplevel)
+	if err != nil {
+		return err
+	}
+	local_path := toplevel
+	if make_copy {
+		local_path = path.Join(GetAppDataDir(), "repos", name)
+		if filepathExists(local_path) {
+			return fmt.Errorf("%s already exists. Remove it, e.g. with `%s clean --repos`, or import under another --name.",
+				local_path, kApplicationName)
+		}
+		ConsoleLogInfo("Copying the local repo %s to %s", toplevel, local_path)
 	} else {
-		ConsoleLogInfo("Successfully cleaned up cache.")
+		ConsoleLogInfo("Importing the local repo %s", toplevel)
 	}
-	return true
+	if isDryRun(runner) {
+		return nil
+	}
+	if make_copy {
+		size, approximate, err := estimateDirSize(toplevel, nil)
+		if err != nil {
+			gLogger.Printf("Error: %v\n", err)
+			return wrapError(err, "Failed to read repo: %s", toplevel)
+		}
+		progress := StartProgress("Copying", size, approximate)
+		stats, err := copyDir(toplevel, local_path, CopyOptions{}, progress)
+		progress.Finish()
+		if err != nil {
+			gLogger.Printf("Error: %v\n", err)
+			os.RemoveAll(local_path)
+			return wrapError(err, "Failed to copy %s to %s", toplevel, local_path)
+		}
+		ConsoleLogInfo("Copied %d files, %s", stats.Files, formatBytes(stats.Bytes))
+	}
+	gConfig.AddRepo(RepoInfo{LocalPath: local_path, Name: name, DisplayName: display_name,
+		DefaultBranch: default_branch, DetachedHead: detached_head})
+	return nil
 }
 
-func runCommand(command ...string) error {
-	return runCommandDir("", command...)
+// How long counting the commits of a range may take. Counting walks the
+// whole range, which takes long on huge histories, while the count is only
+// informative.
+const kCommitCountTimeout = 5 * time.Second
+
+// Counts the commits between lo and hi. When that takes longer than
+// kCommitCountTimeout, counts those of the first-parent chain instead, a
+// lower bound walking fewer commits, and tells so with first_parent. Returns
+// -1 when the count is skipped, that timing out too.
+func countCommits(runner CommandRunner, dir, lo, hi string) (count int, first_parent bool) {
+	for _, first_parent = range []bool{false, true} {
+		command := []string{gGitPath, "rev-list", "--count"}
+		if first_parent {
+			command = append(command, "--first-parent")
+		}
+		out, err := runner.RunOutput(CommandOptions{Dir: dir, Timeout: kCommitCountTimeout}, append(command, lo+".."+hi)...)
+		if err == nil {
+			if count, err = strconv.Atoi(strings.TrimSpace(string(out))); err == nil {
+				return count, first_parent
+			}
+		}
+		if !errors.Is(err, ErrCommandTimeout) {
+			gLogger.Printf("Failed to count the commits of %s..%s: %v\n", lo, hi, err)
+			return -1, false
+		}
+		gLogger.Printf("Counting the commits of %s..%s (first parent: %t) took more than %s\n", lo, hi, first_parent,
+			kCommitCountTimeout)
+	}
+	ConsoleLogInfo("Not counting the commits between %s and %s, the history is too long to count them quickly", lo, hi)
+	return -1, false
 }
 
-func runCommandDir(dir string, command ...string) error {
-	if len(command) < 1 {
-		return fmt.Errorf("Empty command")
+const kPreviewMaxCommits = 50
+
+// Prints the commits between lo and hi, the most recent first, up to
+// kPreviewMaxCommits of them.
+func previewRange(runner CommandRunner, dir, lo, hi string) error {
+	out, err := runCommandDirOutput(runner, dir, gGitPath, "log", "--oneline", "--no-decorate",
+		fmt.Sprintf("--max-count=%d", kPreviewMaxCommits), lo+".."+hi)
+	if err != nil {
+		return err
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	count, first_parent := countCommits(runner, dir, lo, hi)
+	switch {
+	case count < 0:
+		ConsoleLogInfo("Commits in range %s..%s:", lo, hi)
+	case first_parent:
+		ConsoleLogInfo("At least %d commits in range %s..%s, counting the first parents only:", count, lo, hi)
+	default:
+		ConsoleLogInfo("%d commits in range %s..%s:", count, lo, hi)
+	}
+	for _, line := range lines {
+		if len(line) > 0 {
+			ConsoleLogInfo("  %s", line)
+		}
 	}
-	gLogger.Printf("Running command: %s\n", strings.Join(command, " "))
-	cmd := exec.Command(command[0], command[1:]...)
-	cmd.Stdout = gLogFileHandler
-	cmd.Stderr = gLogFileHandler
-	if len(dir) > 0 {
-		cmd.Dir = dir
+	if count > kPreviewMaxCommits {
+		ConsoleLogInfo("  ... and %d more", count-kPreviewMaxCommits)
+	} else if count < 0 && len(lines) == kPreviewMaxCommits {
+		ConsoleLogInfo("  ... and more")
 	}
-	return cmd.Run()
+	return nil
 }
 
-func runCommandDirOutput(dir string, command ...string) ([]byte, error) {
-	if len(command) < 1 {
-		return nil, fmt.Errorf("Empty command")
-	}
-	gLogger.Printf("Running command: %s\n", strings.Join(command, " "))
-	cmd := exec.Command(command[0], command[1:]...)
-	if len(dir) > 0 {
-		cmd.Dir = dir
+// Clones repo_url into clonedir, passing args to git clone.
+func cloneGitRepo(runner CommandRunner, repo_url string, clonedir string, args ...string) error {
+	return cloneRepo(runner, []string{"clone"}, repo_url, clonedir, args...)
+}
+
+// Clones repo_url into clonedir, replacing whatever was there, with the git
+// subcommand clone, e.g. clone or svn clone, passing it args.
+func cloneRepo(runner CommandRunner, clone []string, repo_url string, clonedir string, args ...string) error {
+	gLogger.Printf("Removing directory before cloning new repo into it: [exists? %t] %s\n",
+		filepathExists(clonedir), clonedir)
+	if err := runner.RemoveAll(clonedir); err != nil {
+		return err
 	}
-	return cmd.Output()
+	command := append(append([]string{gGitPath}, clone...), args...)
+	return runCommand(runner, append(command, repo_url, clonedir)...)
 }
 
-func RunBisect(reponame, lo, hi string, steps []string) bool {
-	repo := gConfig.GetRepo(reponame)
-	if repo == nil {
-		ConsoleLogError("No imported repo with name: \"%s\". Run %s import --help",
-			reponame, kApplicationName)
-		return false
+// Returns the hash of the commit back first-parent commits before hi.
+func resolveBack(runner CommandRunner, dir, hi string, back int) (string, error) {
+	if hash, err := resolveRef(runner, dir, fmt.Sprintf("%s~%d", hi, back)); err == nil {
+		return hash, nil
 	}
-	if len(steps) == 0 {
-		ConsoleLogError("No steps provided to execute.")
-		return false
+	out, err := runCommandDirOutput(runner, dir, gGitPath, "rev-list", "--first-parent", "--count", hi)
+	if err != nil {
+		return "", err
 	}
-	for _, step := range steps {
-		if matched := gAlphanumericDashUnderlineRe.MatchString(step); !matched {
-			ConsoleLogError("Invalid step name. Only alphanumeric and underscore/dash allowed.")
-			return false
-		}
+	// The count includes hi.
+	available, _ := strconv.Atoi(strings.TrimSpace(string(out)))
+	err = fmt.Errorf("The first-parent history of hi only has %d commits before it", available-1)
+	if out, _ := runCommandDirOutput(runner, dir, gGitPath, "rev-parse", "--is-shallow-repository"); strings.TrimSpace(string(out)) == "true" {
+		err = fmt.Errorf("%w. The clone is shallow, deepen it with `git -C %s fetch --deepen=%d`", err, shellQuote(dir), back)
 	}
+	return "", err
+}
 
-	cachedir := ""
-	for {
-		hint_dirname := fmt.Sprintf("%s_%d", reponame, rand.Int())
-		cachedir = path.Join(GetAppDataDir(), "cache", hint_dirname)
-		gLogger.Printf("Considering cache dir: %s\n", cachedir)
-		if !filepathExists(cachedir) {
-			break
-		}
+// Returns the latest tag matching the glob pattern, in version order, and
+// the number of tags matching it.
+func resolveTagPattern(runner CommandRunner, dir, pattern string) (string, int, error) {
+	out, err := runCommandDirOutput(runner, dir, gGitPath, "tag", "--list", "--sort=v:refname", pattern)
+	if err != nil {
+		return "", 0, err
 	}
+	tags := strings.Fields(string(out))
+	if len(tags) == 0 {
+		return "", 0, fmt.Errorf("No tag matches %s", pattern)
+	}
+	return tags[len(tags)-1], len(tags), nil
+}
 
-	var err error
-	err = os.MkdirAll(cachedir, os.ModePerm)
+// Returns the most recent tag reachable from hi, for --last-release.
+func resolveLastRelease(runner CommandRunner, dir, hi string) (string, error) {
+	out, err := runCommandDirOutput(runner, dir, gGitPath, "describe", "--tags", "--abbrev=0", hi)
 	if err != nil {
 		gLogger.Printf("Error: %v\n", err)
-		ConsoleLogError("Failed to create cache dir: %s", cachedir)
-		return false
+		return "", errors.New("No tag is reachable from hi")
 	}
-	ConsoleLogInfo("Using cache directory for bisect: %s", cachedir)
+	return strings.TrimSpace(string(out)), nil
+}
 
-	// Copy the repo source to the cache location.
-	cacherepo := path.Join(cachedir, "_repo")
-	{
-		if err = runCommand("cp", "--recursive", repo.LocalPath, cacherepo); err != nil {
-			gLogger.Printf("Error: %v\n", err)
-			ConsoleLogError("Failed to copy repo to cache location.")
-			return false
+// Describes the tag resolved from a --since-tag or --until-tag pattern,
+// pointing out when other tags matched.
+func describeTagMatch(tag, pattern string, count int) string {
+	if count == 1 {
+		return fmt.Sprintf("%s, the only tag matching %s", tag, pattern)
+	}
+	return fmt.Sprintf("%s, the latest of the %d tags matching %s", tag, count, pattern)
+}
+
+// Returns the branch that origin/HEAD points to in the clone at dir, or that
+// HEAD points to if it is a mirror clone.
+func detectDefaultBranch(runner CommandRunner, dir string, mirror bool) (string, error) {
+	if mirror {
+		out, err := runCommandDirOutput(runner, dir, gGitPath, "symbolic-ref", "--short", "HEAD")
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(out)), nil
+	}
+	out, err := runCommandDirOutput(runner, dir, gGitPath, "symbolic-ref", "--short", "refs/remotes/origin/HEAD")
+	if err == nil {
+		return strings.TrimPrefix(strings.TrimSpace(string(out)), "origin/"), nil
+	}
+	// origin/HEAD is only set by clone, guess from the usual names.
+	for _, branch := range []string{"main", "master"} {
+		if runCommandDir(runner, dir, gGitPath, "rev-parse", "--quiet", "--verify", "refs/remotes/origin/"+branch) == nil {
+			return branch, nil
 		}
 	}
+	return "", fmt.Errorf("origin/HEAD is not set in %s", dir)
+}
 
-	ConsoleLogInfo("Lo: %s", lo)
-	ConsoleLogInfo("Hi: %s", hi)
+// Returns the commit HEAD of the repo at dir is detached at, or an empty
+// string when HEAD is a branch.
+func detachedHead(runner CommandRunner, dir string) (string, error) {
+	if runCommandDir(runner, dir, gGitPath, "symbolic-ref", "--quiet", "HEAD") == nil {
+		return "", nil
+	}
+	return resolveRef(runner, dir, "HEAD")
+}
 
-	// DBG: Create tempfile for the script that will be executed in the bisect
-	// operation.
-	tmpfile, err := os.CreateTemp("", "bisect_script")
-	defer os.Remove(tmpfile.Name())
+// Returns the only branch of the clone at dir containing the commit, among
+// those of origin, or the local ones if it is a mirror clone.
+func branchContaining(runner CommandRunner, dir, hash string, mirror bool) (string, error) {
+	prefix := "refs/remotes/origin/"
+	if mirror {
+		prefix = "refs/heads/"
+	}
+	out, err := runCommandDirOutput(runner, dir, gGitPath, "for-each-ref", "--contains", hash, "--format=%(refname)", prefix)
 	if err != nil {
-		ConsoleLogError("Failed to create temp bisect script")
-		return false
+		return "", err
 	}
-
-	{
-		script := `
-		echo "Running bisect on current hash"
-		echo "cwd: $(pwd)"
-		go run . > /tmp/compute 2>&1
-		cat /tmp/compute
-		# test $(cat /tmp/compute | awk '$2 < 40 { print }' | wc -l) -gt 0 || exit 125
-		test $(cat /tmp/compute | awk '$2 < 40 { print }' | wc -l) -gt 0
-		`
-		if _, err = tmpfile.WriteString(script); err != nil {
-			ConsoleLogError("Failed to write script data to tempfile")
-			gLogger.Printf("Error: %v\n", err)
-			return false
+	var branches []string
+	for _, ref := range strings.Fields(string(out)) {
+		if branch := strings.TrimPrefix(ref, prefix); branch != "HEAD" {
+			branches = append(branches, branch)
 		}
-		tmpfile.Close()
-		runCommand("chmod", "+x", tmpfile.Name()) // Give exec perms
 	}
-
-	command_sequence := [][]string{
-		// Ensure that no bisect is running. This will do nothing if
-		// it is not in bisect mode.
-		{"git", "bisect", "reset"},
-		{"git", "bisect", "start"},
-		// TODO: The good and bad are not always synonymous w/ lo and hi commit hash...
-		{"git", "bisect", "good", lo},
-		{"git", "bisect", "bad", hi},
+	if len(branches) != 1 {
+		return "", fmt.Errorf("%d branches contain %s", len(branches), hash)
 	}
+	return branches[0], nil
+}
 
-	for _, cmd := range command_sequence {
-		if err = runCommandDir(cacherepo, cmd...); err != nil {
-			gLogger.Printf("Error: %v\n", err)
-			ConsoleLogError("Error setting up bisect state.")
-			return false
+// The rev used when --hi is omitted: the tip of the default branch of an
+// imported repo, fetched first if requested, or HEAD of a --path repo.
+func defaultHi(runner CommandRunner, repo *RepoInfo, is_path bool, fetch bool) (string, error) {
+	if is_path {
+		return "HEAD", nil
+	}
+	if repo.IsLocalDir() {
+		// Its branches are its own, there is no origin.
+		if fetch {
+			ConsoleLogInfo("Not fetching: %s was imported from a local dir, it has no remote", repo.Label())
+		}
+		if len(repo.DefaultBranch) == 0 {
+			return "HEAD", nil
 		}
+		return repo.DefaultBranch, nil
 	}
+	if fetch {
+		if err := updateRepo(runner, repo); err != nil {
+			return "", err
+		}
+	}
+	if repo.Vcs == kVcsSvn {
+		// The local branches of git svn are not updated by a fetch.
+		return svnTrunkRef(runner, repo.LocalPath)
+	}
+	branch := repo.DefaultBranch
+	if len(branch) == 0 {
+		var err error
+		if branch, err = detectDefaultBranch(runner, repo.LocalPath, repo.Mirror); err != nil {
+			return "", err
+		}
+	}
+	if repo.Mirror {
+		// The branches of a mirror are the remote's.
+		return branch, nil
+	}
+	return "origin/" + branch, nil
+}
 
-	initial_commit_hash_b, err := runCommandDirOutput(cacherepo, "git", "rev-parse", "HEAD")
-	if err != nil || len(initial_commit_hash_b) == 0 {
-		if err != nil {
-			gLogger.Printf("Error: %v", err)
+// Updates the repo from its remote. A mirror has its branches updated and
+// those deleted upstream pruned, and an SVN repo has the new revisions
+// converted.
+func fetchRepo(runner CommandRunner, repo *RepoInfo) error {
+	if repo.IsLocalDir() {
+		return fmt.Errorf("%s was imported from a local dir, it has no remote to fetch", repo.LocalPath)
+	}
+	if repo.Vcs == kVcsSvn {
+		if err := requireGitSvn(runner); err != nil {
+			return err
 		}
-		ConsoleLogError("Failed to get current commit hash")
+		return runCommandDir(runner, repo.LocalPath, gGitPath, "svn", "fetch", "--quiet")
+	}
+	if repo.Mirror {
+		return runCommandDir(runner, repo.LocalPath, gGitPath, "remote", "update", "--prune")
+	}
+	return runCommandDir(runner, repo.LocalPath, gGitPath, "fetch", "--quiet", "--tags", "origin")
+}
+
+// Selects the git executable to use. An empty path keeps the git found on
+// $PATH.
+func SetupGitPath(git_path string) bool {
+	if len(git_path) == 0 {
+		return true
+	}
+	resolved, err := checkGitBinary(git_path)
+	if err != nil {
+		gLogger.Printf("Error: %v\n", err)
+		ConsoleLogError("Git executable does not exist or is not executable: %s", git_path)
 		return false
 	}
-	initial_commit_hash := strings.TrimSpace(string(initial_commit_hash_b))
-	gLogger.Printf("Repo initial commit hash: %s\n", initial_commit_hash)
-	ConsoleLogInfo("Running bisect script")
-	defer func() {
-		gLogger.Println("Resetting git bisect")
-		runCommandDir(cacherepo, "git", "bisect", "reset")
-	}()
-	{
-		_wrap_step := func(script_path, step string) string {
-			return fmt.Sprintf(`
-				CACHE_DIR=%s
-				REPO_DIR=%s
-				STEP_NAME=%s
-				SCRIPT_PATH=%s
+	gLogger.Printf("Using git executable: %s\n", resolved)
+	gGitPath = resolved
+	return true
+}
 
-				# Creating the cache directory for this step's execution.
-				# Note: At script entry, cwd=cacherepo.
-				COMMIT_HASH=$(git rev-parse HEAD)
-				STEP_DIR="${CACHE_DIR}/_run/${COMMIT_HASH}/${STEP_NAME}"
-				echo "Step Dir: ${STEP_DIR}"
-				mkdir -p "${STEP_DIR}"
+// Returns the command to run. git commands are run with gitEnv() and
+// gitConfigArgs(), so that the env of the user cannot change what they
+// operate on or what they output.
+func newCommand(ctx context.Context, command []string) *exec.Cmd {
+	if command[0] != gGitPath {
+		return exec.CommandContext(ctx, command[0], command[1:]...)
+	}
+	cmd := exec.CommandContext(ctx, command[0], append(gitConfigArgs(), command[1:]...)...)
+	cmd.Env = gitEnv()
+	return cmd
+}
 
-				STEP_LOG_FILE="${STEP_DIR}/log.txt"
+func runCommand(runner CommandRunner, command ...string) error {
+	return runCommandDir(runner, "", command...)
+}
 
-				# Running the script for this step.
-				# Also preserve the results of the execution in the cache.
-				"${SCRIPT_PATH}" "${STEP_NAME}" > "${STEP_LOG_FILE}" 2>&1
-				RESULT=$?
-				cat "${STEP_LOG_FILE}"
+func runCommandDir(runner CommandRunner, dir string, command ...string) error {
+	return runner.Run(CommandOptions{Dir: dir}, command...)
+}
 
-				# Checking ther results of the step's execution
-				if [ $RESULT -eq 0 ]
-				then
-					echo "xbisect step=${STEP_NAME} PASS"
-				else
-					echo "xbisect step=${STEP_NAME} FAIL res=${RESULT}"
-					exit $RESULT
-				fi
-			`, cachedir, cacherepo, step, script_path)
-		}
+func runCommandDirOutput(runner CommandRunner, dir string, command ...string) ([]byte, error) {
+	return runner.RunOutput(CommandOptions{Dir: dir}, command...)
+}
 
-		// Create a script that will run the main script for each step provided
-		// by the caller.
-		script_file := tmpfile.Name()
-		wrapper_script_file, err := os.CreateTemp("", "bisect_script_wrapper")
-		defer os.Remove(wrapper_script_file.Name())
-		wrapper_script := "#!/bin/bash\n"
-		for _, step := range steps {
-			wrapper_script += _wrap_step(script_file, step) // fmt.Sprintf("%s %s\n", script_file, step)
-		}
-		gLogger.Printf("Wrapper Script:\n%s\n", wrapper_script)
-		if _, err = wrapper_script_file.WriteString(wrapper_script); err != nil {
-			gLogger.Printf("Error: %v\n", err)
-			ConsoleLogError("Failed to create wrapper script")
-			wrapper_script_file.Close()
-			return false
-		}
-		wrapper_script_file.Close()
-		runCommand("chmod", "+x", wrapper_script_file.Name()) // Give exec perms
+type RunOptions struct {
+	Repo string
+	// Path of a git repo to use instead of an imported repo. The config is
+	// left untouched.
+	Path string
+	// URL of a git repo to clone instead of using an imported repo. The
+	// clone is reused by the runs against the same URL.
+	Git   string
+	Lo    string
+	Hi    string
+	Steps []string
+	// File listing the steps instead of Steps, or "-" for stdin.
+	StepsFile string
+	// File connected to the stdin of every step. Empty means /dev/null.
+	Stdin string
+	// Per-step overrides of Stdin, keyed by step name.
+	StepStdin map[string]string
+	// Glob patterns, relative to the repo root, of core files to collect
+	// when a step fails.
+	CorePatterns []string
+	// Discard local changes and untracked files in the cache repo before
+	// starting.
+	CleanWorktree bool
+	// Go text/template file used to render the summary. Empty means the
+	// default summary.
+	ReportTemplate string
+	// kSummaryFormatTable for the steps of each tested commit, or
+	// kSummaryFormatTree for how the bisect narrowed the range. Empty is
+	// kSummaryFormatTable.
+	SummaryFormat string
+	// Path patterns restricting steps to the commits changing a matching
+	// file, as "step:pattern" entries.
+	StepPaths []string
+	// Conditions on the results of other steps, as "step:other:pass" and
+	// "step:other:fail" entries.
+	StepWhen []string
+	// Steps only run when another step passed, as "step:other" entries.
+	StepNeeds []string
+	// Run the steps with their output on a pseudo-terminal of PtySize
+	// (COLSxROWS).
+	Pty     bool
+	PtySize string
+	// Run the steps in the process group of xbisect rather than in one of
+	// their own, which an interruption signals as a whole.
+	SharedProcessGroup bool
+	// Kill a step running for longer than StepTimeout, if not zero, which
+	// skips the commit, or fails it when OnTimeout is kOnTimeoutFail.
+	StepTimeout time.Duration
+	OnTimeout   string
+	// Git config (KEY=VALUE) passed with -c to the git commands of the run.
+	GitConfig []string
+	// Path, relative to the repo root, of a file or dir whose size makes a
+	// commit bad once it exceeds MaxBytes, or the size measured on
+	// SizeBaseline plus SizeTolerance.
+	SizeOf        string
+	MaxBytes      int64
+	SizeBaseline  string
+	SizeTolerance string
+	// Skip the commits that are not merges, or those that are.
+	MergesOnly bool
+	NoMerges   bool
+	// Only bisect the first-parent chain of Hi, as git bisect --first-parent.
+	FirstParent bool
+	// Reuse the step results recorded for the same repo and script, by warm
+	// or earlier runs, and record the new ones.
+	ReuseResults bool
+	// Only print the first bad commit on the console, or the error when it
+	// is not found.
+	FirstBadOnly bool
+	// Print the report as JSON on stdout instead of the summary, for other
+	// tools to read.
+	JsonReport bool
+	// Run each step AttemptsPerCommit times on every commit, its verdict
+	// being that of the attempts under VerdictPolicy, one of the
+	// kVerdictPolicy. 0 or 1 runs it once.
+	AttemptsPerCommit int
+	VerdictPolicy     string
+	// Commits already known to be good or bad, as "good:<rev>" and
+	// "bad:<rev>" entries, marked before the bisect runs.
+	Marks []string
+	// kModeRegression to find the first commit whose steps fail, or
+	// kModeFix for the first whose steps pass. Empty is kModeRegression.
+	Mode string
+	// Generates the name of the run's cache dir from a prefix derived from
+	// the repo. Called again if the dir already exists. Nil means
+	// randomCacheDirName.
+	CacheDirName func(prefix string) string
+	// File of the script run for each step, with the step name as $1.
+	ScriptFile string
+	// The content of the script, instead of ScriptFile.
+	Script string
+	// Shell command run as the script instead, by default as the single
+	// step kCmdStepName.
+	Cmd string
+	// Do not read the defaults of the steps from the kRepoConfigFileName of
+	// the hi commit.
+	NoRepoConfig bool
+	// Compare the output of BaselineStep, the last step by default, to the
+	// Baseline file or to its output on BaselineRev, instead of judging it
+	// by its exit status.
+	Baseline     string
+	BaselineRev  string
+	BaselineStep string
+	// Paths, relative to the repo root, copied into the run dir of each
+	// commit once the steps ran on it.
+	Artifacts []string
+	// Once the first bad commit is found, compare its Artifacts with those
+	// of its parent, running the steps on the parent if it was not tested.
+	DiffArtifacts bool
+	// File the DOT graph of the bisect path is written to once the bisect
+	// ended, - for stdout.
+	DotOut string
+	// The args the run was started with. When not nil, the command running
+	// the same bisect on the resolved range is printed once it succeeded.
+	ReproArgs []string
+	// Called with the report once the bisect ended, when it is not nil.
+	OnReport func(report *BisectReport)
+	// Called once the run is set up, before the bisect starts, when it is
+	// not nil.
+	OnSetup func(setup *RunSetup)
+	// Env sets the steps are run under, each as space separated NAME=value
+	// pairs. The steps run once per entry on every commit.
+	MatrixEnv []string
+	// Start the steps with an env made only of PATH, HOME, the Env vars and
+	// the EnvPassthrough vars, instead of inheriting the whole env.
+	CleanEnv bool
+	// NAME=value pairs set for the steps.
+	Env []string
+	// Names of the vars of the env passed on to the steps with CleanEnv.
+	EnvPassthrough []string
+	// Point HOME and the XDG base dirs of the steps to a scratch dir of the
+	// run, so that they neither use nor change the user's.
+	IsolateHome bool
+	// How the verdicts of the matrix entries combine into the verdict of
+	// the commit: "any" failing entry or "all" entries failing make the
+	// commit bad.
+	VerdictMatrix string
+	// Fetch origin before resolving the default Hi.
+	Fetch bool
+	// Fetch the new commits of the imported repo before resolving the
+	// range, whether Hi is given or not.
+	Update bool
+	// Print the commits of the range before starting, and ask for
+	// confirmation when stdin is a terminal.
+	Preview bool
+	// Validate the options and resolve the range, then stop before creating
+	// the cache dir. The runner of the run is expected to be a DryRunRunner,
+	// recording the bisect commands instead of running them.
+	DryRun bool
+	// When positive, Lo is set to the commit Back first-parent commits
+	// before Hi.
+	Back int
+	// Glob patterns of tags, Lo and Hi being set to the latest tag matching
+	// each.
+	SinceTag string
+	UntilTag string
+	// Lo defaults to the most recent tag reachable from Hi, and Hi to HEAD.
+	LastRelease bool
+	// Run the steps directly in the repo given with Path instead of a copy.
+	InPlace bool
+	// What to do with local changes of an in-place repo: "refuse" or
+	// "stash" them for the duration of the run.
+	Dirty string
+	// How the repo is copied into the cache.
+	Copy CopyOptions
+	// Patterns of the paths not copied into the cache, in addition to those
+	// of the .xbisectignore file of the repo.
+	Excludes []string
+	// Webhook POSTed to when a bisect finishes, in NotifyFormat ("json" or
+	// "slack").
+	Notify       string
+	NotifyFormat string
+	// Where to upload the report once the bisect ends: "gist", or
+	// "url=<endpoint>".
+	Share string
+	// The commit the bisect is expected to find. The run fails if it finds
+	// another one.
+	ExpectCulprit string
+}
 
-		cmd := exec.Command("git", "bisect", "run", wrapper_script_file.Name())
-		cmd.Dir = cacherepo
-		stdout, err := cmd.StdoutPipe()
-		if err != nil {
-			gLogger.Printf("Error: %v\n", err)
-			ConsoleLogError("Error occurred setting up git bisect output streaming.")
-			return false
-		}
-		if err = cmd.Start(); err != nil {
-			gLogger.Printf("Error: %v\n", err)
-			ConsoleLogError("Failed to start git bisect")
-			return false
-		}
+const kMaxCacheDirNameAttempts = 100
 
-		// Use a teewriter to output to the logfile and also scan the
-		// output.
-		var buf bytes.Buffer
-		tee := io.TeeReader(stdout, &buf)
+func randomCacheDirName(prefix string) string {
+	return fmt.Sprintf("%s_%d", prefix, rand.Int())
+}
 
-		hashLineRe := regexp.MustCompile(`^\[(.*)\] .*$`)
-		statusMatchRe := regexp.MustCompile(`xbisect step=([a-zA-Z0-9_-]+) (PASS|FAIL)( res=[0-9]+)?`)
-		resMatchRe := regexp.MustCompile(`res=([0-9]+)`)
+type StdinInfo struct {
+	Step   string `toml:",omitempty"`
+	Path   string
+	Sha256 string
+}
 
-		scanner := bufio.NewScanner(tee)
-		var lines_until_hash int64 = 0
+// Describes a bisect run. Persisted as run.toml in the run's cache directory
+// so that the inputs of the run are pinned for later reproduction.
+type RunMetadata struct {
+	// The run checks out commits in the user's own working copy at Path.
+	// If it did not complete, OriginalRef and Stash must be restored by
+	// hand.
+	InPlace     bool   `toml:",omitempty"`
+	OriginalRef string `toml:",omitempty"`
+	Stash       string `toml:",omitempty"`
+
+	Repo string
+	// Absolute path of the repo when it was given with --path instead of
+	// being imported.
+	Path string `toml:",omitempty"`
+	// URL of the repo when it was given with --git, cloned without being
+	// imported.
+	Git string `toml:",omitempty"`
+	Lo  string
+	// The --back offset lo was resolved from, if any.
+	Back int `toml:",omitempty"`
+	// The tag patterns lo and hi were resolved from, if any.
+	SinceTag string `toml:",omitempty"`
+	UntilTag string `toml:",omitempty"`
+	// Whether lo was the last release, with --last-release.
+	LastRelease bool `toml:",omitempty"`
+	Hi          string
+	Steps       []string
+	// Absolute path of the --script the steps ran, copied into the run's
+	// cache dir, or the --cmd they ran instead.
+	Script string      `toml:",omitempty"`
+	Cmd    string      `toml:",omitempty"`
+	Stdin  []StdinInfo `toml:",omitempty"`
+	// kModeFix when the run looked for the first commit whose steps pass,
+	// empty for a regression.
+	Mode string `toml:",omitempty"`
+	// Whether defaults were read from the kRepoConfigFileName of hi.
+	RepoConfig bool `toml:",omitempty"`
+	// Path patterns of the steps restricted with --step-paths.
+	StepPaths map[string][]string `toml:",omitempty"`
+	// Dirs the steps given as name@dir run in, relative to the repo root.
+	StepWorkdirs map[string]string `toml:",omitempty"`
+	// Conditions of the steps given with --step-when and --step-needs.
+	StepConditions map[string][]string `toml:",omitempty"`
+	Marks          []string            `toml:",omitempty"`
+	Matrix         []string            `toml:",omitempty"`
+	// Only set along with Matrix.
+	VerdictMatrix string `toml:",omitempty"`
+	// The --timeout of the steps, as a duration, and what a timeout makes of
+	// the commit.
+	StepTimeout string `toml:",omitempty"`
+	OnTimeout   string `toml:",omitempty"`
+	// The runs of each step per commit and how they combine into its
+	// verdict, when a step runs more than once.
+	AttemptsPerCommit int    `toml:",omitempty"`
+	VerdictPolicy     string `toml:",omitempty"`
+	// The --git-config of the run.
+	GitConfig []string `toml:",omitempty"`
+	// Version of the git executable the run used.
+	GitVersion string `toml:",omitempty"`
+	// Window size of the pseudo-terminal the steps ran on, with --pty.
+	Pty string `toml:",omitempty"`
+	// The --size-of path and the size above which a commit is bad, derived
+	// from SizeBaseline if given.
+	SizeOf       string `toml:",omitempty"`
+	MaxBytes     int64  `toml:",omitempty"`
+	SizeBaseline string `toml:",omitempty"`
+	// The step whose output is compared to the baseline file, or to its
+	// output on BaselineRev.
+	BaselineStep string `toml:",omitempty"`
+	Baseline     string `toml:",omitempty"`
+	BaselineRev  string `toml:",omitempty"`
+	// Patterns of the paths not copied into the cache, from .xbisectignore
+	// and --exclude.
+	Excludes     []string `toml:",omitempty"`
+	MergesOnly   bool     `toml:",omitempty"`
+	NoMerges     bool     `toml:",omitempty"`
+	FirstParent  bool     `toml:",omitempty"`
+	ReuseResults bool     `toml:",omitempty"`
+	// Only the names of the --env and passed through vars are recorded,
+	// their values may be secrets.
+	CleanEnv       bool     `toml:",omitempty"`
+	Env            []string `toml:",omitempty"`
+	EnvPassthrough []string `toml:",omitempty"`
+	IsolateHome    bool     `toml:",omitempty"`
+}
 
-		var scan_succeed bool
-		scan_succeed = true
+// Name of the imported repo, or its path if it was not imported.
+func (m *RunMetadata) RepoLabel() string {
+	if len(m.Path) > 0 {
+		return m.Path
+	}
+	if len(m.Git) > 0 {
+		return m.Git
+	}
+	return m.Repo
+}
 
-		type StepResult struct {
-			Name       string
-			Pass       bool
-			ExitStatus int
-		}
-		type CommitResult struct {
-			Hash        string
-			StepResults []StepResult
-		}
-		_get_exit_status := func(data string) (int, error) {
-			if len(data) == 0 {
-				return 0, nil
-			}
-			res_match := resMatchRe.FindStringSubmatch(data)
-			if res_match == nil {
-				return 0, fmt.Errorf("Regex found no match")
+func (m *RunMetadata) Save(cachedir string) error {
+	serialized, err := toml.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path.Join(cachedir, "run.toml"), serialized, 0666)
+}
+
+func LoadRunMetadata(cachedir string) (*RunMetadata, error) {
+	data, err := os.ReadFile(path.Join(cachedir, "run.toml"))
+	if err != nil {
+		return nil, err
+	}
+	metadata := &RunMetadata{}
+	if err = toml.Unmarshal(data, metadata); err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+func sha256File(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Resolves the stdin file of a step to an absolute path, validating that it
+// exists and is a regular file.
+func resolveStdinFile(file string) (string, error) {
+	abspath, err := filepath.Abs(file)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(abspath)
+	if err != nil {
+		return "", err
+	}
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("%s is not a regular file", abspath)
+	}
+	return abspath, nil
+}
+
+// Reads the steps listed one per line in the file, or in stdin when the file
+// is "-". Blank lines and lines starting with # are ignored.
+func readStepsFile(file string) ([]string, error) {
+	var steps []string
+	err := readLinesFile(file, func(step string) error {
+		if _, _, err := parseStepSpec(step); err != nil {
+			return err
+		}
+		steps = append(steps, step)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(steps) == 0 {
+		if file == "-" {
+			file = "stdin"
+		}
+		return nil, fmt.Errorf("No steps in %s", file)
+	}
+	return steps, nil
+}
+
+// Splits a step given as name@dir into its name and the dir it runs in,
+// relative to the root of the repo. The dir is empty when none is given.
+func parseStepSpec(spec string) (string, string, error) {
+	name, workdir := spec, ""
+	if i := strings.LastIndex(spec, "@"); i >= 0 {
+		name, workdir = spec[:i], filepath.Clean(spec[i+1:])
+		if !filepath.IsLocal(workdir) {
+			return "", "", fmt.Errorf("Invalid dir of step %q. Expected a path inside the repo.", spec)
+		}
+	}
+	if err := validateStepName(name); err != nil {
+		return "", "", err
+	}
+	return name, workdir, nil
+}
+
+// Parses the "step:pattern" entries of --step-paths into the patterns of
+// each step.
+func parseStepPaths(entries []string, steps []string) (map[string][]string, error) {
+	step_paths := map[string][]string{}
+	for _, entry := range entries {
+		step, pattern, found := strings.Cut(entry, ":")
+		if !found || len(pattern) == 0 {
+			return nil, fmt.Errorf("Invalid step path %q, expected step:pattern", entry)
+		}
+		if !slices.Contains(steps, step) {
+			return nil, fmt.Errorf("Step path given for unknown step: %s", step)
+		}
+		step_paths[step] = append(step_paths[step], pattern)
+	}
+	return step_paths, nil
+}
+
+type BisectMark struct {
+	// Either "good" or "bad".
+	Term string
+	Rev  string
+}
+
+// The --mode values. A regression bisect looks for the first commit whose
+// steps fail, a fix bisect for the first commit whose steps pass.
+const (
+	kModeRegression = "regression"
+	kModeFix        = "fix"
+)
+
+// The git bisect term of the mark. Marks keep the meaning of the steps
+// whatever the mode, good being a commit whose steps pass, while git names
+// good the commits of the old state: those whose steps fail in kModeFix.
+func (m BisectMark) gitTerm(mode string) string {
+	if mode != kModeFix {
+		return m.Term
+	}
+	if m.Term == "good" {
+		return "bad"
+	}
+	return "good"
+}
+
+// Parses the "good:<rev>" and "bad:<rev>" entries of --mark.
+func parseBisectMarks(entries []string) ([]BisectMark, error) {
+	var marks []BisectMark
+	for _, entry := range entries {
+		term, rev, _ := strings.Cut(entry, ":")
+		if (term != "good" && term != "bad") || len(rev) == 0 {
+			return nil, fmt.Errorf("Invalid mark %q, expected good:<rev> or bad:<rev>", entry)
+		}
+		marks = append(marks, BisectMark{Term: term, Rev: rev})
+	}
+	return marks, nil
+}
+
+// Resolves a --path argument to the top level directory of the git repo
+// containing it.
+func resolveRepoPath(runner CommandRunner, repo_path string) (string, error) {
+	abspath, err := filepath.Abs(repo_path)
+	if err != nil {
+		return "", err
+	}
+	if info, err := os.Stat(abspath); err != nil || !info.IsDir() {
+		return "", fmt.Errorf("%s is not a directory", abspath)
+	}
+	out, err := runCommandDirOutput(runner, abspath, gGitPath, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return "", fmt.Errorf("%s is not in a git repository", abspath)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// A rev that does not name a commit of the repo.
+type InvalidRefError struct {
+	Dir string
+	Ref string
+	// The rev is an abbreviated hash of several objects.
+	Ambiguous bool
+	// The repo is a shallow clone, whose history may not reach the rev.
+	Shallow bool
+}
+
+func (e *InvalidRefError) Error() string {
+	if e.Ambiguous {
+		return fmt.Sprintf("%s is ambiguous, several objects have a hash starting with it. Give more of the hash.", e.Ref)
+	}
+	if e.Shallow {
+		return fmt.Sprintf("%s is not a valid object name. %s is a shallow clone, the commit may be older than its history: deepen it with `git -C %s fetch --deepen=<n>`, or `--unshallow` for the whole history.",
+			e.Ref, e.Dir, shellQuote(e.Dir))
+	}
+	return fmt.Sprintf("%s is not a valid object name. Check its spelling, or run `git -C %s fetch` if it only exists upstream.",
+		e.Ref, shellQuote(e.Dir))
+}
+
+func (e *InvalidRefError) Is(target error) bool {
+	return target == ErrBadRef
+}
+
+// Returns the hash of the commit ref names in the repo at dir. Fails with an
+// InvalidRefError if it names no commit, or is an ambiguous abbreviated hash.
+func resolveRef(runner CommandRunner, dir, ref string) (string, error) {
+	out, err := runCommandDirOutput(runner, dir, gGitPath, "rev-parse", "--verify", ref+"^{commit}")
+	if err == nil {
+		return strings.TrimSpace(string(out)), nil
+	}
+	var exit_err *exec.ExitError
+	if !errors.As(err, &exit_err) {
+		return "", err
+	}
+	// git reports both with "fatal: Needed a single revision", after the
+	// candidates of an ambiguous hash.
+	if gAmbiguousRefRe.Match(exit_err.Stderr) {
+		return "", &InvalidRefError{Dir: dir, Ref: ref, Ambiguous: true}
+	}
+	if exit_err.ExitCode() == 128 {
+		boundary, _ := shallowCommits(runner, dir)
+		return "", &InvalidRefError{Dir: dir, Ref: ref, Shallow: len(boundary) > 0}
+	}
+	return "", err
+}
+
+// The checkout errors due to the commit checked out, a missing or corrupt
+// object or a path the filesystem does not allow, rather than to the state
+// of the repo. Also matched with grep -E by the wrapper.
+var gCommitCheckoutErrorRe = regexp.MustCompile(`unable to read|bad object|invalid object|is corrupt|missing (blob|tree)|` +
+	`could not fetch|promisor remote|is not a tree|invalid path|unable to create (file|symlink)|` +
+	`cannot create directory|Filename too long|beyond a symbolic link`)
+
+// Whether a failed checkout only fails for the commit checked out, given the
+// error of the checkout command. The others, e.g. local changes in the
+// repo, would fail the checkout of any commit.
+func isCommitCheckoutError(err error) bool {
+	var exit_err *exec.ExitError
+	return errors.As(err, &exit_err) && gCommitCheckoutErrorRe.Match(exit_err.Stderr)
+}
+
+// Whether a failed checkout in the repo at dir is due to paths colliding on
+// a case-insensitive filesystem, given the error of the checkout command.
+func isCaseCollision(runner CommandRunner, dir string, err error) bool {
+	var exit_err *exec.ExitError
+	if !errors.As(err, &exit_err) || !gCaseCollisionRe.Match(exit_err.Stderr) {
+		return false
+	}
+	out, err := runCommandDirOutput(runner, dir, gGitPath, "config", "--bool", "core.ignorecase")
+	return err == nil && strings.TrimSpace(string(out)) == "true"
+}
+
+// Returns an error unless rev names a commit of the repo at dir.
+func verifyCommit(runner CommandRunner, dir, rev string) error {
+	_, err := resolveRef(runner, dir, rev)
+	if err != nil {
+		gLogger.Printf("Error: %v\n", err)
+	}
+	return err
+}
+
+// Returns an error unless rev is a descendant of lo and an ancestor of hi.
+func checkRevInRange(runner CommandRunner, dir, rev, lo, hi string) error {
+	if err := verifyCommit(runner, dir, rev); err != nil {
+		return err
+	}
+	if err := runCommandDir(runner, dir, gGitPath, "merge-base", "--is-ancestor", lo, rev); err != nil {
+		return fmt.Errorf("%s is not a descendant of lo (%s)", rev, lo)
+	}
+	if err := runCommandDir(runner, dir, gGitPath, "merge-base", "--is-ancestor", rev, hi); err != nil {
+		return fmt.Errorf("%s is not an ancestor of hi (%s)", rev, hi)
+	}
+	return nil
+}
+
+// Step names may contain dots, slashes and spaces (e.g. "unit.fast",
+// "lint/go"). They name the step's directory in the cache, so a slash
+// separates nested directories and "." or ".." components are rejected.
+func validateStepName(name string) error {
+	if !gStepNameRe.MatchString(name) {
+		return fmt.Errorf("Invalid step name %q. Only alphanumeric, space and _-./ allowed.", name)
+	}
+	if strings.TrimSpace(name) != name {
+		return fmt.Errorf("Invalid step name %q. Leading and trailing spaces are not allowed.", name)
+	}
+	for _, component := range strings.Split(name, "/") {
+		if len(component) == 0 || component == "." || component == ".." {
+			return fmt.Errorf("Invalid step name %q. Empty, \".\" and \"..\" path components are not allowed.", name)
+		}
+	}
+	return nil
+}
+
+// Parses a --matrix-env entry into its NAME=value pairs.
+func parseMatrixEntry(entry string) ([][2]string, error) {
+	var vars [][2]string
+	for _, field := range strings.Fields(entry) {
+		name, value, _ := strings.Cut(field, "=")
+		if !gEnvNameRe.MatchString(name) || !strings.Contains(field, "=") {
+			return nil, fmt.Errorf("Invalid matrix entry %q, expected NAME=value pairs", entry)
+		}
+		vars = append(vars, [2]string{name, value})
+	}
+	if len(vars) == 0 {
+		return nil, fmt.Errorf("Empty matrix entry")
+	}
+	return vars, nil
+}
+
+// Returns the vars set for the steps on top of the inherited env, or the
+// whole env of the steps with clean_env.
+func stepEnvVars(clean_env bool, env []string, passthrough []string) ([][2]string, error) {
+	var vars [][2]string
+	if clean_env {
+		for _, name := range append([]string{"PATH", "HOME"}, passthrough...) {
+			if !gEnvNameRe.MatchString(name) {
+				return nil, fmt.Errorf("Invalid env var name %q", name)
+			}
+			if value, ok := os.LookupEnv(name); ok {
+				vars = append(vars, [2]string{name, value})
+			}
+		}
+	} else if len(passthrough) > 0 {
+		return nil, fmt.Errorf("--env-passthrough requires --clean-env, the whole env is passed on otherwise")
+	}
+	for _, entry := range env {
+		name, value, found := strings.Cut(entry, "=")
+		if !found || !gEnvNameRe.MatchString(name) {
+			return nil, fmt.Errorf("Invalid env var %q, expected NAME=value", entry)
+		}
+		vars = append(vars, [2]string{name, value})
+	}
+	return vars, nil
+}
+
+// Whether the script run for each step is given, rather than to be found in
+// the repo config.
+func hasStepScript(opts RunOptions) bool {
+	return len(opts.Script) > 0 || len(opts.Cmd) > 0 || len(opts.ScriptFile) > 0
+}
+
+// Returns the script run for each step. Read before anything is cloned or
+// copied, so that a bad --script fails the run early.
+func loadStepScript(opts RunOptions) (string, error) {
+	if len(opts.Script) > 0 {
+		return opts.Script, nil
+	}
+	if len(opts.Cmd) > 0 {
+		return cmdStepScript(opts.Cmd), nil
+	}
+	if len(opts.ScriptFile) == 0 {
+		return "", errors.New("--script not specified. Give the script run for each step, with the step name as $1, e.g. --script ./repro.sh, or the command to run with --cmd. The steps can also be declared in a " + kRepoConfigFileName + " at the root of the repo.")
+	}
+	script, err := os.ReadFile(opts.ScriptFile)
+	if err != nil {
+		gLogger.Printf("Error: %v\n", err)
+		return "", fmt.Errorf("Invalid --script: cannot read %s.", opts.ScriptFile)
+	}
+	if len(script) == 0 {
+		return "", fmt.Errorf("Invalid --script: %s is empty.", opts.ScriptFile)
+	}
+	return string(script), nil
+}
+
+// The step --cmd runs when --steps is not given.
+const kCmdStepName = "cmd"
+
+// The script running the --cmd command line with bash, which sees the step
+// name as $1. The command is quoted for its metacharacters to reach bash
+// untouched.
+func cmdStepScript(command string) string {
+	return fmt.Sprintf("#!/usr/bin/env bash\n# Generated for --cmd.\nexec bash -c %s %s \"$@\"\n", shellQuote(command),
+		kCmdStepName)
+}
+
+// Writes a script and makes it executable. The mode is set explicitly since
+// the one given at creation is subject to the umask.
+func writeExecutable(file string, content string) error {
+	if err := os.WriteFile(file, []byte(content), 0755); err != nil {
+		return err
+	}
+	return os.Chmod(file, 0755)
+}
+
+// Quotes s so that it is a single word for the shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// Step results parsed from the markers printed by the wrapper script.
+type StepResult struct {
+	Name       string `json:"name"`
+	Pass       bool   `json:"pass"`
+	ExitStatus int    `json:"exit_status"`
+	// Name of the signal that killed the step (e.g. SIGSEGV), if any.
+	Signal string `json:"signal"`
+	// Whether core files were collected into the step's crash dir.
+	CoreCollected bool `json:"core_collected"`
+	// The step did not run because the commit changes none of the files
+	// matching its --step-paths patterns.
+	SkippedByPaths bool `json:"skipped_by_paths"`
+	// The step did not run because its dir, given as name@dir, does not
+	// exist in the commit.
+	SkippedByWorkdir bool `json:"skipped_by_workdir"`
+	// The step did not run because its --step-when or --step-needs
+	// conditions were not met.
+	SkippedByCondition bool `json:"skipped_by_condition"`
+	// Size of the --size-of path, for the size step.
+	Bytes int64 `json:"bytes"`
+	// The size step did not run because the --size-of path does not exist
+	// in the commit.
+	ArtifactMissing bool `json:"artifact_missing"`
+	// The result was recorded by an earlier run, with --reuse-results,
+	// instead of running the step.
+	Reused bool `json:"reused"`
+	// The --matrix-env entry the step ran under, if any.
+	Matrix string `json:"matrix"`
+	// The output of the step differs from the --baseline.
+	Diverged bool `json:"diverged"`
+	// The diff of the output to the baseline, for the first bad commit.
+	BaselineDiff string `json:"baseline_diff,omitempty"`
+	// The exit status of each attempt, with --attempts-per-commit.
+	Attempts []int `json:"attempts,omitempty"`
+	// The step was killed by --timeout. ExitStatus is kBisectSkipCode or
+	// kStepTimeoutCode, depending on --on-timeout.
+	TimedOut bool `json:"timed_out"`
+}
+
+type CommitResult struct {
+	Hash        string       `json:"hash"`
+	StepResults []StepResult `json:"step_results"`
+	// The commit could not be checked out and was skipped.
+	CheckoutFailed bool `json:"checkout_failed"`
+	// The checkout failed because paths of the commit collide on a
+	// case-insensitive filesystem.
+	CaseCollision bool `json:"case_collision"`
+	// Why the commit was skipped without running the steps, with
+	// --merges-only or --no-merges: kExcludedMerge or kExcludedNonMerge.
+	Excluded string `json:"excluded"`
+}
+
+// Parses a step status marker printed by the wrapper script. Returns nil if
+// the line is not a status marker. matrix lists the --matrix-env entries of
+// the run.
+func parseStepStatus(line string, matrix []string) (*StepResult, error) {
+	match := gStepStatusRe.FindStringSubmatch(line)
+	if match == nil {
+		return nil, nil
+	}
+	res := &StepResult{}
+	res.Name = match[1]
+	res.Pass = match[2] == "PASS"
+	if len(match[3]) > 0 {
+		exit_code, err := strconv.Atoi(strings.TrimPrefix(match[3], " res="))
+		if err != nil {
+			return nil, err
+		}
+		res.ExitStatus = exit_code
+	}
+	if signal := strings.TrimPrefix(match[4], " sig="); len(signal) > 0 {
+		res.Signal = "SIG" + signal
+	}
+	res.CoreCollected = len(match[5]) > 0
+	res.SkippedByPaths = match[2] == "SKIP" && match[6] == " reason=paths"
+	res.SkippedByWorkdir = match[2] == "SKIP" && match[6] == " reason=workdir"
+	res.SkippedByCondition = match[2] == "SKIP" && match[6] == " reason=condition"
+	res.ArtifactMissing = match[2] == "SKIP" && match[6] == " reason=missing"
+	if len(match[7]) > 0 {
+		bytes, err := strconv.ParseInt(strings.TrimPrefix(match[7], " bytes="), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		res.Bytes = bytes
+	}
+	res.Reused = len(match[8]) > 0
+	if len(match[9]) > 0 {
+		index, err := strconv.Atoi(strings.TrimPrefix(match[9], " matrix="))
+		if err != nil {
+			return nil, err
+		}
+		if index < 1 || index > len(matrix) {
+			return nil, fmt.Errorf("Unknown matrix entry index: %d", index)
+		}
+		res.Matrix = matrix[index-1]
+	}
+	res.Diverged = len(match[10]) > 0
+	if len(match[11]) > 0 {
+		attempts, err := parseAttempts(match[11])
+		if err != nil {
+			return nil, err
+		}
+		res.Attempts = attempts
+	}
+	res.TimedOut = len(match[12]) > 0
+	return res, nil
+}
+
+// Colored verdict of a step for console output.
+func formatStepVerdict(step StepResult) string {
+	details := ""
+	if step.Name == kSizeStepName && step.Bytes > 0 {
+		details = fmt.Sprintf(" (%s)", formatBytes(step.Bytes))
+	}
+	if step.Reused {
+		details += " (reused)"
+	}
+	if passed, total := step.attemptsPassed(); len(step.Attempts) > 0 {
+		details += fmt.Sprintf(" (%d/%d attempts passed)", passed, total)
+	}
+	if step.Pass {
+		return fmt.Sprintf("%s%sPASS%s%s", kFontBold, kColorGreen, kConsoleReset, details)
+	} else if step.SkippedByPaths {
+		return fmt.Sprintf("%s%sSKIP%s (no matching changes)", kFontBold, kColorGray, kConsoleReset)
+	} else if step.SkippedByWorkdir {
+		return fmt.Sprintf("%s%sSKIP%s (no step dir)", kFontBold, kColorGray, kConsoleReset)
+	} else if step.SkippedByCondition {
+		return fmt.Sprintf("%s%sSKIP%s (condition)", kFontBold, kColorGray, kConsoleReset)
+	} else if step.ArtifactMissing {
+		return fmt.Sprintf("%s%sSKIP%s (size path missing)", kFontBold, kColorGray, kConsoleReset)
+	} else if step.Diverged {
+		return fmt.Sprintf("%s%sFAIL%s (output differs from the baseline)", kFontBold, kColorRed, kConsoleReset)
+	} else if step.TimedOut && step.ExitStatus == kBisectSkipCode {
+		return fmt.Sprintf("%s%sSKIP%s (timed out)%s", kFontBold, kColorGray, kConsoleReset, details)
+	} else if step.TimedOut {
+		return fmt.Sprintf("%s%sFAIL%s (timed out)%s", kFontBold, kColorRed, kConsoleReset, details)
+	} else if step.ExitStatus == kBisectSkipCode {
+		return fmt.Sprintf("%s%sSKIP%s%s", kFontBold, kColorGray, kConsoleReset, details)
+	}
+	var crash_details []string
+	if len(step.Signal) > 0 {
+		crash_details = append(crash_details, step.Signal)
+	}
+	if step.CoreCollected {
+		crash_details = append(crash_details, "core collected")
+	}
+	if len(crash_details) > 0 {
+		return fmt.Sprintf("%s%sFAIL%s (%s)%s", kFontBold, kColorRed, kConsoleReset,
+			strings.Join(crash_details, ", "), details)
+	}
+	return fmt.Sprintf("%s%sFAIL%s%s", kFontBold, kColorRed, kConsoleReset, details)
+}
+
+// Plain verdict of a step, used for machine readable output.
+func stepVerdict(step StepResult) string {
+	if step.Pass {
+		return "PASS"
+	} else if step.SkippedByPaths {
+		return "SKIP-PATHS"
+	} else if step.SkippedByWorkdir {
+		return "SKIP-WORKDIR"
+	} else if step.SkippedByCondition {
+		return "SKIP-CONDITION"
+	} else if step.ArtifactMissing {
+		return "SKIP-MISSING"
+	} else if step.ExitStatus == kBisectSkipCode {
+		return "SKIP"
+	}
+	return "FAIL"
+}
+
+// The cache directory, repo copy and scripts prepared for executing steps
+// over the commits of a repo.
+type RunSetup struct {
+	Repo *RepoInfo
+	// Runs the commands of the run, recording them instead in a dry run.
+	Runner       CommandRunner
+	CacheDir     string
+	CacheRepo    string
+	StepCacheDir string
+	// The script running every step for the checked out commit. Its exit
+	// status follows the `git bisect run` conventions. It must be passed
+	// WrapperArgs.
+	WrapperPath string
+	WrapperArgs []string
+	// The command `git bisect run` runs, passed WrapperArgs: WrapperPath,
+	// or in kModeFix a script inverting its verdicts for the commits whose
+	// steps pass to be the new ones. Unless the steps share the process group
+	// of xbisect, it is started by step-exec, in a process group of its own
+	// killed once the steps of the commit ran.
+	BisectRunCommand []string
+	Metadata         RunMetadata
+	State            *RunState
+
+	// What the wrapper script was generated from, for running the steps
+	// natively instead.
+	ScriptPath     string
+	Steps          []string
+	StepStdin      map[string]string
+	StepPaths      map[string][]string
+	StepWorkdirs   map[string]string
+	StepConditions map[string][]StepCondition
+	// Nil unless the steps run on a pseudo-terminal.
+	Pty *PtySize
+	// Whether the steps run in the process group of xbisect.
+	SharedProcessGroup bool
+	// Nil unless the size of a path is checked after the steps.
+	Size *SizeCheck
+	// Nil unless the output of a step is compared to a baseline.
+	Baseline *BaselineCheck
+	// Nil unless commits are excluded with --merges-only or --no-merges.
+	Filter *CommitFilter
+	// Where the step results are recorded and reused from. Empty unless
+	// they are.
+	ResultsDir   string
+	Matrix       [][][2]string
+	CorePatterns []string
+	// The env the steps are started with.
+	StepEnv []string
+
+	cleanups []func()
+}
+
+// Records the process group of the steps started by cmd in the state of the
+// run, for kill --force to kill them along with xbisect.
+func (r *RunSetup) trackProcessGroup(cmd *exec.Cmd) {
+	if r.State == nil || r.SharedProcessGroup || cmd.Process == nil {
+		return
+	}
+	r.State.StepsPgid = cmd.Process.Pid
+	if err := r.State.Save(r.CacheDir); err != nil {
+		gLogger.Printf("Failed to save run state: %v\n", err)
+	}
+}
+
+// Runs the cleanups and records the final status of the run.
+func (r *RunSetup) Cleanup(success bool) {
+	for i := len(r.cleanups) - 1; i >= 0; i-- {
+		r.cleanups[i]()
+	}
+	if r.State == nil {
+		return
+	}
+	if gInterrupted.Load() {
+		r.State.Status = kRunStatusAborted
+	} else if success {
+		r.State.Status = kRunStatusFinished
+	} else {
+		r.State.Status = kRunStatusFailed
+	}
+	if err := r.State.Save(r.CacheDir); err != nil {
+		gLogger.Printf("Failed to save run state: %v\n", err)
+	}
+}
+
+// Validates the options, creates the run's cache directory, copies the repo
+// into it and generates the scripts executing the steps.
+// The caller must call Cleanup() on the returned setup.
+func SetupRun(runner CommandRunner, opts RunOptions) (*RunSetup, error) {
+	reponame, lo, hi, steps := opts.Repo, opts.Lo, opts.Hi, opts.Steps
+	setup := &RunSetup{Runner: runner}
+	var script string
+	var err error
+	// Before the first git command of the run.
+	if err = setGitConfigOverrides(opts.GitConfig); err != nil {
+		return setup, err
+	}
+	// Without one, the script is read once the repo config of hi is.
+	if hasStepScript(opts) || opts.NoRepoConfig {
+		if script, err = loadStepScript(opts); err != nil {
+			return setup, err
+		}
+	}
+	sources := 0
+	for _, source := range []string{reponame, opts.Path, opts.Git} {
+		if len(source) > 0 {
+			sources += 1
+		}
+	}
+	if sources > 1 {
+		return setup, errors.New("--repo, --path and --git are mutually exclusive.")
+	}
+	if opts.InPlace && len(opts.Path) == 0 {
+		return setup, errors.New("--in-place requires --path.")
+	}
+	if opts.Update && len(reponame) == 0 {
+		return setup, errors.New("--update requires --repo, only imported repos are updated.")
+	}
+	var repo *RepoInfo
+	// Prefix of the cache dir name.
+	cache_prefix := reponame
+	if len(opts.Path) > 0 {
+		toplevel, err := resolveRepoPath(runner, opts.Path)
+		if err != nil {
+			gLogger.Printf("Error: %v\n", err)
+			return setup, fmt.Errorf("Invalid --path: %w", err)
+		}
+		// Not added to the config: the repo is only known to this run.
+		repo = &RepoInfo{LocalPath: toplevel}
+		cache_prefix = gNonAlphanumericRe.ReplaceAllString(path.Base(toplevel), "_")
+	} else if len(opts.Git) > 0 {
+		var err error
+		if repo, err = prepareAnonymousClone(runner, opts.Git); err != nil {
+			gLogger.Printf("Error: %v\n", err)
+			return setup, fmt.Errorf("Failed to prepare the clone of %s: %w", opts.Git, err)
+		}
+		cache_prefix = anonymousCloneName(opts.Git)
+	} else {
+		if len(reponame) == 0 {
+			return setup, errors.New("One of --repo, --path or --git is required.")
+		}
+		repo = gConfig.GetRepo(reponame)
+		if repo == nil {
+			return setup, repoNotFoundError(reponame)
+		}
+		// Whatever the case of --repo, runs of a repo share their cache
+		// dirs and report it by its name.
+		cache_prefix = repo.Name
+		reponame = repo.Label()
+		if opts.Update {
+			if repo.IsLocalDir() {
+				ConsoleLogInfo("Not updating: %s was imported from a local dir, it has no remote", reponame)
+			} else if err = updateRepo(runner, repo); err != nil {
+				ConsoleLogErr(err)
+			}
+		}
+	}
+	setup.Repo = repo
+	features, err := gitFeatures()
+	if err != nil {
+		gLogger.Printf("Error: %v\n", err)
+		return setup, wrapError(err, "Failed to detect the installed git version.")
+	}
+	gLogger.Printf("Run with %s (%s)\n", features.Version.Raw, gGitPath)
+	required := []GitFeature{kGitFeatureBisectNoCheckout}
+	if repo.Mirror {
+		required = append(required, kGitFeatureWorktree)
+	}
+	if opts.FirstParent {
+		required = append(required, kGitFeatureBisectFirstParent)
+	}
+	if err = requireGitVersion(required...); err != nil {
+		return setup, err
+	}
+	var pty_size *PtySize
+	if opts.Pty {
+		if !kPtySupported {
+			return setup, fmt.Errorf("--pty is not supported on %s.", runtime.GOOS)
+		}
+		size, err := parsePtySize(opts.PtySize)
+		if err != nil {
+			return setup, fmt.Errorf("Invalid --pty-size: %w", err)
+		}
+		pty_size = &size
+	}
+	if opts.Back < 0 {
+		return setup, errors.New("--back must be positive.")
+	}
+	if opts.Back > 0 && len(lo) > 0 {
+		return setup, errors.New("--lo and --back are mutually exclusive.")
+	}
+	if len(opts.SinceTag) > 0 {
+		if len(lo) > 0 || opts.Back > 0 {
+			return setup, errors.New("--since-tag is mutually exclusive with --lo and --back.")
+		}
+		var count int
+		if lo, count, err = resolveTagPattern(runner, repo.LocalPath, opts.SinceTag); err != nil {
+			gLogger.Printf("Error: %v\n", err)
+			return setup, fmt.Errorf("Invalid --since-tag: %w", err)
+		}
+		ConsoleLogInfo("Using lo %s", describeTagMatch(lo, opts.SinceTag, count))
+	}
+	if len(opts.UntilTag) > 0 {
+		if len(hi) > 0 {
+			return setup, errors.New("--hi and --until-tag are mutually exclusive.")
+		}
+		var count int
+		if hi, count, err = resolveTagPattern(runner, repo.LocalPath, opts.UntilTag); err != nil {
+			gLogger.Printf("Error: %v\n", err)
+			return setup, fmt.Errorf("Invalid --until-tag: %w", err)
+		}
+		ConsoleLogInfo("Using hi %s", describeTagMatch(hi, opts.UntilTag, count))
+	}
+	if opts.LastRelease && len(hi) == 0 {
+		hi = "HEAD"
+	}
+	hi_given := len(hi) > 0
+	if !hi_given {
+		var err error
+		if hi, err = defaultHi(runner, repo, len(opts.Path) > 0, opts.Fetch && !opts.Update); err != nil {
+			gLogger.Printf("Error: %v\n", err)
+			return setup, fmt.Errorf("--hi not given and the default branch could not be resolved: %w", err)
+		}
+	}
+	if repo.Shallow && len(opts.Path) == 0 {
+		if err = deepenShallowClone(runner, repo, lo, hi); err != nil {
+			return setup, err
+		}
+	}
+	// Check the range in the source repo, before copying it.
+	for _, rev := range [][2]string{{"--lo", lo}, {"--hi", hi}} {
+		if len(rev[1]) == 0 {
+			continue
+		}
+		if err := verifyCommit(runner, repo.LocalPath, rev[1]); err != nil {
+			return setup, fmt.Errorf("Invalid %s: %w", rev[0], err)
+		}
+	}
+	// Pin hi, which may be a branch moving while the run goes.
+	hi_hash, err := resolveRef(runner, repo.LocalPath, hi)
+	if err != nil {
+		gLogger.Printf("Error: %v\n", err)
+		return setup, wrapError(err, "Failed to resolve --hi: %s", hi)
+	}
+	if !hi_given {
+		ConsoleLogInfo("--hi not given, using the tip of %s: %s", hi, hi_hash)
+	}
+	hi = hi_hash
+	var repo_config *RepoBisectConfig
+	if !opts.NoRepoConfig {
+		if repo_config, err = readRepoConfig(runner, repo.LocalPath, hi); err != nil {
+			return setup, err
+		}
+	}
+	if repo_config != nil {
+		ConsoleLogInfo("Using the %s of %s", kRepoConfigFileName, hi)
+		if err = repo_config.apply(&opts); err != nil {
+			return setup, err
+		}
+		steps = opts.Steps
+	}
+	if len(script) == 0 {
+		if script, err = loadStepScript(opts); err != nil {
+			return setup, err
+		}
+	}
+	// Recorded for the run to be reproduced, when it comes from a file.
+	script_path := ""
+	if len(opts.Cmd) > 0 {
+		gLogger.Printf("Step command: %s\n", opts.Cmd)
+	} else if len(opts.Script) == 0 {
+		if script_path, err = filepath.Abs(opts.ScriptFile); err != nil {
+			script_path = opts.ScriptFile
+		}
+		gLogger.Printf("Step script: %s\n", script_path)
+	}
+	if len(opts.StepsFile) > 0 {
+		if len(steps) > 0 {
+			return setup, errors.New("--steps and --steps-file are mutually exclusive.")
+		}
+		var err error
+		if steps, err = readStepsFile(opts.StepsFile); err != nil {
+			gLogger.Printf("Error: %v\n", err)
+			return setup, fmt.Errorf("Invalid --steps-file: %w", err)
+		}
+	}
+	if len(steps) == 0 && len(opts.Cmd) > 0 {
+		steps = []string{kCmdStepName}
+	}
+	if len(steps) == 0 {
+		return setup, errors.New("No steps provided to execute.")
+	}
+	step_workdirs := map[string]string{}
+	step_names := make([]string, len(steps))
+	for i, spec := range steps {
+		name, workdir, err := parseStepSpec(spec)
+		if err != nil {
+			return setup, err
+		}
+		step_names[i] = name
+		if len(workdir) > 0 {
+			step_workdirs[name] = workdir
+		}
+	}
+	steps = step_names
+	step_conditions, err := parseStepConditions(opts.StepWhen, opts.StepNeeds, steps)
+	if err != nil {
+		return setup, err
+	}
+	if steps, err = orderSteps(steps, step_conditions); err != nil {
+		return setup, err
+	}
+	size_check, err := newSizeCheck(opts, steps)
+	if err != nil {
+		return setup, err
+	}
+	baseline, err := newBaselineCheck(opts, steps)
+	if err != nil {
+		return setup, err
+	}
+	artifacts, err := validateArtifactPaths(opts.Artifacts)
+	if err != nil {
+		return setup, err
+	}
+	if opts.DiffArtifacts && len(artifacts) == 0 {
+		return setup, errors.New("--diff-artifacts requires --artifact.")
+	}
+	attempts, err := newStepAttempts(opts.AttemptsPerCommit, opts.VerdictPolicy)
+	if err != nil {
+		return setup, err
+	}
+	if opts.StepTimeout < 0 {
+		return setup, errors.New("--timeout cannot be negative.")
+	}
+	if opts.StepTimeout > 0 && opts.OnTimeout != kOnTimeoutSkip && opts.OnTimeout != kOnTimeoutFail {
+		return setup, fmt.Errorf("Invalid --on-timeout: %s", opts.OnTimeout)
+	}
+	if opts.Back > 0 {
+		if lo, err = resolveBack(runner, repo.LocalPath, hi, opts.Back); err != nil {
+			gLogger.Printf("Error: %v\n", err)
+			return setup, fmt.Errorf("Invalid --back: %w", err)
+		}
+		ConsoleLogInfo("Using lo %d commits before hi: %s", opts.Back, lo)
+	}
+	last_release := opts.LastRelease && len(lo) == 0 && opts.Back == 0 && len(opts.SinceTag) == 0
+	if last_release {
+		if lo, err = resolveLastRelease(runner, repo.LocalPath, hi); err != nil {
+			return setup, fmt.Errorf("Invalid --last-release: %w", err)
+		}
+		lo_hash, err := resolveRef(runner, repo.LocalPath, lo)
+		if err != nil {
+			gLogger.Printf("Error: %v\n", err)
+			return setup, wrapError(err, "Failed to resolve the last release: %s", lo)
+		}
+		if lo_hash == hi {
+			return setup, fmt.Errorf("Invalid --last-release: hi is the release %s itself, there is nothing to bisect.", lo)
+		}
+		ConsoleLogInfo("Using the last release: lo %s (%s), hi %s", lo, lo_hash, hi)
+	}
+	if (opts.MergesOnly || opts.NoMerges) && len(lo) == 0 {
+		return setup, errors.New("--merges-only and --no-merges require --lo.")
+	}
+	filter, err := newCommitFilter(runner, repo.LocalPath, lo, hi, opts.MergesOnly, opts.NoMerges)
+	if err != nil {
+		gLogger.Printf("Error: %v\n", err)
+		return setup, err
+	}
+	if len(lo) > 0 {
+		warnShallowRange(runner, repo.LocalPath, lo, hi)
+	}
+
+	metadata := RunMetadata{Repo: reponame, Lo: lo, Back: opts.Back, Hi: hi, Steps: steps, Marks: opts.Marks,
+		GitVersion: features.Version.String(), SinceTag: opts.SinceTag, UntilTag: opts.UntilTag, LastRelease: last_release,
+		MergesOnly: opts.MergesOnly, NoMerges: opts.NoMerges, FirstParent: opts.FirstParent, ReuseResults: opts.ReuseResults}
+	if opts.Mode == kModeFix {
+		metadata.Mode = kModeFix
+	}
+	if attempts != nil {
+		metadata.AttemptsPerCommit, metadata.VerdictPolicy = attempts.Count, attempts.Policy
+	}
+	if opts.StepTimeout > 0 {
+		metadata.StepTimeout, metadata.OnTimeout = opts.StepTimeout.String(), opts.OnTimeout
+	}
+	metadata.GitConfig = opts.GitConfig
+	if pty_size != nil {
+		metadata.Pty = pty_size.String()
+	}
+	if baseline != nil {
+		metadata.BaselineStep, metadata.Baseline, metadata.BaselineRev = baseline.Step, opts.Baseline, baseline.Rev
+	}
+	if size_check != nil {
+		metadata.SizeOf, metadata.MaxBytes, metadata.SizeBaseline = size_check.Path, size_check.MaxBytes, size_check.Baseline
+	}
+	if len(opts.Path) > 0 {
+		metadata.Path = repo.LocalPath
+	}
+	metadata.Git = opts.Git
+	metadata.InPlace = opts.InPlace
+	metadata.Script = script_path
+	metadata.Cmd = opts.Cmd
+	metadata.RepoConfig = repo_config != nil
+
+	ignore_patterns, err := readIgnoreFile(repo.LocalPath)
+	if err != nil {
+		gLogger.Printf("Error: %v\n", err)
+		return setup, wrapError(err, "Failed to read the %s of %s", kIgnoreFileName, repo.LocalPath)
+	}
+	metadata.Excludes = append(ignore_patterns, opts.Excludes...)
+	if opts.Copy.Excludes, err = parseExcludePatterns(metadata.Excludes); err != nil {
+		return setup, err
+	}
+
+	// Validate the stdin files up front and pin their content in the run
+	// metadata.
+	step_stdin := map[string]string{}
+	for _, step := range steps {
+		stdin := opts.Stdin
+		if override, ok := opts.StepStdin[step]; ok {
+			stdin = override
+		}
+		if len(stdin) == 0 {
+			continue
+		}
+		abspath, err := resolveStdinFile(stdin)
+		if err != nil {
+			gLogger.Printf("Error: %v\n", err)
+			return setup, wrapError(err, "Invalid stdin file for step %s: %s", step, stdin)
+		}
+		digest, err := sha256File(abspath)
+		if err != nil {
+			gLogger.Printf("Error: %v\n", err)
+			return setup, wrapError(err, "Failed to read stdin file: %s", abspath)
+		}
+		step_stdin[step] = abspath
+		metadata.Stdin = append(metadata.Stdin, StdinInfo{Step: step, Path: abspath, Sha256: digest})
+	}
+	for _, pattern := range opts.CorePatterns {
+		if !gCorePatternRe.MatchString(pattern) {
+			return setup, fmt.Errorf("Invalid core file pattern: %s", pattern)
+		}
+	}
+	for step := range opts.StepStdin {
+		if !slices.Contains(steps, step) {
+			return setup, fmt.Errorf("--step-stdin given for unknown step: %s", step)
+		}
+	}
+	step_paths, err := parseStepPaths(opts.StepPaths, steps)
+	if err != nil {
+		return setup, err
+	}
+	if len(step_paths) > 0 {
+		metadata.StepPaths = step_paths
+	}
+	if len(step_workdirs) > 0 {
+		metadata.StepWorkdirs = step_workdirs
+	}
+	if len(step_conditions) > 0 {
+		metadata.StepConditions = map[string][]string{}
+		for step, conditions := range step_conditions {
+			for _, condition := range conditions {
+				metadata.StepConditions[step] = append(metadata.StepConditions[step], condition.String())
+			}
+		}
+	}
+	var matrix [][][2]string
+	for _, entry := range opts.MatrixEnv {
+		vars, err := parseMatrixEntry(entry)
+		if err != nil {
+			return setup, err
+		}
+		matrix = append(matrix, vars)
+		metadata.Matrix = append(metadata.Matrix, strings.Join(strings.Fields(entry), " "))
+	}
+	if len(matrix) > 0 {
+		if opts.VerdictMatrix != "any" && opts.VerdictMatrix != "all" {
+			return setup, fmt.Errorf("Invalid matrix verdict: %s", opts.VerdictMatrix)
+		}
+		metadata.VerdictMatrix = opts.VerdictMatrix
+	}
+	env_vars, err := stepEnvVars(opts.CleanEnv, opts.Env, opts.EnvPassthrough)
+	if err != nil {
+		return setup, err
+	}
+	metadata.CleanEnv = opts.CleanEnv
+	for _, env := range opts.Env {
+		name, _, _ := strings.Cut(env, "=")
+		metadata.Env = append(metadata.Env, name)
+	}
+	metadata.EnvPassthrough = opts.EnvPassthrough
+	metadata.IsolateHome = opts.IsolateHome
+	for _, name := range opts.EnvPassthrough {
+		registerSecret(os.Getenv(name))
+	}
+
+	if opts.Preview {
+		if err = previewRange(runner, repo.LocalPath, lo, hi); err != nil {
+			gLogger.Printf("Error: %v\n", err)
+			return setup, wrapError(err, "Failed to list the commits between %s and %s", lo, hi)
+		}
+		if isTerminal(os.Stdin) && !confirm("Proceed?") {
+			return setup, wrapError(ErrAborted, "Aborted, nothing was run.")
+		}
+	}
+
+	cache_dir_name := opts.CacheDirName
+	if cache_dir_name == nil {
+		cache_dir_name = randomCacheDirName
+	}
+	cachedir := ""
+	for attempt := 0; ; attempt++ {
+		if attempt == kMaxCacheDirNameAttempts {
+			return setup, fmt.Errorf("Failed to find an unused cache dir name for %s", cache_prefix)
+		}
+		hint_dirname := cache_dir_name(cache_prefix)
+		cachedir = path.Join(GetAppDataDir(), "cache", hint_dirname)
+		gLogger.Printf("Considering cache dir: %s\n", cachedir)
+		if !filepathExists(cachedir) {
+			break
+		}
+	}
+
+	if opts.DryRun {
+		printStepPlan(steps, step_conditions, step_workdirs, step_paths)
+		if len(opts.Copy.Excludes) > 0 && !opts.InPlace && !repo.Mirror {
+			excluded, err := listExcludedPaths(repo.LocalPath, opts.Copy.Excludes)
+			if err != nil {
+				gLogger.Printf("Error: %v\n", err)
+				return setup, wrapError(err, "Failed to list the excluded paths of %s", repo.LocalPath)
+			}
+			ConsoleLogInfo("Paths excluded from the copy: %d", len(excluded))
+			for _, file := range excluded {
+				fmt.Fprintln(gConsoleOutput, "  "+file)
+			}
+		}
+		setup.CacheDir = cachedir
+		setup.CacheRepo = path.Join(cachedir, "_repo")
+		if dry_runner, ok := runner.(*DryRunRunner); ok {
+			if opts.InPlace {
+				setup.CacheRepo = repo.LocalPath
+			} else if repo.Mirror {
+				dry_runner.Record(repo.LocalPath, gGitPath, "worktree", "add", "--detach", setup.CacheRepo, hi)
+			} else {
+				dry_runner.Record("", "cp", "-R", repo.LocalPath, setup.CacheRepo)
+			}
+		}
+		setup.Metadata = metadata
+		setup.WrapperPath = path.Join(cachedir, "_scripts", "bisect_script_wrapper")
+		setup.BisectRunCommand = []string{setup.WrapperPath}
+		setup.WrapperArgs = steps
+		setup.Steps = steps
+		return setup, nil
+	}
+
+	err = os.MkdirAll(cachedir, os.ModePerm)
+	if err != nil {
+		gLogger.Printf("Error: %v\n", err)
+		return setup, wrapError(err, "Failed to create cache dir: %s", cachedir)
+	}
+	setup.CacheDir = cachedir
+	ConsoleLogInfo("Using cache directory for bisect: %s", cachedir)
+	setup.State = NewRunState()
+	if err = setup.State.Save(cachedir); err != nil {
+		gLogger.Printf("Error: %v\n", err)
+		return setup, wrapError(err, "Failed to write run state")
+	}
+	if err = metadata.Save(cachedir); err != nil {
+		gLogger.Printf("Error: %v\n", err)
+		return setup, wrapError(err, "Failed to write run metadata")
+	}
+	setup.Metadata = metadata
+
+	// Scratch space shared by the steps across every commit of this run,
+	// exposed to them as $XBISECT_CACHE_DIR.
+	stepcachedir := path.Join(cachedir, "_step_cache")
+	if err = os.MkdirAll(stepcachedir, os.ModePerm); err != nil {
+		gLogger.Printf("Error: %v\n", err)
+		return setup, wrapError(err, "Failed to create step cache dir: %s", stepcachedir)
+	}
+	setup.StepCacheDir = stepcachedir
+	if opts.IsolateHome {
+		homedir := path.Join(cachedir, "_home")
+		home_vars, err := createIsolatedHome(homedir)
+		if err != nil {
+			gLogger.Printf("Error: %v\n", err)
+			return setup, wrapError(err, "Failed to create the isolated home dir: %s", homedir)
+		}
+		env_vars = withIsolatedHome(env_vars, len(opts.Env), home_vars)
+	}
+
+	cacherepo := path.Join(cachedir, "_repo")
+	if opts.InPlace {
+		cacherepo = repo.LocalPath
+		ConsoleLogInfo("%s%sRunning IN PLACE:%s commits will be checked out in %s", kFontBold, kColorRed, kConsoleReset, cacherepo)
+		err = prepareInPlace(setup, cacherepo, opts.Dirty, opts.CleanWorktree)
+		// Record the state to restore even if preparing failed midway.
+		if err := setup.Metadata.Save(cachedir); err != nil {
+			gLogger.Printf("Error: %v\n", err)
+		}
+		if err != nil {
+			gLogger.Printf("Error: %v\n", err)
+			return setup, err
+		}
+		setup.CacheRepo = cacherepo
+	} else if repo.Mirror {
+		if err = addMirrorWorktree(runner, repo.LocalPath, cacherepo, hi); err != nil {
+			gLogger.Printf("Error: %v\n", err)
+			return setup, wrapError(err, "Failed to create a worktree of the mirror %s", repo.LocalPath)
+		}
+		ConsoleLogInfo("Created a worktree of the mirror: %s", cacherepo)
+		setup.CacheRepo = cacherepo
+	} else {
+		// Copy the repo source to the cache location.
+		size, approximate, err := estimateDirSize(repo.LocalPath, opts.Copy.Excludes)
+		if err != nil {
+			gLogger.Printf("Error: %v\n", err)
+			return setup, wrapError(err, "Failed to read repo: %s", repo.LocalPath)
+		}
+		progress := StartProgress("Copying", size, approximate)
+		stats, err := copyDir(repo.LocalPath, cacherepo, opts.Copy, progress)
+		elapsed, throughput := progress.Finish()
+		if err != nil {
+			gLogger.Printf("Error: %v\n", err)
+			return setup, wrapError(err, "Failed to copy repo to cache location.")
+		}
+		ConsoleLogInfo("Copied repo to cache using %s: %d files, %s in %v (%s)",
+			stats.Strategy(), stats.Files, formatBytes(stats.Bytes), elapsed.Round(time.Millisecond), throughput)
+		if stats.Excluded > 0 {
+			ConsoleLogInfo("Excluded %d paths from the copy, saving %s", stats.Excluded, formatBytes(stats.ExcludedBytes))
+		}
+		setup.CacheRepo = cacherepo
+		if err = repairCacheRepo(runner, cacherepo, hi, opts.CleanWorktree); err != nil {
+			gLogger.Printf("Error: %v\n", err)
+			return setup, fmt.Errorf("Cache repo is not usable: %w", err)
+		}
+	}
+
+	ConsoleLogInfo("Lo: %s", lo)
+	ConsoleLogInfo("Hi: %s", hi)
+
+	// The generated scripts live in the run dir, so that they are kept with
+	// the run and removed along with it.
+	scriptsdir := path.Join(cachedir, "_scripts")
+	if err = os.MkdirAll(scriptsdir, os.ModePerm); err != nil {
+		gLogger.Printf("Error: %v\n", err)
+		return setup, wrapError(err, "Failed to create scripts dir: %s", scriptsdir)
+	}
+
+	if baseline != nil {
+		baseline.File = path.Join(scriptsdir, "baseline")
+		if len(opts.Baseline) > 0 {
+			if err = baseline.saveFrom(opts.Baseline); err != nil {
+				gLogger.Printf("Error: %v\n", err)
+				return setup, wrapError(err, "Failed to copy the baseline %s", opts.Baseline)
+			}
+		}
+	}
+
+	// The copy of the script run for each step, kept with the run.
+	script_file := path.Join(scriptsdir, "bisect_script")
+	results_dir := ""
+	{
+		if err = writeExecutable(script_file, script); err != nil {
+			gLogger.Printf("Error: %v\n", err)
+			return setup, wrapError(err, "Failed to write bisect script")
+		}
+		if opts.ReuseResults {
+			results_dir = stepResultsDir(cache_prefix, script, newStepResultsInputs(&metadata, opts.Env))
+		}
+	}
+
+	{
+		// The step names are passed as arguments to the wrapper rather than
+		// embedded in it, so that they need no quoting. The step at index i
+		// is ${i+1}.
+		step_env_prefix := `env "${XBISECT_STEP_ENV[@]}" `
+		if opts.CleanEnv {
+			step_env_prefix = `env -i "${XBISECT_STEP_ENV[@]}" XBISECT_CACHE_DIR="${XBISECT_CACHE_DIR}" `
+		}
+		// xbisect itself allocates the terminal of --pty and relays its
+		// output, measures the --size-of path and kills the steps running
+		// past --timeout.
+		executable := ""
+		if pty_size != nil || size_check != nil || opts.StepTimeout > 0 {
+			if executable, err = os.Executable(); err != nil {
+				gLogger.Printf("Error: %v\n", err)
+				return setup, wrapError(err, "Failed to locate the %s executable", kApplicationName)
+			}
+		}
+		if pty_size != nil {
+			step_env_prefix = fmt.Sprintf("%s pty-exec --size %s %s", shellQuote(executable), pty_size, step_env_prefix)
+		}
+		if opts.StepTimeout > 0 {
+			step_env_prefix = fmt.Sprintf(`%s step-exec --timeout %s --marker "${STEP_DIR}/timed_out" %s`,
+				shellQuote(executable), opts.StepTimeout, step_env_prefix)
+		}
+		// With conditions, a failing step does not end the sequence: the
+		// steps conditioned on its failure still run, and the others are
+		// reported as skipped.
+		on_failure := "exit $RESULT"
+		if len(step_conditions) > 0 {
+			on_failure = `FAILED_STEPS+=" ${STEP_INDEX}"
+					test -n "${FIRST_FAILURE}" || FIRST_FAILURE=$RESULT`
+		}
+		_wrap_step := func(script_path string, index int, step string) string {
+			stdin_file, ok := step_stdin[step]
+			if !ok {
+				stdin_file = os.DevNull
+			}
+			run_step := fmt.Sprintf(`
+				# Running the script for this step, from its dir.
+				# Also preserve the results of the execution in the cache.
+				(cd %s && %s"${SCRIPT_PATH}" "${STEP_NAME}") < "${STDIN_FILE}" > "${STEP_LOG_FILE}" 2>&1
+				RESULT=$?
+				cat "${STEP_LOG_FILE}"
+				`, shellQuote(path.Join(cacherepo, step_workdirs[step])), step_env_prefix)
+			if opts.StepTimeout > 0 {
+				run_step += stepTimeoutScript(opts.OnTimeout)
+			}
+			if attempts != nil {
+				run_step = attempts.wrapperScript(run_step)
+			}
+			if len(results_dir) > 0 {
+				// Results of interrupted steps are not recorded, nor those
+				// of the steps killed by --timeout, which may not time out
+				// with another one.
+				run_step = fmt.Sprintf(`
+				RESULT_FILE=%s/"${COMMIT_HASH}${XBISECT_MATRIX_DIR}/${STEP_NAME}"
+				REUSED_TAG=
+				if [ -f "${RESULT_FILE}" ]
+				then
+					RESULT=$(cat "${RESULT_FILE}")
+					REUSED_TAG=" reused=1"
+					echo "Reusing the recorded result of step ${STEP_NAME}: ${RESULT}"
+				else
+					%s
+					if [ $RESULT -ne 130 ] && [ $RESULT -ne 143 ] && [ -z "${TIMEOUT_TAG}" ]
+					then
+						mkdir -p "$(dirname "${RESULT_FILE}")" && echo $RESULT > "${RESULT_FILE}"
+					fi
+				fi
+				`, shellQuote(results_dir), run_step)
+			}
+			if baseline != nil && step == baseline.Step {
+				run_step += baseline.wrapperScript()
+			}
+			block := fmt.Sprintf(`
+				CACHE_DIR=%s
+				REPO_DIR=%s
+				STEP_INDEX=%d
+				STEP_NAME="${%d}"
+				SCRIPT_PATH=%s
+				STDIN_FILE=%s
+				GIT=%s
+				export XBISECT_CACHE_DIR=%s
+
+				# Creating the cache directory for this step's execution.
+				# Note: At script entry, cwd=cacherepo.
+				COMMIT_HASH=$("${GIT}" rev-parse HEAD)
+				STEP_DIR="${CACHE_DIR}/_run/${COMMIT_HASH}${XBISECT_MATRIX_DIR}/${STEP_NAME}"
+				echo "Step Dir: ${STEP_DIR}"
+				mkdir -p "${STEP_DIR}"
+
+				STEP_LOG_FILE="${STEP_DIR}/log.txt"
+				BASELINE_TAG=
+				ATTEMPTS_TAG=
+				TIMEOUT_TAG=
+
+				%s
+
+				# Checking ther results of the step's execution
+				if [ $RESULT -eq 0 ]
+				then
+					echo "xbisect step=\"${STEP_NAME}\" PASS${REUSED_TAG}${XBISECT_MATRIX_TAG}${ATTEMPTS_TAG}${TIMEOUT_TAG}"
+					declare "STEP_RESULT_${STEP_INDEX}=pass"
+				else
+					# Collect crash evidence into the step's directory.
+					CRASH_INFO=""
+					CRASH_DIR="${STEP_DIR}/crash"
+					mkdir -p "${CRASH_DIR}"
+					if [ $RESULT -gt 128 ]
+					then
+						CRASH_INFO=" sig=$(kill -l $((RESULT - 128)) 2>/dev/null)"
+						dmesg 2>/dev/null | tail -n 50 > "${CRASH_DIR}/dmesg.txt"
+						test -s "${CRASH_DIR}/dmesg.txt" || rm -f "${CRASH_DIR}/dmesg.txt"
+					fi
+					CORES=0
+					for CORE_FILE in %s
+					do
+						if [ -f "${CORE_FILE}" ] && mv "${CORE_FILE}" "${CRASH_DIR}/"
+						then
+							CORES=$((CORES + 1))
+						fi
+					done
+					# Sanitizer reports written to log_path=<prefix>.<pid>
+					for SAN_OPTIONS in "${ASAN_OPTIONS}" "${UBSAN_OPTIONS}" "${MSAN_OPTIONS}" "${TSAN_OPTIONS}"
+					do
+						SAN_LOG_PATH=$(echo "${SAN_OPTIONS}" | tr ':' '\n' | sed -n 's/^log_path=//p' | tail -n 1)
+						test -n "${SAN_LOG_PATH}" || continue
+						for SAN_LOG in "${SAN_LOG_PATH}".*
+						do
+							test -f "${SAN_LOG}" && mv "${SAN_LOG}" "${CRASH_DIR}/"
+						done
+					done
+					if [ $CORES -gt 0 ]
+					then
+						CRASH_INFO="${CRASH_INFO} core=1"
+					fi
+					rmdir "${CRASH_DIR}" 2>/dev/null
+
+					echo "xbisect step=\"${STEP_NAME}\" FAIL res=${RESULT}${CRASH_INFO}${REUSED_TAG}${XBISECT_MATRIX_TAG}${BASELINE_TAG}${ATTEMPTS_TAG}${TIMEOUT_TAG}"
+					declare "STEP_RESULT_${STEP_INDEX}=fail"
+					# git bisect run aborts on the statuses from 128, which
+					# those of the steps killed by a signal are. A crash is
+					# a failure, only the interrupts stop the bisect.
+					if [ $RESULT -ge 128 ] && [ $RESULT -ne 130 ] && [ $RESULT -ne 143 ] && [ $RESULT -ne %d ]
+					then
+						RESULT=1
+					fi
+					%s
+				fi
+			`, shellQuote(cachedir), shellQuote(cacherepo), index+1, index+1, shellQuote(script_path),
+				shellQuote(stdin_file), shellQuote(gGitPath), shellQuote(stepcachedir), run_step,
+				strings.Join(opts.CorePatterns, " "), kBisectAbortCode, on_failure)
+			if workdir, ok := step_workdirs[step]; ok {
+				// The dir may not exist yet, or anymore, in the commit.
+				block = fmt.Sprintf(`
+			if [ -d %s ]
+			then
+				%s
+			else
+				echo "xbisect step=\"${%d}\" SKIP reason=workdir${XBISECT_MATRIX_TAG}"
+				STEPS_SKIPPED=1
+			fi
+			`, shellQuote(workdir), block, index+1)
+			}
+			if patterns, ok := step_paths[step]; ok {
+				quoted_patterns := make([]string, len(patterns))
+				for i, pattern := range patterns {
+					quoted_patterns[i] = shellQuote(pattern)
+				}
+				block = fmt.Sprintf(`
+			if xbisect_paths_match %s
+			then
+				%s
+			else
+				echo "xbisect step=\"${%d}\" SKIP reason=paths${XBISECT_MATRIX_TAG}"
+				STEPS_SKIPPED=1
+			fi
+			`, strings.Join(quoted_patterns, " "), block, index+1)
+			}
+			if len(step_conditions) == 0 {
+				return block
+			}
+			return fmt.Sprintf(`
+			if %s
+			then
+				%s
+			else
+				echo "xbisect step=\"${%d}\" SKIP reason=condition${XBISECT_MATRIX_TAG}"
+			fi
+			`, stepConditionsShell(step_conditions[step], steps), block, index+1)
+		}
+
+		// Create a script that will run the main script for each step provided
+		// by the caller.
+		wrapper_script_file := path.Join(scriptsdir, "bisect_script_wrapper")
+		filter_script := ""
+		if filter != nil {
+			if err = filter.save(path.Join(scriptsdir, "excluded_commits")); err != nil {
+				gLogger.Printf("Error: %v\n", err)
+				return setup, wrapError(err, "Failed to write the excluded commits")
+			}
+			filter_script = filter.wrapperScript()
+		}
+		wrapper_script := "#!/bin/bash\n"
+		wrapper_script += fmt.Sprintf(`
+			GIT=%s
+
+			# The bisect is started with --no-checkout, so the commit to test
+			# is BISECT_HEAD and checking it out is up to us. This lets a commit
+			# that cannot be checked out be skipped instead of aborting the
+			# whole bisect.
+			if "${GIT}" rev-parse --quiet --verify BISECT_HEAD > /dev/null
+			then
+				BISECT_COMMIT=$("${GIT}" rev-parse BISECT_HEAD)
+				echo "xbisect commit=${BISECT_COMMIT}"
+				%s
+				# git reports the objects it cannot read, but still succeeds
+				# without their files.
+				if ! CHECKOUT_ERROR=$("${GIT}" checkout --quiet --detach BISECT_HEAD 2>&1) ||
+					echo "${CHECKOUT_ERROR}" | grep -q -E %[5]s
+				then
+					echo "${CHECKOUT_ERROR}"
+					# git sets core.ignorecase when the filesystem is
+					# case-insensitive, where paths differing only by case
+					# overwrite each other.
+					if [ "$("${GIT}" config --bool core.ignorecase)" = "true" ] &&
+						echo "${CHECKOUT_ERROR}" | grep -q -E %[3]s
+					then
+						echo "xbisect checkout-failed commit=${BISECT_COMMIT} reason=case-collision"
+						exit %[4]d
+					fi
+					# Only the errors due to the commit skip it. The others,
+					# e.g. local changes in the repo, would fail the checkout
+					# of every commit, and stop the bisect.
+					if echo "${CHECKOUT_ERROR}" | grep -q -E %[5]s
+					then
+						echo "xbisect checkout-failed commit=${BISECT_COMMIT}"
+						exit %[4]d
+					fi
+					echo "xbisect checkout-failed commit=${BISECT_COMMIT} reason=repo"
+					exit %[6]d
+				fi
+			else
+				echo "xbisect commit=$("${GIT}" rev-parse HEAD)"
+			fi
+			XBISECT_MATRIX_TAG=
+			XBISECT_MATRIX_DIR=
+		`, shellQuote(gGitPath), filter_script, shellQuote(gCaseCollisionRe.String()), kBisectSkipCode,
+			shellQuote(gCommitCheckoutErrorRe.String()), kBisectAbortCode)
+		if len(artifacts) > 0 {
+			wrapper_script += artifactsWrapperScript(cachedir, artifacts)
+		}
+		// The args of env starting the steps. With --clean-env, the whole
+		// env of the steps. Otherwise, what restores the env of the user
+		// that the wrapper was started without (see gitEnv), followed by the
+		// --env vars. Matrix entries add their vars to it.
+		wrapper_script += "\nXBISECT_STEP_ENV=(\n"
+		if !opts.CleanEnv {
+			for _, arg := range stepEnvRestoreArgs() {
+				wrapper_script += shellQuote(arg) + "\n"
+			}
+		}
+		for _, v := range env_vars {
+			wrapper_script += shellQuote(v[0]+"="+v[1]) + "\n"
+		}
+		wrapper_script += ")\n"
+		if len(step_paths) > 0 {
+			wrapper_script += `
+			# Files changed by the commit, compared to its first parent. The
+			# root commit has no parent, so every path is considered changed.
+			CHANGED_FILES=$("${GIT}" -c core.quotePath=false diff --name-only HEAD^ HEAD 2>/dev/null) || CHANGED_FILES_UNKNOWN=1
+
+			# Succeeds if a changed file matches one of the glob patterns
+			# given as arguments. The patterns are left unquoted in [[ ]]
+			# for them to be matched as globs.
+			xbisect_paths_match() {
+				test -n "${CHANGED_FILES_UNKNOWN}" && return 0
+				local FILE PATTERN
+				while IFS= read -r FILE
+				do
+					for PATTERN in "$@"
+					do
+						[[ "${FILE}" == ${PATTERN} ]] && return 0
+					done
+				done <<< "${CHANGED_FILES}"
+				return 1
+			}
+			`
+		}
+		wrapper_script += "\nSTEPS_SKIPPED=\n"
+		if len(step_conditions) > 0 {
+			wrapper_script += `
+			FAILED_STEPS=
+			FIRST_FAILURE=
+
+			# Succeeds if no step failed but those whose indexes are given as
+			# arguments.
+			xbisect_only_failed() {
+				local INDEX
+				for INDEX in ${FAILED_STEPS}
+				do
+					[[ " $* " == *" ${INDEX} "* ]] || return 1
+				done
+				return 0
+			}
+			`
+		}
+		steps_script := ""
+		for i, step := range steps {
+			steps_script += _wrap_step(script_file, i, step) // fmt.Sprintf("%s %s\n", script_file, step)
+		}
+		if len(step_conditions) > 0 {
+			steps_script += `
+			test -z "${FIRST_FAILURE}" || exit ${FIRST_FAILURE}
+			`
+		}
+		if len(step_paths) > 0 || len(step_workdirs) > 0 {
+			// A commit changing none of the paths of a step behaves like its
+			// parent for that step, whose verdict is unknown here. Neither
+			// can a step be judged on a commit lacking its dir.
+			steps_script += fmt.Sprintf(`
+			test -z "${STEPS_SKIPPED}" || exit %d
+			`, kBisectSkipCode)
+		}
+		if size_check != nil {
+			// Only measured once every step passed, the path being
+			// usually built by them.
+			size_check.MaxBytesFile = path.Join(scriptsdir, "size_max")
+			if size_check.MaxBytes > 0 {
+				if err = size_check.saveMaxBytes(); err != nil {
+					gLogger.Printf("Error: %v\n", err)
+					return setup, wrapError(err, "Failed to write the size limit")
+				}
+			}
+			steps_script += size_check.wrapperScript(executable, cacherepo)
+		}
+		if len(matrix) == 0 {
+			wrapper_script += steps_script
+		} else {
+			// Run the steps in a subshell per matrix entry, so that the env
+			// of an entry does not leak into the next and a failing step
+			// only ends its entry.
+			wrapper_script += "\nMATRIX_RESULTS=()\n"
+			for i, vars := range matrix {
+				exports := ""
+				for _, v := range vars {
+					exports += fmt.Sprintf("export %s=%s\n", v[0], shellQuote(v[1]))
+					exports += fmt.Sprintf("XBISECT_STEP_ENV+=(%s)\n", shellQuote(v[0]+"="+v[1]))
+				}
+				wrapper_script += fmt.Sprintf(`
+			(
+				XBISECT_MATRIX_TAG=" matrix=%d"
+				XBISECT_MATRIX_DIR="/matrix-%d"
+				%s
+				%s
+			)
+			MATRIX_RESULTS+=($?)
+			`, i+1, i+1, exports, steps_script)
+			}
+			wrapper_script += fmt.Sprintf(`
+			PASSED=0
+			FAILED=0
+			FIRST_FAILURE=0
+			for RESULT in "${MATRIX_RESULTS[@]}"
+			do
+				if [ $RESULT -eq 0 ]
+				then
+					PASSED=$((PASSED + 1))
+				elif [ $RESULT -ne %d ]
+				then
+					FAILED=$((FAILED + 1))
+					test $FIRST_FAILURE -ne 0 || FIRST_FAILURE=$RESULT
+				fi
+			done
+			`, kBisectSkipCode)
+			if opts.VerdictMatrix == "all" {
+				wrapper_script += fmt.Sprintf(`
+			test $FAILED -eq ${#MATRIX_RESULTS[@]} && exit $FIRST_FAILURE
+			test $PASSED -gt 0 && exit 0
+			exit %d
+			`, kBisectSkipCode)
+			} else {
+				wrapper_script += fmt.Sprintf(`
+			test $FAILED -gt 0 && exit $FIRST_FAILURE
+			test $PASSED -eq ${#MATRIX_RESULTS[@]} && exit 0
+			exit %d
+			`, kBisectSkipCode)
+			}
+		}
+		gLogger.Printf("Wrapper Script:\n%s\n", wrapper_script)
+		if err = writeExecutable(wrapper_script_file, wrapper_script); err != nil {
+			gLogger.Printf("Error: %v\n", err)
+			return setup, wrapError(err, "Failed to create wrapper script")
+		}
+		setup.WrapperPath = wrapper_script_file
+		setup.WrapperArgs = steps
+		bisect_run_path := wrapper_script_file
+		if opts.Mode == kModeFix {
+			// Skips and the exit statuses aborting the bisect are kept.
+			invert_script := "#!/bin/bash\n" + fmt.Sprintf(`
+			%s "$@"
+			RESULT=$?
+			test $RESULT -eq 0 && exit 1
+			test $RESULT -eq %d -o $RESULT -ge 128 && exit $RESULT
+			exit 0
+			`, shellQuote(wrapper_script_file), kBisectSkipCode)
+			bisect_run_path = path.Join(scriptsdir, "bisect_fix_wrapper")
+			if err = writeExecutable(bisect_run_path, invert_script); err != nil {
+				gLogger.Printf("Error: %v\n", err)
+				return setup, wrapError(err, "Failed to create the --mode fix wrapper script")
+			}
+		}
+		setup.BisectRunCommand = []string{bisect_run_path}
+		if !opts.SharedProcessGroup {
+			if executable, err = os.Executable(); err != nil {
+				gLogger.Printf("Error: %v\n", err)
+				return setup, wrapError(err, "Failed to locate the %s executable", kApplicationName)
+			}
+			setup.BisectRunCommand = []string{executable, "step-exec", "--pgid-file",
+				path.Join(cachedir, kCommitPgidFilename), bisect_run_path}
+		}
+		setup.ScriptPath = script_file
+		setup.Steps = steps
+		setup.StepStdin = step_stdin
+		setup.StepPaths = step_paths
+		setup.StepWorkdirs = step_workdirs
+		setup.StepConditions = step_conditions
+		setup.Pty = pty_size
+		setup.SharedProcessGroup = opts.SharedProcessGroup
+		setup.Size = size_check
+		setup.Baseline = baseline
+		setup.Filter = filter
+		setup.ResultsDir = results_dir
+		setup.Matrix = matrix
+		setup.CorePatterns = opts.CorePatterns
+		if !opts.CleanEnv {
+			setup.StepEnv = os.Environ()
+		}
+		for _, v := range env_vars {
+			setup.StepEnv = append(setup.StepEnv, v[0]+"="+v[1])
+		}
+	}
+	if size_check != nil && len(size_check.Baseline) > 0 {
+		if err = size_check.measureBaseline(setup); err != nil {
+			return setup, err
+		}
+		setup.Metadata.MaxBytes = size_check.MaxBytes
+		if err = setup.Metadata.Save(cachedir); err != nil {
+			gLogger.Printf("Error: %v\n", err)
+			return setup, wrapError(err, "Failed to write run metadata")
+		}
+	}
+	if baseline != nil && len(baseline.Rev) > 0 {
+		if err = baseline.capture(setup); err != nil {
+			return setup, err
+		}
+	}
+	return setup, nil
+}
+
+// Bisects the range of opts. Returns the first bad commit, or the first fixed
+// one with kModeFix, empty when the bisect did not find it.
+func RunBisect(runner CommandRunner, opts RunOptions) (string, error) {
+	var report *BisectReport
+	on_report := opts.OnReport
+	opts.OnReport = func(r *BisectReport) {
+		report = r
+		if on_report != nil {
+			on_report(r)
+		}
+	}
+	err := runBisect(runner, opts)
+	if report == nil {
+		return "", err
+	}
+	return report.Culprit, err
+}
+
+// Starts a bisect of lo..hi in the repo at dir, replacing the one in
+// progress if any. The commits are checked out by the wrapper, not by git.
+func startBisect(runner CommandRunner, dir, lo, hi string, first_parent bool) error {
+	start_command := []string{gGitPath, "bisect", "start", "--no-checkout"}
+	if first_parent {
+		start_command = append(start_command, "--first-parent")
+	}
+	command_sequence := [][]string{
+		// Ensure that no bisect is running. This will do nothing if
+		// it is not in bisect mode.
+		{gGitPath, "bisect", "reset"},
+		start_command,
+		// lo is in the old state and hi in the new one whatever the mode,
+		// the fix wrapper makes the commits whose steps pass the bad ones
+		// for git in kModeFix.
+		{gGitPath, "bisect", "good", lo},
+		{gGitPath, "bisect", "bad", hi},
+	}
+	for _, cmd := range command_sequence {
+		if err := runCommandDir(runner, dir, cmd...); err != nil {
+			gLogger.Printf("Error: %v\n", err)
+			return wrapError(err, "Error setting up bisect state.")
+		}
+	}
+	return nil
+}
+
+// The commits tested and the outcome of a git bisect run, scanned from its
+// output.
+type bisectScan struct {
+	// The commits in the order they were tested.
+	Commits []CommitResult
+	Culprit string
+	// The commits that may be the first bad one, set when only skipped
+	// commits are left.
+	Candidates []string
+	// The commit whose checkout failed for a reason not due to it,
+	// stopping the bisect.
+	CheckoutAborted string
+}
+
+// Scans the output of git bisect run for the commits it tests, the results of
+// the steps on each and the culprit, logging the skipped commits and the
+// steps that timed out to the console as it goes.
+func scanBisectOutput(r io.Reader, matrix []string, step_timeout time.Duration) (*bisectScan, error) {
+	hashLineRe := regexp.MustCompile(`^\[(.*)\] .*$`)
+
+	scanner := bufio.NewScanner(r)
+	var lines_until_hash int64 = 0
+
+	var commit_results map[string]*CommitResult = make(map[string]*CommitResult)
+	// The hashes of commit_results in the order they were tested, for
+	// the report to list them in that order.
+	var tested_order []string
+	var current_result *CommitResult = nil
+	scan := &bisectScan{}
+	// Set once git reports that only skipped commits are left, after
+	// which it lists the commits that may be the first bad one.
+	only_skipped_left := false
+
+	for scanner.Scan() {
+		lines_until_hash -= 1
+
+		line := strings.TrimSpace(scanner.Text())
+		if matches := gBisectingRevisionsLogRe.MatchString(line); matches {
+			lines_until_hash = 1
+		} else if checkout_match := gCheckoutFailedRe.FindStringSubmatch(line); checkout_match != nil && checkout_match[2] == " reason=repo" {
+			// The commit was not tested, and is left out of the report.
+			scan.CheckoutAborted = checkout_match[1]
+			if current_result != nil && current_result.Hash == scan.CheckoutAborted {
+				delete(commit_results, scan.CheckoutAborted)
+				tested_order = tested_order[:len(tested_order)-1]
+				current_result = nil
 			}
-			exit_code, err := strconv.Atoi(res_match[1])
+		} else if checkout_match != nil {
+			case_collision := len(checkout_match[2]) > 0
+			if case_collision {
+				ConsoleLogError("Failed to check out commit %s. %s", checkout_match[1], kCaseCollisionHelp)
+			} else {
+				ConsoleLogError("Failed to check out commit %s, skipping it.", checkout_match[1])
+			}
+			if current_result != nil {
+				current_result.CheckoutFailed = true
+				current_result.CaseCollision = case_collision
+			}
+		} else if excluded_match := gCommitExcludedRe.FindStringSubmatch(line); excluded_match != nil {
+			ConsoleLogInfo("Skipping commit %s, %s", excluded_match[1], describeExclusion(excluded_match[2]))
+			if current_result != nil {
+				current_result.Excluded = excluded_match[2]
+			}
+		} else if res, err := parseStepStatus(line, matrix); res != nil || err != nil {
 			if err != nil {
-				return 0, err
+				gLogger.Printf("Error: %v\n", err)
+				return nil, wrapError(err, "Failed to parse status of bisect step")
+			}
+			if current_result == nil {
+				return nil, errors.New("Found bisect result before hash")
+			}
+			if res.TimedOut {
+				ConsoleLogError("Step %s ran for longer than --timeout %s on %s and was killed", res.Name,
+					step_timeout, current_result.Hash)
+			}
+			current_result.StepResults = append(current_result.StepResults, *res)
+		}
+
+		current_hash_from_line := ""
+		if lines_until_hash == 0 {
+			hashes := hashLineRe.FindStringSubmatch(line)
+			if len(hashes) != 2 {
+				return nil, errors.New("Failed to parse log of git message")
+			}
+			current_hash_from_line = hashes[1]
+		} else if culprit_match := gFirstBadCommitRe.FindStringSubmatch(line); culprit_match != nil {
+			scan.Culprit = culprit_match[1]
+		} else if gOnlySkippedLeftRe.MatchString(line) {
+			only_skipped_left = true
+		} else if candidate_match := gCandidateCommitRe.FindStringSubmatch(line); candidate_match != nil && only_skipped_left {
+			scan.Candidates = append(scan.Candidates, candidate_match[1])
+		} else if commit_match := gCommitMarkerRe.FindStringSubmatch(line); commit_match != nil {
+			// The wrapper announces the commit it tests. This is the only
+			// source for the initial commit, which git does not announce.
+			if current_result == nil || current_result.Hash != commit_match[1] {
+				current_hash_from_line = commit_match[1]
+			}
+		}
+
+		if len(current_hash_from_line) > 0 {
+			if _, has_hash := commit_results[current_hash_from_line]; has_hash {
+				return nil, fmt.Errorf("Detected duplicate commit: %s", current_hash_from_line)
 			}
-			return exit_code, nil
+			current_result = &CommitResult{}
+			current_result.Hash = current_hash_from_line
+			commit_results[current_hash_from_line] = current_result
+			tested_order = append(tested_order, current_hash_from_line)
 		}
+	}
+	for _, hash := range tested_order {
+		scan.Commits = append(scan.Commits, *commit_results[hash])
+	}
+	return scan, nil
+}
 
-		var commit_results map[string]*CommitResult = make(map[string]*CommitResult)
-		var current_result *CommitResult = nil
-		nb_commit_parse_from_current_line := 0
-		nb_commit_parse_from_regex := 0
+func runBisect(runner CommandRunner, opts RunOptions) (err error) {
+	// Validate the template and marks before doing any work.
+	report_template, err := loadReportTemplate(opts.ReportTemplate)
+	if err != nil {
+		gLogger.Printf("Error: %v\n", err)
+		return fmt.Errorf("Invalid report template: %w", err)
+	}
+	if opts.SummaryFormat == kSummaryFormatTree && (len(opts.ReportTemplate) > 0 || opts.FirstBadOnly) {
+		return errors.New("--summary-format tree cannot be combined with --report-template or --bisect-first-bad-only.")
+	}
+	if opts.JsonReport && (len(opts.ReportTemplate) > 0 || opts.FirstBadOnly || opts.SummaryFormat == kSummaryFormatTree) {
+		return errors.New("--format json cannot be combined with --report-template, --bisect-first-bad-only or --summary-format tree.")
+	}
+	marks, err := parseBisectMarks(opts.Marks)
+	if err != nil {
+		return err
+	}
+	notification := &Notification{Repo: opts.Repo, Lo: opts.Lo, Hi: opts.Hi, start: time.Now()}
+	if len(opts.Notify) > 0 {
+		if err = validateNotifyUrl(opts.Notify); err != nil {
+			return fmt.Errorf("Invalid --notify url: %w", err)
+		}
+		// Deferred first to run last, once the run is cleaned up. A failed
+		// notification does not change the result of the bisect.
+		defer func() {
+			if opts.DryRun {
+				return
+			}
+			notification.Success = err == nil
+			if err := sendNotification(opts.Notify, opts.NotifyFormat, notification); err != nil {
+				gLogger.Printf("Error: %v\n", err)
+				ConsoleLogError("Failed to send the notification to %s", opts.Notify)
+			}
+		}()
+	}
+	var share_provider ShareProvider
+	if len(opts.Share) > 0 {
+		if share_provider, err = parseShareProvider(opts.Share); err != nil {
+			return fmt.Errorf("Invalid --share: %w", err)
+		}
+	}
+	if opts.FirstBadOnly {
+		// Only the errors reach the console until the conclusion.
+		gConsoleLogger.SetLevel(charmlog.ErrorLevel)
+		defer gConsoleLogger.SetLevel(charmlog.InfoLevel)
+	}
+	setup, err := SetupRun(runner, opts)
+	defer func() { setup.Cleanup(err == nil) }()
+	if err != nil {
+		return err
+	}
+	if opts.OnSetup != nil {
+		opts.OnSetup(setup)
+	}
+	// Set once the bisect ended, found the first bad commit or not. A failed
+	// upload does not change the result of the bisect.
+	var report *BisectReport
+	defer func() {
+		if opts.OnReport != nil && report != nil {
+			opts.OnReport(report)
+		}
+	}()
+	defer func() {
+		if share_provider == nil || report == nil {
+			return
+		}
+		share_url, err := shareReport(share_provider, setup.CacheDir, report)
+		if err != nil {
+			gLogger.Printf("Error: %v\n", err)
+			ConsoleLogError("Failed to share the report: %v", err)
+			return
+		}
+		ConsoleLogInfo("Shared the report: %s", share_url)
+	}()
+	cacherepo := setup.CacheRepo
+	lo, hi := setup.Metadata.Lo, setup.Metadata.Hi
+	defer func() {
+		if err == nil && opts.ReproArgs != nil && !opts.DryRun {
+			printReproCommand(runner, setup.Repo.LocalPath, opts.ReproArgs, lo, hi)
+		}
+	}()
+	notification.Repo, notification.Lo, notification.Hi = setup.Metadata.RepoLabel(), lo, hi
+	expected_culprit := ""
+	if len(opts.ExpectCulprit) > 0 {
+		if err = checkRevInRange(runner, setup.Repo.LocalPath, opts.ExpectCulprit, lo, hi); err != nil {
+			return fmt.Errorf("Invalid --expect-culprit: %w", err)
+		}
+		if expected_culprit, err = resolveRef(runner, setup.Repo.LocalPath, opts.ExpectCulprit); err != nil {
+			gLogger.Printf("Error: %v\n", err)
+			return wrapError(err, "Failed to resolve --expect-culprit: %s", opts.ExpectCulprit)
+		}
+	}
 
-		for scanner.Scan() {
-			lines_until_hash -= 1
+	for _, mark := range marks {
+		if err = checkRevInRange(runner, setup.Repo.LocalPath, mark.Rev, lo, hi); err != nil {
+			return fmt.Errorf("Invalid mark %s:%s: %w", mark.Term, mark.Rev, err)
+		}
+	}
 
-			line := strings.TrimSpace(scanner.Text())
-			if matches := gBisectingRevisionsLogRe.MatchString(line); matches {
-				lines_until_hash = 1
-			} else if xbisect_status_match := statusMatchRe.FindStringSubmatch(line); xbisect_status_match != nil {
-				gLogger.Printf("xbisect_status_match: len=%d\n", len(xbisect_status_match))
+	if err = startBisect(runner, cacherepo, lo, hi, setup.Metadata.FirstParent); err != nil {
+		return err
+	}
 
-				res := StepResult{}
-				res.Name = xbisect_status_match[1]
-				res.Pass = xbisect_status_match[2] == "PASS"
-				res.ExitStatus, err = _get_exit_status(xbisect_status_match[3])
-				if err != nil {
+	// Narrow the range with the prior knowledge before running the steps.
+	// The marks alone may be enough to find the first bad commit.
+	for _, mark := range marks {
+		out, err := runCommandDirOutput(runner, cacherepo, gGitPath, "bisect", mark.gitTerm(opts.Mode), mark.Rev)
+		if err != nil {
+			gLogger.Printf("Error: %v\n", err)
+			return wrapError(err, "Failed to mark %s as %s", mark.Rev, mark.Term)
+		}
+		for _, line := range strings.Split(string(out), "\n") {
+			if culprit_match := gFirstBadCommitRe.FindStringSubmatch(strings.TrimSpace(line)); culprit_match != nil {
+				notification.Culprit = culprit_match[1]
+				report = &BisectReport{Repo: setup.Metadata.RepoLabel(), Lo: lo, Hi: hi, Culprit: culprit_match[1],
+					CulpritSvnRevision: culpritSvnRevision(runner, setup.Repo, culprit_match[1]), Mode: setup.Metadata.Mode}
+				report.describeCulprit(runner, cacherepo)
+				ConsoleLogInfo("The marks already determine the %s, no step was run: %s%s",
+					strings.ToLower(report.culpritLabel()), culprit_match[1], report.svnSuffix())
+				if len(opts.ReportTemplate) == 0 {
+					report.printCulpritDetails()
+				}
+				report.SetExpectedCulprit(expected_culprit)
+				if opts.JsonReport {
+					if !printJson(report) {
+						return errors.New("Failed to print the report.")
+					}
+				} else if opts.FirstBadOnly {
+					printFirstBadCommit(runner, cacherepo, report)
+				} else if opts.SummaryFormat == kSummaryFormatTree {
+					// All the verdicts are those of the range and the marks.
+					printBisectTree(runner, cacherepo, lo, hi, report.Culprit, setup.Metadata.Mode, len(marks)+2)
+				} else if err = renderReport(report_template, len(opts.ReportTemplate) > 0, report); err != nil {
 					gLogger.Printf("Error: %v\n", err)
-					ConsoleLogError("Failed to parse status of bisect step")
-					scan_succeed = false
-					break
+					return wrapError(err, "Failed to render the report")
 				}
-				if current_result == nil {
-					ConsoleLogError("Found bisect result before hash")
-					scan_succeed = false
-					break
+				runCommandDir(runner, cacherepo, gGitPath, "bisect", "reset")
+				if opts.DiffArtifacts {
+					diffCulpritArtifacts(setup, culprit_match[1])
 				}
-				current_result.StepResults = append(current_result.StepResults, res)
+				return report.ExpectationError()
 			}
+		}
+	}
 
-			current_hash_from_line := ""
-			if lines_until_hash == 0 {
-				hashes := hashLineRe.FindStringSubmatch(line)
-				if len(hashes) != 2 {
-					ConsoleLogError("Failed to parse log of git message")
-					scan_succeed = false
-					break
-				}
-				nb_commit_parse_from_regex += 1
-				current_hash_from_line = hashes[1]
-			} else if line == "Running bisect on current hash" {
-				// NOTE: The log: "Running bisect on current hash" is always logged. If it is the
-				// first log, there is not going to be a preceding line that informs what the
-				// current has his. In this case, the starting hash is pre-parsed, and once
-				// this log is found the very first time, it uses the pre-parsed initial commit
-				// hash.
-				if nb_commit_parse_from_regex == 0 && nb_commit_parse_from_current_line == 0 {
-					current_hash_from_line = initial_commit_hash
-				}
-				nb_commit_parse_from_current_line += 1
-			}
+	if opts.DryRun {
+		if dry_runner, ok := runner.(*DryRunRunner); ok {
+			command := append([]string{gGitPath, "bisect", "run"}, setup.BisectRunCommand...)
+			dry_runner.Record(cacherepo, append(command, setup.WrapperArgs...)...)
+			dry_runner.Record(cacherepo, gGitPath, "bisect", "reset")
+		}
+		return nil
+	}
 
-			if len(current_hash_from_line) > 0 {
-				if _, has_hash := commit_results[current_hash_from_line]; has_hash {
-					ConsoleLogError("Detected duplicate commit: %s", current_hash_from_line)
-					scan_succeed = false
-					break
-				}
-				current_result = &CommitResult{}
-				current_result.Hash = current_hash_from_line
-				commit_results[current_hash_from_line] = current_result
-			}
+	initial_commit_hash, err := resolveRef(runner, cacherepo, "BISECT_HEAD")
+	if err != nil {
+		gLogger.Printf("Error: %v\n", err)
+		return wrapError(err, "Failed to get current commit hash")
+	}
+	gLogger.Printf("Repo initial commit hash: %s\n", initial_commit_hash)
+	// The verdicts given so far are the range and the marks, the others
+	// are those of the steps.
+	marked, err := readBisectLog(runner, cacherepo)
+	if err != nil {
+		gLogger.Printf("Failed to read the bisect log: %v\n", err)
+	}
+	ConsoleLogInfo("Running bisect script")
+	defer func() {
+		gLogger.Println("Resetting git bisect")
+		runCommandDir(runner, cacherepo, gGitPath, "bisect", "reset")
+	}()
+	{
+		args := append(append(gitConfigArgs(), "bisect", "run"), setup.BisectRunCommand...)
+		cmd := exec.CommandContext(gRunContext, gGitPath, append(args, setup.WrapperArgs...)...)
+		// The wrapper restores the env of the user for the steps.
+		cmd.Env = gitEnv()
+		cmd.Dir = cacherepo
+		if !setup.SharedProcessGroup {
+			runInProcessGroup(cmd)
+			defer killProcessGroup(cmd)
+		}
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			gLogger.Printf("Error: %v\n", err)
+			return wrapError(err, "Error occurred setting up git bisect output streaming.")
+		}
+		if err = cmd.Start(); err != nil {
+			gLogger.Printf("Error: %v\n", err)
+			return wrapError(err, "Failed to start git bisect")
 		}
+		setup.trackProcessGroup(cmd)
+
+		// Use a teereader to output to the logfile and also scan the
+		// output. The output is streamed to the log as it is read, rather
+		// than held in memory until the bisect ends, since verbose steps
+		// can output gigabytes over a bisect.
 		gLogger.Printf("BISECT STREAM DUMP START>>>\n")
-		buf.WriteTo(gLogger.Writer())
+		tee := io.TeeReader(stdout, gLogger.Writer())
+
+		scan, scan_err := scanBisectOutput(tee, setup.Metadata.Matrix, opts.StepTimeout)
 		gLogger.Printf("BISECT STREAM DUMP END>>>\n")
-		if !scan_succeed {
-			return false
-		}
-
-		for hash, result := range commit_results {
-			for _, step := range result.StepResults {
-				success_log := func() string {
-					if step.Pass {
-						return fmt.Sprintf("%s%sPASS%s", kFontBold, kColorGreen, kConsoleReset)
-					} else if step.ExitStatus == kBisectSkipCode {
-						return fmt.Sprintf("%s%sSKIP%s", kFontBold, kColorGray, kConsoleReset)
-					} else {
-						return fmt.Sprintf("%s%sFAIL%s", kFontBold, kColorRed, kConsoleReset)
-					}
-				}()
-				step_log := fmt.Sprintf("%s%12s%s", kColorCyan, step.Name, kConsoleReset)
-				ConsoleLogInfo("%s %s %s", hash, step_log, success_log)
+		if scan_err != nil {
+			return scan_err
+		}
+
+		culprit, candidates, checkout_aborted := scan.Culprit, scan.Candidates, scan.CheckoutAborted
+		notification.Culprit = culprit
+		report = &BisectReport{Repo: setup.Metadata.RepoLabel(), Lo: lo, Hi: hi, Culprit: culprit,
+			CulpritSvnRevision: culpritSvnRevision(runner, setup.Repo, culprit), Mode: setup.Metadata.Mode}
+		report.describeCulprit(runner, cacherepo)
+		report.Commits = scan.Commits
+		if len(candidates) > 0 {
+			if report.Candidates, err = describeCandidates(runner, cacherepo, candidates); err != nil {
+				gLogger.Printf("Error: %v\n", err)
+				return wrapError(err, "Failed to describe the candidate commits")
+			}
+		}
+		report.SetExpectedCulprit(expected_culprit)
+		if setup.Baseline != nil && len(culprit) > 0 {
+			for i := range report.Commits {
+				if report.Commits[i].Hash == culprit {
+					setup.Baseline.attachDiffs(setup.CacheDir, setup.Metadata.Matrix, &report.Commits[i])
+				}
+			}
+			defer setup.Baseline.printDiffPaths(setup.CacheDir, setup.Metadata.Matrix, report)
+		}
+		if opts.JsonReport {
+			if !printJson(report) {
+				return errors.New("Failed to print the report.")
+			}
+		} else if opts.FirstBadOnly {
+			if len(culprit) > 0 {
+				printFirstBadCommit(runner, cacherepo, report)
+			}
+		} else if opts.SummaryFormat == kSummaryFormatTree {
+			printBisectTree(runner, cacherepo, lo, hi, culprit, setup.Metadata.Mode, len(marked))
+		} else if err = renderReport(report_template, len(opts.ReportTemplate) > 0, report); err != nil {
+			gLogger.Printf("Error: %v\n", err)
+			return wrapError(err, "Failed to render the report")
+		}
+		if len(culprit) > 0 && len(opts.ReportTemplate) == 0 && !opts.FirstBadOnly {
+			ConsoleLogInfo("%s: %s%s", report.culpritLabel(), culprit, report.svnSuffix())
+			report.printCulpritDetails()
+		}
+		if opts.ReuseResults && len(opts.ReportTemplate) == 0 {
+			printReuseRate(report.Commits)
+		}
+		if setup.Size != nil && len(opts.ReportTemplate) == 0 {
+			if err := printSizeTrend(runner, cacherepo, lo, hi, report.Commits); err != nil {
+				gLogger.Printf("Error: %v\n", err)
+				ConsoleLogError("Failed to list the commits of the size trend")
 			}
 		}
 
-		if err = cmd.Wait(); err != nil {
+		wait_err := cmd.Wait()
+		if !gInterrupted.Load() {
+			if bisect_path, err := captureBisectPath(runner, cacherepo, lo, hi, culprit, setup.Metadata.Mode, len(marked)); err != nil {
+				gLogger.Printf("Error: %v\n", err)
+				ConsoleLogError("Failed to record the bisect path")
+			} else if err = bisect_path.Save(setup.CacheDir); err != nil {
+				gLogger.Printf("Error: %v\n", err)
+				ConsoleLogError("Failed to record the bisect path")
+			} else if len(opts.DotOut) > 0 {
+				if err = writeDot(bisect_path, opts.DotOut); err != nil {
+					gLogger.Printf("Error: %v\n", err)
+					ConsoleLogError("Failed to write the bisect graph to %s", opts.DotOut)
+				}
+			}
+		}
+		if err = wait_err; err != nil {
 			gLogger.Printf("Error: %v\n", err)
-			ConsoleLogError("Failed to run git bisect")
-			return false
+			if gInterrupted.Load() {
+				return wrapError(err, "Bisect aborted")
+			}
+			if len(checkout_aborted) > 0 {
+				return fmt.Errorf("Failed to check out commit %s, for a reason that would fail every commit, "+
+					"e.g. local changes in the cache repo. Bisect aborted, run \"%s logs\" for the git error.",
+					checkout_aborted, kApplicationName)
+			}
+			// git bisect run fails when it cannot bisect further.
+			if len(candidates) == 0 {
+				return wrapError(err, "Failed to run git bisect")
+			}
+		}
+		if len(candidates) > 0 {
+			// The expected culprit may be among the candidates, but that
+			// does not confirm it.
+			if err = report.ExpectationError(); err != nil {
+				return err
+			}
+			return fmt.Errorf("%w: %d candidate commits remain, all skipped", ErrBisectInconclusive, len(candidates))
+		}
+		if err = report.ExpectationError(); err != nil {
+			return err
+		}
+		if len(culprit) == 0 {
+			return ErrBisectInconclusive
+		}
+		if opts.DiffArtifacts {
+			// The wrapper tests BISECT_HEAD while a bisect is in progress.
+			runCommandDir(runner, cacherepo, gGitPath, "bisect", "reset")
+			diffCulpritArtifacts(setup, culprit)
 		}
 	}
-	return true
+	return nil
+}
+
+// Flags shared by the commands executing steps over a range of commits.
+type RunFlags struct {
+	Repo           string            `help:"Run bisect operation for the given project." short:"r" xor:"source"`
+	Path           string            `help:"Path of a git repo to run on without importing it." xor:"source"`
+	Git            string            `help:"URL of a git repo to clone and run on without importing it. The clone is reused by later runs on the same URL." xor:"source"`
+	Lo             string            `help:"Hash of the earlier commit."`
+	Hi             string            `help:"Hash of the later commit. Defaults to the tip of the default branch of the repo, or HEAD with --path."`
+	Fetch          bool              `help:"Fetch origin before resolving the default --hi."`
+	Update         bool              `help:"Fetch the new commits of the imported repo before resolving the range, e.g. for a --hi more recent than the clone. A failing fetch is reported and the clone bisected as it is."`
+	Preview        bool              `help:"Print the commits between lo and hi before starting, and ask for confirmation when interactive."`
+	Back           int               `help:"Set lo to the commit N first-parent commits before hi, instead of --lo." placeholder:"N"`
+	SinceTag       string            `help:"Set lo to the latest tag matching the glob pattern, in version order, instead of --lo." placeholder:"PATTERN"`
+	UntilTag       string            `help:"Set hi to the latest tag matching the glob pattern, in version order, instead of --hi." placeholder:"PATTERN"`
+	LastRelease    bool              `help:"Bisect between the last release and now: lo defaults to the most recent tag reachable from hi, and hi to HEAD."`
+	StepsFile      string            `help:"File listing the steps, one per line, instead of --steps. - reads them from stdin." xor:"steps" placeholder:"FILE"`
+	Steps          []string          `xor:"steps" help:"List of steps in the  bisect script. Each step will be passed to the bisect script as first argument and will record the return value each step as the status of the bisect."`
+	Spec           string            `help:"TOML file declaring the repo, the range and the steps of the bisect, each step with its command. The flags given along with it override its fields. See README." type:"existingfile" placeholder:"FILE"`
+	Script         string            `help:"Script run for each step, with the step name as $1. It is copied into the cache dir of the run." type:"existingfile" xor:"script" placeholder:"FILE"`
+	Cmd            string            `help:"Shell command run for each step instead of --script, with the step name as $1. Without --steps, it is the single step cmd, run from the repo root." xor:"script" placeholder:"COMMAND"`
+	NoRepoConfig   bool              `help:"Do not read the default steps, their commands and --step-paths from the .xbisect.toml of the hi commit."`
+	Stdin          string            `help:"File connected to the stdin of every step." type:"existingfile"`
+	StepStdin      map[string]string `help:"Per-step stdin file (step=file), overriding --stdin."`
+	CorePattern    []string          `help:"Glob patterns of core files, relative to the repo root, collected when a step fails." default:"core,core.*"`
+	CleanEnv       bool              `help:"Start the steps with only PATH, HOME and the vars given with --env and --env-passthrough, instead of the whole env."`
+	Env            []string          `help:"Var set for the steps (NAME=value). Repeatable." sep:"none"`
+	EnvPassthrough []string          `help:"With --clean-env, name of a var of the env passed on to the steps. Repeatable."`
+	IsolateHome    bool              `help:"Point HOME and the XDG base dirs of the steps to a scratch dir in the cache dir of the run, shared across commits, instead of the user's home."`
+	CleanWorktree  bool              `help:"Discard local changes and untracked files copied along with the repo before starting."`
+	InPlace        bool              `help:"Check out the commits directly in the repo given with --path instead of a copy. The original HEAD is restored at the end."`
+	Dirty          string            `help:"With --in-place, what to do with local changes (refuse, stash)." enum:"refuse,stash" default:"refuse"`
+	CopyBuffer     int               `help:"Size in bytes of the buffer used to copy the repo into the cache. 0 lets the kernel copy the files directly when possible." default:"0"`
+	CopyFsync      bool              `help:"Flush every file copied into the cache to disk. Slower, but the copy survives a crash."`
+	Exclude        []string          `help:"Pattern of paths not copied into the cache, with the gitignore syntax, added to those of the .xbisectignore of the repo. Repeatable." sep:"none" placeholder:"PATTERN"`
+	MatrixEnv      []string          `help:"Env set (space separated NAME=value pairs) to run the steps under. Repeat to run the steps once per set on every commit." sep:"none"`
+	VerdictMatrix  string            `help:"Whether any failing env set or all of them failing makes a commit bad (any, all)." enum:"any,all" default:"any"`
+	StepPaths      []string          `help:"Only run a step on the commits changing a file matching the glob pattern (step:pattern). Repeatable. See README for caveats."`
+	StepWhen       []string          `help:"Only run a step when another step passed or failed on the commit (step:other:pass or step:other:fail). Repeatable."`
+	StepNeeds      []string          `help:"Only run a step when another step passed on the commit (step:other), running the other step first. Repeatable."`
+	Timeout        time.Duration     `help:"Kill a step running for longer than this, e.g. 5m, along with the processes it started. The commit is then skipped, or bad with --on-timeout fail. 0 lets the steps run as long as they take." default:"0"`
+	OnTimeout      string            `help:"What a step killed by --timeout makes of the commit (skip, fail)." enum:"skip,fail" default:"skip"`
+	GitConfig      []string          `help:"Git config (KEY=VALUE) passed with -c to every git command of the run, e.g. core.autocrlf=false. Repeatable." sep:"none" placeholder:"KEY=VALUE"`
+	Pty            bool              `help:"Run the steps with their output on a pseudo-terminal, for the tools behaving differently when it is not a terminal."`
+	PtySize        string            `help:"Window size of the --pty terminal." default:"80x24" placeholder:"COLSxROWS"`
+	SizeOf         string            `help:"Once the steps passed, measure the size of this file or dir, relative to the repo root. A commit is bad when it is above --max-bytes or --size-baseline, and skipped when the path is missing." placeholder:"PATH"`
+	MaxBytes       int64             `help:"With --size-of, the size in bytes above which a commit is bad." placeholder:"N"`
+	SizeBaseline   string            `help:"With --size-of, the rev whose size, plus --size-tolerance, a commit must not exceed. Measured by running the steps on it first." placeholder:"REV"`
+	SizeTolerance  string            `help:"With --size-baseline, how much bigger than the baseline a commit can be, in percent (5%) or bytes." default:"0%"`
+	MergesOnly     bool              `help:"Skip the commits that are not merges, to find the merge that brought the regression in." xor:"merges"`
+	NoMerges       bool              `help:"Skip the merge commits, to find the individual commit that introduced the regression." xor:"merges"`
+	FirstParent    bool              `help:"Only bisect the first-parent chain of hi, following merges instead of the commits of the merged branches. Requires git >= 2.29."`
+}
+
+func (f *RunFlags) Options() RunOptions {
+	return RunOptions{
+		Repo:           f.Repo,
+		Path:           f.Path,
+		Git:            f.Git,
+		Lo:             f.Lo,
+		Hi:             f.Hi,
+		Fetch:          f.Fetch,
+		Update:         f.Update,
+		Preview:        f.Preview,
+		Back:           f.Back,
+		SinceTag:       f.SinceTag,
+		LastRelease:    f.LastRelease,
+		UntilTag:       f.UntilTag,
+		Steps:          f.Steps,
+		StepsFile:      f.StepsFile,
+		ScriptFile:     f.Script,
+		Cmd:            f.Cmd,
+		NoRepoConfig:   f.NoRepoConfig,
+		Stdin:          f.Stdin,
+		StepStdin:      f.StepStdin,
+		CorePatterns:   f.CorePattern,
+		CleanWorktree:  f.CleanWorktree,
+		StepPaths:      f.StepPaths,
+		StepWhen:       f.StepWhen,
+		StepNeeds:      f.StepNeeds,
+		Pty:            f.Pty,
+		PtySize:        f.PtySize,
+		MergesOnly:     f.MergesOnly,
+		NoMerges:       f.NoMerges,
+		FirstParent:    f.FirstParent,
+		SizeOf:         f.SizeOf,
+		MaxBytes:       f.MaxBytes,
+		SizeBaseline:   f.SizeBaseline,
+		SizeTolerance:  f.SizeTolerance,
+		MatrixEnv:      f.MatrixEnv,
+		CleanEnv:       f.CleanEnv,
+		Env:            f.Env,
+		EnvPassthrough: f.EnvPassthrough,
+		IsolateHome:    f.IsolateHome,
+		InPlace:        f.InPlace,
+		Copy:           CopyOptions{BufferSize: f.CopyBuffer, Fsync: f.CopyFsync},
+		Excludes:       f.Exclude,
+		Dirty:          f.Dirty,
+		VerdictMatrix:  f.VerdictMatrix,
+		StepTimeout:    f.Timeout,
+		OnTimeout:      f.OnTimeout,
+		GitConfig:      f.GitConfig,
+	}
 }
 
 var cli struct {
-	Verbose bool `cmd:"" help:"Log everything to console." default:"false"`
+	Verbose bool   `cmd:"" help:"Log everything to console." default:"false"`
+	GitPath string `help:"Path to the git executable to use for every git command instead of the one on $PATH." aliases:"git-bin" env:"XBISECT_GIT"`
+	NoColor bool   `help:"Print no colors on the console."`
+	// Set by run --detach on the process it starts.
+	Detached bool `hidden:""`
 
 	Run struct {
-		Repo  string   `help:"Run bisect operation for the given project." short:"r"`
-		Lo    string   `help:"Hash of the earlier commit."`
-		Hi    string   `help:"Hash of the later commit."`
-		Steps []string `help:"List of steps in the  bisect script. Each step will be passed to the bisect script as first argument and will record the return value each step as the status of the bisect."`
+		RunFlags
+		ReportTemplate     string   `help:"Go text/template file used to render the summary. See README for the available fields." type:"existingfile" xor:"summary"`
+		SummaryFormat      string   `help:"How the summary is printed: table lists the steps run on each tested commit, tree how the bisect narrowed the range." enum:"table,tree" default:"table"`
+		BisectFirstBadOnly bool     `help:"Only print the first bad commit, or why it was not found, instead of the steps run on each commit. The details are still logged." xor:"summary"`
+		Format             string   `help:"How the report is printed: text for the colored summary, json for the tested commits and the first bad commit as JSON on stdout, the rest of the output going to stderr. See README for the fields." enum:"text,json" default:"text"`
+		Mark               []string `help:"Commit already known to be good or bad (good:<rev> or bad:<rev>), marked before running the steps. Repeatable." sep:"none"`
+		AttemptsPerCommit  int      `help:"Run each step this many times on every commit, for flaky steps, the verdict being that of --verdict-policy. Each attempt's output is kept in attempt-<n>.txt of the step dir." default:"1" placeholder:"K"`
+		VerdictPolicy      string   `help:"How the attempts of a step make its verdict: any-fail fails it if one attempt fails, all-pass needs the attempts to agree and skips the commit otherwise, majority follows most attempts and skips on a tie." enum:"any-fail,all-pass,majority" default:"majority"`
+		Mode               string   `help:"What the bisect looks for: regression the first commit whose steps fail, fix the first commit whose steps pass, lo failing them." enum:"regression,fix" default:"regression"`
+		Notify             string   `help:"Webhook URL POSTed to when the bisect finishes." placeholder:"URL"`
+		NotifyFormat       string   `help:"Format of the --notify payload (json, slack)." enum:"json,slack" default:"json"`
+		Share              string   `help:"Upload the markdown and JSON reports once the bisect ends and print the URL: gist (a secret gist, using GITHUB_TOKEN) or url=<endpoint> (POSTed as JSON)." placeholder:"TARGET"`
+		MaxParallelRepos   int      `help:"When --repo is a glob matching several imported repos, the number of repos bisected concurrently." default:"1"`
+		ExpectCulprit      string   `help:"Commit the bisect is expected to find as the first bad commit. The run fails if it finds another one, e.g. to validate the steps against a known regression." aliases:"fail-commit" placeholder:"REV"`
+		DryRun             bool     `help:"Validate the options and resolve the range, then print the commands the bisect would run instead of running them."`
+		ReuseResults       bool     `help:"Reuse the step results recorded by warm or earlier runs with --reuse-results on the same repo, script and env, and record the new ones."`
+		DotOut             string   `help:"Write the Graphviz graph of how the bisect narrowed the range to the file once it ended, - for stdout. See results export." placeholder:"FILE"`
+		Baseline           string   `help:"File the output of the --baseline-step must match for a commit to be good, instead of the step passing. See README." type:"existingfile" xor:"baseline" placeholder:"FILE"`
+		BaselineRev        string   `help:"Rev whose output of the --baseline-step is captured before the run as the baseline, e.g. lo." xor:"baseline" placeholder:"REV"`
+		BaselineStep       string   `help:"The step whose output is compared to the baseline. Defaults to the last step." placeholder:"STEP"`
+		Artifact           []string `help:"Path, relative to the repo root, copied into the run dir of each commit once the steps ran on it. Repeatable." sep:"none" placeholder:"PATH"`
+		DiffArtifacts      bool     `help:"Once the first bad commit is found, compare its --artifact paths with those of its parent, running the steps on the parent if it was not tested."`
+		Transcript         string   `help:"Write a plain text transcript of the console output to the file, each line with the time it was printed." placeholder:"FILE"`
+		KeepNCaches        *int     `help:"Keep only the N most recent run caches, pruning the older ones after each successful run. Saved in the config for the later runs, 0 keeps them all." placeholder:"N"`
+		TrapSignalsInSteps bool     `help:"Run the steps in a process group of their own, interrupted as a whole when xbisect is, and whose leftover processes are killed once the steps ran." default:"true" negatable:""`
+		PrintRepro         bool     `help:"Print the command running the same bisect, with the range pinned to commit hashes, once it succeeded. Always printed with --verbose."`
+		Detach             bool     `help:"Run the bisect in a background process, detached from the terminal, and exit once it started. Its output only goes to the log file."`
 	} `cmd:"" help:"Run a bisect operation"`
 
+	Warm struct {
+		Repo   string `help:"The imported repo to warm." short:"r" required:""`
+		Range  string `help:"The range to warm." required:"" placeholder:"LO..HI"`
+		Step   string `help:"The step to run on the candidates." required:""`
+		Script string `help:"Script run for the step, with the step name as $1. Must be the one of the runs reusing the results." type:"existingfile" placeholder:"FILE"`
+		Max    int    `help:"The number of candidates to run the step on, the most likely to be tested by a bisect first." default:"10"`
+	} `cmd:"" help:"Run a step on the commits a bisect of the range is likely to test, recording their results for run --reuse-results."`
+
+	Sweep struct {
+		RunFlags
+		Output     string `help:"Output format (text, csv)." enum:"text,csv" default:"text"`
+		OutputFile string `help:"Write the csv output to this file instead of stdout." short:"o"`
+		Native     bool   `help:"Run the steps directly instead of through the generated shell wrapper."`
+	} `cmd:"" help:"Run the steps on every commit between lo and hi."`
+
 	Import struct {
-		Git  string `help:"Import repo from remote git url"`
-		Name string `help:"The name to reference the repo by"`
+		Git               string   `help:"Import repo from remote git url, or from owner/repo on --host." xor:"source"`
+		Host              string   `help:"The host of the repos given as owner/repo to --git, e.g. gitlab.com." default:"github.com"`
+		Svn               string   `help:"Import repo from remote SVN url, converted to git with git svn." xor:"source,svn"`
+		Path              string   `help:"Import the git repo checked out in the dir as is, without cloning it." xor:"source" type:"path"`
+		Copy              bool     `help:"With --path, import a copy of the dir made in the repos dir instead of the dir itself."`
+		Bundle            string   `help:"Import repo from a git bundle file, made with git bundle create, e.g. for hosts without network access." xor:"source" type:"existingfile"`
+		Archive           string   `help:"Import the repo of a tarball, e.g. a .tar.gz, holding a checkout with its .git. It is extracted into the repos dir." xor:"source" type:"existingfile"`
+		SvnStdlayout      bool     `help:"Convert the trunk, branches and tags of the standard SVN layout rather than the whole repo as one branch." default:"true" negatable:""`
+		SvnRevisions      string   `help:"Range of SVN revisions to convert, e.g. 1000:HEAD. Converting a long history is slow." placeholder:"START:END"`
+		Name              string   `help:"The name to reference the repo by. Defaults to the last component of the --git url, lowercased."`
+		Mirror            bool     `help:"Import a bare mirror clone. Runs check out a worktree of it instead of copying the repo, which is cheaper for repos bisected often." xor:"svn"`
+		Depth             int      `help:"Only clone the last N commits of each branch, for huge repos bisected over their recent history. Runs warn when lo is older than the clone." placeholder:"N"`
+		Filter            string   `help:"Partial clone filter, e.g. blob:none, leaving out objects that are fetched from the remote when a checkout needs them." placeholder:"FILTER"`
+		DryRun            bool     `help:"Print the commands the import would run instead of running them."`
+		PreCloneHook      []string `help:"Shell command run before cloning, e.g. to check prerequisites. Its failure aborts the import. Repeatable. See README." sep:"none" placeholder:"COMMAND"`
+		PostCloneHook     []string `help:"Shell command run in the clone dir once cloned, e.g. git lfs pull. Its failure removes the clone and aborts the import. Repeatable. See README." sep:"none" placeholder:"COMMAND"`
+		KeepOnHookFailure bool     `help:"Keep the clone and import the repo when a post-clone hook fails."`
 	} `cmd:"" help:"Import remote projects that you want to run bisect on."`
 
 	Clean struct {
+		Cache       bool `help:"Remove the run cache dirs, except those of running runs. The default when nothing else is selected."`
+		Repos       bool `help:"Remove the clones in the repos dir that are not in the config anymore, and the clones made by run --git."`
+		Logs        bool `help:"Truncate the log file."`
+		All         bool `help:"Clean everything, after confirmation."`
+		Yes         bool `help:"Do not ask for confirmation." short:"y"`
+		ForceUnlock bool `help:"Remove the locks left by crashed processes, after listing them and confirmation. The locks of running processes are kept."`
 	} `cmd:"" help:"Clean up the cache."`
+
+	Watch struct {
+		Repo     string        `help:"The imported repo to watch." short:"r" required:""`
+		Steps    []string      `help:"Steps run on each new tip, and bisected when they regress."`
+		Script   string        `help:"Script run for each step, with the step name as $1." type:"existingfile" placeholder:"FILE"`
+		Interval time.Duration `help:"Time between two checks of the remote." default:"30m"`
+		Remote   string        `help:"Remote to fetch." default:"origin"`
+		Branch   string        `help:"Branch of the remote to watch. Defaults to the remote's default branch."`
+	} `cmd:"" help:"Periodically fetch a repo and bisect when its tip regresses."`
+
+	Kill struct {
+		Run     string        `help:"Id of the run to stop (the name of its cache directory). Defaults to the only active run."`
+		Force   bool          `help:"Send SIGKILL if the run does not stop gracefully within the timeout."`
+		Timeout time.Duration `help:"How long to wait for the run to stop." default:"30s"`
+	} `cmd:"" help:"Stop a run started from another terminal."`
+
+	Results struct {
+		Export struct {
+			Run    string `arg:"" help:"Id of the run (the name of its cache directory)."`
+			Format string `help:"Format of the export (dot, a Graphviz graph of how the bisect narrowed the range)." enum:"dot" default:"dot"`
+			Output string `help:"File to write the export to, - for stdout." short:"o" default:"-"`
+		} `cmd:"" help:"Export the results of a finished run."`
+	} `cmd:"" help:"Inspect the results of the runs."`
+
+	Status struct {
+		Json bool `help:"Print the runs and the disk usage of the app data dir as JSON. See README for the fields."`
+	} `cmd:"" help:"List the runs with their status, e.g. to check on a run started with --detach."`
+
+	List struct {
+		Json bool `help:"Print the repos and the disk usage of the app data dir as JSON. See README for the fields."`
+	} `cmd:"" help:"List the imported repos."`
+
+	Update struct {
+		Name string `arg:"" help:"The name of the imported repo."`
+	} `cmd:"" help:"Fetch the new commits and tags of an imported repo from its remote."`
+
+	Remove struct {
+		Name  string `arg:"" help:"The name of the imported repo."`
+		Purge bool   `help:"Also delete its clone from the repos dir."`
+	} `cmd:"" help:"Remove an imported repo from the config, along with the caches of its runs."`
+
+	Logs struct {
+		Follow bool `help:"Keep printing the lines appended to the log file until interrupted." short:"f"`
+		Lines  int  `help:"Number of lines of the end of the log file to print." default:"50" short:"n"`
+	} `cmd:"" help:"Print the end of the log file."`
+
+	Doctor struct{} `cmd:"" help:"Check that the git executable and the app data dir are usable."`
+
+	Selftest struct{} `cmd:"" help:"Bisect a generated repo in a temporary profile to check that xbisect works end to end."`
+
+	// Started by the wrapper script to run a step with --pty.
+	PtyExec struct {
+		Size    string   `default:"80x24"`
+		Command []string `arg:"" passthrough:""`
+	} `cmd:"" hidden:"" name:"pty-exec"`
+
+	// Started by the wrapper script to run a step with --timeout, and by git
+	// bisect run to run the wrapper script on a commit.
+	StepExec struct {
+		Timeout  time.Duration
+		Marker   string
+		PgidFile string
+		Command  []string `arg:"" passthrough:""`
+	} `cmd:"" hidden:"" name:"step-exec"`
+
+	// Started by the wrapper script to measure the --size-of path.
+	SizeOf struct {
+		Path string `arg:""`
+	} `cmd:"" hidden:"" name:"size-of"`
+
+	Config struct {
+		Show struct{} `cmd:"" help:"Print the effective config, merged from config.toml and config.local.toml, with the file each value comes from."`
+		List struct{} `cmd:"" help:"Print every config key with its value."`
+		Get  struct {
+			Key string `arg:"" help:"The key, as repos.<name>.<field>, or KeepNCaches."`
+		} `cmd:"" help:"Print the value of a config key."`
+		Set struct {
+			Key   string `arg:"" help:"The key, as repos.<name>.<field>, or KeepNCaches."`
+			Value string `arg:""`
+		} `cmd:"" help:"Validate a value and set a config key to it in config.toml."`
+	} `cmd:"" help:"Inspect and change the configuration."`
 }
 
-func Main() int {
+func Main() (exit_code int) {
 	ctx := kong.Parse(&cli,
 		kong.Name(kApplicationName),
 		kong.Description(kApplicationDescrption),
@@ -643,24 +3649,259 @@ func Main() int {
 			Summary: true,
 		}))
 
-	SetupLoggerOrDie(cli.Verbose)
+	if ctx.Command() == "pty-exec <command>" {
+		// Runs within a step, without the app data, config and logs.
+		return RunPtyExec(cli.PtyExec.Size, cli.PtyExec.Command)
+	}
+	if ctx.Command() == "step-exec <command>" {
+		return RunStepExec(cli.StepExec.Timeout, cli.StepExec.Marker, cli.StepExec.PgidFile, cli.StepExec.Command)
+	}
+	if ctx.Command() == "size-of <path>" {
+		return RunSizeOf(cli.SizeOf.Path)
+	}
+	SetupLoggerOrDie(cli.Verbose, cli.NoColor)
+	if (ctx.Command() == "sweep" && cli.Sweep.Output == "csv" && len(cli.Sweep.OutputFile) == 0) ||
+		(ctx.Command() == "status" && cli.Status.Json) || (ctx.Command() == "list" && cli.List.Json) ||
+		(ctx.Command() == "run" && cli.Run.Format == "json") {
+		// Keep stdout clean for the csv or JSON data.
+		gConsoleLogger.SetOutput(os.Stderr)
+	}
 
-	SetupAppDataOrDie()
-	InitConfigOrDie()
+	if err := SetupAppData(); err != nil {
+		ConsoleLogError("Failed to create the app data dir %s: %v", GetAppDataDir(), err)
+		CleanupLogger()
+		return 1
+	}
+	// doctor checks the git executable itself.
+	if ctx.Command() != "doctor" && !SetupGitPath(cli.GitPath) {
+		CleanupLogger()
+		return 1
+	}
+	if err := InitConfig(); err != nil {
+		ConsoleLogError("Failed to load the config: %v", err)
+		CleanupLogger()
+		return 1
+	}
+	SetupSignalHandler()
 	// Cleanups
 	defer func() {
+		if err := gConfig.Save(); err != nil {
+			ConsoleLogError("%v", err)
+			exit_code = 1
+		}
 		CleanupLogger()
-		gConfig.Save()
 	}()
 
+	// The commands returning an error set err, the others success.
 	var success bool = false
+	var err error
 	switch ctx.Command() {
 	case "import":
-		success = ImportGitRepo(cli.Import.Git, cli.Import.Name)
+		hooks := CloneHooks{Pre: cli.Import.PreCloneHook, Post: cli.Import.PostCloneHook,
+			KeepOnFailure: cli.Import.KeepOnHookFailure}
+		err = withDryRun(cli.Import.DryRun, func(runner CommandRunner) error {
+			if (cli.Import.Depth != 0 || len(cli.Import.Filter) > 0) && len(cli.Import.Git) == 0 {
+				return errors.New("--depth and --filter only apply to the clone of --git.")
+			}
+			if len(cli.Import.Path) > 0 {
+				if cli.Import.Mirror {
+					return errors.New("--mirror cannot be combined with --path, nothing is cloned.")
+				}
+				if len(hooks.Pre) > 0 || len(hooks.Post) > 0 {
+					return errors.New("--pre-clone-hook and --post-clone-hook cannot be combined with --path, nothing is cloned.")
+				}
+				return ImportLocalRepo(runner, cli.Import.Path, cli.Import.Name, cli.Import.Copy)
+			}
+			if cli.Import.Copy {
+				return errors.New("--copy requires --path, the other imports clone the repo already.")
+			}
+			if len(cli.Import.Archive) > 0 {
+				if cli.Import.Mirror {
+					return errors.New("--mirror cannot be combined with --archive, nothing is cloned.")
+				}
+				if len(hooks.Pre) > 0 || len(hooks.Post) > 0 {
+					return errors.New("--pre-clone-hook and --post-clone-hook cannot be combined with --archive, nothing is cloned.")
+				}
+				return ImportArchive(runner, cli.Import.Archive, cli.Import.Name)
+			}
+			if len(cli.Import.Bundle) > 0 {
+				return ImportBundle(runner, cli.Import.Bundle, cli.Import.Name, CloneOptions{Mirror: cli.Import.Mirror}, hooks)
+			}
+			if len(cli.Import.Svn) > 0 {
+				return ImportSvnRepo(runner, cli.Import.Svn, cli.Import.Name, cli.Import.SvnStdlayout, cli.Import.SvnRevisions, hooks)
+			}
+			return ImportGitRepo(runner, cli.Import.Git, cli.Import.Host, cli.Import.Name,
+				CloneOptions{Mirror: cli.Import.Mirror, Depth: cli.Import.Depth, Filter: cli.Import.Filter}, hooks)
+		})
+		success = err == nil
 	case "run":
-		success = RunBisect(cli.Run.Repo, cli.Run.Lo, cli.Run.Hi, cli.Run.Steps)
+		if len(cli.Run.Spec) > 0 {
+			var spec *BisectSpec
+			if spec, err = LoadBisectSpec(cli.Run.Spec); err != nil {
+				break
+			}
+			if err = cli.Run.applySpec(spec, cli.Run.Spec); err != nil {
+				break
+			}
+		}
+		if cli.Run.KeepNCaches != nil && !cli.Run.DryRun {
+			if *cli.Run.KeepNCaches < 0 {
+				err = errors.New("--keep-n-caches cannot be negative.")
+				break
+			}
+			gConfig.SetKeepNCaches(*cli.Run.KeepNCaches)
+			// Saved right away for the bisects of a repo glob, which run
+			// in their own processes, to see it.
+			if err = gConfig.Save(); err != nil {
+				break
+			}
+		}
+		if cli.Run.Detach {
+			opts := cli.Run.Options()
+			opts.DryRun = cli.Run.DryRun
+			if err = checkDetachable(opts, cli.Run.Repo); err == nil {
+				err = RunDetached(os.Args[1:])
+			}
+			success = err == nil
+			break
+		}
+		if len(cli.Run.Transcript) > 0 {
+			var stop_transcript func()
+			if stop_transcript, err = startTranscript(cli.Run.Transcript); err != nil {
+				break
+			}
+			// Stopped once the outcome of the run is printed.
+			defer stop_transcript()
+		}
+		if isRepoGlob(cli.Run.Repo) {
+			if cli.Run.StepsFile == "-" {
+				err = errors.New("--steps-file - cannot be used with a repo glob, the bisects do not share stdin.")
+				break
+			}
+			success = RunMultiRepoBisect(cli.Run.Repo, os.Args[1:], cli.Run.MaxParallelRepos)
+			if success {
+				applyCacheRetention()
+			}
+			break
+		}
+		opts := cli.Run.Options()
+		opts.ReportTemplate = cli.Run.ReportTemplate
+		opts.SummaryFormat = cli.Run.SummaryFormat
+		opts.Marks = cli.Run.Mark
+		opts.Mode = cli.Run.Mode
+		opts.AttemptsPerCommit = cli.Run.AttemptsPerCommit
+		opts.VerdictPolicy = cli.Run.VerdictPolicy
+		opts.Notify = cli.Run.Notify
+		opts.NotifyFormat = cli.Run.NotifyFormat
+		opts.Share = cli.Run.Share
+		opts.ExpectCulprit = cli.Run.ExpectCulprit
+		opts.DryRun = cli.Run.DryRun
+		opts.ReuseResults = cli.Run.ReuseResults
+		opts.FirstBadOnly = cli.Run.BisectFirstBadOnly
+		opts.JsonReport = cli.Run.Format == "json"
+		opts.DotOut = cli.Run.DotOut
+		opts.Artifacts = cli.Run.Artifact
+		opts.Baseline = cli.Run.Baseline
+		opts.BaselineRev = cli.Run.BaselineRev
+		opts.BaselineStep = cli.Run.BaselineStep
+		opts.DiffArtifacts = cli.Run.DiffArtifacts
+		opts.SharedProcessGroup = !cli.Run.TrapSignalsInSteps
+		if cli.Run.PrintRepro || cli.Verbose {
+			opts.ReproArgs = os.Args[1:]
+		}
+		if cli.Detached {
+			opts.OnSetup = announceDetachedRun
+		}
+		err = withDryRun(opts.DryRun, func(runner CommandRunner) error {
+			_, err := RunBisect(runner, opts)
+			return err
+		})
+		success = err == nil
+		if success && !opts.DryRun {
+			applyCacheRetention()
+		}
+	case "sweep":
+		if len(cli.Sweep.Spec) > 0 {
+			spec, err := LoadBisectSpec(cli.Sweep.Spec)
+			if err != nil {
+				ConsoleLogErr(err)
+				break
+			}
+			if err = cli.Sweep.applySpec(spec, cli.Sweep.Spec); err != nil {
+				ConsoleLogErr(err)
+				break
+			}
+		}
+		success = RunSweep(SweepOptions{
+			RunOptions: cli.Sweep.Options(),
+			Output:     cli.Sweep.Output,
+			OutputFile: cli.Sweep.OutputFile,
+			Native:     cli.Sweep.Native,
+		})
+	case "warm":
+		success = RunWarm(WarmOptions{
+			Repo:   cli.Warm.Repo,
+			Range:  cli.Warm.Range,
+			Step:   cli.Warm.Step,
+			Script: cli.Warm.Script,
+			Max:    cli.Warm.Max,
+		})
 	case "clean":
-		success = CleanCache()
+		err = Clean(CleanOptions{
+			Cache:       cli.Clean.Cache || cli.Clean.All,
+			Repos:       cli.Clean.Repos || cli.Clean.All,
+			Logs:        cli.Clean.Logs || cli.Clean.All,
+			All:         cli.Clean.All,
+			Yes:         cli.Clean.Yes,
+			ForceUnlock: cli.Clean.ForceUnlock,
+		})
+		success = err == nil
+	case "config show":
+		success = ShowConfig()
+	case "config list":
+		success = ListConfig()
+	case "config get <key>":
+		err = GetConfigValue(cli.Config.Get.Key)
+		success = err == nil
+	case "config set <key> <value>":
+		err = SetConfigValue(cli.Config.Set.Key, cli.Config.Set.Value)
+		success = err == nil
+	case "watch":
+		success = Watch(WatchOptions{
+			Repo:     cli.Watch.Repo,
+			Steps:    cli.Watch.Steps,
+			Script:   cli.Watch.Script,
+			Interval: cli.Watch.Interval,
+			Remote:   cli.Watch.Remote,
+			Branch:   cli.Watch.Branch,
+		})
+	case "results export <run>":
+		err = ExportResults(cli.Results.Export.Run, cli.Results.Export.Format, cli.Results.Export.Output)
+		success = err == nil
+	case "status":
+		success = ShowStatus(cli.Status.Json)
+	case "list":
+		success = ListImportedRepos(cli.List.Json)
+	case "update <name>":
+		err = UpdateImportedRepo(cli.Update.Name)
+		success = err == nil
+	case "remove <name>":
+		err = RemoveImportedRepo(cli.Remove.Name, cli.Remove.Purge)
+		success = err == nil
+	case "logs":
+		success = ShowLogs(cli.Logs.Lines, cli.Logs.Follow)
+	case "doctor":
+		success = Doctor(cli.GitPath)
+	case "selftest":
+		success = RunSelftest()
+	case "kill":
+		success = KillRun(cli.Kill.Run, cli.Kill.Force, cli.Kill.Timeout)
+	}
+	if err != nil {
+		ConsoleLogErr(err)
+	}
+	if errors.Is(err, ErrBisectInconclusive) {
+		return kInconclusiveExitCode
 	}
 	if !success {
 		return 1
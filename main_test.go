@@ -0,0 +1,605 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	charmlog "github.com/charmbracelet/log"
+)
+
+func TestMain(m *testing.M) {
+	// The tests never touch the app data dir of the user.
+	home, err := os.MkdirTemp("", "xbisect-test-")
+	if err != nil {
+		panic(err)
+	}
+	os.Setenv("XBISECT_HOME", home)
+	gLogger = log.New(io.Discard, "", 0)
+	gConsoleLogger = charmlog.New(io.Discard)
+	gConsoleOutput = io.Discard
+	// Where the commands run by the tests write their output.
+	if gLogFileHandler, err = os.OpenFile(os.DevNull, os.O_WRONLY, 0); err != nil {
+		panic(err)
+	}
+	code := m.Run()
+	os.RemoveAll(home)
+	os.Exit(code)
+}
+
+// Points the app data dir to a new temp dir and loads its config, restoring
+// the previous config at the end of the test.
+func setupTestAppData(t *testing.T) string {
+	t.Helper()
+	home := t.TempDir()
+	t.Setenv("XBISECT_HOME", home)
+	if err := SetupAppData(); err != nil {
+		t.Fatal(err)
+	}
+	previous_config := gConfig
+	t.Cleanup(func() { gConfig = previous_config })
+	if err := InitConfig(); err != nil {
+		t.Fatal(err)
+	}
+	return home
+}
+
+// Creates the repo of selftest in a temp dir and imports it as name into the
+// app data dir of the test. Returns the hashes of its commits, the oldest
+// first, the kSelftestCulprit-th planting the bug.
+func setupTestRepo(t *testing.T, name string) []string {
+	t.Helper()
+	srcdir := filepath.Join(t.TempDir(), name)
+	hashes, err := createSelftestRepo(&ExecRunner{}, srcdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ImportGitRepo(&ExecRunner{}, srcdir, "", name, CloneOptions{}, CloneHooks{}); err != nil {
+		t.Fatal(err)
+	}
+	return hashes
+}
+
+// Bisects the repo imported as name with the script, the steps sharing the
+// process group of the test rather than being started by step-exec, which
+// the test binary does not have. Returns the report of the run.
+func runTestBisect(t *testing.T, opts RunOptions) *BisectReport {
+	t.Helper()
+	var report *BisectReport
+	opts.SharedProcessGroup = true
+	opts.OnReport = func(r *BisectReport) { report = r }
+	if _, err := RunBisect(&ExecRunner{}, opts); err != nil {
+		t.Fatal(err)
+	}
+	if report == nil {
+		t.Fatal("The bisect reported nothing")
+	}
+	return report
+}
+
+func TestCommitCheckoutErrors(t *testing.T) {
+	tests := []struct {
+		stderr         string
+		commit         bool
+		case_collision bool
+	}{
+		{"error: unable to read sha1 file of counter.txt (2e65efe2a145dda7ee51d1741299f848e5bf752e)", true, false},
+		{"fatal: unable to read tree 4b825dc642cb6eb9a060e54bf8d69288fbee4904", true, false},
+		{"fatal: could not fetch 2e65efe2a145dda7ee51d1741299f848e5bf752e from promisor remote", true, false},
+		{"error: invalid path 'aux.c'", true, false},
+		{"error: unable to create file docs/" + strings.Repeat("x", 300) + ": Filename too long", true, false},
+		{"error: The following untracked working tree files would be overwritten by checkout:\n\tREADME", false, true},
+		{"warning: the following paths have collided (e.g. case-sensitive paths\non a case-insensitive filesystem)", false, true},
+		{"error: Your local changes to the following files would be overwritten by checkout:\n\tcounter.txt\n" +
+			"Please commit your changes or stash them before you switch branches.", false, false},
+		{"fatal: Unable to create '/repo/.git/index.lock': File exists.", false, false},
+		{"error: you need to resolve your current index first", false, false},
+	}
+	for _, tt := range tests {
+		if got := gCommitCheckoutErrorRe.MatchString(tt.stderr); got != tt.commit {
+			t.Errorf("%q is due to the commit: %t, want %t", tt.stderr, got, tt.commit)
+		}
+		if got := gCaseCollisionRe.MatchString(tt.stderr); got != tt.case_collision {
+			t.Errorf("%q is a case collision: %t, want %t", tt.stderr, got, tt.case_collision)
+		}
+	}
+}
+
+// A commit whose objects are missing, as in a broken partial clone, is
+// skipped, and the bisect goes on with the others.
+func TestCheckoutFailureSkipsCommit(t *testing.T) {
+	setupTestAppData(t)
+	hashes := setupTestRepo(t, "corrupt")
+	repo := gConfig.GetRepo("corrupt")
+	// The counter of the commits before the culprit, but for the first, is
+	// only in those commits.
+	corrupted := map[string]bool{}
+	for _, hash := range hashes[1 : kSelftestCulprit-2] {
+		out, err := runCommandDirOutput(&ExecRunner{}, repo.LocalPath, gGitPath, "rev-parse", hash+":counter.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		blob := strings.TrimSpace(string(out))
+		if err = os.Remove(filepath.Join(repo.LocalPath, ".git", "objects", blob[:2], blob[2:])); err != nil {
+			t.Fatal(err)
+		}
+		corrupted[hash] = true
+	}
+
+	report := runTestBisect(t, RunOptions{Repo: "corrupt", Lo: hashes[0], Steps: []string{"check"},
+		Script: "#!/bin/sh\ntest ! -e bug\n"})
+	if planted := hashes[kSelftestCulprit-1]; report.Culprit != planted {
+		t.Errorf("Culprit = %q, want %s", report.Culprit, planted)
+	}
+	failed := 0
+	for _, commit := range report.Commits {
+		if commit.CheckoutFailed != corrupted[commit.Hash] {
+			t.Errorf("Commit %s: CheckoutFailed = %t", commit.Hash, commit.CheckoutFailed)
+		}
+		if commit.CheckoutFailed {
+			failed++
+		}
+	}
+	if failed == 0 {
+		t.Errorf("No corrupted commit was tested: %+v", report.Commits)
+	}
+}
+
+// A checkout failing for a reason that is not due to the commit, here the
+// local changes of a step, stops the bisect instead of skipping every commit.
+func TestCheckoutFailureAbortsBisect(t *testing.T) {
+	setupTestAppData(t)
+	hashes := setupTestRepo(t, "dirty")
+	opts := RunOptions{Repo: "dirty", Lo: hashes[0], Steps: []string{"check"}, SharedProcessGroup: true,
+		Script: "#!/bin/sh\necho changed >> counter.txt\ntest ! -e bug\n"}
+	_, err := RunBisect(&ExecRunner{}, opts)
+	if err == nil || !strings.Contains(err.Error(), "Failed to check out commit") {
+		t.Errorf("RunBisect() = %v, want a checkout error", err)
+	}
+}
+
+// A step killed by a signal fails its commit rather than stopping git bisect
+// run, which aborts on the statuses from 128.
+func TestCrashingStepFindsCulprit(t *testing.T) {
+	setupTestAppData(t)
+	hashes := setupTestRepo(t, "crash")
+	planted := hashes[kSelftestCulprit-1]
+	tests := []struct {
+		mode   string
+		script string
+	}{
+		{kModeRegression, "#!/bin/sh\ntest ! -e bug || kill -SEGV $$\n"},
+		// The crashes are on the commits before the fix.
+		{kModeFix, "#!/bin/sh\ntest -e bug || kill -SEGV $$\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			report := runTestBisect(t, RunOptions{Repo: "crash", Lo: hashes[0], Mode: tt.mode,
+				Steps: []string{"check"}, Script: tt.script})
+			if report.Culprit != planted {
+				t.Errorf("Culprit = %q, want %s", report.Culprit, planted)
+			}
+			crashed := 0
+			for _, commit := range report.Commits {
+				if res := commit.StepResults; len(res) == 1 && res[0].Signal == "SIGSEGV" && res[0].ExitStatus == 139 {
+					crashed++
+				}
+			}
+			if crashed == 0 {
+				t.Errorf("No step was reported killed by SIGSEGV: %+v", report.Commits)
+			}
+		})
+	}
+}
+
+var kHostileStepNames = []string{"foo;rm -rf", "$(touch pwned)", "`touch pwned`", `say "hi"`, "it's", "a|b"}
+
+func TestValidateStepName(t *testing.T) {
+	for _, name := range []string{"build", "unit.fast", "lint/go", "with space"} {
+		if err := validateStepName(name); err != nil {
+			t.Errorf("validateStepName(%q) = %v", name, err)
+		}
+	}
+	for _, name := range append(kHostileStepNames, "", " lead", "a//b", "./a", "../up") {
+		if err := validateStepName(name); err == nil {
+			t.Errorf("validateStepName(%q) accepted it", name)
+		}
+	}
+}
+
+func TestParseStepStatusNames(t *testing.T) {
+	for _, name := range []string{"unit.fast", "lint/go", "with space"} {
+		res, err := parseStepStatus(`xbisect step="`+name+`" FAIL res=2`, nil)
+		if err != nil || res == nil || res.Name != name || res.Pass || res.ExitStatus != 2 {
+			t.Errorf("parseStepStatus() for %q = %+v, %v", name, res, err)
+		}
+	}
+	for _, name := range kHostileStepNames {
+		if res, err := parseStepStatus(`xbisect step="`+name+`" PASS`, nil); res != nil || err != nil {
+			t.Errorf("parseStepStatus() for %q = %+v, %v, want no status", name, res, err)
+		}
+	}
+}
+
+func TestFormatStepVerdictCrash(t *testing.T) {
+	tests := []struct {
+		step StepResult
+		want string
+	}{
+		{StepResult{ExitStatus: 139, Signal: "SIGSEGV", CoreCollected: true}, " (SIGSEGV, core collected)"},
+		{StepResult{ExitStatus: 139, Signal: "SIGSEGV", Reused: true}, " (SIGSEGV) (reused)"},
+		{StepResult{ExitStatus: 134, Signal: "SIGABRT", Attempts: []int{134, 0, 134}}, " (SIGABRT) (1/3 attempts passed)"},
+	}
+	for _, tt := range tests {
+		want := kFontBold + kColorRed + "FAIL" + kConsoleReset + tt.want
+		if got := formatStepVerdict(tt.step); got != want {
+			t.Errorf("formatStepVerdict(%+v) = %q, want %q", tt.step, got, want)
+		}
+	}
+}
+
+func TestScanBisectOutputOrder(t *testing.T) {
+	// The hashes sort in the reverse of the order they are tested in, so
+	// that a report ordered by hash rather than by discovery fails.
+	hashes := make([]string, 5)
+	for i := range hashes {
+		hashes[i] = strings.Repeat(string(rune('f'-i)), 40)
+	}
+	stream := strings.Join([]string{
+		"running  '/tmp/wrapper.sh' 'check'",
+		// git does not announce the initial commit, only the wrapper does.
+		"xbisect commit=" + hashes[0],
+		`xbisect step="check" PASS res=0`,
+		"Bisecting: 3 revisions left to test after this (roughly 2 steps)",
+		"[" + hashes[1] + "] Second commit tested",
+		"running  '/tmp/wrapper.sh' 'check'",
+		"xbisect commit=" + hashes[1],
+		`xbisect step="check" FAIL res=1`,
+		"Bisecting: 1 revision left to test after this (roughly 1 step)",
+		"[" + hashes[2] + "] Merge branch 'topic'",
+		"xbisect commit=" + hashes[2],
+		"xbisect commit-excluded commit=" + hashes[2] + " reason=merge",
+		"Bisecting: 1 revision left to test after this (roughly 1 step)",
+		"[" + hashes[3] + "] Fourth commit tested",
+		"xbisect commit=" + hashes[3],
+		"xbisect checkout-failed commit=" + hashes[3],
+		"Bisecting: 0 revisions left to test after this (roughly 0 steps)",
+		"[" + hashes[4] + "] Fifth commit tested",
+		"xbisect commit=" + hashes[4],
+		`xbisect step="check" FAIL res=1`,
+		hashes[4] + " is the first bad commit",
+		"commit " + hashes[4],
+		"bisect found first bad commit",
+	}, "\n")
+	scan, err := scanBisectOutput(strings.NewReader(stream), nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tested []string
+	for _, commit := range scan.Commits {
+		tested = append(tested, commit.Hash)
+	}
+	if !slices.Equal(tested, hashes) {
+		t.Errorf("Commits in order %q, want %q", tested, hashes)
+	}
+	if scan.Culprit != hashes[4] || len(scan.Candidates) > 0 || len(scan.CheckoutAborted) > 0 {
+		t.Errorf("scanBisectOutput() = %+v, want culprit %s", scan, hashes[4])
+	}
+	if len(scan.Commits) != len(hashes) {
+		return
+	}
+	if res := scan.Commits[1].StepResults; len(res) != 1 || res[0].Pass || res[0].ExitStatus != 1 {
+		t.Errorf("Step results of %s = %+v, want check failing", hashes[1], res)
+	}
+	if scan.Commits[2].Excluded != "merge" || !scan.Commits[3].CheckoutFailed {
+		t.Errorf("Commits = %+v, want %s excluded and %s failing to check out", scan.Commits, hashes[2], hashes[3])
+	}
+
+	// A commit tested twice means the stream is not that of one bisect.
+	duplicate := strings.Join([]string{
+		"xbisect commit=" + hashes[0],
+		"Bisecting: 0 revisions left to test after this (roughly 0 steps)",
+		"[" + hashes[0] + "] First commit tested",
+	}, "\n")
+	if _, err := scanBisectOutput(strings.NewReader(duplicate), nil, 0); err == nil {
+		t.Error("scanBisectOutput() accepted a commit tested twice")
+	}
+}
+
+// The step names are passed to the wrapper as its args rather than
+// embedded in it, so that even the names validation rejects reach the
+// script as they are, without being run by the shell.
+func TestWrapperStepNames(t *testing.T) {
+	setupTestAppData(t)
+	hashes := setupTestRepo(t, "names")
+	namesfile := filepath.Join(t.TempDir(), "names")
+	steps := []string{"unit.fast", "lint/go", "with space"}
+	setup, err := SetupRun(&ExecRunner{}, RunOptions{Repo: "names", Lo: hashes[0], Steps: steps,
+		SharedProcessGroup: true, Script: "#!/bin/sh\nprintf '%s\\n' \"$1\" >> " + shellQuote(namesfile) + "\n"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer setup.Cleanup(true)
+	wrapper, err := os.ReadFile(setup.WrapperPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, step := range steps {
+		if strings.Contains(string(wrapper), step) {
+			t.Errorf("The step name %q is embedded in the wrapper", step)
+		}
+	}
+
+	tests := []struct {
+		names []string
+		// The names of the statuses parsed from the output of the wrapper.
+		parsed []string
+	}{
+		{steps, steps},
+		{kHostileStepNames[:len(steps)], nil},
+	}
+	for _, tt := range tests {
+		os.Remove(namesfile)
+		cmd := exec.Command(setup.WrapperPath, tt.names...)
+		cmd.Dir = setup.CacheRepo
+		cmd.Env = gitEnv()
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("The wrapper failed with %q: %v\n%s", tt.names, err, out)
+		}
+		if filepathExists(filepath.Join(setup.CacheRepo, "pwned")) {
+			t.Fatalf("The wrapper ran a step name: %q", tt.names)
+		}
+		data, err := os.ReadFile(namesfile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n"); !slices.Equal(got, tt.names) {
+			t.Errorf("The script got the step names %q, want %q", got, tt.names)
+		}
+		var parsed []string
+		for _, line := range strings.Split(string(out), "\n") {
+			if res, err := parseStepStatus(line, nil); res != nil && err == nil {
+				parsed = append(parsed, res.Name)
+			}
+		}
+		if !slices.Equal(parsed, tt.parsed) {
+			t.Errorf("Parsed the statuses of %q from:\n%s", parsed, out)
+		}
+	}
+}
+
+// The scripts of a run are generated in its cache dir, nothing is left in
+// the temp dir.
+func TestRunLeavesNoTempFiles(t *testing.T) {
+	setupTestAppData(t)
+	hashes := setupTestRepo(t, "tmpdir")
+	tmpdir := t.TempDir()
+	t.Setenv("TMPDIR", tmpdir)
+	report := runTestBisect(t, RunOptions{Repo: "tmpdir", Lo: hashes[0], Steps: []string{"check"},
+		Script: "#!/bin/sh\ntest ! -e bug\n"})
+	if planted := hashes[kSelftestCulprit-1]; report.Culprit != planted {
+		t.Errorf("Culprit = %q, want %s", report.Culprit, planted)
+	}
+	entries, err := os.ReadDir(tmpdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		t.Errorf("The run left %s in the temp dir", entry.Name())
+	}
+}
+
+// The failures of a run are told apart by their error, from which Main
+// picks the exit status.
+func TestRunBisectErrors(t *testing.T) {
+	setupTestAppData(t)
+	hashes := setupTestRepo(t, "errors")
+	script := "#!/bin/sh\ntest ! -e bug\n"
+	tests := []struct {
+		name string
+		opts RunOptions
+		want error
+	}{
+		{"missing repo", RunOptions{Repo: "missing", Lo: hashes[0], Script: script}, ErrRepoNotFound},
+		{"bad lo", RunOptions{Repo: "errors", Lo: "no-such-ref", Script: script}, ErrBadRef},
+		{"every commit skipped", RunOptions{Repo: "errors", Lo: hashes[0], Script: "#!/bin/sh\nexit 125\n"}, ErrBisectInconclusive},
+		{"unexpected culprit", RunOptions{Repo: "errors", Lo: hashes[0], Script: script, ExpectCulprit: hashes[1]}, ErrUnexpectedCulprit},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := tt.opts
+			opts.Steps = []string{"check"}
+			opts.SharedProcessGroup = true
+			_, err := RunBisect(&ExecRunner{}, opts)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("RunBisect() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+	err := ImportGitRepo(&ExecRunner{}, gConfig.GetRepo("errors").LocalPath, "", "Errors", CloneOptions{}, CloneHooks{})
+	if err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Errorf("ImportGitRepo() = %v for a name taken with another case", err)
+	}
+}
+
+func TestReadStepsFile(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "steps")
+	if err := os.WriteFile(file, []byte(kMessyLines), 0666); err != nil {
+		t.Fatal(err)
+	}
+	_, err := readStepsFile(file)
+	var line_err *LineError
+	if !errors.As(err, &line_err) || line_err.Line != 7 {
+		t.Errorf("readStepsFile() = %v, want the error of line 7", err)
+	}
+	if err = os.WriteFile(file, []byte(strings.Replace(kMessyLines, "lint # not a comment", "lint", 1)), 0666); err != nil {
+		t.Fatal(err)
+	}
+	steps, err := readStepsFile(file)
+	if want := []string{"build", "test@sub dir", "lint"}; err != nil || !slices.Equal(steps, want) {
+		t.Errorf("readStepsFile() = %q, %v, want %q", steps, err, want)
+	}
+	if err = os.WriteFile(file, []byte("# nothing\n\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if steps, err = readStepsFile(file); err == nil {
+		t.Errorf("readStepsFile() = %q without any step", steps)
+	}
+}
+
+// Repos are looked up whatever the case, and shown with the case they were
+// imported with.
+func TestMixedCaseRepoName(t *testing.T) {
+	setupTestAppData(t)
+	srcdir := filepath.Join(t.TempDir(), "src")
+	hashes, err := createSelftestRepo(&ExecRunner{}, srcdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"MyRepo", "plain"} {
+		if err = ImportGitRepo(&ExecRunner{}, srcdir, "", name, CloneOptions{}, CloneHooks{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The display name survives a reload of the config.
+	if err = gConfig.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if err = InitConfig(); err != nil {
+		t.Fatal(err)
+	}
+	for _, lookup := range []string{"MyRepo", "myrepo", "MYREPO"} {
+		repo := gConfig.GetRepo(lookup)
+		if repo == nil || repo.Name != "myrepo" || repo.Label() != "MyRepo" {
+			t.Fatalf("GetRepo(%q) = %+v, want myrepo labeled MyRepo", lookup, repo)
+		}
+	}
+	if repo := gConfig.GetRepo("plain"); repo == nil || len(repo.DisplayName) > 0 || repo.Label() != "plain" {
+		t.Errorf("GetRepo(plain) = %+v, want no display name", repo)
+	}
+	if table := reposTable([]RepoListing{newRepoListing(gConfig.GetRepo("myrepo"))}); !strings.Contains(table, "MyRepo") {
+		t.Errorf("The repo list shows:\n%s", table)
+	}
+	if _, _, err = checkImportName("MYREPO"); err == nil || !strings.Contains(err.Error(), `"MyRepo"`) {
+		t.Errorf("checkImportName(MYREPO) = %v, want MyRepo to be taken", err)
+	}
+
+	report := runTestBisect(t, RunOptions{Repo: "myrepo", Lo: hashes[0], Steps: []string{"check"},
+		Script: "#!/bin/sh\ntest ! -e bug\n"})
+	if report.Repo != "MyRepo" {
+		t.Errorf("The report is of repo %q, want MyRepo", report.Repo)
+	}
+}
+
+// Returns the error of a command that failed with the stderr and exit
+// status of git.
+func gitExitError(t *testing.T, stderr string, status int) error {
+	t.Helper()
+	_, err := exec.Command("sh", "-c", `printf '%s' "$1" >&2; exit $2`, "sh", stderr, fmt.Sprint(status)).Output()
+	if _, ok := err.(*exec.ExitError); !ok {
+		t.Fatalf("The command did not fail: %v", err)
+	}
+	return gitCommandError([]string{gGitPath, "rev-parse"}, err)
+}
+
+func TestResolveRef(t *testing.T) {
+	setupTestAppData(t)
+	hashes := setupTestRepo(t, "refs")
+	dir := gConfig.GetRepo("refs").LocalPath
+	runner := &ExecRunner{}
+	for ref, want := range map[string]string{
+		"HEAD":         hashes[len(hashes)-1],
+		"HEAD~2":       hashes[len(hashes)-3],
+		hashes[0][:12]: hashes[0],
+		hashes[0]:      hashes[0],
+	} {
+		if got, err := resolveRef(runner, dir, ref); err != nil || got != want {
+			t.Errorf("resolveRef(%q) = %q, %v, want %s", ref, got, err, want)
+		}
+	}
+	// Unknown refs, and objects that are not commits.
+	for _, ref := range []string{"no-such-ref", "HEAD~100", "HEAD^{tree}", strings.Repeat("0", 40)} {
+		_, err := resolveRef(runner, dir, ref)
+		var ref_err *InvalidRefError
+		if !errors.Is(err, ErrBadRef) || !errors.As(err, &ref_err) || ref_err.Ambiguous || ref_err.Shallow {
+			t.Errorf("resolveRef(%q) = %v, want an InvalidRefError", ref, err)
+		}
+	}
+
+	ambiguous := "error: short object ID abcd is ambiguous\nhint: The candidates are:\n" +
+		"hint:   abcd123 commit 2024-01-01 - one\nhint:   abcd456 tree\nfatal: Needed a single revision\n"
+	fake := &fakeRunner{errors: map[string]error{
+		gGitPath + " rev-parse --verify abcd^{commit}": gitExitError(t, ambiguous, 128),
+		gGitPath + " rev-parse --verify gone^{commit}": gitExitError(t, "fatal: Needed a single revision\n", 128),
+	}, outputs: map[string]string{gGitPath + " rev-parse --git-path shallow": filepath.Join(t.TempDir(), "shallow")}}
+	var ref_err *InvalidRefError
+	if _, err := resolveRef(fake, "/repo", "abcd"); !errors.As(err, &ref_err) || !ref_err.Ambiguous {
+		t.Errorf("resolveRef(abcd) = %v, want an ambiguous ref error", err)
+	} else if !strings.Contains(err.Error(), "ambiguous") {
+		t.Errorf("resolveRef(abcd) = %q", err)
+	}
+	if _, err := resolveRef(fake, "/repo", "gone"); !errors.As(err, &ref_err) || ref_err.Ambiguous || ref_err.Shallow {
+		t.Errorf("resolveRef(gone) = %v, want an invalid ref error", err)
+	}
+	// Any other failure, e.g. not being in a repo, is returned as is.
+	fake.errors[gGitPath+" rev-parse --verify HEAD^{commit}"] = ErrCommandTimeout
+	if _, err := resolveRef(fake, "/repo", "HEAD"); err != ErrCommandTimeout {
+		t.Errorf("resolveRef(HEAD) = %v, want the error of git", err)
+	}
+}
+
+// A local repo in detached HEAD state imported in place is bisected up to
+// its HEAD by default. Its clones record the detached HEAD, but are bisected
+// up to the tip of their default branch.
+func TestImportDetachedHead(t *testing.T) {
+	setupTestAppData(t)
+	srcdir := filepath.Join(t.TempDir(), "src")
+	hashes, err := createSelftestRepo(&ExecRunner{}, srcdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := runCommandDirOutput(&ExecRunner{}, srcdir, gGitPath, "symbolic-ref", "--short", "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	branch := strings.TrimSpace(string(out))
+	head := hashes[kSelftestCulprit+1]
+	if err = runCommandDir(&ExecRunner{}, srcdir, gGitPath, "checkout", "--quiet", "--detach", head); err != nil {
+		t.Fatal(err)
+	}
+	if err = ImportLocalRepo(&ExecRunner{}, srcdir, "inplace", false); err != nil {
+		t.Fatal(err)
+	}
+	if err = ImportGitRepo(&ExecRunner{}, srcdir, "", "cloned", CloneOptions{}, CloneHooks{}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name          string
+		defaultBranch string
+		hi            string
+	}{
+		{"inplace", "", head},
+		{"cloned", branch, hashes[len(hashes)-1]},
+	}
+	for _, tt := range tests {
+		repo := gConfig.GetRepo(tt.name)
+		if repo.DetachedHead != head || repo.DefaultBranch != tt.defaultBranch {
+			t.Errorf("%s: DetachedHead %q, DefaultBranch %q, want %s and %q", tt.name, repo.DetachedHead,
+				repo.DefaultBranch, head, tt.defaultBranch)
+		}
+		report := runTestBisect(t, RunOptions{Repo: tt.name, Lo: hashes[0], Steps: []string{"check"},
+			Script: "#!/bin/sh\ntest ! -e bug\n"})
+		if report.Hi != tt.hi || report.Culprit != hashes[kSelftestCulprit-1] {
+			t.Errorf("%s: bisected up to %s, culprit %s, want up to %s", tt.name, report.Hi, report.Culprit, tt.hi)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Why a commit is excluded by --merges-only or --no-merges, recorded in its
+// CommitResult.
+const (
+	kExcludedMerge    = "merge"
+	kExcludedNonMerge = "non-merge"
+)
+
+// The commits of the range skipped without running the steps, with
+// --merges-only or --no-merges.
+type CommitFilter struct {
+	// Either kExcludedMerge or kExcludedNonMerge.
+	Reason  string
+	Commits map[string]bool
+	// The file listing Commits for the wrapper script, one hash per line.
+	File string
+}
+
+// Lists the commits between lo and hi that --merges-only or --no-merges
+// exclude. Returns nil when neither is given. Fails if no commit of the range
+// is left to test.
+func newCommitFilter(runner CommandRunner, dir, lo, hi string, merges_only, no_merges bool) (*CommitFilter, error) {
+	if merges_only && no_merges {
+		return nil, errors.New("--merges-only and --no-merges are mutually exclusive.")
+	}
+	if !merges_only && !no_merges {
+		return nil, nil
+	}
+	filter := &CommitFilter{Reason: kExcludedMerge, Commits: map[string]bool{}}
+	class := "--merges"
+	if merges_only {
+		filter.Reason = kExcludedNonMerge
+		class = "--no-merges"
+	}
+	out, err := runCommandDirOutput(runner, dir, gGitPath, "rev-list", class, lo+".."+hi)
+	if err != nil {
+		return nil, err
+	}
+	for _, hash := range strings.Fields(string(out)) {
+		filter.Commits[hash] = true
+	}
+	total, first_parent := countCommits(runner, dir, lo, hi)
+	if total < 0 || first_parent {
+		// Without the exact total, the range is left to the bisect to
+		// find empty.
+		ConsoleLogInfo("Skipping %d %s commits in range", len(filter.Commits), filter.Reason)
+		return filter, nil
+	}
+	if total == len(filter.Commits) {
+		if merges_only {
+			return nil, fmt.Errorf("No merge commit between %s and %s, --merges-only leaves nothing to test.", lo, hi)
+		}
+		return nil, fmt.Errorf("Only merge commits between %s and %s, --no-merges leaves nothing to test.", lo, hi)
+	}
+	ConsoleLogInfo("Skipping %d %s commits of the %d in range", len(filter.Commits), filter.Reason, total)
+	return filter, nil
+}
+
+// Writes Commits for the wrapper script.
+func (f *CommitFilter) save(file string) error {
+	var hashes strings.Builder
+	for hash := range f.Commits {
+		hashes.WriteString(hash + "\n")
+	}
+	f.File = file
+	return os.WriteFile(file, []byte(hashes.String()), 0666)
+}
+
+// The wrapper script skipping the commit BISECT_COMMIT if it is excluded.
+func (f *CommitFilter) wrapperScript() string {
+	return fmt.Sprintf(`
+				if grep -qxF "${BISECT_COMMIT}" %s
+				then
+					echo "xbisect commit-excluded commit=${BISECT_COMMIT} reason=%s"
+					exit %d
+				fi
+				`, shellQuote(f.File), f.Reason, kBisectSkipCode)
+}
+
+// Describes why the commit was skipped, for console output.
+func describeExclusion(reason string) string {
+	if reason == kExcludedNonMerge {
+		return "not a merge, excluded by --merges-only"
+	}
+	return "a merge, excluded by --no-merges"
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var gFirstBadCommitLineRe = regexp.MustCompile(`First (?:bad|fixed) commit: ([0-9a-f]{40})`)
+
+type MultiRepoResult struct {
+	Repo    string
+	Success bool
+	// Empty if the bisect did not find the first bad commit.
+	Culprit string
+}
+
+func isRepoGlob(reponame string) bool {
+	return strings.ContainsAny(reponame, "*?[")
+}
+
+// Returns args with the value of --repo replaced by reponame, or with
+// --repo added when the glob came from the --spec file.
+func replaceRepoArg(args []string, reponame string) []string {
+	replaced := slices.Clone(args)
+	for i := 0; i < len(replaced); i++ {
+		arg := replaced[i]
+		switch {
+		case arg == "--":
+			if !slices.ContainsFunc(replaced[:i], isRepoArg) {
+				return slices.Insert(replaced, i, "--repo="+reponame)
+			}
+			return replaced
+		case arg == "--repo" || arg == "-r":
+			if i+1 < len(replaced) {
+				replaced[i+1] = reponame
+				i++
+			}
+		case strings.HasPrefix(arg, "--repo="):
+			replaced[i] = "--repo=" + reponame
+		}
+	}
+	if !slices.ContainsFunc(replaced, isRepoArg) {
+		replaced = append(replaced, "--repo="+reponame)
+	}
+	return replaced
+}
+
+func isRepoArg(arg string) bool {
+	return arg == "--repo" || arg == "-r" || strings.HasPrefix(arg, "--repo=")
+}
+
+// Runs xbisect with the given args for a single repo, prefixing each line
+// of its output with the repo name.
+func runRepoBisect(executable string, args []string, reponame string, output_mu *sync.Mutex) MultiRepoResult {
+	result := MultiRepoResult{Repo: reponame}
+	// The output of the bisect is relayed to the transcript.
+	cmd := exec.CommandContext(gRunContext, executable, withoutTranscriptArg(replaceRepoArg(args, reponame))...)
+	// Let the child clean up its bisect on interruption.
+	cmd.Cancel = func() error { return cmd.Process.Signal(os.Interrupt) }
+	cmd.WaitDelay = time.Minute
+	reader, writer := io.Pipe()
+	cmd.Stdout = writer
+	cmd.Stderr = writer
+
+	gLogger.Printf("[%s] Running: %s %s\n", reponame, executable, strings.Join(cmd.Args[1:], " "))
+	if err := cmd.Start(); err != nil {
+		gLogger.Printf("Error: %v\n", err)
+		ConsoleLogError("[%s] Failed to start the bisect", reponame)
+		return result
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		scanner := bufio.NewScanner(reader)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if match := gFirstBadCommitLineRe.FindStringSubmatch(line); match != nil {
+				result.Culprit = match[1]
+			}
+			output_mu.Lock()
+			fmt.Fprintf(gConsoleOutput, "[%s] %s\n", reponame, line)
+			output_mu.Unlock()
+		}
+		io.Copy(io.Discard, reader)
+	}()
+	err := cmd.Wait()
+	writer.Close()
+	<-done
+	if err != nil {
+		gLogger.Printf("[%s] Error: %v\n", reponame, err)
+		return result
+	}
+	result.Success = true
+	return result
+}
+
+// Bisects every imported repo whose name matches the glob, at most
+// max_parallel at a time. Each repo is bisected by its own xbisect process
+// running with the same args, so that each gets its own cache dir, logs and
+// signal handling.
+func RunMultiRepoBisect(pattern string, args []string, max_parallel int) bool {
+	if max_parallel < 1 {
+		ConsoleLogError("--max-parallel-repos must be at least 1.")
+		return false
+	}
+	var reponames []string
+	for _, repo := range gConfig.ListRepos() {
+		matched, err := path.Match(strings.ToLower(pattern), repo.Name)
+		if err != nil {
+			ConsoleLogError("Invalid repo glob: %s", pattern)
+			return false
+		}
+		if matched {
+			reponames = append(reponames, repo.Label())
+		}
+	}
+	if len(reponames) == 0 {
+		ConsoleLogError("No imported repo matches: \"%s\"", pattern)
+		return false
+	}
+	slices.SortFunc(reponames, func(a, b string) int {
+		return strings.Compare(strings.ToLower(a), strings.ToLower(b))
+	})
+	executable, err := os.Executable()
+	if err != nil {
+		gLogger.Printf("Error: %v\n", err)
+		ConsoleLogError("Failed to locate the %s executable", kApplicationName)
+		return false
+	}
+	ConsoleLogInfo("Bisecting %d repos, %d at a time: %s", len(reponames), max_parallel, strings.Join(reponames, ", "))
+
+	results := make([]MultiRepoResult, len(reponames))
+	var output_mu sync.Mutex
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, max_parallel)
+	for i, reponame := range reponames {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			if gInterrupted.Load() {
+				results[i] = MultiRepoResult{Repo: reponame}
+				return
+			}
+			results[i] = runRepoBisect(executable, args, reponame, &output_mu)
+		}()
+	}
+	wg.Wait()
+
+	success := true
+	ConsoleLogInfo("Summary:")
+	for _, result := range results {
+		switch {
+		case !result.Success:
+			success = false
+			ConsoleLogInfo("  %-20s %s%sFAILED%s", result.Repo, kFontBold, kColorRed, kConsoleReset)
+		case len(result.Culprit) > 0:
+			ConsoleLogInfo("  %-20s first bad commit: %s", result.Repo, result.Culprit)
+		default:
+			ConsoleLogInfo("  %-20s no first bad commit found", result.Repo)
+		}
+	}
+	if gInterrupted.Load() {
+		ConsoleLogError("Bisect aborted")
+		return false
+	}
+	return success
+}
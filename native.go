@@ -0,0 +1,279 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Converts a bash glob, as matched by [[ == ]], to a regexp: unlike
+// path.Match, `*` also matches `/`.
+func bashGlobRegexp(pattern string) (*regexp.Regexp, error) {
+	var re strings.Builder
+	re.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			re.WriteString(".*")
+		case '?':
+			re.WriteString(".")
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				re.WriteString(`\[`)
+				continue
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			re.WriteString("[" + class + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+			}
+			re.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	re.WriteString("$")
+	return regexp.Compile(re.String())
+}
+
+// Whether one of the files matches one of the patterns.
+func anyPathMatches(files []string, patterns []string) (bool, error) {
+	for _, pattern := range patterns {
+		re, err := bashGlobRegexp(pattern)
+		if err != nil {
+			return false, fmt.Errorf("Invalid step path pattern %q: %w", pattern, err)
+		}
+		for _, file := range files {
+			if re.MatchString(file) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// Moves the core files and sanitizer reports left by a failed step into its
+// crash dir. Returns whether core files were collected.
+func collectCrashEvidence(setup *RunSetup, crashdir string) bool {
+	if err := os.MkdirAll(crashdir, os.ModePerm); err != nil {
+		gLogger.Printf("Error: %v\n", err)
+		return false
+	}
+	cores := 0
+	for _, pattern := range setup.CorePatterns {
+		matches, _ := filepath.Glob(path.Join(setup.CacheRepo, pattern))
+		for _, file := range matches {
+			if info, err := os.Stat(file); err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+			if err := os.Rename(file, path.Join(crashdir, path.Base(file))); err == nil {
+				cores += 1
+			}
+		}
+	}
+	// Sanitizer reports written to log_path=<prefix>.<pid>
+	for _, name := range []string{"ASAN_OPTIONS", "UBSAN_OPTIONS", "MSAN_OPTIONS", "TSAN_OPTIONS"} {
+		log_path := ""
+		for _, option := range strings.Split(os.Getenv(name), ":") {
+			if value, found := strings.CutPrefix(option, "log_path="); found {
+				log_path = value
+			}
+		}
+		if len(log_path) == 0 {
+			continue
+		}
+		if !path.IsAbs(log_path) {
+			log_path = path.Join(setup.CacheRepo, log_path)
+		}
+		matches, _ := filepath.Glob(log_path + ".*")
+		for _, file := range matches {
+			os.Rename(file, path.Join(crashdir, path.Base(file)))
+		}
+	}
+	// Only keep the crash dir if something was collected.
+	os.Remove(crashdir)
+	return cores > 0
+}
+
+func hasShebang(file string) bool {
+	f, err := os.Open(file)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	magic := make([]byte, 2)
+	_, err = io.ReadFull(f, magic)
+	return err == nil && string(magic) == "#!"
+}
+
+// Runs a step on the checked out commit, recording its result from the exit
+// status of the process.
+func runStepNative(setup *RunSetup, hash string, step string, stepdir string, env []string) (StepResult, error) {
+	result := StepResult{Name: step}
+	if err := os.MkdirAll(stepdir, os.ModePerm); err != nil {
+		return result, err
+	}
+	logfile, err := os.Create(path.Join(stepdir, "log.txt"))
+	if err != nil {
+		return result, err
+	}
+	defer logfile.Close()
+	stdin_file, ok := setup.StepStdin[step]
+	if !ok {
+		stdin_file = os.DevNull
+	}
+	stdin, err := os.Open(stdin_file)
+	if err != nil {
+		return result, err
+	}
+	defer stdin.Close()
+
+	command := []string{setup.ScriptPath, step}
+	if !hasShebang(setup.ScriptPath) {
+		// Like the wrapper, which lets bash run scripts without a shebang.
+		command = append([]string{"bash"}, command...)
+	}
+	cmd := exec.CommandContext(gRunContext, command[0], command[1:]...)
+	cmd.Dir = path.Join(setup.CacheRepo, setup.StepWorkdirs[step])
+	cmd.Env = env
+	cmd.Stdin = stdin
+	output := io.MultiWriter(logfile, gLogger.Writer())
+	cmd.Stdout = output
+	cmd.Stderr = output
+	if !setup.SharedProcessGroup {
+		runInProcessGroup(cmd)
+		defer killProcessGroup(cmd)
+	}
+	gLogger.Printf("Running step %s on %s\n", step, hash)
+	if setup.Pty != nil {
+		var wait func() error
+		if wait, err = startWithPty(cmd, *setup.Pty, output); err == nil {
+			setup.trackProcessGroup(cmd)
+			err = wait()
+		}
+	} else if err = cmd.Start(); err == nil {
+		setup.trackProcessGroup(cmd)
+		err = cmd.Wait()
+	}
+	if errors.Is(err, exec.ErrWaitDelay) {
+		// The step exited successfully, but processes it left behind
+		// kept its output open until they were killed.
+		gLogger.Printf("Step %s on %s left processes holding its output\n", step, hash)
+		err = nil
+	}
+	if err == nil {
+		result.Pass = true
+		return result, nil
+	}
+	exit_err, ok := err.(*exec.ExitError)
+	if !ok {
+		return result, err
+	}
+	result.ExitStatus = exit_err.ExitCode()
+	if signal, number := exitSignal(exit_err.ProcessState); len(signal) > 0 {
+		result.Signal = signal
+		// As reported by the shell for a process killed by a signal.
+		result.ExitStatus = 128 + number
+	}
+	result.CoreCollected = collectCrashEvidence(setup, path.Join(stepdir, "crash"))
+	return result, nil
+}
+
+// Runs every step on the checked out commit from Go rather than through the
+// wrapper script, so that results come from the exit statuses of the steps
+// instead of parsing markers. Behaves like the wrapper: steps are run once
+// per matrix entry, steps whose paths do not match the changed files, whose
+// dir is missing or whose conditions are not met are skipped, and the
+// sequence of an entry stops at the first failing step unless the steps have
+// conditions.
+func runStepsNative(setup *RunSetup, hash string) ([]StepResult, error) {
+	var changed_files []string
+	changed_files_known := false
+	if len(setup.StepPaths) > 0 {
+		out, err := runCommandDirOutput(setup.Runner, setup.CacheRepo, gGitPath, "-c", "core.quotePath=false",
+			"diff", "--name-only", "HEAD^", "HEAD")
+		// The root commit has no parent, so every path is considered changed.
+		if err == nil {
+			changed_files = strings.Split(strings.TrimSpace(string(out)), "\n")
+			changed_files_known = true
+		}
+	}
+
+	entries := setup.Matrix
+	if len(entries) == 0 {
+		entries = [][][2]string{nil}
+	}
+	var results []StepResult
+	for i, vars := range entries {
+		rundir := path.Join(setup.CacheDir, "_run", hash)
+		env := append(slices.Clone(setup.StepEnv), "XBISECT_CACHE_DIR="+setup.StepCacheDir)
+		label := ""
+		if len(setup.Matrix) > 0 {
+			rundir = path.Join(rundir, fmt.Sprintf("matrix-%d", i+1))
+			label = setup.Metadata.Matrix[i]
+			for _, v := range vars {
+				env = append(env, v[0]+"="+v[1])
+			}
+		}
+		entry_results := map[string]StepResult{}
+		var failed []string
+		// Whether a step was skipped for its paths or dir, or failed,
+		// leaving the commit without a verdict from its size.
+		incomplete := false
+		for _, step := range setup.Steps {
+			if len(setup.StepConditions) > 0 && !stepConditionsMet(setup.StepConditions[step], entry_results, failed) {
+				results = append(results, StepResult{Name: step, SkippedByCondition: true, Matrix: label})
+				continue
+			}
+			if patterns, ok := setup.StepPaths[step]; ok && changed_files_known {
+				matched, err := anyPathMatches(changed_files, patterns)
+				if err != nil {
+					return nil, err
+				}
+				if !matched {
+					results = append(results, StepResult{Name: step, SkippedByPaths: true, Matrix: label})
+					incomplete = true
+					continue
+				}
+			}
+			if workdir, ok := setup.StepWorkdirs[step]; ok && !isDir(path.Join(setup.CacheRepo, workdir)) {
+				results = append(results, StepResult{Name: step, SkippedByWorkdir: true, Matrix: label})
+				incomplete = true
+				continue
+			}
+			result, err := runStepNative(setup, hash, step, path.Join(rundir, step), env)
+			if err != nil {
+				return nil, err
+			}
+			result.Matrix = label
+			results = append(results, result)
+			entry_results[step] = result
+			if !result.Pass {
+				incomplete = true
+				if len(setup.StepConditions) == 0 {
+					break
+				}
+				failed = append(failed, step)
+			}
+		}
+		if setup.Size != nil && !incomplete {
+			result := setup.Size.result(setup.CacheRepo)
+			result.Matrix = label
+			results = append(results, result)
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const kNotifyTimeout = 10 * time.Second
+
+// What is sent to the --notify webhook when a bisect finishes.
+type Notification struct {
+	Repo    string `json:"repo"`
+	Lo      string `json:"lo"`
+	Hi      string `json:"hi"`
+	Success bool   `json:"success"`
+	// Empty if the bisect did not find the first bad commit.
+	Culprit         string  `json:"culprit,omitempty"`
+	DurationSeconds float64 `json:"duration_seconds"`
+
+	start time.Time
+}
+
+func validateNotifyUrl(notify_url string) error {
+	parsed, err := url.Parse(notify_url)
+	if err != nil {
+		return err
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return fmt.Errorf("Unsupported scheme %q, expected http or https", parsed.Scheme)
+	}
+	return nil
+}
+
+func (n *Notification) slackText() string {
+	status := "failed"
+	switch {
+	case n.Success && len(n.Culprit) > 0:
+		status = "found the first bad commit " + n.Culprit
+	case n.Success:
+		status = "finished without finding a first bad commit"
+	}
+	return fmt.Sprintf("%s bisect of %s (%s..%s) %s after %v", kApplicationName, n.Repo, n.Lo, n.Hi, status,
+		time.Duration(n.DurationSeconds*float64(time.Second)).Round(time.Second))
+}
+
+// POSTs the notification to the webhook, formatted as a generic JSON payload
+// ("json") or as a Slack incoming webhook message ("slack").
+func sendNotification(notify_url string, format string, n *Notification) error {
+	n.DurationSeconds = time.Since(n.start).Seconds()
+	var payload any = n
+	if format == "slack" {
+		payload = map[string]string{"text": n.slackText()}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: kNotifyTimeout}
+	resp, err := client.Post(notify_url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("Webhook responded with %s", resp.Status)
+	}
+	return nil
+}
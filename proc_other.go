@@ -0,0 +1,42 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+func signalProcessTree(pid int, sig syscall.Signal) error {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return p.Signal(sig)
+}
+
+func signalProcessGroup(pgid int, sig syscall.Signal) error {
+	return errors.New("Process groups are not supported on this platform")
+}
+
+// Process groups are not supported, canceling the context of the command
+// only kills it.
+func runInProcessGroup(cmd *exec.Cmd) {}
+
+func killProcessGroup(cmd *exec.Cmd) {}
+
+func exitSignal(state *os.ProcessState) (string, int) {
+	return "", 0
+}
+
+const kDetachSupported = false
+
+func detachedProcAttr() *syscall.SysProcAttr {
+	return nil
+}
+
+func detachOutput() (*os.File, error) {
+	return nil, errors.New("Detaching is not supported on this platform")
+}
@@ -0,0 +1,97 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Signals the process. When the process leads its own process group, the
+// whole group is signaled so that its children are stopped as well.
+func signalProcessTree(pid int, sig syscall.Signal) error {
+	if pgid, err := syscall.Getpgid(pid); err == nil && pgid == pid {
+		return syscall.Kill(-pid, sig)
+	}
+	return syscall.Kill(pid, sig)
+}
+
+// Signals every process of the process group.
+func signalProcessGroup(pgid int, sig syscall.Signal) error {
+	return syscall.Kill(-pgid, sig)
+}
+
+// Starts the command in its own process group, which its children, and
+// theirs, inherit. Canceling its context interrupts the whole group, and kills
+// it if it is still there after kProcessGroupKillDelay, rather than only
+// killing the command and leaving the processes it spawned orphaned.
+func runInProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+	cmd.Cancel = func() error {
+		pgid := cmd.Process.Pid
+		time.AfterFunc(kProcessGroupKillDelay, func() { syscall.Kill(-pgid, syscall.SIGKILL) })
+		return syscall.Kill(-pgid, syscall.SIGINT)
+	}
+	// The processes left in the group may hold the output open.
+	cmd.WaitDelay = kProcessGroupKillDelay
+}
+
+// Kills what is left of the process group of a command started with
+// runInProcessGroup once it exited, e.g. the servers its steps started in
+// the background.
+func killProcessGroup(cmd *exec.Cmd) {
+	if cmd.Process == nil || cmd.SysProcAttr == nil || !(cmd.SysProcAttr.Setpgid || cmd.SysProcAttr.Setsid) {
+		return
+	}
+	if err := syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL); err == nil {
+		gLogger.Printf("Killed the processes left in the group of %s\n", cmd.Path)
+	}
+}
+
+// Returns the name (e.g. SIGSEGV) and number of the signal that terminated
+// the process, or an empty name if it exited normally.
+func exitSignal(state *os.ProcessState) (string, int) {
+	status, ok := state.Sys().(syscall.WaitStatus)
+	if !ok || !status.Signaled() {
+		return "", 0
+	}
+	return unix.SignalName(status.Signal()), int(status.Signal())
+}
+
+// Whether run --detach is supported: the detached process starts its own
+// session, without a controlling terminal.
+const kDetachSupported = true
+
+func detachedProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setsid: true}
+}
+
+// Points stdout and stderr to /dev/null, so that the process survives the
+// exit of the one reading them. Returns the previous stdout.
+func detachOutput() (*os.File, error) {
+	fd, err := unix.Dup(int(os.Stdout.Fd()))
+	if err != nil {
+		return nil, err
+	}
+	stdout := os.NewFile(uintptr(fd), "stdout")
+	devnull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		stdout.Close()
+		return nil, err
+	}
+	defer devnull.Close()
+	for _, target := range []*os.File{os.Stdout, os.Stderr} {
+		if err = unix.Dup2(int(devnull.Fd()), int(target.Fd())); err != nil {
+			stdout.Close()
+			return nil, err
+		}
+	}
+	return stdout, nil
+}
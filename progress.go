@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Bounds of the size estimate done before long operations. Past either
+	// of them the estimate is reported as approximate.
+	kSizeEstimateMaxFiles    = 200000
+	kSizeEstimateMaxDuration = 3 * time.Second
+
+	kProgressInterval = time.Second
+	// Interval between progress lines when the console is not a terminal.
+	kProgressLogInterval = 15 * time.Second
+)
+
+func formatBytes(n int64) string {
+	const unit = 1000
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "kMGTPE"[exp])
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// Computes the total size of the regular files under dir, except those the
+// exclude patterns skip. Huge trees are
+// not walked entirely: the walk stops after kSizeEstimateMaxFiles entries or
+// kSizeEstimateMaxDuration and the returned size is a lower bound.
+func estimateDirSize(dir string, excludes []ExcludePattern) (size int64, approximate bool, err error) {
+	start := time.Now()
+	entries := 0
+	errStop := fmt.Errorf("stop")
+	err = filepath.WalkDir(dir, func(file string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if rel, _ := filepath.Rel(dir, file); rel != "." && isExcluded(excludes, filepath.ToSlash(rel), entry.IsDir()) {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		entries += 1
+		if entries%1000 == 0 && (entries >= kSizeEstimateMaxFiles || time.Since(start) > kSizeEstimateMaxDuration) {
+			return errStop
+		}
+		if entry.Type().IsRegular() {
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+		}
+		return nil
+	})
+	if err == errStop {
+		return size, true, nil
+	}
+	return size, false, err
+}
+
+// Reports the progress of a long operation processing a known amount of
+// bytes. On a terminal the progress is updated in place, otherwise a line is
+// logged periodically.
+type Progress struct {
+	verb        string
+	total       int64
+	approximate bool
+	done        atomic.Int64
+	start       time.Time
+	stop        chan struct{}
+	wg          sync.WaitGroup
+}
+
+// Starts reporting the progress of an operation, e.g. verb="Copying".
+func StartProgress(verb string, total int64, approximate bool) *Progress {
+	p := &Progress{verb: verb, total: total, approximate: approximate, start: time.Now(), stop: make(chan struct{})}
+	estimate := formatBytes(total)
+	if approximate {
+		estimate = fmt.Sprintf("at least %s (approximate)", estimate)
+	}
+	ConsoleLogInfo("%s %s…", verb, estimate)
+
+	interactive := isTerminal(os.Stdout)
+	interval := kProgressInterval
+	if !interactive {
+		interval = kProgressLogInterval
+	}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.stop:
+				if interactive {
+					fmt.Fprint(os.Stdout, "\r\033[K")
+				}
+				return
+			case <-ticker.C:
+				if interactive {
+					fmt.Fprintf(os.Stdout, "\r\033[K    %s", p.status())
+				} else {
+					ConsoleLogInfo("%s", p.status())
+				}
+			}
+		}
+	}()
+	return p
+}
+
+func (p *Progress) status() string {
+	done := p.done.Load()
+	if p.approximate || p.total <= 0 {
+		return fmt.Sprintf("%s %s", p.verb, formatBytes(done))
+	}
+	return fmt.Sprintf("%s %s / %s (%d%%)", p.verb, formatBytes(done), formatBytes(p.total), done*100/p.total)
+}
+
+func (p *Progress) Add(n int64) {
+	if p != nil {
+		p.done.Add(n)
+	}
+}
+
+// Stops reporting and returns the elapsed time and throughput.
+func (p *Progress) Finish() (time.Duration, string) {
+	close(p.stop)
+	p.wg.Wait()
+	elapsed := time.Since(p.start)
+	throughput := int64(float64(p.done.Load()) / max(elapsed.Seconds(), 0.001))
+	return elapsed, formatBytes(throughput) + "/s"
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// The window size of the pseudo-terminal of the steps run with --pty.
+type PtySize struct {
+	Cols uint16
+	Rows uint16
+}
+
+func (s PtySize) String() string {
+	return fmt.Sprintf("%dx%d", s.Cols, s.Rows)
+}
+
+// Parses a COLSxROWS window size.
+func parsePtySize(size string) (PtySize, error) {
+	cols, rows, found := strings.Cut(size, "x")
+	c, cols_err := strconv.ParseUint(cols, 10, 16)
+	r, rows_err := strconv.ParseUint(rows, 10, 16)
+	if !found || cols_err != nil || rows_err != nil || c == 0 || r == 0 {
+		return PtySize{}, fmt.Errorf("Invalid window size %q, expected COLSxROWS, e.g. 80x24", size)
+	}
+	return PtySize{Cols: uint16(c), Rows: uint16(r)}, nil
+}
+
+// Runs the command with its output on a pseudo-terminal, copied to stdout.
+// Called by the wrapper script to start the steps with --pty. Returns the
+// exit status of the command, as the shell reports it.
+func RunPtyExec(size string, command []string) int {
+	// Runs within a step, without the logs of the run.
+	gLogger = log.New(io.Discard, "", 0)
+	pty_size, err := parsePtySize(size)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdin = os.Stdin
+	// The command runs in a session of its own, which an interruption of the
+	// step does not reach: it is passed on.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	wait, err := startWithPty(cmd, pty_size, os.Stdout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to start %s on a pseudo-terminal: %v\n", command[0], err)
+		return 127
+	}
+	go func() {
+		for sig := range signals {
+			signalProcessTree(cmd.Process.Pid, sig.(syscall.Signal))
+		}
+	}()
+	err = wait()
+	var exit_err *exec.ExitError
+	if errors.As(err, &exit_err) {
+		if _, number := exitSignal(exit_err.ProcessState); number > 0 {
+			return 128 + number
+		}
+		return exit_err.ExitCode()
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const kPtySupported = true
+
+// Opens a new pseudo-terminal of the given size. Returns its master and
+// slave sides. The terminal does not translate newlines, so that the output
+// of the steps is logged as they write it.
+func openPty(size PtySize) (*os.File, *os.File, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|unix.O_NOCTTY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	fd := int(master.Fd())
+	if err = unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0); err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("Failed to unlock the pseudo-terminal: %w", err)
+	}
+	number, err := unix.IoctlGetInt(fd, unix.TIOCGPTN)
+	if err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("Failed to get the pseudo-terminal number: %w", err)
+	}
+	slave, err := os.OpenFile(fmt.Sprintf("/dev/pts/%d", number), os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	err = unix.IoctlSetWinsize(int(slave.Fd()), unix.TIOCSWINSZ, &unix.Winsize{Col: size.Cols, Row: size.Rows})
+	if err == nil {
+		var termios *unix.Termios
+		if termios, err = unix.IoctlGetTermios(int(slave.Fd()), unix.TCGETS); err == nil {
+			termios.Oflag &^= unix.ONLCR
+			err = unix.IoctlSetTermios(int(slave.Fd()), unix.TCSETS, termios)
+		}
+	}
+	if err != nil {
+		master.Close()
+		slave.Close()
+		return nil, nil, fmt.Errorf("Failed to set up the pseudo-terminal: %w", err)
+	}
+	return master, slave, nil
+}
+
+// Starts the command with its stdout and stderr on a new pseudo-terminal,
+// which becomes its controlling terminal, and copies what it writes there to
+// output. The returned func waits for the command, kills what is left of its
+// session, and waits for the end of the copy.
+func startWithPty(cmd *exec.Cmd, size PtySize, output io.Writer) (func() error, error) {
+	master, slave, err := openPty(size)
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	// The new session is a process group of its own as well.
+	cmd.SysProcAttr.Setpgid = false
+	cmd.SysProcAttr.Setsid = true
+	cmd.SysProcAttr.Setctty = true
+	// The fd of the terminal in the command, its stdout.
+	cmd.SysProcAttr.Ctty = 1
+	err = cmd.Start()
+	slave.Close()
+	if err != nil {
+		master.Close()
+		return nil, err
+	}
+	copied := make(chan struct{})
+	go func() {
+		// Reading fails with EIO once every process of the terminal
+		// closed it, which ends the copy.
+		io.Copy(output, master)
+		close(copied)
+	}()
+	return func() error {
+		err := cmd.Wait()
+		// The processes left in the session would hold the terminal open,
+		// and the copy with it.
+		killProcessGroup(cmd)
+		<-copied
+		master.Close()
+		return err
+	}, nil
+}
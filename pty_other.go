@@ -0,0 +1,16 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os/exec"
+	"runtime"
+)
+
+const kPtySupported = false
+
+func startWithPty(cmd *exec.Cmd, size PtySize, output io.Writer) (func() error, error) {
+	return nil, fmt.Errorf("Pseudo-terminals are not supported on %s", runtime.GOOS)
+}
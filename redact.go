@@ -0,0 +1,38 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"sync"
+)
+
+const kRedacted = "[REDACTED]"
+
+// Values that must not leave the machine, masked in what xbisect uploads.
+var gSecrets struct {
+	mu     sync.Mutex
+	values []string
+}
+
+// Registers a value to mask. Short values are ignored, masking them would
+// mangle unrelated text.
+func registerSecret(value string) {
+	if len(value) < 4 {
+		return
+	}
+	gSecrets.mu.Lock()
+	defer gSecrets.mu.Unlock()
+	if !slices.Contains(gSecrets.values, value) {
+		gSecrets.values = append(gSecrets.values, value)
+	}
+}
+
+// Masks the registered secrets in s.
+func redactSecrets(s string) string {
+	gSecrets.mu.Lock()
+	defer gSecrets.mu.Unlock()
+	for _, value := range gSecrets.values {
+		s = strings.ReplaceAll(s, value, kRedacted)
+	}
+	return s
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Clones the file with clonefile(2), which preserves the mode.
+func cloneFile(src, dst string, mode fs.FileMode) error {
+	err := unix.Clonefile(src, dst, unix.CLONE_NOFOLLOW)
+	if err != nil {
+		if errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EXDEV) {
+			return errReflinkUnsupported
+		}
+		return err
+	}
+	return os.Chmod(dst, mode.Perm())
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin
+
+package main
+
+import "io/fs"
+
+func cloneFile(src, dst string, mode fs.FileMode) error {
+	return errReflinkUnsupported
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+)
+
+// File at the root of a repo with the defaults of the bisects run on it, read
+// from the hi commit, e.g.
+//
+//	StepPaths = ["test:src/*"]
+//
+//	[[Steps]]
+//	Name = "build"
+//	Command = "make"
+//
+//	[[Steps]]
+//	Name = "test"
+//	Command = "make test"
+const kRepoConfigFileName = ".xbisect.toml"
+
+// The content of the kRepoConfigFileName of a repo. The flags of the run
+// override its fields.
+type RepoBisectConfig struct {
+	Steps []SpecStep
+	// Entries as those of --step-paths, "step:pattern", skipping the step on
+	// the commits changing no file matching the pattern.
+	StepPaths []string
+}
+
+// Reads the repo config of the commit of the repo. Returns nil when the
+// commit has none.
+func readRepoConfig(runner CommandRunner, repodir, commit string) (*RepoBisectConfig, error) {
+	object := commit + ":" + kRepoConfigFileName
+	if _, err := runCommandDirOutput(runner, repodir, gGitPath, "rev-parse", "--verify", "--quiet", object); err != nil {
+		return nil, nil
+	}
+	data, err := runCommandDirOutput(runner, repodir, gGitPath, "cat-file", "blob", object)
+	if err != nil {
+		gLogger.Printf("Error: %v\n", err)
+		return nil, wrapError(err, "Failed to read the %s of %s", kRepoConfigFileName, commit)
+	}
+	config := &RepoBisectConfig{}
+	decoder := toml.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err = decoder.Decode(config); err != nil {
+		gLogger.Printf("Error: %v\n", err)
+		var strict_err *toml.StrictMissingError
+		if errors.As(err, &strict_err) && len(strict_err.Errors) > 0 {
+			key := strings.Join(strict_err.Errors[0].Key(), ".")
+			return nil, fmt.Errorf("Invalid %s of %s: unknown key %q. Disable it with --no-repo-config.",
+				kRepoConfigFileName, commit, key)
+		}
+		return nil, fmt.Errorf("Invalid %s of %s: %w", kRepoConfigFileName, commit, err)
+	}
+	if err = validateSpecSteps(config.Steps); err != nil {
+		return nil, fmt.Errorf("Invalid %s of %s: %w", kRepoConfigFileName, commit, err)
+	}
+	gLogger.Printf("%s of %s:\n%s\n", kRepoConfigFileName, commit, data)
+	return config, nil
+}
+
+// Sets the options left unset to the values of the repo config. Those given
+// on the command line win, which is logged for the user to know which value
+// the run uses. Fails when the steps given on the command line have no
+// command in the repo config to run.
+func (c *RepoBisectConfig) apply(opts *RunOptions) error {
+	if len(c.Steps) > 0 {
+		if len(opts.Steps) > 0 || len(opts.StepsFile) > 0 {
+			ConsoleLogInfo("--steps or --steps-file override the steps of %s", kRepoConfigFileName)
+		} else {
+			for _, step := range c.Steps {
+				opts.Steps = append(opts.Steps, step.Name)
+			}
+		}
+		if len(opts.Script) > 0 || len(opts.ScriptFile) > 0 || len(opts.Cmd) > 0 {
+			ConsoleLogInfo("--script or --cmd override the commands of the steps of %s", kRepoConfigFileName)
+		} else if err := checkStepsDeclared(opts.Steps, c.Steps, kRepoConfigFileName); err != nil {
+			return fmt.Errorf("Invalid --steps: %w", err)
+		} else {
+			opts.Cmd = stepsCommand(c.Steps)
+		}
+	}
+	if len(c.StepPaths) > 0 {
+		if len(opts.StepPaths) > 0 {
+			ConsoleLogInfo("--step-paths overrides the StepPaths of %s", kRepoConfigFileName)
+		} else {
+			opts.StepPaths = c.StepPaths
+		}
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/template"
+
+	charmlog "github.com/charmbracelet/log"
+)
+
+// The --summary-format values.
+const (
+	kSummaryFormatTable = "table"
+	kSummaryFormatTree  = "tree"
+)
+
+// The default summary: one line per executed step of each tested commit.
+// Each line of the rendered output is logged to the console.
+const kDefaultReportTemplate = `{{range .Commits}}{{$commit := .}}
+{{- if .CaseCollision}}{{.Hash}} {{stepName "checkout"}} {{skipped "case collision"}}
+{{else if .CheckoutFailed}}{{.Hash}} {{stepName "checkout"}} {{skipped "checkout failed"}}
+{{else if .Excluded}}{{.Hash}} {{stepName "filter"}} {{skipped (printf "%s commit" .Excluded)}}
+{{end}}
+{{- range .StepResults}}{{$commit.Hash}} {{stepName .Name}}{{if .Matrix}} [{{.Matrix}}]{{end}} {{verdict .}}
+{{end}}{{end}}
+{{- if .Candidates}}Inconclusive: {{len .Candidates}} candidate commits remain, all skipped:
+{{range .Candidates}}  {{.Hash}} {{.Subject}}
+{{end}}{{end}}`
+
+// The data exposed to the report templates.
+type BisectReport struct {
+	Repo    string         `json:"repo"`
+	Lo      string         `json:"lo"`
+	Hi      string         `json:"hi"`
+	Commits []CommitResult `json:"commits"`
+	// Hash of the first bad commit. Empty if the bisect did not find it.
+	Culprit string `json:"culprit"`
+	// The SVN revision of Culprit, e.g. r1234, when the repo was converted
+	// from SVN.
+	CulpritSvnRevision string `json:"culprit_svn_revision"`
+	// The author, as name <email>, and the subject of Culprit.
+	CulpritAuthor  string `json:"culprit_author"`
+	CulpritSubject string `json:"culprit_subject"`
+	// When only skipped commits were left to test, the commits any of which
+	// may be the first bad commit.
+	Candidates []CandidateCommit `json:"candidates"`
+	// The first bad commit given with --expect-culprit, and whether Culprit
+	// is that commit. Empty if none was given.
+	ExpectedCulprit   string `json:"expected_culprit"`
+	CulpritAsExpected bool   `json:"culprit_as_expected"`
+	// kModeFix when Culprit is the first commit whose steps pass, empty for
+	// a regression.
+	Mode string `json:"mode"`
+}
+
+type CandidateCommit struct {
+	Hash    string `json:"hash"`
+	Subject string `json:"subject"`
+}
+
+// Looks up the subjects of the candidate commits.
+func describeCandidates(runner CommandRunner, dir string, hashes []string) ([]CandidateCommit, error) {
+	out, err := runCommandDirOutput(runner, dir, append([]string{gGitPath, "show", "-s", "--format=%H%x00%s"}, hashes...)...)
+	if err != nil {
+		return nil, err
+	}
+	var candidates []CandidateCommit
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		hash, subject, _ := strings.Cut(line, "\x00")
+		candidates = append(candidates, CandidateCommit{Hash: hash, Subject: subject})
+	}
+	return candidates, nil
+}
+
+// Prints the first bad commit with its subject, whatever the level of the
+// console, for --bisect-first-bad-only.
+func printFirstBadCommit(runner CommandRunner, dir string, report *BisectReport) {
+	gConsoleLogger.SetLevel(charmlog.InfoLevel)
+	out, err := runCommandDirOutput(runner, dir, gGitPath, "show", "-s", "--format=%h%x00%s", report.Culprit)
+	if err != nil {
+		gLogger.Printf("Error: %v\n", err)
+		ConsoleLogInfo("%s: %s%s", report.culpritLabel(), report.Culprit, report.svnSuffix())
+		return
+	}
+	short, subject, _ := strings.Cut(strings.TrimSpace(string(out)), "\x00")
+	ConsoleLogInfo("%s: %s%s%s%s %s", report.culpritLabel(), kFontBold, short, kConsoleReset, report.svnSuffix(), subject)
+}
+
+// Looks up the author and subject of the culprit in the repo at dir. They
+// are left empty when that fails, the hash being what matters.
+func (r *BisectReport) describeCulprit(runner CommandRunner, dir string) {
+	if len(r.Culprit) == 0 {
+		return
+	}
+	out, err := runCommandDirOutput(runner, dir, gGitPath, "show", "-s", "--format=%an <%ae>%x00%s", r.Culprit)
+	if err != nil {
+		gLogger.Printf("Failed to describe %s: %v\n", r.Culprit, err)
+		return
+	}
+	r.CulpritAuthor, r.CulpritSubject, _ = strings.Cut(strings.TrimSpace(string(out)), "\x00")
+}
+
+// Prints the author and subject of the culprit, under the line giving its
+// hash.
+func (r *BisectReport) printCulpritDetails() {
+	if len(r.CulpritAuthor) > 0 {
+		ConsoleLogInfo("  Author:  %s", r.CulpritAuthor)
+	}
+	if len(r.CulpritSubject) > 0 {
+		ConsoleLogInfo("  Subject: %s%s%s", kFontBold, r.CulpritSubject, kConsoleReset)
+	}
+}
+
+// How the culprit is printed on the console, depending on the mode.
+func (r *BisectReport) culpritLabel() string {
+	if r.Mode == kModeFix {
+		return "First fixed commit"
+	}
+	return "First bad commit"
+}
+
+// The SVN revision of the culprit to append to it for console output, if
+// any.
+func (r *BisectReport) svnSuffix() string {
+	if len(r.CulpritSvnRevision) == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" (SVN %s)", r.CulpritSvnRevision)
+}
+
+// Records the expected culprit, if any, and whether the bisect found it.
+func (r *BisectReport) SetExpectedCulprit(expected string) {
+	r.ExpectedCulprit = expected
+	r.CulpritAsExpected = len(expected) > 0 && r.Culprit == expected
+}
+
+// Returns an error if a culprit was expected and the bisect did not find it.
+func (r *BisectReport) ExpectationError() error {
+	if len(r.ExpectedCulprit) == 0 || r.CulpritAsExpected {
+		return nil
+	}
+	found := r.Culprit
+	if len(found) == 0 {
+		found = "none"
+	}
+	return fmt.Errorf("%w: expected %s, found %s", ErrUnexpectedCulprit, r.ExpectedCulprit, found)
+}
+
+var gReportTemplateFuncs = template.FuncMap{
+	"verdict":      formatStepVerdict,
+	"plainVerdict": stepVerdict,
+	"stepName": func(name string) string {
+		return fmt.Sprintf("%s%12s%s", kColorCyan, name, kConsoleReset)
+	},
+	"skipped": func(reason string) string {
+		return fmt.Sprintf("%s%sSKIP%s (%s)", kFontBold, kColorGray, kConsoleReset, reason)
+	},
+	"short": func(hash string) string {
+		if len(hash) > 12 {
+			return hash[:12]
+		}
+		return hash
+	},
+}
+
+// Parses the report template from the given file, or the default template
+// when the file is empty.
+func loadReportTemplate(file string) (*template.Template, error) {
+	if len(file) == 0 {
+		return template.New("default").Funcs(gReportTemplateFuncs).Parse(kDefaultReportTemplate)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return template.New(file).Funcs(gReportTemplateFuncs).Parse(string(data))
+}
+
+// Renders the report. The output of the default template is logged line by
+// line to the console, while custom templates are written to stdout as is so
+// that they are in full control of the format.
+func renderReport(tmpl *template.Template, custom bool, report *BisectReport) error {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, report); err != nil {
+		return err
+	}
+	if custom {
+		_, err := io.WriteString(gConsoleOutput, consoleText(buf.String()))
+		return err
+	}
+	for _, line := range strings.Split(strings.TrimRight(buf.String(), "\n"), "\n") {
+		if len(line) > 0 {
+			ConsoleLogInfo("%s", line)
+		}
+	}
+	return nil
+}
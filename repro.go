@@ -0,0 +1,110 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Flags of a run left out of the command reproducing it, and whether they
+// take a value. The range ones are replaced by the resolved --lo and --hi,
+// the others only matter to the run that was started.
+var kReproDroppedFlags = map[string]bool{
+	"--lo":            true,
+	"--hi":            true,
+	"--back":          true,
+	"--since-tag":     true,
+	"--until-tag":     true,
+	"--last-release":  false,
+	"--fetch":         false,
+	"--preview":       false,
+	"--detach":        false,
+	"--detached":      false,
+	"--print-repro":   false,
+	"--notify":        true,
+	"--share":         true,
+	"--keep-n-caches": true,
+}
+
+// Names of the vars whose --env value is left out of the command reproducing
+// the run.
+var gSecretEnvNameRe = regexp.MustCompile(`(?i)TOKEN|SECRET|PASSWORD|PASSWD|CREDENTIAL|API_?KEY|PRIVATE`)
+
+// Returns the args of the run with the range pinned to lo and hi, and
+// without the flags that only matter to the run that was started.
+func reproArgs(args []string, lo, hi string) []string {
+	var repro []string
+	pinned := false
+	pin := func() {
+		if !pinned {
+			if len(lo) > 0 {
+				repro = append(repro, "--lo", lo)
+			}
+			repro = append(repro, "--hi", hi)
+			pinned = true
+		}
+	}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			pin()
+			return append(repro, args[i:]...)
+		}
+		name, _, has_value := strings.Cut(arg, "=")
+		takes_value, dropped := kReproDroppedFlags[name]
+		if !dropped {
+			repro = append(repro, arg)
+			if arg == "run" {
+				pin()
+			}
+			continue
+		}
+		if takes_value && !has_value {
+			// The value is the next arg.
+			i++
+		}
+	}
+	pin()
+	return repro
+}
+
+// Quotes an arg of the command reproducing the run, leaving out the value
+// of the --env vars named like secrets.
+func quoteReproArg(previous, arg string) string {
+	if previous == "--env" || strings.HasPrefix(arg, "--env=") {
+		prefix, env := "", arg
+		if previous != "--env" {
+			prefix, env = "--env=", strings.TrimPrefix(arg, "--env=")
+		}
+		if name, _, found := strings.Cut(env, "="); found && gSecretEnvNameRe.MatchString(name) {
+			// Taken from the env of whoever runs the command.
+			return prefix + `"` + name + `=$` + name + `"`
+		}
+	}
+	return displayArg(arg)
+}
+
+// Returns the shell command running the same bisect as the run with the
+// args, on the range from lo to hi. The registered secrets are masked.
+func reproCommand(args []string, lo, hi string) string {
+	command := []string{kApplicationName}
+	previous := ""
+	for _, arg := range reproArgs(args, lo, hi) {
+		command = append(command, quoteReproArg(previous, arg))
+		previous = arg
+	}
+	return redactSecrets(strings.Join(command, " "))
+}
+
+// Pins the range of a finished run to hashes and prints the command
+// reproducing it.
+func printReproCommand(runner CommandRunner, dir string, args []string, lo, hi string) {
+	if len(lo) > 0 {
+		lo_hash, err := resolveRef(runner, dir, lo)
+		if err != nil {
+			gLogger.Printf("Failed to resolve lo for the reproduction command: %v\n", err)
+			return
+		}
+		lo = lo_hash
+	}
+	ConsoleLogInfo("Reproduce this bisect with: %s", reproCommand(args, lo, hi))
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// What a run sets up for its steps, besides the script, that can change the
+// exit status of a step on a commit.
+type StepResultsInputs struct {
+	// The --env and passed through vars, as NAME=value.
+	Env         []string
+	CleanEnv    bool
+	IsolateHome bool
+	Matrix      []string
+	// The sha256 of the stdin file of each step.
+	Stdin        map[string]string
+	StepWorkdirs map[string]string
+	StepTimeout  string
+	OnTimeout    string
+	Pty          string
+	GitConfig    []string
+	Excludes     []string
+	// Zero when each step runs once.
+	AttemptsPerCommit int
+	VerdictPolicy     string
+}
+
+// The inputs of the steps of a run, from its metadata and the values of the
+// env vars it only records the names of.
+func newStepResultsInputs(metadata *RunMetadata, env []string) StepResultsInputs {
+	inputs := StepResultsInputs{Env: env, CleanEnv: metadata.CleanEnv, IsolateHome: metadata.IsolateHome,
+		Matrix: metadata.Matrix, StepWorkdirs: metadata.StepWorkdirs, StepTimeout: metadata.StepTimeout,
+		OnTimeout: metadata.OnTimeout, Pty: metadata.Pty, GitConfig: metadata.GitConfig, Excludes: metadata.Excludes,
+		AttemptsPerCommit: metadata.AttemptsPerCommit, VerdictPolicy: metadata.VerdictPolicy}
+	for _, name := range metadata.EnvPassthrough {
+		if value, ok := os.LookupEnv(name); ok {
+			inputs.Env = append(inputs.Env, name+"="+value)
+		}
+	}
+	if len(metadata.Stdin) > 0 {
+		inputs.Stdin = map[string]string{}
+		for _, stdin := range metadata.Stdin {
+			inputs.Stdin[stdin.Step] = stdin.Sha256
+		}
+	}
+	return inputs
+}
+
+// The dir of the step results recorded with --reuse-results and by warm, for
+// the repo and the script with its inputs. Results are recorded per commit
+// and step, as the exit status of the step, and are only reused by runs with
+// the same script and inputs.
+func stepResultsDir(prefix string, script string, inputs StepResultsInputs) string {
+	hash := sha256.New()
+	hash.Write([]byte(script))
+	hash.Write([]byte{0})
+	// Maps are printed sorted by key.
+	fmt.Fprintf(hash, "%+v", inputs)
+	return path.Join(GetAppDataDir(), "results", prefix, fmt.Sprintf("%x", hash.Sum(nil))[:16])
+}
+
+// Removes the recorded step results.
+func cleanStepResults() (int64, error) {
+	resultsdir := path.Join(GetAppDataDir(), "results")
+	size, err := removeDirFreed(resultsdir)
+	if err != nil {
+		gLogger.Printf("Error: %v\n", err)
+		return size, wrapError(err, "Failed to remove the step results dir")
+	}
+	return size, nil
+}
+
+// Reports how many of the step results of the commits were reused.
+func printReuseRate(commits []CommitResult) {
+	ran, reused := 0, 0
+	for _, commit := range commits {
+		for _, step := range commit.StepResults {
+			if step.SkippedByPaths || step.SkippedByWorkdir || step.SkippedByCondition || step.Name == kSizeStepName {
+				continue
+			}
+			ran += 1
+			if step.Reused {
+				reused += 1
+			}
+		}
+	}
+	if ran == 0 {
+		return
+	}
+	ConsoleLogInfo("Reused %d of %d step results (%d%%)", reused, ran, reused*100/ran)
+}
+
+type WarmOptions struct {
+	Repo string
+	// The range to warm, as lo..hi.
+	Range string
+	Step  string
+	// File of the script run for the step.
+	Script string
+	// The number of candidates to run the step on.
+	Max int
+}
+
+// Lists the commits between lo and hi in the order git bisect is the most
+// likely to test them, the best bisection points first.
+func listBisectCandidates(runner CommandRunner, dir, lo, hi string) ([]string, error) {
+	out, err := runCommandDirOutput(runner, dir, gGitPath, "rev-list", "--bisect-all", hi, "^"+lo)
+	if err != nil {
+		return nil, err
+	}
+	var candidates []string
+	scanner := bufio.NewScanner(strings.NewReader(string(out)))
+	for scanner.Scan() {
+		// Each line is "<hash> (dist=<n>)".
+		if fields := strings.Fields(scanner.Text()); len(fields) > 0 {
+			candidates = append(candidates, fields[0])
+		}
+	}
+	return candidates, nil
+}
+
+// Runs the step on the commits of the range most likely to be tested by a
+// bisect, recording their results for the runs with --reuse-results.
+func RunWarm(opts WarmOptions) (success bool) {
+	lo, hi, found := strings.Cut(opts.Range, "..")
+	if !found || len(lo) == 0 || len(hi) == 0 {
+		ConsoleLogError("Invalid --range %q, expected lo..hi", opts.Range)
+		return false
+	}
+	if opts.Max <= 0 {
+		ConsoleLogError("--max must be positive.")
+		return false
+	}
+	setup, err := SetupRun(&ExecRunner{}, RunOptions{Repo: opts.Repo, Lo: lo, Hi: hi, Steps: []string{opts.Step},
+		ScriptFile: opts.Script, ReuseResults: true})
+	defer func() { setup.Cleanup(success) }()
+	if err != nil {
+		ConsoleLogErr(err)
+		return false
+	}
+	candidates, err := listBisectCandidates(setup.Runner, setup.CacheRepo, setup.Metadata.Lo, setup.Metadata.Hi)
+	if err != nil {
+		gLogger.Printf("Error: %v\n", err)
+		ConsoleLogError("Failed to list the bisect candidates between %s and %s", lo, hi)
+		return false
+	}
+	candidates = candidates[:min(opts.Max, len(candidates))]
+	ConsoleLogInfo("Warming %d commits", len(candidates))
+	warmed := 0
+	for i, hash := range candidates {
+		ConsoleLogInfo("[%d/%d] %s", i+1, len(candidates), hash)
+		result, err := sweepCommit(setup, hash, false)
+		if gInterrupted.Load() {
+			// The results of the commits already run are kept.
+			ConsoleLogError("Warm aborted after %d commits", warmed)
+			return false
+		}
+		if err != nil {
+			gLogger.Printf("Error: %v\n", err)
+			ConsoleLogError("Failed to run the step on commit %s", hash)
+			return false
+		}
+		for _, step := range result.StepResults {
+			ConsoleLogInfo("%s %s%12s%s %s", hash, kColorCyan, step.Name, kConsoleReset, formatStepVerdict(step))
+		}
+		warmed += 1
+	}
+	ConsoleLogInfo("Recorded the results of %d commits in %s", warmed, setup.ResultsDir)
+	return true
+}
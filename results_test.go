@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestStepResultsDirInputs(t *testing.T) {
+	base := func() StepResultsInputs {
+		return StepResultsInputs{Env: []string{"A=1"}, StepWorkdirs: map[string]string{"test": "src"}}
+	}
+	dir := stepResultsDir("foo", "script", base())
+	if again := stepResultsDir("foo", "script", base()); again != dir {
+		t.Errorf("stepResultsDir() = %s then %s for the same inputs", dir, again)
+	}
+	changes := map[string]func(*StepResultsInputs){
+		"env value":   func(i *StepResultsInputs) { i.Env = []string{"A=2"} },
+		"passthrough": func(i *StepResultsInputs) { i.Env = append(i.Env, "TOKEN=x") },
+		"clean env":   func(i *StepResultsInputs) { i.CleanEnv = true },
+		"home":        func(i *StepResultsInputs) { i.IsolateHome = true },
+		"matrix":      func(i *StepResultsInputs) { i.Matrix = []string{"CC=clang"} },
+		"stdin":       func(i *StepResultsInputs) { i.Stdin = map[string]string{"test": "abcd"} },
+		"workdir":     func(i *StepResultsInputs) { i.StepWorkdirs["test"] = "lib" },
+		"timeout":     func(i *StepResultsInputs) { i.StepTimeout = "5m0s" },
+		"on timeout":  func(i *StepResultsInputs) { i.OnTimeout = kOnTimeoutFail },
+		"pty":         func(i *StepResultsInputs) { i.Pty = "80x24" },
+		"git config":  func(i *StepResultsInputs) { i.GitConfig = []string{"core.autocrlf=true"} },
+		"excludes":    func(i *StepResultsInputs) { i.Excludes = []string{"vendor/"} },
+		"attempts":    func(i *StepResultsInputs) { i.AttemptsPerCommit = 3 },
+	}
+	for name, change := range changes {
+		inputs := base()
+		change(&inputs)
+		if got := stepResultsDir("foo", "script", inputs); got == dir {
+			t.Errorf("%s: stepResultsDir() unchanged", name)
+		}
+	}
+	if got := stepResultsDir("foo", "other script", base()); got == dir {
+		t.Errorf("script: stepResultsDir() unchanged")
+	}
+}
+
+func TestNewStepResultsInputsPassthrough(t *testing.T) {
+	t.Setenv("XBISECT_TEST_TOKEN", "secret")
+	metadata := &RunMetadata{EnvPassthrough: []string{"XBISECT_TEST_TOKEN", "XBISECT_TEST_UNSET"},
+		Stdin: []StdinInfo{{Step: "test", Path: "/tmp/in", Sha256: "abcd"}}}
+	inputs := newStepResultsInputs(metadata, []string{"A=1"})
+	if len(inputs.Env) != 2 || inputs.Env[1] != "XBISECT_TEST_TOKEN=secret" {
+		t.Errorf("Env = %q, want the --env then the passed through values", inputs.Env)
+	}
+	if inputs.Stdin["test"] != "abcd" {
+		t.Errorf("Stdin = %v, want the sha256 of the stdin file", inputs.Stdin)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+)
+
+type CommandOptions struct {
+	// Working directory of the command. Empty is the current directory.
+	Dir string
+	// Vars (NAME=value) added to the env of the command.
+	Env []string
+	// Connected to the stdin of the command when not nil.
+	Stdin io.Reader
+	// How long the command may run before it is killed and ErrCommandTimeout
+	// returned. 0 is no limit.
+	Timeout time.Duration
+}
+
+// Runs the external commands of the import and bisect code paths. Each
+// operation passes its runner down to the code running its commands, so that
+// they can be recorded rather than executed.
+type CommandRunner interface {
+	// Runs the command, its output going to the log.
+	Run(opts CommandOptions, command ...string) error
+	// Runs the command and returns its stdout.
+	RunOutput(opts CommandOptions, command ...string) ([]byte, error)
+	// Removes path and everything under it, as rm -rf.
+	RemoveAll(path string) error
+}
+
+// Executes the commands, logging them.
+type ExecRunner struct{}
+
+// Returns the command along with the context enforcing its timeout, to
+// cancel once it is done.
+func (r *ExecRunner) command(opts CommandOptions, command []string) (*exec.Cmd, context.Context, context.CancelFunc) {
+	gLogger.Printf("Running command: %s\n", strings.Join(command, " "))
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if opts.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+	}
+	cmd := newCommand(ctx, command)
+	if opts.Timeout > 0 {
+		// Not to wait on children left holding the output once it is
+		// killed.
+		cmd.WaitDelay = time.Second
+	}
+	if len(opts.Env) > 0 {
+		if cmd.Env == nil {
+			cmd.Env = os.Environ()
+		}
+		cmd.Env = append(cmd.Env, opts.Env...)
+	}
+	cmd.Stdin = opts.Stdin
+	cmd.Dir = opts.Dir
+	return cmd, ctx, cancel
+}
+
+// The error of the command, ErrCommandTimeout if it was killed for running
+// past its timeout.
+func commandError(ctx context.Context, opts CommandOptions, command []string, err error) error {
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w after %s: %s", ErrCommandTimeout, opts.Timeout, strings.Join(command, " "))
+	}
+	return gitCommandError(command, err)
+}
+
+func (r *ExecRunner) Run(opts CommandOptions, command ...string) error {
+	if len(command) < 1 {
+		return fmt.Errorf("Empty command")
+	}
+	cmd, ctx, cancel := r.command(opts, command)
+	defer cancel()
+	cmd.Stdout = gLogFileHandler
+	cmd.Stderr = gLogFileHandler
+	return commandError(ctx, opts, command, cmd.Run())
+}
+
+func (r *ExecRunner) RunOutput(opts CommandOptions, command ...string) ([]byte, error) {
+	if len(command) < 1 {
+		return nil, fmt.Errorf("Empty command")
+	}
+	cmd, ctx, cancel := r.command(opts, command)
+	defer cancel()
+	out, err := cmd.Output()
+	return out, commandError(ctx, opts, command, err)
+}
+
+func (r *ExecRunner) RemoveAll(path string) error {
+	return os.RemoveAll(path)
+}
+
+// The git commands only reading the repo, which a dry run executes so that
+// the revs are still resolved and validated.
+var kReadOnlyGitCommands = []string{
+	"cat-file", "describe", "for-each-ref", "log", "ls-remote", "merge-base",
+	"rev-list", "rev-parse", "show-ref", "status", "symbolic-ref", "version", "--version",
+}
+
+// Records the commands changing something instead of executing them. The
+// read-only git commands are passed on to Next.
+type DryRunRunner struct {
+	Next     CommandRunner
+	Commands []string
+}
+
+func (r *DryRunRunner) readOnly(command []string) bool {
+	if command[0] != gGitPath || len(command) < 2 {
+		return false
+	}
+	return slices.Contains(kReadOnlyGitCommands, command[1]) || (command[1] == "tag" && slices.Contains(command, "--list")) ||
+		(command[1] == "svn" && len(command) > 2 && slices.Contains([]string{"--version", "find-rev"}, command[2]))
+}
+
+func (r *DryRunRunner) Run(opts CommandOptions, command ...string) error {
+	if len(command) < 1 {
+		return fmt.Errorf("Empty command")
+	}
+	if r.readOnly(command) {
+		return r.Next.Run(opts, command...)
+	}
+	r.Record(opts.Dir, command...)
+	return nil
+}
+
+func (r *DryRunRunner) RunOutput(opts CommandOptions, command ...string) ([]byte, error) {
+	if len(command) < 1 {
+		return nil, fmt.Errorf("Empty command")
+	}
+	if r.readOnly(command) {
+		return r.Next.RunOutput(opts, command...)
+	}
+	r.Record(opts.Dir, command...)
+	return nil, nil
+}
+
+func (r *DryRunRunner) RemoveAll(path string) error {
+	r.Record("", "rm", "-rf", path)
+	return nil
+}
+
+// Quotes the argument for display, unless it does not need quoting.
+func displayArg(arg string) string {
+	if gPlainShellWordRe.MatchString(arg) {
+		return arg
+	}
+	return shellQuote(arg)
+}
+
+// Records a command that is not run through the runner.
+func (r *DryRunRunner) Record(dir string, command ...string) {
+	line := make([]string, len(command))
+	for i, arg := range command {
+		line[i] = displayArg(arg)
+	}
+	if command[0] == gGitPath {
+		line[0] = "git"
+		if len(dir) > 0 {
+			line = slices.Insert(line, 1, "-C", displayArg(dir))
+		}
+	} else if len(dir) > 0 {
+		line = slices.Insert(line, 0, "cd", displayArg(dir), "&&")
+	}
+	r.Commands = append(r.Commands, strings.Join(line, " "))
+}
+
+// Prints the recorded commands.
+func (r *DryRunRunner) Print() {
+	ConsoleLogInfo("Dry run, nothing was changed. The commands that would run:")
+	for _, command := range r.Commands {
+		fmt.Fprintln(gConsoleOutput, "  "+command)
+	}
+}
+
+// Whether the runner records the commands rather than executing them.
+func isDryRun(runner CommandRunner) bool {
+	_, ok := runner.(*DryRunRunner)
+	return ok
+}
+
+// Runs op with the runner of its commands: one recording and printing them
+// rather than executing them when dry_run is set.
+func withDryRun(dry_run bool, op func(runner CommandRunner) error) error {
+	if !dry_run {
+		return op(&ExecRunner{})
+	}
+	runner := &DryRunRunner{Next: &ExecRunner{}}
+	if err := op(runner); err != nil {
+		return err
+	}
+	runner.Print()
+	return nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Records the commands instead of running them, answering those of outputs,
+// keyed by their args joined with spaces, and failing the others. Removals
+// are recorded as rm -rf.
+type fakeRunner struct {
+	outputs  map[string]string
+	errors   map[string]error
+	commands []string
+}
+
+func (r *fakeRunner) RunOutput(opts CommandOptions, command ...string) ([]byte, error) {
+	key := strings.Join(command, " ")
+	r.commands = append(r.commands, key)
+	if err, ok := r.errors[key]; ok {
+		return nil, err
+	}
+	if out, ok := r.outputs[key]; ok {
+		return []byte(out), nil
+	}
+	return nil, errors.New("unexpected command: " + key)
+}
+
+func (r *fakeRunner) Run(opts CommandOptions, command ...string) error {
+	_, err := r.RunOutput(opts, command...)
+	return err
+}
+
+func (r *fakeRunner) RemoveAll(path string) error {
+	r.commands = append(r.commands, "rm -rf "+path)
+	return nil
+}
+
+func TestDetectDefaultBranch(t *testing.T) {
+	git := gGitPath
+	tests := []struct {
+		name    string
+		mirror  bool
+		outputs map[string]string
+		want    string
+	}{
+		{"origin HEAD", false, map[string]string{git + " symbolic-ref --short refs/remotes/origin/HEAD": "origin/trunk\n"}, "trunk"},
+		{"mirror", true, map[string]string{git + " symbolic-ref --short HEAD": "develop\n"}, "develop"},
+		{"guessed", false, map[string]string{git + " rev-parse --quiet --verify refs/remotes/origin/master": ""}, "master"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := detectDefaultBranch(&fakeRunner{outputs: tt.outputs}, "/repo", tt.mirror)
+			if err != nil || got != tt.want {
+				t.Errorf("detectDefaultBranch() = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+	if got, err := detectDefaultBranch(&fakeRunner{}, "/repo", false); err == nil {
+		t.Errorf("detectDefaultBranch() = %q without any branch, want an error", got)
+	}
+}
+
+func TestCountCommitsTimeout(t *testing.T) {
+	runner := &fakeRunner{
+		errors:  map[string]error{gGitPath + " rev-list --count lo..hi": ErrCommandTimeout},
+		outputs: map[string]string{gGitPath + " rev-list --count --first-parent lo..hi": "42\n"},
+	}
+	count, first_parent := countCommits(runner, "/repo", "lo", "hi")
+	if count != 42 || !first_parent {
+		t.Errorf("countCommits() = %d, %t, want the first-parent count 42", count, first_parent)
+	}
+	runner.errors[gGitPath+" rev-list --count --first-parent lo..hi"] = ErrCommandTimeout
+	if count, _ = countCommits(runner, "/repo", "lo", "hi"); count != -1 {
+		t.Errorf("countCommits() = %d when both counts time out, want -1", count)
+	}
+}
+
+func TestImportGitRepoCommands(t *testing.T) {
+	setupTestAppData(t)
+	clonedir := filepath.Join(GetAppDataDir(), "repos", "foo")
+	clone := gGitPath + " clone --depth=1 --no-single-branch https://example.com/foo.git " + clonedir
+	symbolic_ref := gGitPath + " symbolic-ref --short refs/remotes/origin/HEAD"
+	runner := &fakeRunner{outputs: map[string]string{clone: "", symbolic_ref: "origin/trunk\n"}}
+	if err := ImportGitRepo(runner, "https://example.com/foo.git", "", "foo", CloneOptions{Depth: 1}, CloneHooks{}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"rm -rf " + clonedir, clone, symbolic_ref}; !reflect.DeepEqual(runner.commands, want) {
+		t.Errorf("ran %q, want %q", runner.commands, want)
+	}
+	repo := gConfig.GetRepo("foo")
+	if repo == nil || repo.LocalPath != clonedir || repo.DefaultBranch != "trunk" || !repo.Shallow {
+		t.Errorf("imported %+v", repo)
+	}
+}
+
+func TestStartBisectCommands(t *testing.T) {
+	for _, first_parent := range []bool{false, true} {
+		start := gGitPath + " bisect start --no-checkout"
+		if first_parent {
+			start += " --first-parent"
+		}
+		want := []string{gGitPath + " bisect reset", start, gGitPath + " bisect good lo", gGitPath + " bisect bad hi"}
+		outputs := map[string]string{}
+		for _, command := range want {
+			outputs[command] = ""
+		}
+		runner := &fakeRunner{outputs: outputs}
+		if err := startBisect(runner, "/repo", "lo", "hi", first_parent); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(runner.commands, want) {
+			t.Errorf("ran %q, want %q", runner.commands, want)
+		}
+	}
+	// The sequence stops at the first failing command.
+	runner := &fakeRunner{outputs: map[string]string{gGitPath + " bisect reset": ""}}
+	if err := startBisect(runner, "/repo", "lo", "hi", false); err == nil || len(runner.commands) != 2 {
+		t.Errorf("startBisect() = %v after running %q, want an error after the start", err, runner.commands)
+	}
+}
+
+func TestCloneRepoDryRun(t *testing.T) {
+	clonedir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(clonedir, "kept"), nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeRunner{}
+	runner := &DryRunRunner{Next: fake}
+	if err := cloneGitRepo(runner, "https://example.com/foo.git", clonedir, "--depth=1"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"rm -rf " + displayArg(clonedir),
+		"git clone --depth=1 https://example.com/foo.git " + displayArg(clonedir),
+	}
+	if !reflect.DeepEqual(runner.Commands, want) {
+		t.Errorf("recorded %q, want %q", runner.Commands, want)
+	}
+	if len(fake.commands) > 0 {
+		t.Errorf("ran %q in a dry run", fake.commands)
+	}
+	if !filepathExists(filepath.Join(clonedir, "kept")) {
+		t.Errorf("the dry run removed %s", clonedir)
+	}
+}
+
+func TestDryRunRunnerPassesReadOnlyCommands(t *testing.T) {
+	fake := &fakeRunner{outputs: map[string]string{gGitPath + " rev-parse --verify HEAD^{commit}": "abcd\n"}}
+	runner := &DryRunRunner{Next: fake}
+	if hash, err := resolveRef(runner, "/repo", "HEAD"); err != nil || hash != "abcd" {
+		t.Errorf("resolveRef() = %q, %v through the dry run", hash, err)
+	}
+	if err := fetchRepo(runner, &RepoInfo{LocalPath: "/repo", Remote: "https://example.com/foo.git"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.commands) != 1 {
+		t.Errorf("ran %q, want only the rev-parse", fake.commands)
+	}
+	if want := []string{"git -C /repo fetch --quiet --tags origin"}; !reflect.DeepEqual(runner.Commands, want) {
+		t.Errorf("recorded %q, want %q", runner.Commands, want)
+	}
+}
+
+func TestWithDryRunPassesTheRunner(t *testing.T) {
+	for _, dry_run := range []bool{false, true} {
+		err := withDryRun(dry_run, func(runner CommandRunner) error {
+			if isDryRun(runner) != dry_run {
+				t.Errorf("withDryRun(%t) passed a %T", dry_run, runner)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+
+	charmlog "github.com/charmbracelet/log"
+)
+
+// The number of commits of the repo generated by selftest, and the one, from
+// 1, planting the bug the bisect must find.
+const (
+	kSelftestCommits = 20
+	kSelftestCulprit = 13
+)
+
+// The step script of selftest: the commits with the planted bug fail.
+const kSelftestScript = `#!/bin/sh
+# Generated by xbisect selftest.
+test ! -e bug
+`
+
+// Creates a git repo in dir with kSelftestCommits commits, the
+// kSelftestCulprit-th planting the bug. Returns the hashes of the commits,
+// the oldest first.
+func createSelftestRepo(runner CommandRunner, dir string) ([]string, error) {
+	if err := runCommand(runner, gGitPath, "init", "--quiet", dir); err != nil {
+		return nil, err
+	}
+	git := []string{gGitPath, "-c", "user.name=xbisect", "-c", "user.email=selftest@xbisect.invalid",
+		"-c", "commit.gpgsign=false"}
+	var hashes []string
+	for i := 1; i <= kSelftestCommits; i++ {
+		if err := os.WriteFile(path.Join(dir, "counter.txt"), []byte(fmt.Sprintln(i)), 0666); err != nil {
+			return nil, err
+		}
+		if i == kSelftestCulprit {
+			if err := os.WriteFile(path.Join(dir, "bug"), nil, 0666); err != nil {
+				return nil, err
+			}
+		}
+		if err := runCommandDir(runner, dir, gGitPath, "add", "--all"); err != nil {
+			return nil, err
+		}
+		if err := runCommandDir(runner, dir, append(git, "commit", "--quiet", "-m", fmt.Sprintf("Commit %d", i))...); err != nil {
+			return nil, err
+		}
+		hash, err := resolveRef(runner, dir, "HEAD")
+		if err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes, nil
+}
+
+// Points the app data dir and the config to a new profile in dir. Returns
+// the function restoring the previous ones.
+func useTemporaryProfile(dir string) (func(), error) {
+	previous_home, home_set := os.LookupEnv("XBISECT_HOME")
+	previous_config := gConfig
+	restore := func() {
+		if home_set {
+			os.Setenv("XBISECT_HOME", previous_home)
+		} else {
+			os.Unsetenv("XBISECT_HOME")
+		}
+		gConfig = previous_config
+	}
+	os.Setenv("XBISECT_HOME", dir)
+	if err := SetupAppData(); err != nil {
+		restore()
+		return nil, err
+	}
+	if err := InitConfig(); err != nil {
+		restore()
+		return nil, err
+	}
+	return restore, nil
+}
+
+// Bisects a generated repo in a temporary profile, and checks that the
+// planted bug is found. Prints PASS or FAIL for each phase. Everything it
+// creates is removed, whether it passed or not.
+func RunSelftest() bool {
+	tmpdir, err := os.MkdirTemp("", "xbisect-selftest-")
+	if err != nil {
+		gLogger.Printf("Error: %v\n", err)
+		ConsoleLogError("Failed to create the selftest dir: %v", err)
+		return false
+	}
+	defer func() {
+		if err := os.RemoveAll(tmpdir); err != nil {
+			gLogger.Printf("Error: %v\n", err)
+			ConsoleLogError("Failed to remove the selftest dir %s", tmpdir)
+		}
+	}()
+	// The profile is restored before the config of the user is saved.
+	restore_profile := func() {}
+	defer func() { restore_profile() }()
+	runner := &ExecRunner{}
+	var hashes []string
+	var report *BisectReport
+	phases := []doctorCheck{
+		{"git available", func() (string, error) {
+			features, err := gitFeatures()
+			if err != nil {
+				return "", err
+			}
+			return features.Version.Raw, requireGitVersion()
+		}},
+		{"appdata writable", func() (string, error) {
+			f, err := os.CreateTemp(GetAppDataDir(), ".selftest")
+			if err != nil {
+				return "", err
+			}
+			f.Close()
+			return GetAppDataDir(), os.Remove(f.Name())
+		}},
+		{"clone", func() (string, error) {
+			srcdir := path.Join(tmpdir, "src")
+			if hashes, err = createSelftestRepo(runner, srcdir); err != nil {
+				return "", err
+			}
+			if restore_profile, err = useTemporaryProfile(path.Join(tmpdir, "home")); err != nil {
+				restore_profile = func() {}
+				return "", err
+			}
+			if err = ImportGitRepo(runner, srcdir, "", "selftest", CloneOptions{}, CloneHooks{}); err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("%d commits", len(hashes)), nil
+		}},
+		{"bisect", func() (string, error) {
+			_, err := RunBisect(runner, RunOptions{Repo: "selftest", Lo: hashes[0], Steps: []string{"check"},
+				Script: kSelftestScript, OnReport: func(r *BisectReport) { report = r }})
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("%s..%s", hashes[0][:12], hashes[len(hashes)-1][:12]), nil
+		}},
+		{"parse", func() (string, error) {
+			if report == nil {
+				return "", errors.New("The bisect reported nothing")
+			}
+			for _, commit := range report.Commits {
+				if len(commit.StepResults) != 1 || commit.StepResults[0].Name != "check" {
+					return "", fmt.Errorf("The result of step check on %s was not parsed", commit.Hash)
+				}
+			}
+			return fmt.Sprintf("%d commits tested", len(report.Commits)), nil
+		}},
+		{"report", func() (string, error) {
+			planted := hashes[kSelftestCulprit-1]
+			if report.Culprit != planted {
+				return "", fmt.Errorf("Expected the first bad commit %s, found %q", planted, report.Culprit)
+			}
+			return "first bad commit " + planted, nil
+		}},
+	}
+	for i, phase := range phases {
+		// Only the errors of the phases reach the console.
+		gConsoleLogger.SetLevel(charmlog.ErrorLevel)
+		found, err := phase.check()
+		gConsoleLogger.SetLevel(charmlog.InfoLevel)
+		if err != nil {
+			gLogger.Printf("Error: %v\n", err)
+			ConsoleLogError("%-16s FAIL %v", phase.name, err)
+			for _, skipped := range phases[i+1:] {
+				ConsoleLogInfo("%-16s SKIP", skipped.name)
+			}
+			return false
+		}
+		ConsoleLogInfo("%-16s PASS %s", phase.name, found)
+	}
+	return true
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// The partial clone filters of import --filter.
+var gCloneFilterRe = regexp.MustCompile(`^(blob:none|blob:limit=[0-9]+[kmg]?|tree:[0-9]+)$`)
+
+// A full or abbreviated commit hash.
+var gHexHashRe = regexp.MustCompile(`^[0-9a-f]{4,40}$`)
+
+// How import clones a git repo.
+type CloneOptions struct {
+	// A bare mirror clone, which runs check out worktrees of.
+	Mirror bool
+	// Only fetch the last Depth commits of each branch, if not zero.
+	Depth int
+	// Partial clone filter, e.g. blob:none, the objects left out being
+	// fetched from the remote when a checkout needs them.
+	Filter string
+}
+
+func (c CloneOptions) validate() error {
+	if c.Depth < 0 {
+		return fmt.Errorf("Invalid --depth %d, expected at least 1.", c.Depth)
+	}
+	if len(c.Filter) > 0 && !gCloneFilterRe.MatchString(c.Filter) {
+		return fmt.Errorf("Invalid --filter %q, expected blob:none, blob:limit=<size> or tree:<depth>.", c.Filter)
+	}
+	return nil
+}
+
+// The git features the clone needs.
+func (c CloneOptions) requiredFeatures() []GitFeature {
+	var required []GitFeature
+	if c.Mirror {
+		// Mirrors are bisected in worktrees.
+		required = append(required, kGitFeatureWorktree)
+	}
+	if len(c.Filter) > 0 {
+		required = append(required, kGitFeaturePartialClone)
+	}
+	return required
+}
+
+// The options of git clone. Local repos are only cloned shallow or partially
+// through file://, git copying their objects as is otherwise.
+func (c CloneOptions) args(repo_url string) ([]string, string) {
+	var args []string
+	if c.Mirror {
+		args = append(args, "--mirror")
+	}
+	if c.Depth > 0 {
+		args = append(args, fmt.Sprintf("--depth=%d", c.Depth))
+		if !c.Mirror {
+			// Branches other than the default one are bisected too.
+			args = append(args, "--no-single-branch")
+		}
+	}
+	if len(c.Filter) > 0 {
+		args = append(args, "--filter="+c.Filter)
+	}
+	if (c.Depth > 0 || len(c.Filter) > 0) && isDir(repo_url) {
+		if abspath, err := filepath.Abs(repo_url); err == nil {
+			repo_url = "file://" + abspath
+		}
+	}
+	return args, repo_url
+}
+
+// Returns the shallow boundary of the repo at dir: the commits whose parents
+// were left out of a shallow clone. Empty when the clone is complete.
+func shallowCommits(runner CommandRunner, dir string) ([]string, error) {
+	out, err := runCommandDirOutput(runner, dir, gGitPath, "rev-parse", "--git-path", "shallow")
+	if err != nil {
+		return nil, err
+	}
+	shallow_file := strings.TrimSpace(string(out))
+	if !filepath.IsAbs(shallow_file) {
+		shallow_file = filepath.Join(dir, shallow_file)
+	}
+	f, err := os.Open(shallow_file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var commits []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); len(line) > 0 {
+			commits = append(commits, line)
+		}
+	}
+	return commits, scanner.Err()
+}
+
+// Returns the first commit of the shallow boundary of the repo at dir within
+// lo..hi, whose parents the bisect cannot see and takes it for a root. Empty
+// when the range does not cross the boundary.
+func shallowBoundaryInRange(runner CommandRunner, dir, lo, hi string) (string, error) {
+	boundary, err := shallowCommits(runner, dir)
+	if err != nil || len(boundary) == 0 {
+		return "", err
+	}
+	out, err := runCommandDirOutput(runner, dir, gGitPath, "rev-list", lo+".."+hi)
+	if err != nil {
+		return "", err
+	}
+	in_range := map[string]bool{}
+	for _, line := range strings.Split(string(out), "\n") {
+		if hash := strings.TrimSpace(line); len(hash) > 0 {
+			in_range[hash] = true
+		}
+	}
+	for _, hash := range boundary {
+		if in_range[hash] {
+			return hash, nil
+		}
+	}
+	return "", nil
+}
+
+// Warns when the history of the shallow clone at dir does not cover the
+// range. A lo older than the clone fails to resolve, with InvalidRefError
+// telling to deepen it.
+func warnShallowRange(runner CommandRunner, dir, lo, hi string) {
+	hash, err := shallowBoundaryInRange(runner, dir, lo, hi)
+	if err != nil {
+		gLogger.Printf("Failed to check the shallow boundary of %s in %s..%s: %v\n", dir, lo, hi, err)
+		return
+	}
+	if len(hash) > 0 {
+		ConsoleLogError("Warning: the shallow clone %s stops at %s, within the range. The bisect may blame it for commits it cannot see. Deepen it with `git -C %s fetch --deepen=<n>`, or `--unshallow` for the whole history.",
+			dir, hash, shellQuote(dir))
+	}
+}
+
+// Whether the repo at dir has the commit rev names.
+func hasCommit(runner CommandRunner, dir, rev string) bool {
+	return runCommandDir(runner, dir, gGitPath, "cat-file", "-e", rev+"^{commit}") == nil
+}
+
+// Fails with an InvalidRefError when rev, missing from the shallow clone of
+// the repo, does not exist upstream either, e.g. for a typo, rather than
+// deepening the clone to its whole history looking for it. A rev relative to
+// a commit of the clone, e.g. HEAD~300, or an abbreviated hash, which cannot
+// be looked up upstream, is taken to exist.
+func checkUpstreamRev(runner CommandRunner, repo *RepoInfo, rev string) error {
+	base := rev
+	if i := strings.IndexAny(rev, "~^@:"); i >= 0 {
+		base = rev[:i]
+	}
+	if len(base) == 0 || hasCommit(runner, repo.LocalPath, base) {
+		return nil
+	}
+	if gHexHashRe.MatchString(base) {
+		if len(base) < 40 {
+			return nil
+		}
+		// Only the commit itself is fetched, the deepening fetches its
+		// history.
+		if isDryRun(runner) || runCommandDir(runner, repo.LocalPath, gGitPath, "fetch", "--quiet", "--depth=1", "origin", base) == nil {
+			return nil
+		}
+	} else {
+		name := strings.TrimPrefix(strings.TrimPrefix(base, "refs/remotes/"), "origin/")
+		out, err := runCommandDirOutput(runner, repo.LocalPath, gGitPath, "ls-remote", "origin", name)
+		if err != nil {
+			gLogger.Printf("Error: %v\n", err)
+			return wrapError(err, "Failed to look up %s in %s", rev, repo.Remote)
+		}
+		if len(strings.TrimSpace(string(out))) > 0 {
+			return nil
+		}
+	}
+	return &InvalidRefError{Dir: repo.LocalPath, Ref: rev}
+}
+
+// How many commits the shallow clone of a run is deepened by, in turn, before
+// its whole history is fetched.
+var kShallowDeepenSteps = []int{100, 1000, 10000}
+
+// Deepens the shallow clone of the repo, imported with --depth, until its
+// history covers lo..hi: both exist and the range does not cross the
+// shallow boundary. Fetches the whole history as a last resort. A missing rev
+// is first looked up upstream, failing right away if it does not exist.
+func deepenShallowClone(runner CommandRunner, repo *RepoInfo, lo, hi string) error {
+	covered := func() bool {
+		for _, rev := range []string{lo, hi} {
+			if len(rev) > 0 && !hasCommit(runner, repo.LocalPath, rev) {
+				return false
+			}
+		}
+		if len(lo) == 0 || len(hi) == 0 {
+			return true
+		}
+		hash, err := shallowBoundaryInRange(runner, repo.LocalPath, lo, hi)
+		return err == nil && len(hash) == 0
+	}
+	// Also records that the clone is complete, once deepened to its roots.
+	done := func() bool {
+		if boundary, err := shallowCommits(runner, repo.LocalPath); err == nil && len(boundary) == 0 {
+			if !isDryRun(runner) {
+				gConfig.SetShallow(repo.Name, false)
+			}
+			return true
+		}
+		return covered()
+	}
+	if done() {
+		return nil
+	}
+	for _, rev := range [][2]string{{"--lo", lo}, {"--hi", hi}} {
+		if len(rev[1]) > 0 && !hasCommit(runner, repo.LocalPath, rev[1]) {
+			if err := checkUpstreamRev(runner, repo, rev[1]); err != nil {
+				return fmt.Errorf("Invalid %s: %w", rev[0], err)
+			}
+		}
+	}
+	if !isDryRun(runner) {
+		for _, deepen := range kShallowDeepenSteps {
+			ConsoleLogInfo("The range reaches outside of the shallow clone of %s, deepening it by %d commits", repo.Label(),
+				deepen)
+			if err := runCommandDir(runner, repo.LocalPath, gGitPath, "fetch", "--quiet", fmt.Sprintf("--deepen=%d", deepen),
+				"origin"); err != nil {
+				gLogger.Printf("Error: %v\n", err)
+				return wrapError(err, "The clone of %s is too shallow for the range, and deepening it from %s failed",
+					repo.Label(), repo.Remote)
+			}
+			if done() {
+				return nil
+			}
+		}
+	}
+	ConsoleLogInfo("Fetching the whole history of %s", repo.Label())
+	if err := runCommandDir(runner, repo.LocalPath, gGitPath, "fetch", "--quiet", "--unshallow", "origin"); err != nil {
+		gLogger.Printf("Error: %v\n", err)
+		return wrapError(err, "The clone of %s is too shallow for the range, and fetching its whole history from %s failed",
+			repo.Label(), repo.Remote)
+	}
+	if !isDryRun(runner) {
+		gConfig.SetShallow(repo.Name, false)
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"text/template"
+)
+
+const (
+	kGistApiUrl = "https://api.github.com/gists"
+	// Markdown rendering of the report, uploaded by --share.
+	kMarkdownReportTemplate = `# {{.Repo}} bisect
+
+Range: ` + "`{{.Lo}}`..`{{.Hi}}`" + `
+
+{{if .Culprit}}First bad commit: ` + "`{{.Culprit}}`" + `{{else}}The first bad commit was not found.{{end}}
+
+| Commit | Step | Verdict |
+| --- | --- | --- |
+{{range .Commits}}{{$commit := .}}
+{{- if .CaseCollision}}| ` + "`{{short .Hash}}`" + ` | checkout | SKIP (case collision) |
+{{else if .CheckoutFailed}}| ` + "`{{short .Hash}}`" + ` | checkout | SKIP (checkout failed) |
+{{else if .Excluded}}| ` + "`{{short .Hash}}`" + ` | filter | SKIP ({{.Excluded}} commit) |
+{{end}}
+{{- range .StepResults}}| ` + "`{{short $commit.Hash}}`" + ` | {{.Name}}{{if .Matrix}} [{{.Matrix}}]{{end}} | {{plainVerdict .}} |
+{{end}}{{end}}
+{{- if .Candidates}}
+Inconclusive: {{len .Candidates}} candidate commits remain, all skipped:
+{{range .Candidates}}
+- ` + "`{{.Hash}}`" + ` {{.Subject}}
+{{- end}}
+{{end}}`
+)
+
+// A service the report files are uploaded to, returning the URL to share.
+type ShareProvider interface {
+	Upload(description string, files map[string]string) (string, error)
+}
+
+// Parses the --share target: "gist", or "url=<endpoint>" for a generic
+// endpoint.
+func parseShareProvider(target string) (ShareProvider, error) {
+	if target == "gist" {
+		token := os.Getenv("GITHUB_TOKEN")
+		if len(token) == 0 {
+			return nil, errors.New("--share gist requires GITHUB_TOKEN to be set")
+		}
+		registerSecret(token)
+		return &GistProvider{Token: token}, nil
+	}
+	if endpoint, found := strings.CutPrefix(target, "url="); found {
+		if err := validateNotifyUrl(endpoint); err != nil {
+			return nil, err
+		}
+		return &PostProvider{Url: endpoint}, nil
+	}
+	return nil, fmt.Errorf("Unknown share target %q, expected gist or url=<endpoint>", target)
+}
+
+// Uploads the files as a secret GitHub gist.
+type GistProvider struct {
+	Token string
+}
+
+func (p *GistProvider) Upload(description string, files map[string]string) (string, error) {
+	type gistFile struct {
+		Content string `json:"content"`
+	}
+	payload := struct {
+		Description string              `json:"description"`
+		Public      bool                `json:"public"`
+		Files       map[string]gistFile `json:"files"`
+	}{Description: description, Files: map[string]gistFile{}}
+	for name, content := range files {
+		payload.Files[name] = gistFile{content}
+	}
+	var created struct {
+		HtmlUrl string `json:"html_url"`
+	}
+	body, err := postJson(kGistApiUrl, map[string]string{"Authorization": "Bearer " + p.Token}, payload)
+	if err != nil {
+		return "", err
+	}
+	if err = json.Unmarshal(body, &created); err != nil || len(created.HtmlUrl) == 0 {
+		return "", fmt.Errorf("Unexpected response from the GitHub API: %s", body)
+	}
+	return created.HtmlUrl, nil
+}
+
+// POSTs the files as {"description": ..., "files": {name: content}} to a
+// generic endpoint, which responds with the URL either as plain text or as
+// the "url" field of a JSON object.
+type PostProvider struct {
+	Url string
+}
+
+func (p *PostProvider) Upload(description string, files map[string]string) (string, error) {
+	payload := map[string]any{"description": description, "files": files}
+	body, err := postJson(p.Url, nil, payload)
+	if err != nil {
+		return "", err
+	}
+	var response struct {
+		Url string `json:"url"`
+	}
+	if json.Unmarshal(body, &response) == nil && len(response.Url) > 0 {
+		return response.Url, nil
+	}
+	share_url := strings.TrimSpace(string(body))
+	if validateNotifyUrl(share_url) != nil {
+		return "", fmt.Errorf("Unexpected response from %s: %s", p.Url, body)
+	}
+	return share_url, nil
+}
+
+func postJson(post_url string, headers map[string]string, payload any) ([]byte, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, post_url, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	client := &http.Client{Timeout: kNotifyTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("%s responded with %s", post_url, resp.Status)
+	}
+	return body, nil
+}
+
+// Writes the markdown and JSON reports into the run's cache dir and uploads
+// them, with the secrets masked. Returns the URL to share.
+func shareReport(provider ShareProvider, cachedir string, report *BisectReport) (string, error) {
+	tmpl, err := template.New("markdown").Funcs(gReportTemplateFuncs).Parse(kMarkdownReportTemplate)
+	if err != nil {
+		return "", err
+	}
+	var markdown bytes.Buffer
+	if err = tmpl.Execute(&markdown, report); err != nil {
+		return "", err
+	}
+	results, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	files := map[string]string{
+		"report.md":   redactSecrets(markdown.String()),
+		"report.json": redactSecrets(string(results)),
+	}
+	for name, content := range files {
+		if err = os.WriteFile(path.Join(cachedir, name), []byte(content), 0666); err != nil {
+			return "", err
+		}
+	}
+	return provider.Upload(fmt.Sprintf("%s bisect of %s", kApplicationName, report.Repo), files)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Name of the pseudo step checking the size of the --size-of path, run once
+// the steps passed on a commit.
+const kSizeStepName = "size"
+
+// Width of the bar of the largest size in the size trend.
+const kSizeTrendWidth = 40
+
+// A commit is bad when the size of Path, relative to the repo root, exceeds
+// MaxBytes. With Baseline, MaxBytes is derived from the size measured on
+// that rev before the run.
+type SizeCheck struct {
+	Path     string
+	MaxBytes int64
+	Baseline string
+	// How much bigger than the baseline size a commit can be.
+	Tolerance string
+	// The file the wrapper reads MaxBytes from.
+	MaxBytesFile string
+}
+
+// Returns the size of the file, or the total size of the regular files under
+// it when it is a dir. Symlinks are not followed.
+func measureSize(file string) (int64, error) {
+	var total int64
+	err := filepath.WalkDir(file, func(_ string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		total += info.Size()
+		return nil
+	})
+	return total, err
+}
+
+// Prints the size of the file, for the wrapper script. Prints nothing and
+// fails when it does not exist.
+func RunSizeOf(file string) int {
+	size, err := measureSize(file)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		return 1
+	}
+	fmt.Println(size)
+	return 0
+}
+
+// Applies the tolerance, either a percentage (e.g. 5%) or a number of
+// bytes, to the baseline size.
+func applySizeTolerance(baseline int64, tolerance string) (int64, error) {
+	if percent, found := strings.CutSuffix(tolerance, "%"); found {
+		value, err := strconv.ParseFloat(percent, 64)
+		if err != nil || value < 0 {
+			return 0, fmt.Errorf("Invalid size tolerance %q, expected a percentage or a number of bytes", tolerance)
+		}
+		return baseline + int64(math.Round(float64(baseline)*value/100)), nil
+	}
+	value, err := strconv.ParseInt(tolerance, 10, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("Invalid size tolerance %q, expected a percentage or a number of bytes", tolerance)
+	}
+	return baseline + value, nil
+}
+
+// Validates the --size-of options. Returns nil when no size is checked.
+func newSizeCheck(opts RunOptions, steps []string) (*SizeCheck, error) {
+	if len(opts.SizeOf) == 0 {
+		if opts.MaxBytes > 0 || len(opts.SizeBaseline) > 0 {
+			return nil, errors.New("--max-bytes and --size-baseline require --size-of.")
+		}
+		return nil, nil
+	}
+	if !filepath.IsLocal(filepath.Clean(opts.SizeOf)) {
+		return nil, fmt.Errorf("Invalid --size-of %q. Expected a path inside the repo.", opts.SizeOf)
+	}
+	if slices.Contains(steps, kSizeStepName) {
+		return nil, fmt.Errorf("A step cannot be named %q along with --size-of.", kSizeStepName)
+	}
+	if (opts.MaxBytes > 0) == (len(opts.SizeBaseline) > 0) {
+		return nil, errors.New("--size-of requires one of --max-bytes and --size-baseline.")
+	}
+	if _, err := applySizeTolerance(0, opts.SizeTolerance); err != nil {
+		return nil, err
+	}
+	return &SizeCheck{Path: filepath.Clean(opts.SizeOf), MaxBytes: opts.MaxBytes, Baseline: opts.SizeBaseline,
+		Tolerance: opts.SizeTolerance}, nil
+}
+
+// The wrapper script checking the size once the steps passed, in the repo at
+// repodir. executable is the xbisect executable measuring it.
+func (c *SizeCheck) wrapperScript(executable, repodir string) string {
+	return fmt.Sprintf(`
+			SIZE_BYTES=$(%s size-of %s)
+			if [ -z "${SIZE_BYTES}" ]
+			then
+				echo "xbisect step=\"%s\" SKIP reason=missing${XBISECT_MATRIX_TAG}"
+				exit %d
+			elif [ "${SIZE_BYTES}" -gt "$(cat %s)" ]
+			then
+				echo "xbisect step=\"%s\" FAIL res=1 bytes=${SIZE_BYTES}${XBISECT_MATRIX_TAG}"
+				exit 1
+			fi
+			echo "xbisect step=\"%s\" PASS bytes=${SIZE_BYTES}${XBISECT_MATRIX_TAG}"
+			`, shellQuote(executable), shellQuote(path.Join(repodir, c.Path)), kSizeStepName, kBisectSkipCode,
+		shellQuote(c.MaxBytesFile), kSizeStepName, kSizeStepName)
+}
+
+// Checks the size in the checked out repo, like the wrapper script does.
+func (c *SizeCheck) result(repodir string) StepResult {
+	result := StepResult{Name: kSizeStepName}
+	size, err := measureSize(path.Join(repodir, c.Path))
+	if err != nil {
+		gLogger.Printf("Failed to measure the size of %s: %v\n", c.Path, err)
+		result.ArtifactMissing = true
+		return result
+	}
+	result.Bytes = size
+	result.Pass = size <= c.MaxBytes
+	if !result.Pass {
+		result.ExitStatus = 1
+	}
+	return result
+}
+
+// Writes MaxBytes for the wrapper script.
+func (c *SizeCheck) saveMaxBytes() error {
+	return os.WriteFile(c.MaxBytesFile, []byte(fmt.Sprintln(c.MaxBytes)), 0666)
+}
+
+// Runs the steps on the baseline rev to measure its size, and sets MaxBytes
+// from it.
+func (c *SizeCheck) measureBaseline(setup *RunSetup) error {
+	hash, err := resolveRef(setup.Runner, setup.CacheRepo, c.Baseline)
+	if err != nil {
+		gLogger.Printf("Error: %v\n", err)
+		return fmt.Errorf("Invalid --size-baseline: %w", err)
+	}
+	ConsoleLogInfo("Measuring the size of %s on the baseline %s", c.Path, hash)
+	// No limit while measuring.
+	c.MaxBytes = math.MaxInt64
+	if err = c.saveMaxBytes(); err != nil {
+		return err
+	}
+	result, err := sweepCommit(setup, hash, false)
+	if err != nil {
+		return err
+	}
+	if result.CheckoutFailed {
+		return fmt.Errorf("Failed to check out the size baseline %s", hash)
+	}
+	for _, step := range result.StepResults {
+		if step.Name != kSizeStepName {
+			if !step.Pass {
+				return fmt.Errorf("Step %s failed on the size baseline %s, its size is unknown", step.Name, hash)
+			}
+			continue
+		}
+		if step.ArtifactMissing {
+			return fmt.Errorf("%s does not exist on the size baseline %s", c.Path, hash)
+		}
+		if c.MaxBytes, err = applySizeTolerance(step.Bytes, c.Tolerance); err != nil {
+			return err
+		}
+		ConsoleLogInfo("Size of %s on the baseline: %s, commits above %s are bad", c.Path,
+			formatBytes(step.Bytes), formatBytes(c.MaxBytes))
+		return c.saveMaxBytes()
+	}
+	return fmt.Errorf("The size of %s was not measured on the baseline %s", c.Path, hash)
+}
+
+// Prints the size measured on each tested commit, from the oldest to the
+// newest, with a bar proportional to it.
+func printSizeTrend(runner CommandRunner, repodir, lo, hi string, commits []CommitResult) error {
+	sizes := map[string]int64{}
+	var largest int64
+	for _, commit := range commits {
+		for _, step := range commit.StepResults {
+			if step.Name == kSizeStepName && !step.ArtifactMissing {
+				sizes[commit.Hash] = max(sizes[commit.Hash], step.Bytes)
+				largest = max(largest, step.Bytes)
+			}
+		}
+	}
+	if len(sizes) == 0 {
+		return nil
+	}
+	out, err := runCommandDirOutput(runner, repodir, gGitPath, "rev-list", "--reverse", lo+".."+hi)
+	if err != nil {
+		return err
+	}
+	ConsoleLogInfo("Size trend of the tested commits, oldest first:")
+	for _, hash := range strings.Fields(string(out)) {
+		size, ok := sizes[hash]
+		if !ok {
+			continue
+		}
+		width := 1
+		if largest > 0 {
+			width = max(1, int(size*kSizeTrendWidth/largest))
+		}
+		ConsoleLogInfo("  %.12s %10s %s", hash, formatBytes(size), strings.Repeat("#", width))
+	}
+	return nil
+}
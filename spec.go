@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+)
+
+// A step of a spec file, run by a shell command of its own.
+type SpecStep struct {
+	// The step name, optionally as name@dir to run it in a dir of the repo.
+	Name    string
+	Command string
+}
+
+// A bisect declared in a TOML file given with --spec, e.g.
+//
+//	Repo = "foo"
+//	Lo = "v1.2.0"
+//	Hi = "main"
+//
+//	[[Steps]]
+//	Name = "build"
+//	Command = "go build ./..."
+//
+// The flags given along with it override its fields.
+type BisectSpec struct {
+	Repo  string
+	Lo    string
+	Hi    string
+	Steps []SpecStep
+}
+
+// Reads and validates the spec file. Unknown keys are errors, so that a
+// misspelled one does not go unnoticed.
+func LoadBisectSpec(file string) (*BisectSpec, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		gLogger.Printf("Error: %v\n", err)
+		return nil, fmt.Errorf("Invalid --spec: cannot read %s.", file)
+	}
+	defer f.Close()
+	spec := &BisectSpec{}
+	decoder := toml.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	if err = decoder.Decode(spec); err != nil {
+		gLogger.Printf("Error: %v\n", err)
+		var strict_err *toml.StrictMissingError
+		if errors.As(err, &strict_err) && len(strict_err.Errors) > 0 {
+			key := strings.Join(strict_err.Errors[0].Key(), ".")
+			return nil, fmt.Errorf("Invalid --spec %s: unknown key %q.", file, key)
+		}
+		return nil, fmt.Errorf("Invalid --spec %s: %w", file, err)
+	}
+	if err = validateSpecSteps(spec.Steps); err != nil {
+		return nil, fmt.Errorf("Invalid --spec %s: %w", file, err)
+	}
+	serialized, _ := toml.Marshal(spec)
+	gLogger.Printf("Spec %s:\n%s\n", file, serialized)
+	return spec, nil
+}
+
+// Checks that the steps have valid and distinct names, and a command each.
+func validateSpecSteps(steps []SpecStep) error {
+	names := map[string]bool{}
+	for _, step := range steps {
+		name, _, err := parseStepSpec(step.Name)
+		if err != nil {
+			return err
+		}
+		if names[name] {
+			return fmt.Errorf("step %s is declared twice.", name)
+		}
+		names[name] = true
+		if len(strings.TrimSpace(step.Command)) == 0 {
+			return fmt.Errorf("step %s has no Command.", name)
+		}
+	}
+	return nil
+}
+
+// The --cmd running the command of the step given as $1. Another step skips
+// the commit rather than failing it, which would blame it for the missing
+// command.
+func stepsCommand(steps []SpecStep) string {
+	var command strings.Builder
+	command.WriteString("case \"$1\" in\n")
+	for _, step := range steps {
+		name, _, _ := parseStepSpec(step.Name)
+		fmt.Fprintf(&command, "%s) eval %s ;;\n", shellQuote(name), shellQuote(step.Command))
+	}
+	fmt.Fprintf(&command, "*) echo \"No command for step $1\" >&2; exit %d ;;\nesac\n", kBisectSkipCode)
+	return command.String()
+}
+
+// Checks that the steps given with --steps have a command among the steps
+// declared in from, whose commands are run.
+func checkStepsDeclared(steps []string, declared []SpecStep, from string) error {
+	names := map[string]bool{}
+	for _, step := range declared {
+		name, _, _ := parseStepSpec(step.Name)
+		names[name] = true
+	}
+	for _, step := range steps {
+		if name, _, err := parseStepSpec(step); err == nil && !names[name] {
+			return fmt.Errorf("Step %s has no Command in %s. Declare it there, or give its command with --script or --cmd.",
+				name, from)
+		}
+	}
+	return nil
+}
+
+// Sets the flags left unset to the values of the spec. Those set on the
+// command line win, which is logged when the spec had another value. Fails
+// when the steps given on the command line have no command in the spec to
+// run.
+func (f *RunFlags) applySpec(spec *BisectSpec, file string) error {
+	override := func(flag string, value *string, spec_value string) {
+		if len(spec_value) == 0 {
+			return
+		}
+		if len(*value) > 0 {
+			if *value != spec_value {
+				gLogger.Printf("--%s %s overrides %q of the spec\n", flag, *value, spec_value)
+			}
+			return
+		}
+		*value = spec_value
+	}
+	if len(f.Path) == 0 && len(f.Git) == 0 {
+		override("repo", &f.Repo, spec.Repo)
+	}
+	if f.Back == 0 && len(f.SinceTag) == 0 && !f.LastRelease {
+		override("lo", &f.Lo, spec.Lo)
+	}
+	if len(f.UntilTag) == 0 {
+		override("hi", &f.Hi, spec.Hi)
+	}
+	if len(spec.Steps) == 0 {
+		return nil
+	}
+	if len(f.Steps) > 0 || len(f.StepsFile) > 0 {
+		gLogger.Printf("--steps or --steps-file override the steps of the spec\n")
+	} else {
+		for _, step := range spec.Steps {
+			f.Steps = append(f.Steps, step.Name)
+		}
+	}
+	if len(f.Script) > 0 || len(f.Cmd) > 0 {
+		gLogger.Printf("--script or --cmd override the commands of the steps of the spec\n")
+		return nil
+	}
+	if err := checkStepsDeclared(f.Steps, spec.Steps, file); err != nil {
+		return fmt.Errorf("Invalid --steps: %w", err)
+	}
+	f.Cmd = stepsCommand(spec.Steps)
+	return nil
+}
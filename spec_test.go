@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestApplySpecSteps(t *testing.T) {
+	spec := &BisectSpec{Steps: []SpecStep{
+		{Name: "build", Command: "true"},
+		{Name: "test@src", Command: "true"},
+	}}
+	tests := []struct {
+		name    string
+		flags   RunFlags
+		wantErr string
+	}{
+		{name: "spec steps"},
+		{name: "declared steps", flags: RunFlags{Steps: []string{"test@other", "build"}}},
+		{name: "undeclared step", flags: RunFlags{Steps: []string{"build", "lint"}}, wantErr: "Step lint has no Command"},
+		{name: "undeclared step with --cmd", flags: RunFlags{Steps: []string{"lint"}, Cmd: "true"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flags := tt.flags
+			err := flags.applySpec(spec, "spec.toml")
+			if len(tt.wantErr) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("applySpec() = %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("applySpec() = %v", err)
+			}
+		})
+	}
+}
+
+func TestStepsCommandSkipsUndeclaredStep(t *testing.T) {
+	command := stepsCommand([]SpecStep{{Name: "build", Command: "exit 3"}})
+	for step, want := range map[string]int{"build": 3, "lint": kBisectSkipCode} {
+		err := exec.Command("sh", "-c", command, "sh", step).Run()
+		exit_err, ok := err.(*exec.ExitError)
+		if !ok || exit_err.ExitCode() != want {
+			t.Errorf("step %s: %v, want exit status %d", step, err, want)
+		}
+	}
+}
+
+func TestRepoConfigApplySteps(t *testing.T) {
+	config := &RepoBisectConfig{Steps: []SpecStep{{Name: "build", Command: "true"}}}
+	opts := RunOptions{Steps: []string{"lint"}}
+	if err := config.apply(&opts); err == nil || !strings.Contains(err.Error(), "Step lint has no Command") {
+		t.Errorf("apply() = %v, want an error for the undeclared step", err)
+	}
+	opts = RunOptions{Steps: []string{"lint"}, Cmd: "true"}
+	if err := config.apply(&opts); err != nil {
+		t.Errorf("apply() with --cmd = %v", err)
+	}
+	opts = RunOptions{}
+	if err := config.apply(&opts); err != nil || len(opts.Cmd) == 0 {
+		t.Errorf("apply() = %v, Cmd %q", err, opts.Cmd)
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+)
+
+const (
+	kRunStatusRunning  = "running"
+	kRunStatusFinished = "finished"
+	kRunStatusFailed   = "failed"
+	kRunStatusAborted  = "aborted"
+
+	kRunStateFilename = "state.toml"
+	// The process group of the steps of the commit being tested, which
+	// step-exec starts within StepsPgid in run mode.
+	kCommitPgidFilename = "commit.pgid"
+
+	// How long the processes of interrupted steps get to exit before they
+	// are killed.
+	kProcessGroupKillDelay = 10 * time.Second
+)
+
+var (
+	// Canceled when xbisect receives SIGINT/SIGTERM. Long running child
+	// processes are bound to it so that they are stopped on interruption.
+	gRunContext    context.Context = context.Background()
+	gInterrupted   atomic.Bool
+	gCancelRunFunc context.CancelFunc
+)
+
+// The live state of a run, persisted as state.toml in the run's cache
+// directory and updated as the run progresses.
+type RunState struct {
+	Pid int
+	// Start time of the process as reported by ps, used to detect pid reuse.
+	StartTime string
+	Status    string
+	UpdatedAt time.Time
+	// The process group of the steps running, unless they share the group
+	// of the process. kill --force kills it along with the process.
+	StepsPgid int `toml:",omitempty"`
+}
+
+func (s *RunState) Save(cachedir string) error {
+	s.UpdatedAt = time.Now()
+	serialized, err := toml.Marshal(s)
+	if err != nil {
+		return err
+	}
+	// Write atomically so that readers never see a partial file.
+	tmpfile := path.Join(cachedir, kRunStateFilename+".tmp")
+	if err = os.WriteFile(tmpfile, serialized, 0666); err != nil {
+		return err
+	}
+	return os.Rename(tmpfile, path.Join(cachedir, kRunStateFilename))
+}
+
+func LoadRunState(cachedir string) (*RunState, error) {
+	data, err := os.ReadFile(path.Join(cachedir, kRunStateFilename))
+	if err != nil {
+		return nil, err
+	}
+	state := &RunState{}
+	if err = toml.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// Returns the start time of the process, or an error if it does not exist.
+func processStartTime(pid int) (string, error) {
+	out, err := runCommandDirOutput(&ExecRunner{}, "", "ps", "-o", "lstart=", "-p", fmt.Sprint(pid))
+	if err != nil {
+		return "", err
+	}
+	start_time := strings.TrimSpace(string(out))
+	if len(start_time) == 0 {
+		return "", fmt.Errorf("No process with pid %d", pid)
+	}
+	return start_time, nil
+}
+
+// Whether the process of the run still exists, comparing start times to
+// detect pid reuse.
+func (s *RunState) ProcessAlive() bool {
+	start_time, err := processStartTime(s.Pid)
+	return err == nil && start_time == s.StartTime
+}
+
+func NewRunState() *RunState {
+	state := &RunState{Pid: os.Getpid(), Status: kRunStatusRunning}
+	start_time, err := processStartTime(state.Pid)
+	if err != nil {
+		gLogger.Printf("Failed to get the process start time: %v\n", err)
+	}
+	state.StartTime = start_time
+	return state
+}
+
+// Cancels gRunContext on the first SIGINT/SIGTERM so that the running
+// command can clean up. A second signal exits immediately.
+func SetupSignalHandler() {
+	gRunContext, gCancelRunFunc = context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		gLogger.Printf("Received signal %v, aborting\n", sig)
+		gInterrupted.Store(true)
+		gCancelRunFunc()
+		sig = <-signals
+		gLogger.Printf("Received signal %v again, exiting\n", sig)
+		os.Exit(130)
+	}()
+}
+
+// Lists the ids of the runs whose state is still running.
+func activeRunIds() ([]string, error) {
+	entries, err := os.ReadDir(path.Join(GetAppDataDir(), "cache"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var ids []string
+	for _, entry := range entries {
+		state, err := LoadRunState(path.Join(GetAppDataDir(), "cache", entry.Name()))
+		if err != nil {
+			continue
+		}
+		if state.Status == kRunStatusRunning {
+			ids = append(ids, entry.Name())
+		}
+	}
+	return ids, nil
+}
+
+// Stops a run started from another terminal by signaling its process and
+// waiting for it to record that it aborted.
+func KillRun(run_id string, force bool, timeout time.Duration) bool {
+	if len(run_id) == 0 {
+		ids, err := activeRunIds()
+		if err != nil {
+			gLogger.Printf("Error: %v\n", err)
+			ConsoleLogError("Failed to list runs")
+			return false
+		}
+		if len(ids) == 0 {
+			ConsoleLogError("No active run found.")
+			return false
+		}
+		if len(ids) > 1 {
+			ConsoleLogError("Multiple active runs, select one with --run: %s", strings.Join(ids, ", "))
+			return false
+		}
+		run_id = ids[0]
+	}
+	cachedir := path.Join(GetAppDataDir(), "cache", run_id)
+	state, err := LoadRunState(cachedir)
+	if err != nil {
+		gLogger.Printf("Error: %v\n", err)
+		ConsoleLogError("No run with id: %s", run_id)
+		return false
+	}
+	if state.Status != kRunStatusRunning {
+		ConsoleLogError("Run %s is not running (status: %s)", run_id, state.Status)
+		return false
+	}
+	start_time, err := processStartTime(state.Pid)
+	if err != nil || start_time != state.StartTime {
+		gLogger.Printf("Recorded start time: %q, actual: %q, err: %v\n", state.StartTime, start_time, err)
+		ConsoleLogError("Process %d of run %s is gone or its pid was reused, not signaling it.", state.Pid, run_id)
+		return false
+	}
+
+	ConsoleLogInfo("Stopping run %s (pid %d)", run_id, state.Pid)
+	if err = signalProcessTree(state.Pid, syscall.SIGTERM); err != nil {
+		gLogger.Printf("Error: %v\n", err)
+		ConsoleLogError("Failed to signal process %d", state.Pid)
+		return false
+	}
+
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(200 * time.Millisecond)
+		state, err = LoadRunState(cachedir)
+		if err == nil && state.Status != kRunStatusRunning {
+			ConsoleLogInfo("Run %s stopped (status: %s), cleanup completed.", run_id, state.Status)
+			return true
+		}
+	}
+
+	if !force {
+		ConsoleLogError("Run %s did not stop within %v. Use --force to kill it.", run_id, timeout)
+		return false
+	}
+	ConsoleLogInfo("Run %s did not stop within %v, killing it", run_id, timeout)
+	if err = signalProcessTree(state.Pid, syscall.SIGKILL); err != nil {
+		gLogger.Printf("Error: %v\n", err)
+		ConsoleLogError("Failed to kill process %d", state.Pid)
+		return false
+	}
+	// The steps run in groups of their own, which would be left running.
+	pgids := []int{state.StepsPgid}
+	if data, err := os.ReadFile(path.Join(cachedir, kCommitPgidFilename)); err == nil {
+		if pgid, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil {
+			pgids = append(pgids, pgid)
+		}
+	}
+	for _, pgid := range pgids {
+		if pgid <= 0 {
+			continue
+		}
+		if err = signalProcessGroup(pgid, syscall.SIGKILL); err != nil {
+			gLogger.Printf("Failed to kill the process group %d of the steps: %v\n", pgid, err)
+		}
+	}
+	state.Status = kRunStatusAborted
+	if err = state.Save(cachedir); err != nil {
+		gLogger.Printf("Error: %v\n", err)
+	}
+	ConsoleLogInfo("Run %s killed, cleanup did not complete.", run_id)
+	return true
+}
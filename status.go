@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Prints the runs of the cache dir, the most recently updated first. With
+// as_json, prints them as JSON along with the stats of the app data dir.
+func ShowStatus(as_json bool) bool {
+	cachedir := path.Join(GetAppDataDir(), "cache")
+	entries, err := os.ReadDir(cachedir)
+	if err != nil && !os.IsNotExist(err) {
+		gLogger.Printf("Error: %v\n", err)
+		ConsoleLogError("Failed to list the cache dir")
+		return false
+	}
+	type run struct {
+		id    string
+		state *RunState
+	}
+	var runs []run
+	for _, entry := range entries {
+		state, err := LoadRunState(path.Join(cachedir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		runs = append(runs, run{entry.Name(), state})
+	}
+	if len(runs) == 0 && !as_json {
+		ConsoleLogInfo("No run found.")
+		return true
+	}
+	slices.SortFunc(runs, func(a, b run) int { return b.state.UpdatedAt.Compare(a.state.UpdatedAt) })
+	listings := []RunListing{}
+	for _, run := range runs {
+		status := run.state.Status
+		if status == kRunStatusRunning && !run.state.ProcessAlive() {
+			// The process died without recording it.
+			status = "dead"
+		}
+		if as_json {
+			listing := RunListing{Id: run.id, Status: status, Pid: run.state.Pid, UpdatedAt: run.state.UpdatedAt}
+			if metadata, err := LoadRunMetadata(path.Join(cachedir, run.id)); err == nil {
+				listing.Repo = metadata.RepoLabel()
+			}
+			listings = append(listings, listing)
+			continue
+		}
+		ConsoleLogInfo("%-32s %-8s pid %-7d updated %s", run.id, status, run.state.Pid,
+			run.state.UpdatedAt.Local().Format(time.DateTime))
+	}
+	if as_json {
+		return printJson(struct {
+			Runs    []RunListing `json:"runs"`
+			AppData AppDataStats `json:"appdata"`
+		}{listings, collectAppDataStats()})
+	}
+	return true
+}
+
+// Prints the last lines of the log file. With follow, then prints the lines
+// appended to it until interrupted.
+func ShowLogs(lines int, follow bool) bool {
+	logfile := path.Join(GetAppDataDir(), "log.txt")
+	file, err := os.Open(logfile)
+	if err != nil {
+		gLogger.Printf("Error: %v\n", err)
+		ConsoleLogError("Failed to open the log file %s", logfile)
+		return false
+	}
+	defer file.Close()
+	var tail []string
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		tail = append(tail, scanner.Text())
+		if len(tail) > lines {
+			tail = tail[1:]
+		}
+	}
+	if len(tail) > 0 {
+		os.Stdout.WriteString(strings.Join(tail, "\n") + "\n")
+	}
+	if !follow {
+		return true
+	}
+	for !gInterrupted.Load() {
+		if _, err := io.Copy(os.Stdout, file); err != nil {
+			gLogger.Printf("Error: %v\n", err)
+			return false
+		}
+		select {
+		case <-gRunContext.Done():
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+	return true
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// RepoInfo.Vcs of the repos converted from SVN with git svn. Empty for git
+// repos.
+const kVcsSvn = "svn"
+
+// A range of SVN revisions for git svn clone -r, e.g. 1000:HEAD.
+var gSvnRevisionsRe = regexp.MustCompile(`^[0-9]+:([0-9]+|HEAD)$`)
+
+// Fails with how to install git svn when it is not available. git svn is
+// packaged apart from git by most distributions.
+func requireGitSvn(runner CommandRunner) error {
+	if err := runCommand(runner, gGitPath, "svn", "--version"); err != nil {
+		gLogger.Printf("Error: %v\n", err)
+		return errors.New("git svn is not installed, it is needed for SVN repos. Install it, e.g. with `apt install git-svn` or `dnf install git-svn`, and retry.")
+	}
+	return nil
+}
+
+// Converts the SVN repo at svn_url into a git repo in the repos dir with git
+// svn clone. revisions bounds the converted history, as for git svn clone -r,
+// which is slow for long histories.
+func ImportSvnRepo(runner CommandRunner, svn_url string, name string, stdlayout bool, revisions string, hooks CloneHooks) error {
+	name, display_name, err := checkImportName(name)
+	if err != nil {
+		return err
+	}
+	if len(svn_url) == 0 {
+		return errors.New("--svn is empty.")
+	}
+	if len(revisions) > 0 && !gSvnRevisionsRe.MatchString(revisions) {
+		return fmt.Errorf("Invalid --svn-revisions %q, expected START:END, e.g. 1000:HEAD.", revisions)
+	}
+	if err := requireGitVersion(); err != nil {
+		return err
+	}
+	if err := requireGitSvn(runner); err != nil {
+		return err
+	}
+
+	clonedir := path.Join(GetAppDataDir(), "repos", name)
+	if err := hooks.runPre(runner, svn_url, name, clonedir); err != nil {
+		return err
+	}
+	clone_args := []string{"--quiet"}
+	if stdlayout {
+		clone_args = append(clone_args, "--stdlayout")
+	}
+	if len(revisions) > 0 {
+		clone_args = append(clone_args, "-r", revisions)
+	}
+	ConsoleLogInfo("Converting SVN repo: %s", svn_url)
+	if err := cloneRepo(runner, []string{"svn", "clone"}, svn_url, clonedir, clone_args...); err != nil {
+		gLogger.Printf("Error: %v\n", err)
+		return wrapError(err, "git svn clone failed")
+	}
+	imported, hook_err := hooks.runPost(runner, svn_url, name, clonedir)
+	if !imported {
+		return hook_err
+	}
+	if isDryRun(runner) {
+		// There is no clone to add.
+		return nil
+	}
+	gConfig.AddRepo(RepoInfo{Remote: svn_url, LocalPath: clonedir, Name: name, DisplayName: display_name,
+		Vcs: kVcsSvn})
+	if hook_err != nil {
+		ConsoleLogInfo("Imported %s despite the failed hook, as --keep-on-hook-failure was given", name)
+	}
+	return hook_err
+}
+
+// The ref of the SVN trunk in a repo converted by git svn: origin/trunk for
+// the standard layout, git-svn otherwise.
+func svnTrunkRef(runner CommandRunner, dir string) (string, error) {
+	for _, ref := range []string{"origin/trunk", "git-svn"} {
+		if runCommandDir(runner, dir, gGitPath, "rev-parse", "--quiet", "--verify", "refs/remotes/"+ref) == nil {
+			return ref, nil
+		}
+	}
+	return "", fmt.Errorf("No SVN trunk ref in %s", dir)
+}
+
+// Returns the SVN revision the commit was converted from, e.g. r1234.
+func svnRevision(runner CommandRunner, dir, hash string) (string, error) {
+	out, err := runCommandDirOutput(runner, dir, gGitPath, "svn", "find-rev", hash)
+	if err != nil {
+		return "", err
+	}
+	revision := strings.TrimSpace(string(out))
+	if len(revision) == 0 {
+		return "", fmt.Errorf("Commit %s has no SVN revision", hash)
+	}
+	return "r" + revision, nil
+}
+
+// Maps the culprit of a run on an SVN repo to its SVN revision. Returns an
+// empty revision for git repos, or when it cannot be found, as it is only
+// informative.
+func culpritSvnRevision(runner CommandRunner, repo *RepoInfo, culprit string) string {
+	if repo == nil || repo.Vcs != kVcsSvn || len(culprit) == 0 {
+		return ""
+	}
+	revision, err := svnRevision(runner, repo.LocalPath, culprit)
+	if err != nil {
+		gLogger.Printf("Failed to find the SVN revision of %s: %v\n", culprit, err)
+		return ""
+	}
+	return revision
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+)
+
+type SweepOptions struct {
+	RunOptions
+	// Either "text" or "csv".
+	Output string
+	// File to write the csv output to. Empty means stdout.
+	OutputFile string
+	// Run the steps from Go instead of through the wrapper script.
+	Native bool
+}
+
+type SweepCommit struct {
+	CommitResult
+	Date    string
+	Subject string
+}
+
+// Lists the commits from lo to hi (both inclusive) in topological order,
+// following the ancestry path between them.
+func listSweepCommits(runner CommandRunner, dir, lo, hi string) ([]string, error) {
+	lo_hash, err := resolveRef(runner, dir, lo)
+	if err != nil {
+		return nil, err
+	}
+	commits := []string{lo_hash}
+	out, err := runCommandDirOutput(runner, dir, gGitPath, "rev-list", "--reverse", "--ancestry-path", lo+".."+hi)
+	if err != nil {
+		return nil, err
+	}
+	commits = append(commits, strings.Fields(string(out))...)
+	return commits, nil
+}
+
+// Checks out the commit and runs the wrapper script on it, or the steps
+// directly when native is set, collecting the result of each executed step.
+func sweepCommit(setup *RunSetup, hash string, native bool) (*SweepCommit, error) {
+	result := &SweepCommit{CommitResult: CommitResult{Hash: hash}}
+	out, err := runCommandDirOutput(setup.Runner, setup.CacheRepo, gGitPath, "show", "-s", "--format=%cI%x00%s", hash)
+	if err != nil {
+		return nil, err
+	}
+	result.Date, result.Subject, _ = strings.Cut(strings.TrimSpace(string(out)), "\x00")
+	if setup.Filter != nil && setup.Filter.Commits[hash] {
+		ConsoleLogInfo("Skipping commit %s, %s", hash, describeExclusion(setup.Filter.Reason))
+		result.Excluded = setup.Filter.Reason
+		return result, nil
+	}
+
+	if _, err = runCommandDirOutput(setup.Runner, setup.CacheRepo, gGitPath, "checkout", "--quiet", "--detach", hash); err != nil {
+		gLogger.Printf("Error: %v\n", err)
+		if exit_err, ok := err.(*exec.ExitError); ok {
+			gLogger.Printf("%s\n", exit_err.Stderr)
+		}
+		result.CaseCollision = isCaseCollision(setup.Runner, setup.CacheRepo, err)
+		if result.CaseCollision {
+			ConsoleLogError("Failed to check out commit %s. %s", hash, kCaseCollisionHelp)
+		} else if isCommitCheckoutError(err) {
+			ConsoleLogError("Failed to check out commit %s, skipping it.", hash)
+		} else {
+			// Every other commit would fail the same way.
+			ConsoleLogError("Failed to check out commit %s, for a reason that would fail every commit, "+
+				"e.g. local changes in the cache repo.", hash)
+			return nil, err
+		}
+		result.CheckoutFailed = true
+		return result, nil
+	}
+	// git reports the objects it cannot read, but still succeeds without
+	// their files.
+	if out, err := runCommandDirOutput(setup.Runner, setup.CacheRepo, gGitPath, "ls-files", "--deleted"); err != nil {
+		return nil, err
+	} else if missing := strings.TrimSpace(string(out)); len(missing) > 0 {
+		gLogger.Printf("Files missing from the checkout of %s: %s\n", hash, missing)
+		ConsoleLogError("Failed to check out commit %s, skipping it.", hash)
+		result.CheckoutFailed = true
+		return result, nil
+	}
+	if native {
+		result.StepResults, err = runStepsNative(setup, hash)
+		if err != nil {
+			return nil, err
+		}
+		return result, nil
+	}
+	cmd := exec.CommandContext(gRunContext, setup.WrapperPath, setup.WrapperArgs...)
+	// The wrapper restores the env of the user for the steps.
+	cmd.Env = gitEnv()
+	cmd.Dir = setup.CacheRepo
+	if !setup.SharedProcessGroup {
+		runInProcessGroup(cmd)
+		defer killProcessGroup(cmd)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stderr = gLogFileHandler
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+	setup.trackProcessGroup(cmd)
+	scanner := bufio.NewScanner(io.TeeReader(stdout, gLogger.Writer()))
+	var scan_err error
+	for scan_err == nil && scanner.Scan() {
+		var res *StepResult
+		if res, scan_err = parseStepStatus(strings.TrimSpace(scanner.Text()), setup.Metadata.Matrix); res != nil {
+			result.StepResults = append(result.StepResults, *res)
+		}
+	}
+	if scan_err == nil {
+		scan_err = scanner.Err()
+	}
+	if scan_err != nil {
+		// The rest of the output is not read: stop the wrapper rather than
+		// leaving it blocked on the pipe.
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, scan_err
+	}
+	// A non-zero exit status only means that a step failed, which is
+	// already recorded in the step results.
+	if err = cmd.Wait(); err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// Writes one row per commit with a column per step, or per step and matrix
+// entry when the run has a matrix.
+func writeSweepCsv(w io.Writer, steps []string, matrix []string, results []*SweepCommit) error {
+	writer := csv.NewWriter(w)
+	type column struct {
+		step   string
+		matrix string
+	}
+	entries := matrix
+	if len(entries) == 0 {
+		entries = []string{""}
+	}
+	var columns []column
+	header := []string{"hash", "date", "subject"}
+	for _, entry := range entries {
+		for _, step := range steps {
+			columns = append(columns, column{step, entry})
+			if len(entry) > 0 {
+				header = append(header, fmt.Sprintf("%s [%s]", step, entry))
+			} else {
+				header = append(header, step)
+			}
+		}
+	}
+	if err := writer.Write(header); err != nil {
+		return err
+	}
+	for _, result := range results {
+		row := []string{result.Hash, result.Date, result.Subject}
+		for _, col := range columns {
+			if result.CheckoutFailed {
+				row = append(row, "SKIP")
+				continue
+			}
+			if len(result.Excluded) > 0 {
+				row = append(row, "SKIP-"+strings.ToUpper(result.Excluded))
+				continue
+			}
+			// Steps after a failing one are not executed and have no verdict.
+			verdict := ""
+			for _, step_result := range result.StepResults {
+				if step_result.Name == col.step && step_result.Matrix == col.matrix {
+					verdict = stepVerdict(step_result)
+				}
+			}
+			row = append(row, verdict)
+		}
+		if err := writer.Write(row); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// Runs the steps on every commit between lo and hi, instead of bisecting.
+func RunSweep(opts SweepOptions) (success bool) {
+	setup, err := SetupRun(&ExecRunner{}, opts.RunOptions)
+	defer func() { setup.Cleanup(success) }()
+	if err != nil {
+		ConsoleLogErr(err)
+		return false
+	}
+
+	commits, err := listSweepCommits(setup.Runner, setup.CacheRepo, setup.Metadata.Lo, setup.Metadata.Hi)
+	if err != nil {
+		gLogger.Printf("Error: %v\n", err)
+		ConsoleLogError("Failed to list the commits between %s and %s", setup.Metadata.Lo, setup.Metadata.Hi)
+		return false
+	}
+	ConsoleLogInfo("Sweeping %d commits", len(commits))
+
+	var results []*SweepCommit
+	for i, hash := range commits {
+		ConsoleLogInfo("[%d/%d] %s", i+1, len(commits), hash)
+		result, err := sweepCommit(setup, hash, opts.Native)
+		if gInterrupted.Load() {
+			ConsoleLogError("Sweep aborted")
+			return false
+		}
+		if err != nil {
+			gLogger.Printf("Error: %v\n", err)
+			ConsoleLogError("Failed to run the steps on commit %s", hash)
+			return false
+		}
+		results = append(results, result)
+		if opts.Output == "text" {
+			for _, step := range result.StepResults {
+				matrix := ""
+				if len(step.Matrix) > 0 {
+					matrix = fmt.Sprintf(" [%s]", step.Matrix)
+				}
+				ConsoleLogInfo("%s %s%12s%s%s %s", hash, kColorCyan, step.Name, kConsoleReset, matrix, formatStepVerdict(step))
+			}
+		}
+	}
+	if setup.Size != nil && opts.Output == "text" {
+		commit_results := make([]CommitResult, len(results))
+		for i, result := range results {
+			commit_results[i] = result.CommitResult
+		}
+		if err = printSizeTrend(setup.Runner, setup.CacheRepo, setup.Metadata.Lo, setup.Metadata.Hi, commit_results); err != nil {
+			gLogger.Printf("Error: %v\n", err)
+			ConsoleLogError("Failed to list the commits of the size trend")
+		}
+	}
+
+	if opts.Output == "csv" {
+		var w io.Writer = os.Stdout
+		if len(opts.OutputFile) > 0 {
+			f, err := os.Create(opts.OutputFile)
+			if err != nil {
+				gLogger.Printf("Error: %v\n", err)
+				ConsoleLogError("Failed to create output file: %s", opts.OutputFile)
+				return false
+			}
+			defer f.Close()
+			w = f
+		}
+		steps := setup.Steps
+		if setup.Size != nil {
+			steps = append(slices.Clone(steps), kSizeStepName)
+		}
+		if err = writeSweepCsv(w, steps, setup.Metadata.Matrix, results); err != nil {
+			gLogger.Printf("Error: %v\n", err)
+			ConsoleLogError("Failed to write csv output")
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// The --on-timeout values: what a step killed by --timeout makes of the
+// commit.
+const (
+	kOnTimeoutSkip = "skip"
+	kOnTimeoutFail = "fail"
+)
+
+// Exit status of a step killed by --timeout, as that of coreutils timeout.
+const kStepTimeoutCode = 124
+
+// Runs the command in a process group of its own, which is killed once the
+// command exited, or once it ran for longer than timeout if not zero. The
+// marker file is then created, for the wrapper script to tell the timeout
+// from a failure, and kStepTimeoutCode returned. Called by the wrapper script
+// to start the steps with --timeout, and by git bisect run to run the wrapper
+// script on each commit, whose process group is then written to pgid_file for
+// kill --force. Returns the exit status of the command, as the shell reports
+// it.
+func RunStepExec(timeout time.Duration, marker string, pgid_file string, command []string) int {
+	// Runs within a step, without the logs of the run.
+	gLogger = log.New(io.Discard, "", 0)
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	defer cancel()
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	runInProcessGroup(cmd)
+	// An interruption of the run reaches this process, not the process
+	// group of the step.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to start %s: %v\n", command[0], err)
+		return 127
+	}
+	if len(pgid_file) > 0 {
+		if err := os.WriteFile(pgid_file, []byte(fmt.Sprint(cmd.Process.Pid)), 0666); err == nil {
+			defer os.Remove(pgid_file)
+		}
+	}
+	go func() {
+		for sig := range signals {
+			signalProcessTree(cmd.Process.Pid, sig.(syscall.Signal))
+			// Before xbisect kills the group of this process, which the
+			// group of the command is not part of.
+			time.AfterFunc(kProcessGroupKillDelay/2, func() { signalProcessTree(cmd.Process.Pid, syscall.SIGKILL) })
+		}
+	}()
+	err := cmd.Wait()
+	// The processes the step left behind would hold its dirs.
+	killProcessGroup(cmd)
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		fmt.Fprintf(os.Stderr, "xbisect: the step ran for longer than --timeout %s and was killed\n", timeout)
+		if marker_err := os.WriteFile(marker, nil, 0666); marker_err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to mark the step as timed out: %v\n", marker_err)
+		}
+		return kStepTimeoutCode
+	}
+	var exit_err *exec.ExitError
+	if errors.As(err, &exit_err) {
+		if _, number := exitSignal(exit_err.ProcessState); number > 0 {
+			return 128 + number
+		}
+		return exit_err.ExitCode()
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// The shell code of the wrapper script handling a step killed by --timeout,
+// run right after it with its exit status in RESULT. The step is reported
+// with timeout=1, and RESULT is made a skip or a failure.
+func stepTimeoutScript(on_timeout string) string {
+	result := kBisectSkipCode
+	if on_timeout == kOnTimeoutFail {
+		result = kStepTimeoutCode
+	}
+	return fmt.Sprintf(`
+				if [ -f "${STEP_DIR}/timed_out" ]
+				then
+					rm -f "${STEP_DIR}/timed_out"
+					TIMEOUT_TAG=" timeout=1"
+					RESULT=%d
+				fi
+				`, result)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/lipgloss"
+)
+
+// Where the console output goes: stdout, and the transcript once one is
+// started.
+var gConsoleOutput io.Writer = os.Stdout
+
+// Writes the lines written to it to file, each prefixed with the time it was
+// written at and stripped of the ANSI escapes.
+type transcriptWriter struct {
+	mu   sync.Mutex
+	file *os.File
+	// The start of a line not ended yet.
+	pending []byte
+}
+
+func (w *transcriptWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.pending = append(w.pending, p...)
+	for {
+		line, rest, found := bytes.Cut(w.pending, []byte("\n"))
+		if !found {
+			break
+		}
+		if err := w.writeLine(string(line)); err != nil {
+			return 0, err
+		}
+		w.pending = rest
+	}
+	return len(p), nil
+}
+
+func (w *transcriptWriter) writeLine(line string) error {
+	line = strings.TrimRight(gAnsiEscapeRe.ReplaceAllString(line, ""), " \r")
+	_, err := w.file.WriteString(time.Now().Format(time.TimeOnly) + " " + line + "\n")
+	return err
+}
+
+// Writes the line left unended, and closes the file.
+func (w *transcriptWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.pending) > 0 {
+		w.writeLine(string(w.pending))
+		w.pending = nil
+	}
+	return w.file.Close()
+}
+
+// Starts copying the console output to the file. Returns the function
+// stopping it.
+func startTranscript(file string) (func(), error) {
+	f, err := os.Create(file)
+	if err != nil {
+		gLogger.Printf("Error: %v\n", err)
+		return nil, wrapError(err, "Failed to create the transcript %s", file)
+	}
+	transcript := &transcriptWriter{file: f}
+	previous := gConsoleOutput
+	// The logger would not color its output for a writer that is not the
+	// terminal.
+	profile := lipgloss.NewRenderer(os.Stdout).ColorProfile()
+	gConsoleOutput = io.MultiWriter(previous, transcript)
+	gConsoleLogger.SetOutput(gConsoleOutput)
+	gConsoleLogger.SetColorProfile(profile)
+	return func() {
+		gConsoleOutput = previous
+		gConsoleLogger.SetOutput(previous)
+		if err := transcript.Close(); err != nil {
+			gLogger.Printf("Failed to write the transcript %s: %v\n", file, err)
+		}
+	}, nil
+}
+
+// The args without --transcript, for the processes whose output is relayed
+// to the console, and so to the transcript, by another.
+func withoutTranscriptArg(args []string) []string {
+	var filtered []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			return append(filtered, args[i:]...)
+		}
+		if arg == "--transcript" {
+			// The value is the next arg.
+			i++
+			continue
+		}
+		if !strings.HasPrefix(arg, "--transcript=") {
+			filtered = append(filtered, arg)
+		}
+	}
+	return filtered
+}
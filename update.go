@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Fetches the new commits of the repo from its remote, reports how many
+// arrived on its default branch and records when it was fetched. A fetch
+// failing leaves the clone as it was, git only updating the refs once their
+// objects are fetched.
+func updateRepo(runner CommandRunner, repo *RepoInfo) error {
+	ref, err := defaultHi(runner, repo, false, false)
+	if err != nil {
+		gLogger.Printf("Failed to resolve the default branch of %s: %v\n", repo.Label(), err)
+	}
+	before := ""
+	if len(ref) > 0 {
+		before, _ = resolveRef(runner, repo.LocalPath, ref)
+	}
+	ConsoleLogInfo("Fetching %s", repo.Remote)
+	if err = fetchRepo(runner, repo); err != nil {
+		gLogger.Printf("Error: %v\n", err)
+		return wrapError(err, "Failed to fetch %s, the clone of %s is left as it was", repo.Remote, repo.Label())
+	}
+	if _, dry_run := runner.(*DryRunRunner); dry_run {
+		return nil
+	}
+	gConfig.SetLastFetched(repo.Name, time.Now().UTC())
+	if len(ref) == 0 {
+		return nil
+	}
+	after, err := resolveRef(runner, repo.LocalPath, ref)
+	if err != nil {
+		gLogger.Printf("Error: %v\n", err)
+		ConsoleLogError("%s is gone from %s after the fetch", ref, repo.Label())
+		return nil
+	}
+	if before == after {
+		ConsoleLogInfo("%s is up to date at %s", ref, after)
+		return nil
+	}
+	if len(before) == 0 {
+		ConsoleLogInfo("%s is now at %s", ref, after)
+		return nil
+	}
+	count, first_parent := countCommits(runner, repo.LocalPath, before, after)
+	switch {
+	case count < 0:
+		ConsoleLogInfo("%s moved from %s to %s", ref, before, after)
+	case first_parent:
+		ConsoleLogInfo("At least %d new commits on %s, counting the first parents only: %s..%s", count, ref,
+			before, after)
+	default:
+		ConsoleLogInfo("%d new commits on %s: %s..%s", count, ref, before, after)
+	}
+	return nil
+}
+
+// Updates the imported repo from its remote, for the update command.
+func UpdateImportedRepo(reponame string) error {
+	repo := gConfig.GetRepo(reponame)
+	if repo == nil {
+		return repoNotFoundError(reponame)
+	}
+	if len(repo.Archive) > 0 {
+		return fmt.Errorf("%s was extracted from the archive %s, it has no remote to update from. Import a newer archive instead.",
+			repo.Label(), repo.Archive)
+	}
+	if repo.IsLocalDir() {
+		return fmt.Errorf("%s was imported from the local dir %s, it has no remote to update from.", repo.Label(),
+			repo.LocalPath)
+	}
+	if !isDir(repo.LocalPath) {
+		return fmt.Errorf("The clone of %s is missing: %s. Import it again.", repo.Label(), repo.LocalPath)
+	}
+	return updateRepo(&ExecRunner{}, repo)
+}
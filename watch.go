@@ -0,0 +1,208 @@
+package main
+
+import (
+	"os"
+	"path"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+)
+
+type WatchOptions struct {
+	Repo  string
+	Steps []string
+	// File of the script run for each step.
+	Script   string
+	Interval time.Duration
+	Remote   string
+	// Branch of the remote to watch. Empty means the remote's default
+	// branch.
+	Branch string
+}
+
+// What a watch remembers across restarts, persisted in
+// $XBISECT_HOME/watch/<repo>.toml.
+type WatchState struct {
+	// The latest tip on which the steps passed.
+	LastGoodTip string
+	// The latest tip on which the steps ran, and whether they passed.
+	LastCheckedTip    string
+	LastCheckedPassed bool
+	LastCheckedAt     time.Time
+}
+
+func watchStatePath(reponame string) string {
+	return path.Join(GetAppDataDir(), "watch", reponame+".toml")
+}
+
+func LoadWatchState(reponame string) (*WatchState, error) {
+	state := &WatchState{}
+	data, err := os.ReadFile(watchStatePath(reponame))
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err = toml.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+func (s *WatchState) Save(reponame string) error {
+	serialized, err := toml.Marshal(s)
+	if err != nil {
+		return err
+	}
+	statefile := watchStatePath(reponame)
+	if err = os.MkdirAll(path.Dir(statefile), os.ModePerm); err != nil {
+		return err
+	}
+	tmpfile := statefile + ".tmp"
+	if err = os.WriteFile(tmpfile, serialized, 0666); err != nil {
+		return err
+	}
+	return os.Rename(tmpfile, statefile)
+}
+
+// Fetches the remote and returns the hash of the watched branch's tip.
+func fetchWatchedTip(runner CommandRunner, repo *RepoInfo, opts WatchOptions) (string, error) {
+	if err := runCommandDir(runner, repo.LocalPath, gGitPath, "fetch", "--quiet", opts.Remote); err != nil {
+		return "", err
+	}
+	ref := opts.Remote + "/HEAD"
+	if len(opts.Branch) > 0 {
+		ref = opts.Remote + "/" + opts.Branch
+	}
+	if repo.Mirror {
+		// The fetch updated the branches of the mirror themselves.
+		ref = "HEAD"
+		if len(opts.Branch) > 0 {
+			ref = "refs/heads/" + opts.Branch
+		}
+	}
+	return resolveRef(runner, repo.LocalPath, ref)
+}
+
+// Runs the steps on a single commit. Returns whether they passed.
+func checkTip(runner CommandRunner, opts WatchOptions, tip string) (passed bool, ok bool) {
+	setup, err := SetupRun(runner, RunOptions{Repo: opts.Repo, Lo: tip, Hi: tip, Steps: opts.Steps, ScriptFile: opts.Script})
+	defer func() { setup.Cleanup(ok) }()
+	if err != nil {
+		ConsoleLogErr(err)
+		return false, false
+	}
+	result, err := sweepCommit(setup, tip, false)
+	if err != nil || gInterrupted.Load() {
+		if err != nil {
+			gLogger.Printf("Error: %v\n", err)
+			ConsoleLogError("Failed to run the steps on %s", tip)
+		}
+		return false, false
+	}
+	if result.CheckoutFailed {
+		return false, false
+	}
+	for _, step := range result.StepResults {
+		ConsoleLogInfo("%s %s%12s%s %s", tip, kColorCyan, step.Name, kConsoleReset, formatStepVerdict(step))
+		if !step.Pass {
+			return false, true
+		}
+	}
+	return true, true
+}
+
+// Runs one check of the watched branch: when its tip moved, runs the steps
+// on the new tip, and bisects between the last good tip and the new one if
+// they fail there while they passed on the previously checked tip.
+func watchTick(runner CommandRunner, repo *RepoInfo, opts WatchOptions, state *WatchState) {
+	release, err := AcquireRepoLock(repo.LocalPath)
+	if err != nil {
+		ConsoleLogError("Skipping this check: %v", err)
+		return
+	}
+	defer release()
+
+	tip, err := fetchWatchedTip(runner, repo, opts)
+	if err != nil {
+		// Not a regression: the remote may just be unreachable for now.
+		gLogger.Printf("Error: %v\n", err)
+		ConsoleLogError("Failed to fetch %s, retrying at the next check.", opts.Remote)
+		return
+	}
+	if tip == state.LastCheckedTip {
+		gLogger.Printf("Tip of %s did not change: %s\n", opts.Repo, tip)
+		return
+	}
+	ConsoleLogInfo("New tip: %s", tip)
+	passed, ok := checkTip(runner, opts, tip)
+	if !ok {
+		ConsoleLogError("Could not run the steps on %s, retrying at the next check.", tip)
+		return
+	}
+	previous_passed := state.LastCheckedPassed && len(state.LastCheckedTip) > 0
+	state.LastCheckedTip = tip
+	state.LastCheckedPassed = passed
+	state.LastCheckedAt = time.Now()
+	if passed {
+		state.LastGoodTip = tip
+	}
+	if err = state.Save(opts.Repo); err != nil {
+		gLogger.Printf("Error: %v\n", err)
+		ConsoleLogError("Failed to save the watch state")
+	}
+
+	if passed || !previous_passed || len(state.LastGoodTip) == 0 {
+		return
+	}
+	ConsoleLogInfo("Regression between %s and %s, bisecting", state.LastGoodTip, tip)
+	if _, err := RunBisect(runner, RunOptions{Repo: opts.Repo, Lo: state.LastGoodTip, Hi: tip, Steps: opts.Steps,
+		ScriptFile: opts.Script}); err != nil {
+		ConsoleLogErr(err)
+		ConsoleLogError("Bisect of the regression failed")
+	}
+}
+
+// Checks the remote of an imported repo periodically and bisects the
+// regressions it gains, until interrupted.
+func Watch(opts WatchOptions) bool {
+	repo := gConfig.GetRepo(opts.Repo)
+	if repo == nil {
+		ConsoleLogErr(repoNotFoundError(opts.Repo))
+		return false
+	}
+	// The watch state is kept per repo, whatever the case of --repo.
+	opts.Repo = repo.Name
+	if len(opts.Steps) == 0 {
+		ConsoleLogError("No steps provided to execute.")
+		return false
+	}
+	if opts.Interval <= 0 {
+		ConsoleLogError("--interval must be positive.")
+		return false
+	}
+	state, err := LoadWatchState(opts.Repo)
+	if err != nil {
+		gLogger.Printf("Error: %v\n", err)
+		ConsoleLogError("Failed to read the watch state: %s", watchStatePath(opts.Repo))
+		return false
+	}
+	if len(state.LastCheckedTip) > 0 {
+		ConsoleLogInfo("Resuming watch of %s, last checked %s at %v", repo.Label(), state.LastCheckedTip,
+			state.LastCheckedAt.Format(time.RFC3339))
+	}
+	ConsoleLogInfo("Watching %s every %v", repo.Label(), opts.Interval)
+
+	runner := &ExecRunner{}
+	ticker := time.NewTicker(opts.Interval)
+	defer ticker.Stop()
+	for {
+		watchTick(runner, repo, opts, state)
+		select {
+		case <-gRunContext.Done():
+			ConsoleLogInfo("Watch stopped")
+			return true
+		case <-ticker.C:
+		}
+	}
+}